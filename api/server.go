@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/metrics"
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type ServerConfig struct {
+	Address string
+}
+
+type ServerDependencies struct {
+	Logger  *logging.Logger
+	Service *service.Service
+	Metrics *metrics.Registry // Optional
+}
+
+// Server provides an HTTP admin API for the cleanup service.
+type Server struct {
+	ServerConfig
+	ServerDependencies
+}
+
+// NewServer creates a new admin server instance.
+func NewServer(config ServerConfig, deps ServerDependencies) *Server {
+	return &Server{
+		ServerConfig:       config,
+		ServerDependencies: deps,
+	}
+}
+
+// Run listens on the configured address and serves admin requests until an error occurs.
+func (s *Server) Run() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", s.handleRun)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/report", s.handleReport)
+	if s.Metrics != nil {
+		mux.HandleFunc("/metrics", s.handleMetrics)
+	}
+
+	s.Logger.Infof("Admin API listening on %s", s.Address)
+	if err := http.ListenAndServe(s.Address, mux); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// handleRun triggers a cleanup run.
+// The (optional) request body contains a JSON encoded service.RunOptions.
+// These options can only narrow the run, they cannot disable a dry run or raise the configured max delete.
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var opts service.RunOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.Logger.Infof("Run triggered by %s", r.RemoteAddr)
+	summary, err := s.Service.RunWithOptions(opts)
+	if err != nil {
+		s.Logger.Errorf("Triggered run failed: %#v", err)
+		status := http.StatusInternalServerError
+		if service.IsEtcdUnreachable(err) {
+			status = http.StatusServiceUnavailable
+		} else if service.IsInvalidArgument(err) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handleHealth reports whether the service is running (200) or shutting down (503).
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Service.Stopping() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "stopping"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReport returns the full report of the latest run.
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	report, ok := s.Service.LastReport()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no run has finished yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleMetrics serves all metrics in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		s.Metrics.WriteTo(w)
+	}
+}
+
+// writeJSON writes the given value as JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error message as JSON response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
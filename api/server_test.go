@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+func newTestServer(t *testing.T, config service.ServiceConfig) *Server {
+	// Nothing listens on this address, requests must either fail before reaching etcd or use an offline backup
+	config.EtcdURL = url.URL{Scheme: "http", Host: "127.0.0.1:1"}
+	svc, err := service.NewService(config, service.ServiceDependencies{})
+	if err != nil {
+		t.Fatalf("failed to create service: %#v", err)
+	}
+	return NewServer(ServerConfig{}, ServerDependencies{Logger: logging.MustGetLogger("test"), Service: svc})
+}
+
+func TestHandleRunRejectsWideningOverrides(t *testing.T) {
+	s := newTestServer(t, service.ServiceConfig{MaxDelete: 10})
+	for _, body := range []string{
+		`{"maxDelete": 0}`,
+		`{"maxDelete": -1}`,
+		`{"jobFilter": "("}`,
+		`{"jobFilter": ""}`,
+	} {
+		req, err := http.NewRequest("POST", "/run", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create request: %#v", err)
+		}
+		rec := httptest.NewRecorder()
+		s.handleRun(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d (%s)", body, http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// registryDump is a dump of the keys API with a job of team a and a job of team b, both without a job object.
+const registryDump = `{"action": "get", "node": {"key": "/_coreos.com/fleet", "dir": true, "nodes": [
+	{"key": "/_coreos.com/fleet/machines", "dir": true, "nodes": [
+		{"key": "/_coreos.com/fleet/machines/m1", "dir": true, "nodes": [
+			{"key": "/_coreos.com/fleet/machines/m1/object", "value": "{\"ID\": \"m1\"}"}]}]},
+	{"key": "/_coreos.com/fleet/unit", "dir": true, "nodes": [
+		{"key": "/_coreos.com/fleet/unit/0100000000000000000000000000000000000000", "value": "{\"Raw\": \"[Service]\"}"}]},
+	{"key": "/_coreos.com/fleet/job", "dir": true, "nodes": [
+		{"key": "/_coreos.com/fleet/job/a-1.service", "dir": true, "nodes": [
+			{"key": "/_coreos.com/fleet/job/a-1.service/target-state", "value": "inactive"}]},
+		{"key": "/_coreos.com/fleet/job/b-1.service", "dir": true, "nodes": [
+			{"key": "/_coreos.com/fleet/job/b-1.service/target-state", "value": "inactive"}]}]}]}}`
+
+func TestHandleRunCannotWidenJobFilter(t *testing.T) {
+	f, err := ioutil.TempFile("", "fleet-cleanup-test")
+	if err != nil {
+		t.Fatalf("failed to create dump: %#v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(registryDump); err != nil {
+		t.Fatalf("failed to write dump: %#v", err)
+	}
+	f.Close()
+
+	s := newTestServer(t, service.ServiceConfig{
+		EtcdTransport: service.TransportConfig{OfflineBackup: f.Name()},
+		DryRun:        true,
+		JobFilter:     "^a-",
+		Rules:         map[string]bool{service.RuleBrokenJobs: true},
+	})
+	for _, body := range []string{
+		`{}`,
+		`{"jobFilter": ".*"}`,
+		`{"jobFilter": "^b-"}`,
+	} {
+		req, err := http.NewRequest("POST", "/run", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create request: %#v", err)
+		}
+		rec := httptest.NewRecorder()
+		s.handleRun(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d (%s)", body, http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var summary service.RunSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("%s: invalid summary: %#v", body, err)
+		}
+		expected := 1
+		if body == `{"jobFilter": "^b-"}` {
+			// Must match the configured filter as well
+			expected = 0
+		}
+		found := -1
+		for _, r := range summary.Rules {
+			if r.Name == service.RuleBrokenJobs {
+				found = r.Candidates
+			}
+		}
+		if found != expected {
+			t.Errorf("%s: expected %d broken jobs, got %d", body, expected, found)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+const (
+	archiveFilePrefix = "cleanup-"
+	archiveFileSuffix = ".tar.gz"
+	manifestName      = "manifest.json"
+)
+
+type DirArchiverConfig struct {
+	// Directory in which archives are written
+	Dir string
+	// Number of archives to keep (0 means unlimited)
+	Keep int
+}
+
+type DirArchiverDependencies struct {
+	Logger *logging.Logger
+}
+
+// DirArchiver writes a cleanup-<runid>.tar.gz file per run to a local directory.
+// The tarball contains a file per removed key (at the path of the key) holding its value,
+// and a manifest.json file with the etcd indexes of all keys.
+type DirArchiver struct {
+	DirArchiverConfig
+	DirArchiverDependencies
+}
+
+// NewDirArchiver creates a new archiver that writes to a local directory.
+func NewDirArchiver(config DirArchiverConfig, deps DirArchiverDependencies) (*DirArchiver, error) {
+	if config.Keep < 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "number of archives to keep cannot be negative"))
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot create archive directory '%s'", config.Dir))
+	}
+	return &DirArchiver{
+		DirArchiverConfig:       config,
+		DirArchiverDependencies: deps,
+	}, nil
+}
+
+// Archive writes the given record to cleanup-<runid>.tar.gz and prunes old archives.
+func (a *DirArchiver) Archive(record service.ArchiveRecord) error {
+	name := filepath.Join(a.Dir, archiveFilePrefix+record.RunID+archiveFileSuffix)
+	tmpName := name + ".tmp"
+	if err := writeTarball(tmpName, record); err != nil {
+		os.Remove(tmpName)
+		return maskAny(err)
+	}
+	if err := os.Rename(tmpName, name); err != nil {
+		os.Remove(tmpName)
+		return maskAny(err)
+	}
+	a.Logger.Debugf("Wrote archive of %d keys to %s", len(record.Entries), name)
+
+	// Pruning is best effort, the archive itself has been written
+	if err := a.prune(); err != nil {
+		a.Logger.Warningf("Failed to prune old archives in %s: %#v", a.Dir, err)
+	}
+	return nil
+}
+
+// prune removes the oldest archives, such that only the configured number of archives is kept.
+func (a *DirArchiver) prune() error {
+	if a.Keep == 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(a.Dir, archiveFilePrefix+"*"+archiveFileSuffix))
+	if err != nil {
+		return maskAny(err)
+	}
+	var archives archiveFiles
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		archives = append(archives, archiveFile{Path: m, Info: info})
+	}
+	if len(archives) <= a.Keep {
+		return nil
+	}
+	sort.Sort(archives)
+	for _, f := range archives[:len(archives)-a.Keep] {
+		if err := os.Remove(f.Path); err != nil {
+			return maskAny(err)
+		}
+		a.Logger.Debugf("Removed old archive %s", f.Path)
+	}
+	return nil
+}
+
+// writeTarball writes a gzip'd tarball of the given record to a file with given name.
+func writeTarball(name string, record service.ArchiveRecord) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := addFile(tw, manifestName, manifest, record); err != nil {
+		return maskAny(err)
+	}
+	for _, e := range record.Entries {
+		if err := addFile(tw, strings.TrimPrefix(e.Key, "/"), []byte(e.Value), record); err != nil {
+			return maskAny(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return maskAny(err)
+	}
+	if err := gz.Close(); err != nil {
+		return maskAny(err)
+	}
+	if err := f.Sync(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// addFile adds a single file to the given tarball.
+func addFile(tw *tar.Writer, name string, content []byte, record service.ArchiveRecord) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: record.Time,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return maskAny(fmt.Errorf("cannot add %s: %v", name, err))
+	}
+	if _, err := tw.Write(content); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+type archiveFile struct {
+	Path string
+	Info os.FileInfo
+}
+
+// archiveFiles sorts archive files from oldest to newest.
+type archiveFiles []archiveFile
+
+func (l archiveFiles) Len() int      { return len(l) }
+func (l archiveFiles) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l archiveFiles) Less(i, j int) bool {
+	return l[i].Info.ModTime().Before(l[j].Info.ModTime())
+}
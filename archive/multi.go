@@ -0,0 +1,33 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// MultiArchiver passes records to multiple archivers.
+// It fails as soon as one of the archivers fails.
+type MultiArchiver []service.Archiver
+
+// Archive passes the given record to all archivers.
+func (l MultiArchiver) Archive(record service.ArchiveRecord) error {
+	for _, a := range l {
+		if err := a.Archive(record); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+const (
+	uploadTimeout = 30 * time.Second
+	defaultRegion = "us-east-1"
+)
+
+type S3ArchiverConfig struct {
+	// URL of the bucket (path-style), optionally followed by a key prefix.
+	// E.g. https://s3.eu-west-1.amazonaws.com/my-bucket/fleet-cleanup
+	URL string
+}
+
+type S3ArchiverDependencies struct {
+	Logger *logging.Logger
+}
+
+// S3Archiver uploads a gzip'd JSON archive of removed keys to an S3-compatible bucket.
+// Credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY (and optional
+// AWS_SESSION_TOKEN) environment variables, the region from AWS_REGION or AWS_DEFAULT_REGION.
+type S3Archiver struct {
+	S3ArchiverConfig
+	S3ArchiverDependencies
+
+	endpoint     url.URL
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+// NewS3Archiver creates a new archiver that uploads to an S3-compatible bucket.
+func NewS3Archiver(config S3ArchiverConfig, deps S3ArchiverDependencies) (*S3Archiver, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid archive URL '%s'", config.URL))
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "archive URL '%s' must be of the form https://<host>/<bucket>[/<prefix>]", config.URL))
+	}
+	a := &S3Archiver{
+		S3ArchiverConfig:       config,
+		S3ArchiverDependencies: deps,
+		endpoint:               *u,
+		accessKey:              os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:              os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:           os.Getenv("AWS_SESSION_TOKEN"),
+		region:                 os.Getenv("AWS_REGION"),
+	}
+	if a.accessKey == "" || a.secretKey == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set"))
+	}
+	if a.region == "" {
+		a.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if a.region == "" {
+		a.region = defaultRegion
+	}
+	return a, nil
+}
+
+// Archive uploads the given record as cleanup-<runid>.json.gz.
+func (a *S3Archiver) Archive(record service.ArchiveRecord) error {
+	body, err := gzipJSON(record)
+	if err != nil {
+		return maskAny(err)
+	}
+	u := a.endpoint
+	u.Path = path.Join(u.Path, fmt.Sprintf("cleanup-%s.json.gz", record.RunID))
+	if err := a.put(u, body, "application/gzip"); err != nil {
+		return maskAny(err)
+	}
+	a.Logger.Debugf("Uploaded archive of %d keys to %s", len(record.Entries), u.String())
+	return nil
+}
+
+// put uploads the given body to the given URL, signing the request with AWS signature version 4.
+func (a *S3Archiver) put(u url.URL, body []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return maskAny(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	a.sign(req, body, time.Now().UTC())
+
+	client := &http.Client{Timeout: uploadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return maskAny(fmt.Errorf("%s returned status %d: %s", u.String(), resp.StatusCode, strings.TrimSpace(string(msg))))
+	}
+	return nil
+}
+
+// sign adds an AWS signature version 4 authorization header to the given request.
+func (a *S3Archiver) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if a.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders bytes.Buffer
+	for _, h := range signedHeaders {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(req.Header.Get(h)))
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, a.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// gzipJSON returns the gzip compressed JSON encoding of the given value.
+func gzipJSON(value interface{}) ([]byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, maskAny(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, maskAny(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
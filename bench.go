@@ -0,0 +1,90 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdBench = &cobra.Command{
+		Use:   "bench",
+		Short: "Measure read & delete throughput of etcd",
+		Long: "Measure the write, read, scan & delete throughput and latency of etcd, using keys in a sandbox directory\n" +
+			"below /_pulcy/fleet-cleanup/bench that is removed afterwards. The fleet registry is not touched.\n\n" +
+			"Every concurrency level is measured separately, to find how much load a cluster handles.",
+		Run: cmdBenchRun,
+	}
+	benchFlags struct {
+		keys        int
+		valueSize   int
+		concurrency []int
+	}
+)
+
+func init() {
+	cmdBench.Flags().IntVar(&benchFlags.keys, "keys", 1000, "Number of keys to write, read & delete at every concurrency level")
+	cmdBench.Flags().IntVar(&benchFlags.valueSize, "value-size", 512, "Size of every value in bytes (fleet units are typically 200-2000 bytes)")
+	cmdBench.Flags().IntSliceVar(&benchFlags.concurrency, "concurrency", []int{1, 4, 16}, "Number of concurrent requests (can be repeated or comma separated)")
+	cmdMain.AddCommand(cmdBench)
+}
+
+func cmdBenchRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	if benchFlags.keys < 1 || benchFlags.valueSize < 0 {
+		Exitf("--keys must be at least 1 and --value-size cannot be negative")
+	}
+	for _, c := range benchFlags.concurrency {
+		if c < 1 {
+			Exitf("--concurrency must be at least 1")
+		}
+	}
+	svc := newTraceService()
+	stopOnSignal(svc, logging.MustGetLogger(projectName))
+
+	var results []service.BenchResult
+	for _, c := range benchFlags.concurrency {
+		result, err := svc.Bench(service.BenchOptions{
+			Keys:        benchFlags.keys,
+			ValueSize:   benchFlags.valueSize,
+			Concurrency: c,
+		})
+		if err != nil {
+			ExitWithCodef(exitCodeForError(err), "Benchmark failed at concurrency %d: %#v", c, err)
+		}
+		results = append(results, result)
+		if svc.Stopping() {
+			break
+		}
+	}
+
+	out := output{
+		Value:  results,
+		Header: []string{"CONCURRENCY", "PHASE", "OPS", "ERRORS", "OPS/S", "P50", "P90", "P99", "MAX"},
+	}
+	for _, r := range results {
+		for _, p := range r.Phases {
+			out.Rows = append(out.Rows, []string{strconv.Itoa(r.Concurrency), p.Name, strconv.Itoa(p.Ops), strconv.Itoa(p.Errors), fmt.Sprintf("%.1f", p.OpsPerSec),
+				p.LatencyP50.String(), p.LatencyP90.String(), p.LatencyP99.String(), p.LatencyMax.String()})
+		}
+	}
+	writeOutput(f, out)
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdBrowse = &cobra.Command{
+		Use:   "browse",
+		Short: "Interactively explore the registry and remove selected garbage",
+		Long: "Interactively explore the jobs, units and garbage in the registry and remove selected garbage.\n\n" +
+			"Accepts the same flags as a cleanup, they decide which keys are garbage. Only garbage can be marked,\n" +
+			"marked keys are removed after a single confirmation, in the same way 'fleet-cleanup apply' removes a plan.\n" +
+			"Type 'help' at the prompt for a list of commands.",
+		Run: cmdBrowseRun,
+	}
+)
+
+func init() {
+	cmdMain.AddCommand(cmdBrowse)
+}
+
+func cmdBrowseRun(cmd *cobra.Command, args []string) {
+	if globalFlags.interval != 0 {
+		Exitf("--interval cannot be used with browse")
+	}
+	// The garbage listing replaces the per-key report, unless explicitly asked for
+	if !globalFlags.verbose {
+		globalFlags.quiet = true
+	}
+	planFlags.mode = runModeBrowse
+	cmdMainRun(cmd, args)
+}
+
+const browseHelp = `Commands:
+  jobs                      List all jobs and their units
+  units                     List all units and the jobs that reference them
+  garbage                   List all garbage found by the cleanup rules, numbered
+  show <#|unit|job>         Show a garbage entry, unit (hash or unique prefix) or the unit of a job
+  mark <#...|all>           Mark garbage entries for removal
+  unmark <#...|all>         Unmark garbage entries
+  marked                    List the marked entries
+  delete                    Remove all marked entries, after confirmation
+  refresh                   Reload the registry, clears all marks
+  help                      Show this help
+  quit                      Leave without removing anything else
+`
+
+// browser holds the state of an interactive browse session.
+type browser struct {
+	svc     *service.Service
+	opts    service.RunOptions
+	in      *bufio.Scanner
+	out     io.Writer
+	listing service.RegistryListing
+	plan    service.Plan
+	marked  map[int]bool // Indexes in plan.Entries
+	summary service.RunSummary
+}
+
+// browseRegistry runs an interactive browse session reading commands from the given reader.
+// It returns the summary of the last removal (if any).
+func browseRegistry(svc *service.Service, opts service.RunOptions, in io.Reader, out io.Writer) (service.RunSummary, error) {
+	b := &browser{
+		svc:  svc,
+		opts: opts,
+		in:   bufio.NewScanner(in),
+		out:  out,
+	}
+	if err := b.refresh(); err != nil {
+		return service.RunSummary{}, maskAny(err)
+	}
+	fmt.Fprintln(out, "Type 'help' for a list of commands")
+	for {
+		line, ok := b.prompt("browse> ")
+		if !ok {
+			fmt.Fprintln(out)
+			return b.summary, nil
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "jobs":
+			b.listJobs()
+		case "units":
+			b.listUnits()
+		case "garbage":
+			b.listGarbage(false)
+		case "show":
+			b.show(args[1:])
+		case "mark":
+			b.mark(args[1:], true)
+		case "unmark":
+			b.mark(args[1:], false)
+		case "marked":
+			b.listGarbage(true)
+		case "delete":
+			b.delete()
+		case "refresh":
+			if err := b.refresh(); err != nil {
+				fmt.Fprintf(out, "Failed to reload the registry: %v\n", err)
+			}
+		case "help", "?":
+			fmt.Fprint(out, browseHelp)
+		case "quit", "exit", "q":
+			return b.summary, nil
+		default:
+			fmt.Fprintf(out, "Unknown command '%s', type 'help' for a list of commands\n", args[0])
+		}
+	}
+}
+
+// prompt writes the given prompt and reads a line. Returns false at the end of the input.
+func (b *browser) prompt(prompt string) (string, bool) {
+	fmt.Fprint(b.out, prompt)
+	if !b.in.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(b.in.Text()), true
+}
+
+// refresh reloads all jobs & units and scans the registry for garbage.
+func (b *browser) refresh() error {
+	listing, err := b.svc.ListRegistry()
+	if err != nil {
+		return maskAny(err)
+	}
+	plan, _, err := b.svc.CreatePlan(b.opts)
+	if err != nil {
+		return maskAny(err)
+	}
+	b.listing = listing
+	b.plan = plan
+	b.marked = make(map[int]bool)
+	fmt.Fprintf(b.out, "%d jobs, %d units, %d garbage keys\n", len(listing.Jobs), len(listing.Units), len(plan.Entries))
+	return nil
+}
+
+func (b *browser) listJobs() {
+	w := tabwriter.NewWriter(b.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tUNIT")
+	for _, j := range b.listing.Jobs {
+		unit := j.UnitHash
+		if j.UnitMissing {
+			unit += " (missing)"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", j.Name, unit)
+	}
+	w.Flush()
+}
+
+func (b *browser) listUnits() {
+	w := tabwriter.NewWriter(b.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "UNIT\tBYTES\tJOBS")
+	for _, u := range b.listing.Units {
+		jobs := strings.Join(u.Jobs, ",")
+		if jobs == "" {
+			jobs = "none (obsolete)"
+			if len(u.LastKnownJobs) > 0 {
+				jobs = fmt.Sprintf("none (obsolete, was %s)", strings.Join(u.LastKnownJobs, ","))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", u.Hash, len(u.Content), jobs)
+	}
+	w.Flush()
+}
+
+// listGarbage lists all garbage entries, or only the marked ones.
+func (b *browser) listGarbage(markedOnly bool) {
+	if markedOnly && len(b.marked) == 0 {
+		fmt.Fprintln(b.out, "Nothing marked")
+		return
+	}
+	if len(b.plan.Entries) == 0 {
+		fmt.Fprintln(b.out, "No garbage found")
+		return
+	}
+	w := tabwriter.NewWriter(b.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tMARK\tRULE\tKIND\tKEY\tJOB")
+	for i, e := range b.plan.Entries {
+		if markedOnly && !b.marked[i] {
+			continue
+		}
+		mark := ""
+		if b.marked[i] {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, mark, e.Rule, e.Kind, e.Key, e.Job)
+	}
+	w.Flush()
+}
+
+// show prints a garbage entry, a unit or the unit of a job.
+func (b *browser) show(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(b.out, "Usage: show <#|unit|job>")
+		return
+	}
+	arg := args[0]
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n < 1 || n > len(b.plan.Entries) {
+			fmt.Fprintf(b.out, "No garbage entry #%d\n", n)
+			return
+		}
+		e := b.plan.Entries[n-1]
+		fmt.Fprintf(b.out, "Key:    %s\nRule:   %s\nAction: %s\n", e.Key, e.Rule, e.Action)
+		for _, u := range b.listing.Units {
+			if u.Key == e.Key {
+				b.showUnit(u)
+				return
+			}
+		}
+		fmt.Fprintf(b.out, "\n%s\n", e.Value)
+		return
+	}
+	for _, j := range b.listing.Jobs {
+		if j.Name == arg {
+			arg = j.UnitHash
+			break
+		}
+	}
+	var found []service.RegistryUnit
+	for _, u := range b.listing.Units {
+		if strings.HasPrefix(u.Hash, arg) {
+			found = append(found, u)
+		}
+	}
+	switch len(found) {
+	case 0:
+		fmt.Fprintf(b.out, "No unit or job '%s'\n", arg)
+	case 1:
+		fmt.Fprintf(b.out, "Key:    %s\n", found[0].Key)
+		b.showUnit(found[0])
+	default:
+		fmt.Fprintf(b.out, "'%s' matches %d units\n", arg, len(found))
+	}
+}
+
+func (b *browser) showUnit(u service.RegistryUnit) {
+	jobs := strings.Join(u.Jobs, ",")
+	if jobs == "" {
+		jobs = "none (obsolete)"
+	}
+	fmt.Fprintf(b.out, "Jobs:   %s\n\n%s\n", jobs, strings.TrimRight(u.Content, "\n"))
+}
+
+// mark (un)marks the garbage entries with the given numbers (or all entries).
+func (b *browser) mark(args []string, marked bool) {
+	if len(args) == 0 {
+		fmt.Fprintln(b.out, "Usage: mark|unmark <#...|all>")
+		return
+	}
+	var indexes []int
+	if len(args) == 1 && args[0] == "all" {
+		for i := range b.plan.Entries {
+			indexes = append(indexes, i)
+		}
+	} else {
+		for _, arg := range args {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > len(b.plan.Entries) {
+				fmt.Fprintf(b.out, "No garbage entry #%s\n", arg)
+				return
+			}
+			indexes = append(indexes, n-1)
+		}
+	}
+	for _, i := range indexes {
+		if marked {
+			b.marked[i] = true
+		} else {
+			delete(b.marked, i)
+		}
+	}
+	fmt.Fprintf(b.out, "%d of %d entries marked\n", len(b.marked), len(b.plan.Entries))
+}
+
+// delete removes all marked entries after confirmation, then reloads the registry.
+func (b *browser) delete() {
+	if len(b.marked) == 0 {
+		fmt.Fprintln(b.out, "Nothing marked")
+		return
+	}
+	b.listGarbage(true)
+	answer, _ := b.prompt(fmt.Sprintf("Remove these %d keys? [y/N] ", len(b.marked)))
+	if answer != "y" && answer != "yes" {
+		fmt.Fprintln(b.out, "Nothing removed")
+		return
+	}
+	plan := b.plan
+	plan.Entries = nil
+	for i, e := range b.plan.Entries {
+		if b.marked[i] {
+			plan.Entries = append(plan.Entries, e)
+		}
+	}
+	summary, err := b.svc.ApplyPlan(plan)
+	b.summary = summary
+	removed := summary.RemovedUnits + summary.RemovedLeases + summary.RemovedStates
+	if summary.DryRun {
+		fmt.Fprintf(b.out, "Dry run, would have removed %d keys\n", len(plan.Entries))
+	} else {
+		fmt.Fprintf(b.out, "Removed %d of %d keys\n", removed, len(plan.Entries))
+	}
+	if err != nil {
+		fmt.Fprintf(b.out, "Failed to remove all keys: %v\n", err)
+	}
+	if err := b.refresh(); err != nil {
+		fmt.Fprintf(b.out, "Failed to reload the registry: %v\n", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdReport = &cobra.Command{
+		Use:   "report",
+		Short: "Report the garbage in one or more clusters, without removing anything",
+		Long: "Report the garbage in one or more clusters, without removing anything.\n\n" +
+			"Without --compare, the cluster at --etcd-addr is reported. With --compare, the given clusters are reported\n" +
+			"side by side, ordered by the amount of garbage. A cluster is given as 'name=etcd-url' or as the name of a\n" +
+			"cluster in --clusters-file, e.g. 'fleet-cleanup report --clusters-file clusters.json --compare eu,us'.",
+		Run: cmdReportRun,
+	}
+	reportFlags struct {
+		compare      []string
+		clustersFile string
+	}
+)
+
+func init() {
+	cmdReport.Flags().StringSliceVar(&reportFlags.compare, "compare", nil, "Clusters to compare ('name=etcd-url' or a name from --clusters-file)")
+	cmdReport.Flags().StringVar(&reportFlags.clustersFile, "clusters-file", "", "Path of a JSON file with the etcd settings of clusters by name")
+	cmdMain.AddCommand(cmdReport)
+}
+
+// clusterConfig holds the etcd settings of a single cluster in a clusters file.
+// Settings that are not set default to the etcd flags of the command.
+type clusterConfig struct {
+	EtcdAddr            string `json:"etcdAddr"`
+	EtcdProxy           string `json:"etcdProxy,omitempty"`
+	EtcdBearerTokenFile string `json:"etcdBearerTokenFile,omitempty"`
+}
+
+// clusterReport contains the garbage found in a single cluster.
+type clusterReport struct {
+	Cluster string             `json:"cluster"`
+	Summary service.RunSummary `json:"summary"`
+	Garbage int                `json:"garbage"` // Total number of obsolete units, stale leases & orphaned unit states
+	Error   string             `json:"error,omitempty"`
+}
+
+type clusterReportsByGarbage []clusterReport
+
+func (l clusterReportsByGarbage) Len() int { return len(l) }
+func (l clusterReportsByGarbage) Less(i, j int) bool {
+	if l[i].Garbage != l[j].Garbage {
+		return l[i].Garbage > l[j].Garbage
+	}
+	return l[i].Cluster < l[j].Cluster
+}
+func (l clusterReportsByGarbage) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func cmdReportRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	setLogLevel(globalFlags.logLevel, projectName)
+	names, clusters := reportClusters()
+
+	var reports []clusterReport
+	failed := false
+	for _, name := range names {
+		report := reportCluster(name, clusters[name])
+		if report.Error != "" {
+			failed = true
+		}
+		reports = append(reports, report)
+	}
+	sort.Sort(clusterReportsByGarbage(reports))
+
+	out := output{
+		Value:  reports,
+		Header: []string{"CLUSTER", "GARBAGE", "JOBS", "UNITS", "OBSOLETE UNITS", "LEASES", "STALE LEASES", "STATES", "ORPHAN STATES", "REGISTRY BYTES", "RESULT"},
+	}
+	for _, r := range reports {
+		s := r.Summary
+		result := "ok"
+		if r.Error != "" {
+			result = "failed: " + r.Error
+		}
+		out.Rows = append(out.Rows, []string{r.Cluster, strconv.Itoa(r.Garbage), strconv.Itoa(s.Jobs), strconv.Itoa(s.Units), strconv.Itoa(s.ObsoleteUnits),
+			strconv.Itoa(s.Leases), strconv.Itoa(s.StaleLeases), strconv.Itoa(s.States), strconv.Itoa(s.OrphanStates), strconv.FormatInt(s.RegistryBytes, 10), result})
+	}
+	writeOutput(f, out)
+	if failed {
+		os.Exit(exitCodeFailure)
+	}
+}
+
+// reportClusters returns the names & settings of the clusters to report.
+func reportClusters() ([]string, map[string]clusterConfig) {
+	known := make(map[string]clusterConfig)
+	if reportFlags.clustersFile != "" {
+		raw, err := ioutil.ReadFile(reportFlags.clustersFile)
+		if err != nil {
+			Exitf("Failed to read --clusters-file '%s': %#v", reportFlags.clustersFile, err)
+		}
+		if err := json.Unmarshal(raw, &known); err != nil {
+			Exitf("--clusters-file '%s' is not valid: %v", reportFlags.clustersFile, err)
+		}
+	}
+	if len(reportFlags.compare) == 0 {
+		parseEtcdURL()
+		return []string{globalFlags.etcdAddr}, map[string]clusterConfig{
+			globalFlags.etcdAddr: {EtcdAddr: globalFlags.etcdAddr},
+		}
+	}
+
+	var names []string
+	clusters := make(map[string]clusterConfig)
+	for _, arg := range reportFlags.compare {
+		name, cluster := arg, clusterConfig{}
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+			name, cluster.EtcdAddr = parts[0], parts[1]
+		} else if c, ok := known[arg]; ok {
+			cluster = c
+		} else {
+			Exitf("Unknown cluster '%s' in --compare, use 'name=etcd-url' or a cluster from --clusters-file", arg)
+		}
+		if _, ok := clusters[name]; ok {
+			Exitf("Cluster '%s' is given more than once in --compare", name)
+		}
+		if cluster.EtcdAddr == "" {
+			Exitf("Cluster '%s' has no etcd address", name)
+		}
+		names = append(names, name)
+		clusters[name] = cluster
+	}
+	return names, clusters
+}
+
+// reportCluster scans the given cluster with all default rules (including leases & unit states),
+// without removing anything.
+func reportCluster(name string, cluster clusterConfig) clusterReport {
+	report := clusterReport{Cluster: name}
+	etcdUrl, err := url.Parse(cluster.EtcdAddr)
+	if err != nil {
+		report.Error = fmt.Sprintf("invalid etcd address '%s'", cluster.EtcdAddr)
+		return report
+	}
+	transport := etcdTransportConfig()
+	if cluster.EtcdProxy != "" {
+		transport.Proxy = cluster.EtcdProxy
+	}
+	if cluster.EtcdBearerTokenFile != "" {
+		transport.AuthHeader = ""
+		transport.BearerTokenFile = cluster.EtcdBearerTokenFile
+	}
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:          *etcdUrl,
+		EtcdTransport:    transport,
+		Registry:         registryConfig(),
+		EtcdVersionCheck: globalFlags.versionCheck,
+		CleanLeases:      true,
+		CleanStates:      true,
+		AssumeReadOnly:   true,
+		Version:          projectVersion,
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	summary, err := svc.RunWithOptions(service.RunOptions{})
+	report.Summary = summary
+	report.Garbage = summary.ObsoleteUnits + summary.StaleLeases + summary.OrphanStates
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
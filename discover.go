@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdDiscover = &cobra.Command{
+		Use:   "discover",
+		Short: "Find all fleet registries in etcd",
+		Long: "Find all fleet registries in etcd: the registry at the well-known fleet prefix, registries recorded\n" +
+			"by earlier cleanups and directories in the etcd root that look like a fleet registry.\n\n" +
+			"Nothing is removed. Use --all-registries to clean all registries that are found.",
+		Run: cmdDiscoverRun,
+	}
+)
+
+func init() {
+	cmdMain.AddCommand(cmdDiscover)
+}
+
+func cmdDiscoverRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	svc := newTraceService()
+
+	registries, err := svc.DiscoverRegistries()
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to discover registries: %#v", err)
+	}
+
+	out := output{
+		Value:  registries,
+		Header: []string{"PREFIX", "UNIT TEMPLATE", "JOB TEMPLATE", "JOBS", "UNITS", "MACHINES", "FOUND BY"},
+		Empty:  "No fleet registries found",
+	}
+	for _, r := range registries {
+		prefix := r.Registry.Prefix
+		if r.Configured {
+			prefix += " (configured)"
+		}
+		out.Rows = append(out.Rows, []string{prefix, orDefault(r.Registry.UnitPathTemplate), orDefault(r.Registry.JobPathTemplate),
+			strconv.Itoa(r.Jobs), strconv.Itoa(r.Units), strconv.Itoa(r.Machines), strings.Join(r.Sources, ", ")})
+	}
+	writeOutput(f, out)
+}
+
+// orDefault returns the given path template, or "default" when it is not set.
+func orDefault(template string) string {
+	if template == "" {
+		return "default"
+	}
+	return template
+}
+
+// runAllRegistries discovers all fleet registries and performs a single cleanup of each of them,
+// using the given configuration for everything but the location of the registry.
+// It returns the combined summary of all runs and the error of the first failed run (later registries are still cleaned).
+func runAllRegistries(svc *service.Service, config service.ServiceConfig, deps service.ServiceDependencies, opts service.RunOptions, logger *logging.Logger) (service.RunSummary, error) {
+	registries, err := svc.DiscoverRegistries()
+	if err != nil {
+		return service.RunSummary{}, maskAny(err)
+	}
+	var services []*service.Service
+	for _, r := range registries {
+		registryConfig := config
+		registryConfig.Registry = r.Registry
+		s, err := service.NewService(registryConfig, deps)
+		if err != nil {
+			return service.RunSummary{}, maskAny(err)
+		}
+		services = append(services, s)
+	}
+	stopAllOnSignal(services, logger)
+
+	var total service.RunSummary
+	var firstErr error
+	for i, s := range services {
+		if s.Stopping() {
+			logger.Infof("Stopped, not cleaning the remaining registries")
+			break
+		}
+		logger.Infof("Cleaning registry at %s (%d of %d)", registries[i].Registry.Prefix, i+1, len(services))
+		summary, err := s.RunWithOptions(opts)
+		if err != nil {
+			logger.Errorf("Failed to clean registry at %s: %#v", registries[i].Registry.Prefix, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		total.RunID = summary.RunID
+		total.DryRun = summary.DryRun
+		total.Jobs += summary.Jobs
+		total.Units += summary.Units
+		total.ObsoleteUnits += summary.ObsoleteUnits
+		total.RemovedUnits += summary.RemovedUnits
+		total.Leases += summary.Leases
+		total.StaleLeases += summary.StaleLeases
+		total.RemovedLeases += summary.RemovedLeases
+		total.States += summary.States
+		total.OrphanStates += summary.OrphanStates
+		total.RemovedStates += summary.RemovedStates
+		total.FailedDeletes += summary.FailedDeletes
+		total.Duration += summary.Duration
+		total.Rules = addRuleResults(total.Rules, summary.Rules)
+	}
+	if len(services) == 0 {
+		logger.Warningf("No fleet registries found")
+	} else {
+		logger.Infof("Cleaned %d registries: %d obsolete units (%d removed), %d stale leases (%d removed), %d orphaned unit states (%d removed), %d failed deletes",
+			len(services), total.ObsoleteUnits, total.RemovedUnits, total.StaleLeases, total.RemovedLeases, total.OrphanStates, total.RemovedStates, total.FailedDeletes)
+	}
+	if firstErr != nil {
+		return total, maskAny(firstErr)
+	}
+	return total, nil
+}
+
+// addRuleResults adds the given rule results to the totals, by rule name.
+func addRuleResults(totals, results []service.RuleResult) []service.RuleResult {
+	for _, r := range results {
+		found := false
+		for i := range totals {
+			if totals[i].Name == r.Name {
+				totals[i].Candidates += r.Candidates
+				totals[i].Removed += r.Removed
+				found = true
+			}
+		}
+		if !found {
+			totals = append(totals, r)
+		}
+	}
+	return totals
+}
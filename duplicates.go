@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdDuplicates = &cobra.Command{
+		Use:   "duplicates",
+		Short: "Report units that are stored under multiple hashes with the same content",
+		Long: "Report units that are stored under multiple hashes with the same content, without removing anything.\n\n" +
+			"Units are compared after removing comments, blank lines and surrounding whitespace. Every group of\n" +
+			"duplicates is listed with the jobs referencing its units, to find the pipeline that uploads them.",
+		Run: cmdDuplicatesRun,
+	}
+)
+
+func init() {
+	cmdMain.AddCommand(cmdDuplicates)
+}
+
+func cmdDuplicatesRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+
+	groups, err := svc.FindDuplicateUnits()
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to find duplicate units: %#v", err)
+	}
+
+	out := output{
+		Value:  groups,
+		Header: []string{"CONTENT", "UNIT", "JOBS"},
+		Empty:  "No duplicate units found",
+	}
+	duplicates := 0
+	for _, g := range groups {
+		for i, u := range g.Units {
+			content := ""
+			if i == 0 {
+				content = fmt.Sprintf("%s (%d units, %d bytes)", g.ContentHash[:12], len(g.Units), g.Bytes)
+			}
+			jobs := strings.Join(u.Jobs, ",")
+			if jobs == "" {
+				jobs = "none (obsolete)"
+				if len(u.LastKnownJobs) > 0 {
+					jobs = fmt.Sprintf("none (obsolete, was %s)", strings.Join(u.LastKnownJobs, ","))
+				}
+			}
+			out.Rows = append(out.Rows, []string{content, u.Hash, jobs})
+		}
+		duplicates += len(g.Units) - 1
+	}
+	out.Footer = fmt.Sprintf("%d groups, %d redundant units", len(groups), duplicates)
+	writeOutput(f, out)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// Exit codes of the fleet-cleanup process
+const (
+	exitCodeOK                 = 0  // Run succeeded, no garbage left behind
+	exitCodeUsage              = 1  // Invalid command line arguments
+	exitCodeEtcdUnreachable    = 2  // Cannot connect to etcd
+	exitCodeDeleteFailed       = 3  // One or more keys could not be removed
+	exitCodeGarbageFound       = 4  // Garbage found while --fail-on-garbage is set
+	exitCodePermissionDenied   = 5  // etcd refused access to one or more keys
+	exitCodeCorruptData        = 6  // Fleet data in etcd cannot be parsed
+	exitCodeFailure            = 7  // Any other failure
+	exitCodeUnknownSchema      = 8  // Fleet registry has an unknown layout
+	exitCodeClusterUnhealthy   = 9  // etcd cluster is unhealthy, nothing was removed
+	exitCodeUnsupportedVersion = 10 // etcd version is outside the tested range (with --etcd-version-check=strict)
+	exitCodeVerificationFailed = 11 // Removed keys still exist or other units disappeared (with --verify-deletes)
+	exitCodeCanaryFailed       = 12 // Anomalies were detected after the canary deletes, the remaining keys were not removed (with --canary)
+	exitCodeRunLocked          = 13 // Run lock was taken over by another run, the remaining keys were not removed
+)
+
+// exitCodeForError returns the exit code matching the cause of the given error.
+func exitCodeForError(err error) int {
+	switch {
+	case err == nil:
+		return exitCodeOK
+	case service.IsInvalidArgument(err):
+		return exitCodeUsage
+	case service.IsEtcdUnreachable(err):
+		return exitCodeEtcdUnreachable
+	case service.IsDeleteFailed(err):
+		return exitCodeDeleteFailed
+	case service.IsPermissionDenied(err):
+		return exitCodePermissionDenied
+	case service.IsCorruptData(err):
+		return exitCodeCorruptData
+	case service.IsUnknownSchema(err):
+		return exitCodeUnknownSchema
+	case service.IsClusterUnhealthy(err):
+		return exitCodeClusterUnhealthy
+	case service.IsUnsupportedVersion(err):
+		return exitCodeUnsupportedVersion
+	case service.IsVerificationFailed(err):
+		return exitCodeVerificationFailed
+	case service.IsCanaryFailed(err):
+		return exitCodeCanaryFailed
+	case service.IsRunLocked(err):
+		return exitCodeRunLocked
+	default:
+		return exitCodeFailure
+	}
+}
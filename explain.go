@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/policy"
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdExplain = &cobra.Command{
+		Use:   "explain <unit hash>",
+		Short: "Show everything known about a unit and why it would (not) be removed",
+		Long: "Show everything known about a unit: the jobs that refer to it (now or earlier), its size, indexes\n" +
+			"and unit file, and the verdict of every cleanup rule about the unit and its unit states, leases & jobs.\n\n" +
+			"Nothing is removed. Pass the NDJSON events of earlier runs (see --events) with --audit-log to find\n" +
+			"the jobs that referred to a unit before it became obsolete.",
+		Run: cmdExplainRun,
+	}
+	explainFlags struct {
+		auditLogs  []string
+		policyFile string
+	}
+)
+
+func init() {
+	cmdExplain.Flags().StringSliceVar(&explainFlags.auditLogs, "audit-log", nil, "File with NDJSON events of earlier runs ('-' means stdin), used to find jobs that referred to the unit")
+	cmdExplain.Flags().StringVar(&explainFlags.policyFile, "policy-file", "", "Path of the policy file used by the cleanups, so the verdicts take it into account")
+	cmdMain.AddCommand(cmdExplain)
+}
+
+func cmdExplainRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the hash of the unit to explain")
+	}
+	f := outputFormatter()
+	svc := newExplainService()
+
+	e, err := svc.ExplainUnit(args[0])
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to explain unit %s: %#v", args[0], err)
+	}
+	for _, source := range explainFlags.auditLogs {
+		jobs, err := auditLogJobs(source, e.Key)
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "Failed to read audit log '%s': %v", source, err)
+		}
+		e.HistoricalJobs = mergeJobs(e.HistoricalJobs, jobs, e.Jobs)
+	}
+
+	out := output{
+		Value:  e,
+		Header: []string{"RULE", "VERDICT", "ACTION", "KEY", "REASON"},
+		Text:   func(w io.Writer) error { return writeExplanation(w, e) },
+	}
+	for _, v := range e.Verdicts {
+		out.Rows = append(out.Rows, []string{v.Rule, v.Verdict, v.Action, v.Key, v.Reason})
+	}
+	writeOutput(f, out)
+}
+
+// writeExplanation writes the given explanation of a unit for people to read.
+func writeExplanation(out io.Writer, e service.UnitExplanation) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Unit:\t%s\n", e.Key)
+	if !e.Exists {
+		fmt.Fprintf(w, "Exists:\tno\n")
+	} else {
+		storage := "key"
+		if e.Dir {
+			storage = "directory"
+		}
+		fmt.Fprintf(w, "Size:\t%d bytes (%s)\n", e.Size, storage)
+		fmt.Fprintf(w, "Indexes:\tcreated at %d, modified at %d (~%s ago)\n", e.CreatedIndex, e.ModifiedIndex, e.Age)
+		fmt.Fprintf(w, "Types:\t%s\n", orNone(e.UnitTypes))
+	}
+	fmt.Fprintf(w, "Jobs:\t%s\n", orNone(e.Jobs))
+	fmt.Fprintf(w, "Unit states of:\t%s\n", orNone(e.StateJobs))
+	fmt.Fprintf(w, "Earlier jobs:\t%s\n", orNone(e.HistoricalJobs))
+	if len(e.Templates) > 0 {
+		fmt.Fprintf(w, "Templates:\t%s\n", strings.Join(e.Templates, ", "))
+	}
+	if m := e.Marker; m != nil {
+		fmt.Fprintf(w, "Annotated:\tby rule %s in run %s at %s\n", m.Rule, m.RunID, m.Time.Format("2006-01-02 15:04:05"))
+	}
+	if v := e.Veto; v != nil {
+		fmt.Fprintf(w, "Vetoed:\tby %s at %s: %s\n", orDash(v.Hostname), v.Time.Format("2006-01-02 15:04:05"), orDash(v.Reason))
+	}
+	if err := w.Flush(); err != nil {
+		return maskAny(err)
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tVERDICT\tACTION\tKEY\tREASON")
+	for _, v := range e.Verdicts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Rule, v.Verdict, orDash(v.Action), orDash(v.Key), v.Reason)
+	}
+	if err := w.Flush(); err != nil {
+		return maskAny(err)
+	}
+
+	if e.Content != "" {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Unit file:")
+		for _, line := range strings.Split(strings.TrimRight(e.Content, "\n"), "\n") {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	return nil
+}
+
+// newExplainService creates a service used to explain a unit, configured with the given policy file (if any).
+func newExplainService() *service.Service {
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	var cleanupPolicy service.Policy
+	if explainFlags.policyFile != "" {
+		var err error
+		cleanupPolicy, err = policy.LoadFile(explainFlags.policyFile)
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "--policy-file '%s' is not valid: %v", explainFlags.policyFile, err)
+		}
+	}
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+		Policy:        cleanupPolicy,
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+	return svc
+}
+
+// auditLogJobs returns the names of the jobs of all events for the given key in the given file
+// with NDJSON events ('-' means stdin).
+func auditLogJobs(source, key string) ([]string, error) {
+	f := os.Stdin
+	if source != "-" {
+		var err error
+		f, err = os.Open(source)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		defer f.Close()
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024) // Events of a run summary can be large
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var event service.Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, maskAny(err)
+		}
+		if event.Key != key || event.Job == "" {
+			continue
+		}
+		result = append(result, strings.Split(event.Job, ",")...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, maskAny(err)
+	}
+	return result, nil
+}
+
+// mergeJobs adds the given job names to the given list (unless they are in except), sorted & without duplicates.
+func mergeJobs(list, names, except []string) []string {
+	seen := make(map[string]bool)
+	for _, name := range except {
+		seen[name] = true
+	}
+	var result []string
+	for _, name := range append(append([]string(nil), list...), names...) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// orDash returns the given value, or "-" when it is empty.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// orNone returns the given list joined by commas, or "none" when it is empty.
+func orNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats (see --output)
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+)
+
+// formatters holds the formatter of every output format.
+var formatters = map[string]formatter{
+	outputTable: tableFormatter{},
+	outputJSON:  jsonFormatter{},
+	outputYAML:  yamlFormatter{},
+	outputCSV:   csvFormatter{},
+}
+
+// output is the output of a command. Structured formats (JSON, YAML) write its value,
+// tabular formats (table, CSV) write the same data as rows.
+type output struct {
+	Value  interface{}
+	Header []string
+	Rows   [][]string
+	Empty  string                  // If set, the table format writes this line instead of an empty table
+	Footer string                  // If set, the table format writes this line after the table
+	Text   func(w io.Writer) error // If set, the table format writes this instead of the rows
+}
+
+// formatter writes the output of a command in a single output format.
+type formatter interface {
+	Format(w io.Writer, out output) error
+}
+
+// tableFormatter writes aligned columns for people to read.
+type tableFormatter struct{}
+
+func (tableFormatter) Format(w io.Writer, out output) error {
+	if out.Text != nil {
+		return maskAny(out.Text(w))
+	}
+	if len(out.Rows) == 0 && out.Empty != "" {
+		_, err := fmt.Fprintln(w, out.Empty)
+		return maskAny(err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(out.Header, "\t"))
+	for _, row := range out.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return maskAny(err)
+	}
+	if out.Footer != "" {
+		if _, err := fmt.Fprintln(w, out.Footer); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// jsonFormatter writes the value as indented JSON.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(w io.Writer, out output) error {
+	raw, err := json.MarshalIndent(out.Value, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	if _, err := fmt.Fprintln(w, string(raw)); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// csvFormatter writes the header and rows as CSV.
+type csvFormatter struct{}
+
+func (csvFormatter) Format(w io.Writer, out output) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(out.Header); err != nil {
+		return maskAny(err)
+	}
+	if err := cw.WriteAll(out.Rows); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// yamlFormatter writes the value as YAML. The value is encoded as JSON first,
+// so the YAML document has the same fields (in the same order) as the JSON document.
+type yamlFormatter struct{}
+
+func (yamlFormatter) Format(w io.Writer, out output) error {
+	raw, err := json.Marshal(out.Value)
+	if err != nil {
+		return maskAny(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		return maskAny(err)
+	}
+	bw := bufio.NewWriter(w)
+	if isYAMLScalar(value) {
+		fmt.Fprintln(bw, yamlScalar(value))
+	} else {
+		writeYAML(bw, value, 0)
+	}
+	if err := bw.Flush(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// yamlMapping is a JSON object with its keys in the original order.
+type yamlMapping []yamlEntry
+
+type yamlEntry struct {
+	key   string
+	value interface{}
+}
+
+// decodeOrdered decodes the next JSON value, keeping the order of object keys.
+// Objects become a yamlMapping, arrays a []interface{}, numbers a json.Number.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	switch tok {
+	case json.Delim('{'):
+		m := yamlMapping{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			m = append(m, yamlEntry{key: fmt.Sprint(key), value: value})
+		}
+		_, err := dec.Token() // Closing '}'
+		return m, maskAny(err)
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token() // Closing ']'
+		return list, maskAny(err)
+	default:
+		return tok, nil
+	}
+}
+
+// writeYAML writes the given mapping or (non-empty) list in block style at the given indentation.
+func writeYAML(w io.Writer, value interface{}, indent int) {
+	prefix := strings.Repeat(" ", indent)
+	switch v := value.(type) {
+	case yamlMapping:
+		for _, e := range v {
+			if isYAMLScalar(e.value) {
+				fmt.Fprintf(w, "%s%s: %s\n", prefix, yamlString(e.key), yamlScalar(e.value))
+				continue
+			}
+			fmt.Fprintf(w, "%s%s:\n", prefix, yamlString(e.key))
+			if _, ok := e.value.(yamlMapping); ok {
+				writeYAML(w, e.value, indent+2)
+			} else {
+				// Lists are not indented below their key
+				writeYAML(w, e.value, indent)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if isYAMLScalar(item) {
+				fmt.Fprintf(w, "%s- %s\n", prefix, yamlScalar(item))
+				continue
+			}
+			// Write the item indented below the dash, then put the dash on its first line
+			var buf bytes.Buffer
+			writeYAML(&buf, item, indent+2)
+			fmt.Fprintf(w, "%s- %s", prefix, buf.String()[indent+2:])
+		}
+	}
+}
+
+// isYAMLScalar returns true if the given value is written on a single line: anything but
+// a non-empty mapping or list.
+func isYAMLScalar(value interface{}) bool {
+	switch v := value.(type) {
+	case yamlMapping:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return true
+	}
+}
+
+// yamlScalar returns the YAML representation of a value that is written on a single line.
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case yamlMapping:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	default:
+		return yamlString(fmt.Sprint(v))
+	}
+}
+
+// yamlString returns the given string, quoted when YAML would read it as something else
+// than that string (e.g. a number, a boolean or a mapping).
+func yamlString(s string) string {
+	if !yamlNeedsQuotes(s) {
+		return s
+	}
+	// A JSON string is a valid double-quoted YAML string
+	raw, _ := json.Marshal(s)
+	return string(raw)
+}
+
+// yamlNeedsQuotes returns true if the given string cannot be written as a plain YAML scalar.
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`+.0123456789") {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return true
+		}
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "y", "n", "on", "off", "null", "~":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// readUnitHashes reads a list of unit hashes from the given file ('-' means stdin).
+// Every non-empty line can be a unit hash, a unit key (e.g. /_coreos.com/fleet/unit/<hash>)
+// or an NDJSON event as emitted with --events=ndjson.
+// Lines starting with '#' are ignored.
+func readUnitHashes(source string) ([]string, error) {
+	var r io.Reader
+	if source == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			// NDJSON event
+			var event struct {
+				Kind string `json:"kind"`
+				Key  string `json:"key"`
+			}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				return nil, maskAny(err)
+			}
+			if event.Kind != "unit" || event.Key == "" {
+				continue
+			}
+			line = event.Key
+		}
+		result = append(result, path.Base(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, maskAny(err)
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// Exit codes of check-heartbeat, as expected by Nagios & Sensu
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var (
+	cmdCheckHeartbeat = &cobra.Command{
+		Use:   "check-heartbeat",
+		Short: "Check that cleanups are still running (Nagios/Sensu plugin)",
+		Long: "Check that cleanups are still running, using the heartbeat written by runs with --heartbeat-ttl.\n\n" +
+			"Prints a single status line and exits with 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN).\n" +
+			"The check is critical when the heartbeat expired, i.e. no run succeeded within the heartbeat TTL.",
+		Run: cmdCheckHeartbeatRun,
+	}
+	checkHeartbeatFlags struct {
+		warningAge  time.Duration
+		criticalAge time.Duration
+		shard       string
+	}
+)
+
+func init() {
+	cmdCheckHeartbeat.Flags().DurationVar(&checkHeartbeatFlags.warningAge, "warning-age", 0, "If set, warn when the last successful run is older than this")
+	cmdCheckHeartbeat.Flags().DurationVar(&checkHeartbeatFlags.criticalAge, "critical-age", 0, "If set, fail when the last successful run is older than this (the heartbeat TTL always applies)")
+	cmdCheckHeartbeat.Flags().StringVar(&checkHeartbeatFlags.shard, "shard", "", "If set, check the heartbeat of this shard (<index>/<count>)")
+	cmdMain.AddCommand(cmdCheckHeartbeat)
+}
+
+func cmdCheckHeartbeatRun(cmd *cobra.Command, args []string) {
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	var shard service.Shard
+	if checkHeartbeatFlags.shard != "" {
+		var err error
+		shard, err = service.ParseShard(checkHeartbeatFlags.shard)
+		if err != nil {
+			checkExit(checkUnknown, "UNKNOWN - --shard '%s' is not valid: %v", checkHeartbeatFlags.shard, err)
+		}
+	}
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+		Shard:         shard,
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		checkExit(checkUnknown, "UNKNOWN - %v", err)
+	}
+
+	hb, found, err := svc.LastHeartbeat()
+	if err != nil {
+		checkExit(checkUnknown, "UNKNOWN - cannot read heartbeat: %v", err)
+	}
+	if !found {
+		checkExit(checkCritical, "CRITICAL - no heartbeat, no cleanup succeeded within the heartbeat TTL")
+	}
+	age := time.Since(hb.Time)
+	status := fmt.Sprintf("last cleanup %s succeeded %s ago on %s", hb.RunID, age-age%time.Second, hb.Hostname)
+	if hb.DryRun {
+		status += " (dry run)"
+	}
+	switch {
+	case checkHeartbeatFlags.criticalAge > 0 && age > checkHeartbeatFlags.criticalAge:
+		checkExit(checkCritical, "CRITICAL - %s", status)
+	case checkHeartbeatFlags.warningAge > 0 && age > checkHeartbeatFlags.warningAge:
+		checkExit(checkWarning, "WARNING - %s", status)
+	default:
+		checkExit(checkOK, "OK - %s", status)
+	}
+}
+
+// checkExit prints the given status line to stdout and exits with the given check exit code.
+func checkExit(code int, format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+	os.Exit(code)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdHistory = &cobra.Command{
+		Use:   "history",
+		Short: "Show the most recent cleanup runs",
+		Run:   cmdHistoryRun,
+	}
+	historyFlags struct {
+		limit int
+	}
+)
+
+func init() {
+	cmdHistory.Flags().IntVarP(&historyFlags.limit, "limit", "n", 10, "Maximum number of runs to show (0 shows all)")
+	cmdHistory.Flags().StringVar(&globalFlags.historyFile, "history-file", "", "If set, read the run history from this local file instead of etcd")
+	cmdMain.AddCommand(cmdHistory)
+}
+
+func cmdHistoryRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+		HistoryFile:   globalFlags.historyFile,
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+
+	records, err := svc.History(historyFlags.limit)
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to load history: %#v", err)
+	}
+
+	out := output{
+		Value:  records,
+		Header: []string{"TIME", "RUN", "HOST", "VERSION", "MODE", "JOBS", "UNITS", "OBSOLETE", "REMOVED", "STALE LEASES", "FAILED", "DURATION", "RESULT"},
+		Empty:  "No runs recorded",
+	}
+	for _, r := range records {
+		mode := "delete"
+		if r.DryRun {
+			mode = "dry-run"
+		} else if r.Postponed {
+			mode = "postponed"
+		} else if r.Paused {
+			mode = "paused"
+		}
+		result := "ok"
+		if !r.Succeeded() {
+			result = "failed: " + r.Error
+		}
+		out.Rows = append(out.Rows, []string{
+			r.Time.Format(time.RFC3339), r.RunID, r.Hostname, r.Version, mode,
+			strconv.Itoa(r.Jobs), strconv.Itoa(r.Units), strconv.Itoa(r.ObsoleteUnits), strconv.Itoa(r.RemovedUnits + r.RemovedLeases + r.RemovedStates),
+			strconv.Itoa(r.StaleLeases), strconv.Itoa(r.FailedDeletes), r.Duration.String(), result,
+		})
+	}
+	writeOutput(f, out)
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+// Command integration runs fleet-cleanup against a real etcd server (see 'make integration').
+// Every scenario seeds a realistic fleet registry, performs a single run and checks exactly
+// which keys of the registry remain.
+// It removes everything under /_coreos.com and /_pulcy, so never point it at a cluster in use.
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+const (
+	fleetPrefix  = "/_coreos.com/fleet"
+	toolPrefix   = "/_pulcy"
+	readyTimeout = 30 * time.Second
+)
+
+// seedKey is a key of the seeded registry.
+type seedKey struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// scenario is a single run against a freshly seeded registry.
+type scenario struct {
+	Name      string
+	Configure func(config *service.ServiceConfig)
+	Removed   []string // Seeded keys the run must remove, all other keys must remain
+}
+
+var (
+	usedUnit     = "[Service]\nExecStart=/bin/web\n"
+	obsoleteUnit = "[Service]\nExecStart=/bin/old\n"
+	brokenUnit   = "[Service]\nExecStart=/bin/broken\n"
+
+	// seed is a registry with a running job, an inactive job, a machine (with TTL), an obsolete unit,
+	// a lease of an unknown machine and unit states of an unknown machine.
+	seed = []seedKey{
+		{Key: unitKey(usedUnit), Value: unitValue(usedUnit)},
+		{Key: unitKey(obsoleteUnit), Value: unitValue(obsoleteUnit)},
+		{Key: unitKey(brokenUnit), Value: unitValue(brokenUnit)},
+		{Key: fleetPrefix + "/job/web.service/object", Value: jobValue("web.service", usedUnit)},
+		{Key: fleetPrefix + "/job/web.service/target-state", Value: "launched"},
+		{Key: fleetPrefix + "/job/web.service/target", Value: "m1"},
+		{Key: fleetPrefix + "/job/broken.service/object", Value: jobValue("broken.service", brokenUnit)},
+		{Key: fleetPrefix + "/job/broken.service/target-state", Value: "inactive"},
+		{Key: fleetPrefix + "/machines/m1/object", Value: `{"ID":"m1","PublicIP":"10.0.0.1","Metadata":{}}`, TTL: time.Hour},
+		{Key: fleetPrefix + "/lease/engine-leader", Value: `{"MachineID":"m1","Version":1}`, TTL: time.Hour},
+		{Key: fleetPrefix + "/lease/web.service", Value: `{"MachineID":"m1","Version":1}`, TTL: time.Hour},
+		{Key: fleetPrefix + "/lease/old.service", Value: `{"MachineID":"m2","Version":1}`, TTL: time.Hour},
+		{Key: fleetPrefix + "/states/web.service/m1", Value: stateValue(usedUnit)},
+		{Key: fleetPrefix + "/states/old.service/m2", Value: stateValue(obsoleteUnit)},
+	}
+
+	scenarios = []scenario{
+		{
+			Name:      "dry-run",
+			Configure: func(config *service.ServiceConfig) { config.DryRun = true },
+		},
+		{
+			Name:    "obsolete units",
+			Removed: []string{unitKey(obsoleteUnit)},
+		},
+		{
+			Name: "leases and states",
+			Configure: func(config *service.ServiceConfig) {
+				config.CleanLeases = true
+				config.CleanStates = true
+			},
+			Removed: []string{unitKey(obsoleteUnit), fleetPrefix + "/lease/old.service", fleetPrefix + "/states/old.service/m2"},
+		},
+		{
+			Name: "excluded by policy",
+			Configure: func(config *service.ServiceConfig) {
+				config.Policy = service.Policy{Rules: map[string]service.RulePolicy{
+					service.RuleOrphanUnits: {Exclude: []string{"^" + unitKey(obsoleteUnit) + "$"}},
+				}}
+			},
+		},
+		{
+			Name: "max delete",
+			Configure: func(config *service.ServiceConfig) {
+				config.CleanLeases = true
+				config.MaxDelete = 1
+				config.DeleteOrder = service.DeleteOrderName
+			},
+			Removed: []string{fleetPrefix + "/lease/old.service"},
+		},
+	}
+)
+
+func main() {
+	etcdAddr := flag.String("etcd-addr", "http://127.0.0.1:2379", "Address of the etcd server to test against (all its data is removed)")
+	verbose := flag.Bool("v", false, "If set, log the output of the service")
+	flag.Parse()
+
+	endpoint, err := url.Parse(*etcdAddr)
+	if err != nil {
+		exitf("--etcd-addr '%s' is not valid: %v", *etcdAddr, err)
+	}
+	logLevel := logging.WARNING
+	if *verbose {
+		logLevel = logging.DEBUG
+	}
+	logging.SetLevel(logLevel, "integration")
+	logger := logging.MustGetLogger("integration")
+
+	c, err := client.New(client.Config{Endpoints: []string{*etcdAddr}})
+	if err != nil {
+		exitf("Failed to create etcd client: %v", err)
+	}
+	keysAPI := client.NewKeysAPI(c)
+	if err := waitForEtcd(keysAPI); err != nil {
+		exitf("etcd at %s is not ready: %v", *etcdAddr, err)
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if err := runScenario(keysAPI, *endpoint, logger, sc); err != nil {
+			fmt.Printf("FAIL %s: %v\n", sc.Name, err)
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", sc.Name)
+		}
+	}
+	if failed > 0 {
+		exitf("%d of %d scenarios failed", failed, len(scenarios))
+	}
+}
+
+// runScenario seeds the registry, runs the service once and checks the remaining keys.
+func runScenario(keysAPI client.KeysAPI, endpoint url.URL, logger *logging.Logger, sc scenario) error {
+	if err := reset(keysAPI); err != nil {
+		return err
+	}
+	for _, k := range seed {
+		if _, err := keysAPI.Set(context.Background(), k.Key, k.Value, &client.SetOptions{TTL: k.TTL}); err != nil {
+			return fmt.Errorf("cannot seed %s: %v", k.Key, err)
+		}
+	}
+	config := service.ServiceConfig{
+		EtcdURL:          endpoint,
+		ChurnIndexWindow: 0, // The registry was just seeded
+		HealthCheck:      true,
+	}
+	if sc.Configure != nil {
+		sc.Configure(&config)
+	}
+	svc, err := service.NewService(config, service.ServiceDependencies{Logger: logger})
+	if err != nil {
+		return fmt.Errorf("cannot create service: %v", err)
+	}
+	if _, err := svc.RunWithOptions(service.RunOptions{}); err != nil {
+		return fmt.Errorf("run failed: %v", err)
+	}
+
+	removed := make(map[string]bool)
+	for _, key := range sc.Removed {
+		removed[key] = true
+	}
+	var expected []string
+	for _, k := range seed {
+		if !removed[k.Key] {
+			expected = append(expected, k.Key)
+		}
+	}
+	actual, err := listKeys(keysAPI, fleetPrefix)
+	if err != nil {
+		return fmt.Errorf("cannot list remaining keys: %v", err)
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if strings.Join(expected, "\n") != strings.Join(actual, "\n") {
+		return fmt.Errorf("unexpected keys remain\nexpected:\n  %s\nactual:\n  %s", strings.Join(expected, "\n  "), strings.Join(actual, "\n  "))
+	}
+	return nil
+}
+
+// reset removes the fleet registry and all keys of fleet-cleanup.
+func reset(keysAPI client.KeysAPI) error {
+	for _, prefix := range []string{"/_coreos.com", toolPrefix} {
+		_, err := keysAPI.Delete(context.Background(), prefix, &client.DeleteOptions{Recursive: true, Dir: true})
+		if err != nil && !client.IsKeyNotFound(err) {
+			return fmt.Errorf("cannot remove %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// listKeys returns the keys of all values under the given directory.
+func listKeys(keysAPI client.KeysAPI, dir string) ([]string, error) {
+	resp, err := keysAPI.Get(context.Background(), dir, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var result []string
+	var walk func(n *client.Node)
+	walk = func(n *client.Node) {
+		if !n.Dir {
+			result = append(result, n.Key)
+		}
+		for _, child := range n.Nodes {
+			walk(child)
+		}
+	}
+	walk(resp.Node)
+	return result, nil
+}
+
+// waitForEtcd waits until etcd accepts requests, since the container takes a moment to start.
+func waitForEtcd(keysAPI client.KeysAPI) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		_, err := keysAPI.Get(context.Background(), "/", nil)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// unitHash returns the fleet hash (sha1) of the given unit file.
+func unitHash(unit string) []byte {
+	h := sha1.Sum([]byte(unit))
+	return h[:]
+}
+
+func unitKey(unit string) string {
+	return fleetPrefix + "/unit/" + hex.EncodeToString(unitHash(unit))
+}
+
+func unitValue(unit string) string {
+	return fmt.Sprintf(`{"Raw":%q}`, unit)
+}
+
+func jobValue(name, unit string) string {
+	return fmt.Sprintf(`{"Name":%q,"UnitHash":%q}`, name, base64.StdEncoding.EncodeToString(unitHash(unit)))
+}
+
+func stateValue(unit string) string {
+	return fmt.Sprintf(`{"loadState":"loaded","activeState":"active","subState":"running","machineState":{"ID":"m1"},"unitHash":%q}`, hex.EncodeToString(unitHash(unit)))
+}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdJob = &cobra.Command{
+		Use:   "job",
+		Short: "Commands operating on a single job",
+	}
+	cmdJobRm = &cobra.Command{
+		Use:   "rm <job name>",
+		Short: "Remove all registry traces of a job",
+		Long: "Remove all registry traces of a job: its job directory (object, target state & schedule), its lease,\n" +
+			"its unit states and its unit, unless another job uses the same unit.\n\n" +
+			"Useful when 'fleetctl destroy' left partial state behind. Jobs that fleet is supposed to run\n" +
+			"(target state loaded or launched) are only removed with --force.",
+		Run: cmdJobRmRun,
+	}
+	jobRmFlags struct {
+		dryRun bool
+		force  bool
+	}
+)
+
+func init() {
+	cmdJobRm.Flags().BoolVar(&jobRmFlags.dryRun, "dry-run", false, "If set, only show the keys that would be removed")
+	cmdJobRm.Flags().BoolVar(&jobRmFlags.force, "force", false, "If set, also remove jobs that are loaded or launched, and ignore a pause of all cleanups")
+	cmdJob.AddCommand(cmdJobRm)
+	cmdMain.AddCommand(cmdJob)
+}
+
+func cmdJobRmRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the name of the job to remove")
+	}
+	svc := newTraceService()
+
+	traces, err := svc.FindJobTraces(args[0])
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to find keys of job %s: %#v", args[0], err)
+	}
+	if len(traces.Keys) == 0 {
+		fmt.Printf("No keys of job %s found\n", traces.Job)
+		return
+	}
+	if len(traces.SharedWith) > 0 {
+		fmt.Printf("Keeping unit %s, it is also used by %s\n", traces.UnitHash, strings.Join(traces.SharedWith, ", "))
+	}
+	if jobRmFlags.dryRun {
+		for _, k := range traces.Keys {
+			fmt.Printf("would remove %s %s\n", k.Kind, k.Key)
+		}
+		return
+	}
+	if traces.Active() && !jobRmFlags.force {
+		Exitf("Job %s has target state %s, use 'fleetctl destroy %s' or pass --force", traces.Job, traces.TargetState, traces.Job)
+	}
+	if !jobRmFlags.force {
+		checkNotPaused(svc)
+	}
+	err = svc.RemoveJobTraces(&traces)
+	for _, k := range traces.Keys {
+		if k.Removed {
+			fmt.Printf("removed %s %s\n", k.Kind, k.Key)
+		}
+	}
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to remove job %s: %#v", traces.Job, err)
+	}
+}
+
+// newTraceService creates a service used to find & remove the keys of a single job or machine.
+func newTraceService() *service.Service {
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+	return svc
+}
+
+// checkNotPaused exits when an operator paused all cleanups (see 'fleet-cleanup pause').
+func checkNotPaused(svc *service.Service) {
+	p, paused, err := svc.Paused()
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to check for a pause: %#v", err)
+	}
+	if paused {
+		Exitf("Cleanups are paused (%s), pass --force to remove keys anyway", p.Reason)
+	}
+}
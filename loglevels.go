@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// Components with their own logger, whose level can be set with --log-level=<component>=<level>
+const (
+	componentNotifier = "notifier" // Alerts, reports & error reporting
+	componentHTTP     = "http"     // Admin API server
+)
+
+var logComponents = []string{service.ComponentRegistry, service.ComponentRules, componentNotifier, componentHTTP}
+
+// setLogLevel sets the levels of the given logger and the loggers of all components.
+// The log level is a comma separated list of levels (e.g. 'info,registry=debug'), where a level without
+// component applies to the given logger and all components that are not listed.
+func setLogLevel(logLevel, loggerName string) {
+	levels := make(map[string]logging.Level)
+	base := logging.INFO
+	for _, part := range strings.Split(logLevel, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component := ""
+		if i := strings.Index(part, "="); i >= 0 {
+			component, part = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+			if !isLogComponent(component) {
+				Exitf("Invalid log-level '%s': unknown component '%s', expected one of %s", logLevel, component, strings.Join(logComponents, ", "))
+			}
+		}
+		level, err := logging.LogLevel(part)
+		if err != nil {
+			Exitf("Invalid log-level '%s': %#v", logLevel, err)
+		}
+		if component == "" {
+			base = level
+		} else {
+			levels[component] = level
+		}
+	}
+	logging.SetLevel(base, loggerName)
+	for _, component := range logComponents {
+		level, ok := levels[component]
+		if !ok {
+			level = base
+		}
+		logging.SetLevel(level, componentLoggerName(loggerName, component))
+	}
+}
+
+// isLogComponent returns true if the given name is a component with its own logger.
+func isLogComponent(name string) bool {
+	for _, c := range logComponents {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// componentLoggerName returns the name of the logger of the given component.
+func componentLoggerName(loggerName, component string) string {
+	return loggerName + "." + component
+}
+
+// componentLogger returns the logger of the given component.
+func componentLogger(component string) *logging.Logger {
+	return logging.MustGetLogger(componentLoggerName(projectName, component))
+}
+
+// serviceComponentLoggers returns the loggers of the components of the service.
+func serviceComponentLoggers() map[string]service.Logger {
+	return map[string]service.Logger{
+		service.ComponentRegistry: componentLogger(service.ComponentRegistry),
+		service.ComponentRules:    componentLogger(service.ComponentRules),
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdMachine = &cobra.Command{
+		Use:   "machine",
+		Short: "Commands operating on a single machine",
+	}
+	cmdMachineRm = &cobra.Command{
+		Use:   "rm <machine id>",
+		Short: "Remove all registry traces of a machine",
+		Long: "Remove all registry traces of a machine: the schedule entries (job targets) pointing at it,\n" +
+			"the unit states it published and its machine directory.\n\n" +
+			"Useful to excise a host that was terminated without draining. Machines that are still registered\n" +
+			"in fleet are only removed with --force.",
+		Run: cmdMachineRmRun,
+	}
+	machineRmFlags struct {
+		dryRun bool
+		force  bool
+	}
+)
+
+func init() {
+	cmdMachineRm.Flags().BoolVar(&machineRmFlags.dryRun, "dry-run", false, "If set, only show the keys that would be removed")
+	cmdMachineRm.Flags().BoolVar(&machineRmFlags.force, "force", false, "If set, also remove machines that are still registered, and ignore a pause of all cleanups")
+	cmdMachine.AddCommand(cmdMachineRm)
+	cmdMain.AddCommand(cmdMachine)
+}
+
+func cmdMachineRmRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the ID of the machine to remove")
+	}
+	svc := newTraceService()
+
+	traces, err := svc.FindMachineTraces(args[0])
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to find keys of machine %s: %#v", args[0], err)
+	}
+	if len(traces.Keys) == 0 {
+		fmt.Printf("No keys of machine %s found\n", traces.Machine)
+		return
+	}
+	if machineRmFlags.dryRun {
+		for _, k := range traces.Keys {
+			fmt.Printf("would remove %s %s\n", k.Kind, k.Key)
+		}
+		return
+	}
+	if traces.Registered && !machineRmFlags.force {
+		Exitf("Machine %s is still registered in fleet, stop its fleet agent first or pass --force", traces.Machine)
+	}
+	if !machineRmFlags.force {
+		checkNotPaused(svc)
+	}
+	err = svc.RemoveMachineTraces(&traces)
+	for _, k := range traces.Keys {
+		if k.Removed {
+			fmt.Printf("removed %s %s\n", k.Kind, k.Key)
+		}
+	}
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to remove machine %s: %#v", traces.Machine, err)
+	}
+}
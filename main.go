@@ -16,15 +16,26 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/juju/errgo"
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
 
+	"github.com/pulcy/fleet-cleanup/api"
+	"github.com/pulcy/fleet-cleanup/archive"
+	"github.com/pulcy/fleet-cleanup/metrics"
+	"github.com/pulcy/fleet-cleanup/policy"
+	"github.com/pulcy/fleet-cleanup/reporting"
 	"github.com/pulcy/fleet-cleanup/service"
+	"github.com/pulcy/fleet-cleanup/tracing"
 )
 
 var (
@@ -39,12 +50,118 @@ const (
 
 	defaultLogLevel = "debug"
 	defaultEtcdAddr = "http://localhost:2379"
+
+	defaultFleetPrefix      = "/_coreos.com/fleet"
+	defaultUnitPathTemplate = "unit/{hash}"
+	defaultJobPathTemplate  = "job/{name}"
+
+	defaultChurnIndexWindow = 100
+	defaultMaxRaftIndexLag  = 1000
+	defaultHistorySize      = 50
+	defaultArchiveKeep      = 30
+	defaultInactiveJobAge   = 7 * 24 * time.Hour
+	defaultTrashTTL         = 7 * 24 * time.Hour
+	defaultDeleteTimeout    = 10 * time.Second
+	defaultLeaderTTL        = 30 * time.Second
+	defaultStealLockAfter   = time.Hour
 )
 
 type globalOptions struct {
-	logLevel string
-	etcdAddr string
-	dryRun   bool
+	logLevel      string
+	etcdAddr      string
+	etcdProxy     string
+	etcdInsecure  bool
+	etcdAuth      string
+	etcdTokenFile string
+	etcdMaxIdle   int
+	etcdKeepAlive time.Duration
+	etcdHeaderTO  time.Duration
+	etcdNoReuse   bool
+	keyPrefix     string
+	offlineBackup string
+	fleetPrefix   string
+	unitTemplate  string
+	jobTemplate   string
+	versionCheck  string
+	dryRun        bool
+	cleanLeases   bool
+	cleanStates   bool
+	churnWindow   uint64
+	healthCheck   bool
+	raftIndexLag  uint64
+	interval      time.Duration
+	splay         time.Duration
+	events        string
+	maxDelete     int
+	deleteOrder   string
+	templateUnits string
+	maxDuration   time.Duration
+	maxEtcdOps    int
+	adminAddr     string
+	otlpEndpoint  string
+	sentryDSN     string
+	errorWebhook  string
+	failOnGarbage bool
+	jsonSummary   bool
+	allRegistries bool
+	leaderElect   bool
+	leaderTTL     time.Duration
+	stealLock     time.Duration
+	hashesFrom    string
+	jobFilter     string
+	noColor       bool
+	color         string
+	output        string
+	quiet         bool
+	verbose       bool
+	historySize   int
+	historyFile   string
+	statusFile    string
+	archiveS3URL  string
+	archiveDir    string
+	archiveKeep   int
+	fullReport    bool
+	exporterOnly  bool
+	readOnly      bool
+	forceSchema   string
+	enableRules   []string
+	disableRules  []string
+	ruleActions   []string
+	inactiveAge   time.Duration
+	policyFile    string
+	maintWindow   string
+	trashTTL      time.Duration
+	annotateTTL   time.Duration
+	restoredTTL   time.Duration
+	deleteTimeout time.Duration
+	pacing        bool
+	pacingLatency time.Duration
+	pacingMax     time.Duration
+	canary        int
+	canaryObserve time.Duration
+	watchOrphans  bool
+	orphanDelay   time.Duration
+	profileRun    bool
+	verifyDeletes bool
+	scanCache     bool
+	minSeverity   string
+	ownerLabels   string
+	shard         string
+	protectTypes  []string
+	emitScript    string
+	scriptOut     string
+	saveScan      string
+	useScan       string
+	alertLimit    int
+	alertGrowth   float64
+	alertBeat     time.Duration
+	heartbeatTTL  time.Duration
+	alertWebhook  string
+	slackWebhook  string
+	emailTo       []string
+	emailFrom     string
+	smtpAddr      string
+	smtpUsername  string
 }
 
 var (
@@ -58,23 +175,224 @@ var (
 func init() {
 	logging.SetFormatter(logging.MustStringFormatter("[%{level:-5s}] %{message}"))
 
-	cmdMain.Flags().StringVar(&globalFlags.logLevel, "log-level", defaultLogLevel, "Minimum log level (debug|info|warning|error)")
-	cmdMain.Flags().StringVar(&globalFlags.etcdAddr, "etcd-addr", defaultEtcdAddr, "Address of etcd")
+	cmdMain.PersistentFlags().BoolVarP(&globalFlags.quiet, "quiet", "q", false, "If set, only report the final summary & errors")
+	cmdMain.PersistentFlags().BoolVarP(&globalFlags.verbose, "verbose", "v", false, "If set, report per-key details including etcd responses")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.logLevel, "log-level", defaultLogLevel, "Minimum log level (debug|info|warning|error), optionally per component (registry|rules|notifier|http), e.g. 'info,registry=debug'")
+	cmdMain.PersistentFlags().StringVarP(&globalFlags.output, "output", "o", "", "Output format (table|json|yaml|csv), defaults to table on a terminal or in CI and json otherwise; cleanup runs write the final run report in this format when set")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.etcdAddr, "etcd-addr", defaultEtcdAddr, "Address of etcd")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.etcdProxy, "etcd-proxy", "", "If set, connect to etcd through this HTTP proxy (defaults to HTTP_PROXY/HTTPS_PROXY environment variables)")
+	cmdMain.PersistentFlags().BoolVar(&globalFlags.etcdInsecure, "etcd-insecure-skip-verify", false, "DANGEROUS: if set, do not verify the TLS certificate of etcd (only for lab clusters with self-signed certificates)")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.etcdAuth, "etcd-auth-header", "", "If set, send this value as Authorization header with every etcd request (e.g. 'Bearer <token>')")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.etcdTokenFile, "etcd-bearer-token-file", "", "If set, send the bearer token in this file as Authorization header with every etcd request")
+	cmdMain.PersistentFlags().IntVar(&globalFlags.etcdMaxIdle, "etcd-max-idle-conns", 0, "Maximum number of idle connections to keep per etcd endpoint (0 uses the default)")
+	cmdMain.PersistentFlags().DurationVar(&globalFlags.etcdKeepAlive, "etcd-tcp-keepalive", 0, "Interval of TCP keep-alive probes on etcd connections (0 uses the default of 30s, negative disables them)")
+	cmdMain.PersistentFlags().DurationVar(&globalFlags.etcdHeaderTO, "etcd-response-header-timeout", 0, "Maximum time to wait for the response headers of an etcd request (0 means no limit)")
+	cmdMain.PersistentFlags().BoolVar(&globalFlags.etcdNoReuse, "etcd-disable-keepalives", false, "If set, use a new connection for every etcd request (HTTP keep-alives disabled)")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.keyPrefix, "key-prefix-rewrite", "", "If set, add this prefix to all keys sent to etcd and remove it from all keys received, e.g. for a namespaced etcd proxy")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.offlineBackup, "offline-backup", "", "If set, do not connect to etcd, but read the registry from this etcd v2 backup (data directory, snapshot file or JSON dump of the store), implies --assume-read-only")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.versionCheck, "etcd-version-check", service.EtcdVersionCheckWarn, "How to handle an etcd version outside the tested range (warn|strict|off)")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.fleetPrefix, "fleet-prefix", defaultFleetPrefix, "Root of the fleet registry in etcd")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.unitTemplate, "unit-path-template", defaultUnitPathTemplate, "Key of a unit, relative to the fleet prefix")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.jobTemplate, "job-path-template", defaultJobPathTemplate, "Directory of a job, relative to the fleet prefix")
 	cmdMain.Flags().BoolVar(&globalFlags.dryRun, "dry-run", false, "If set, only list garbage, but do not remove it")
+	cmdMain.Flags().BoolVar(&globalFlags.cleanLeases, "clean-leases", false, "If set, remove leases owned by unknown machines")
+	cmdMain.Flags().BoolVar(&globalFlags.cleanStates, "clean-states", false, "If set, remove unit states of unknown machines or units")
+	cmdMain.Flags().StringVar(&globalFlags.forceSchema, "force-schema", "", "If set, do not detect the fleet registry schema, but assume this schema (0.9|0.11)")
+	cmdMain.Flags().StringSliceVar(&globalFlags.enableRules, "enable-rule", nil, "Enable the cleanup rule with this name (see 'fleet-cleanup rules')")
+	cmdMain.Flags().StringSliceVar(&globalFlags.disableRules, "disable-rule", nil, "Disable the cleanup rule with this name (see 'fleet-cleanup rules')")
+	cmdMain.Flags().StringSliceVar(&globalFlags.ruleActions, "rule", nil, "Set the action of a cleanup rule, e.g. orphan-units=delete (actions: report, soft-delete, delete)")
+	cmdMain.Flags().DurationVar(&globalFlags.inactiveAge, "inactive-job-min-age", defaultInactiveJobAge, "Minimum age of inactive jobs reported by the old-inactive-jobs rule")
+	cmdMain.Flags().StringVar(&globalFlags.emitScript, "emit-script", "", "If set, write a shell script that removes the garbage with this tool (etcdctl|etcdctl3) instead of removing it")
+	cmdMain.Flags().StringVar(&globalFlags.scriptOut, "script-out", "cleanup.sh", "Path of the script written by --emit-script")
+	cmdMain.Flags().StringVar(&globalFlags.saveScan, "save-scan", "", "If set, write the garbage found by the run to this scan file, so it can be removed later with --use-scan")
+	cmdMain.Flags().StringVar(&globalFlags.useScan, "use-scan", "", "If set, remove the garbage in this scan file (see --save-scan) instead of scanning the registry (keys modified since the scan are skipped)")
+	cmdMain.Flags().StringVar(&globalFlags.policyFile, "policy-file", "", "Path of a YAML file with per-rule settings (min-age, include, exclude, max-delete, action) and notifiers")
+	cmdMain.Flags().StringVar(&globalFlags.minSeverity, "min-severity", service.SeverityInfo, "Only report & notify about garbage of at least this severity (info|warning|critical)")
+	cmdMain.Flags().StringSliceVar(&globalFlags.protectTypes, "protect-unit-type", nil, "Never remove garbage of units of this type, e.g. template, template-instance, global or timer (can be repeated)")
+	cmdMain.Flags().StringVar(&globalFlags.shard, "shard", "", "If set, only clean this part of the registry, as <index>/<count> (e.g. 2/4), so multiple instances can each clean a disjoint part")
+	cmdMain.Flags().StringVar(&globalFlags.ownerLabels, "owner-labels", strings.Join(service.DefaultOwnerLabels, ","), "Comma separated labels read from the [X-Fleet] section of units (options or machine metadata) to show the owners of garbage (empty disables)")
+	cmdMain.Flags().BoolVar(&globalFlags.scanCache, "scan-cache", true, "If set, a daemon run reuses the results of the previous run when nothing changed in etcd since then")
+	cmdMain.Flags().BoolVar(&globalFlags.verifyDeletes, "verify-deletes", false, "If set, read the registry again after removing keys and fail the run when removed keys still exist or other units disappeared")
+	cmdMain.Flags().BoolVar(&globalFlags.profileRun, "profile-run", false, "If set, record peak memory, allocations and phase timings of every run and add them to the run summary")
+	cmdMain.Flags().DurationVar(&globalFlags.deleteTimeout, "delete-timeout", defaultDeleteTimeout, "Skip deletes that take longer than this and retry them at the end of the run (0 disables)")
+	cmdMain.Flags().BoolVar(&globalFlags.pacing, "adaptive-pacing", false, "If set, slow down deletes while etcd is slow or failing, and resume full speed when it recovers")
+	cmdMain.Flags().DurationVar(&globalFlags.pacingLatency, "pacing-latency", service.DefaultPacingLatency, "Delete latency above which adaptive pacing slows down deletes")
+	cmdMain.Flags().DurationVar(&globalFlags.pacingMax, "pacing-max-delay", service.DefaultPacingMaxDelay, "Maximum delay between deletes with adaptive pacing")
+	cmdMain.Flags().IntVar(&globalFlags.canary, "canary", 0, "If set, runs that remove more keys first remove this many, observe the registry and only remove the rest when no anomalies are found")
+	cmdMain.Flags().DurationVar(&globalFlags.canaryObserve, "canary-observation", service.DefaultCanaryObservation, "Time the registry is observed after the canary deletes")
+	cmdMain.Flags().BoolVar(&globalFlags.watchOrphans, "watch-orphans", false, "If set (in daemon mode), watch etcd for units that become orphaned and remove them once they stayed orphaned for --orphan-delay")
+	cmdMain.Flags().DurationVar(&globalFlags.orphanDelay, "orphan-delay", service.DefaultOrphanDelay, "Time a unit must stay orphaned before --watch-orphans removes it")
+	cmdMain.Flags().DurationVar(&globalFlags.annotateTTL, "annotate-ttl", 0, "If set, store a marker key with this TTL for every candidate under /_pulcy/fleet-cleanup/candidates instead of removing it")
+	cmdMain.Flags().DurationVar(&globalFlags.trashTTL, "trash-ttl", defaultTrashTTL, "Time to keep keys removed by the soft-delete action in the trash (0 keeps them until removed manually)")
+	cmdMain.Flags().DurationVar(&globalFlags.restoredTTL, "restored-ttl", service.DefaultRestoredTTL, "TTL set by the restore-ttl action on keys that lost their TTL (missing-ttl rule)")
+	cmdMain.Flags().Uint64Var(&globalFlags.churnWindow, "churn-index-window", defaultChurnIndexWindow, "Postpone deletions when fleet jobs or engine leader changed within this many etcd indexes (0 disables)")
+	cmdMain.Flags().BoolVar(&globalFlags.healthCheck, "health-check", true, "If set, only remove keys when all etcd members are reachable, the cluster has a leader and no member lags behind")
+	cmdMain.Flags().Uint64Var(&globalFlags.raftIndexLag, "max-raft-index-lag", defaultMaxRaftIndexLag, "Maximum number of raft indexes an etcd member may lag behind the others in the health check (0 means unlimited)")
+	cmdMain.Flags().StringVar(&globalFlags.maintWindow, "maintenance-window", "", "If set, only remove keys inside this daily window, e.g. '02:00-05:00 Europe/Amsterdam' (local time without time zone)")
+	cmdMain.Flags().DurationVar(&globalFlags.interval, "interval", 0, "If set, run as daemon and perform a cleanup at this interval")
+	cmdMain.Flags().DurationVar(&globalFlags.splay, "splay", 0, "If set (in daemon mode), delay every run by a random duration up to this value, to spread the load of many instances on etcd")
+	cmdMain.Flags().BoolVar(&globalFlags.failOnGarbage, "fail-on-garbage", false, "If set, exit with code 4 when any rule finds garbage")
+	cmdMain.Flags().BoolVar(&globalFlags.allRegistries, "all-registries", false, "If set, clean all fleet registries found in etcd (see 'fleet-cleanup discover') instead of only the one at --fleet-prefix")
+	cmdMain.Flags().BoolVar(&globalFlags.jsonSummary, "json-summary", false, "If set, write the summary of every run as JSON on a single line to stdout (last line when running once)")
+	cmdMain.Flags().BoolVar(&globalFlags.leaderElect, "leader-election", false, "If set (in daemon mode), only the elected leader among all instances using the same etcd cluster removes keys")
+	cmdMain.Flags().DurationVar(&globalFlags.leaderTTL, "leader-ttl", defaultLeaderTTL, "Time after which a standby takes over when the leader stops refreshing its leadership")
+	cmdMain.Flags().DurationVar(&globalFlags.stealLock, "steal-lock-after", defaultStealLockAfter, "Take over the run lock of a run that has not refreshed it for longer than this, e.g. after a crash (0 never takes it over)")
+	cmdMain.Flags().StringVar(&globalFlags.hashesFrom, "hashes-from", "", "If set, only consider the unit hashes listed in this file ('-' for stdin)")
+	cmdMain.Flags().StringVar(&globalFlags.jobFilter, "job-filter", "", "If set, only consider units whose (last known) job name matches this regular expression")
+	cmdMain.Flags().IntVar(&globalFlags.maxDelete, "max-delete", 0, "Maximum number of keys to remove in a single run (0 means unlimited)")
+	cmdMain.Flags().StringVar(&globalFlags.templateUnits, "template-units", service.TemplateUnitsInstances, "Treatment of units of template jobs (instances: keep them while instances of the template exist, hash: only keep units referenced by a job)")
+	cmdMain.Flags().StringVar(&globalFlags.deleteOrder, "delete-order", service.DeleteOrderRule, "Order in which garbage is removed (rule|oldest|largest|name), so runs capped by --max-delete make predictable progress")
+	cmdMain.Flags().DurationVar(&globalFlags.maxDuration, "max-duration", 0, "Stop removing keys once a run took this long (0 means unlimited)")
+	cmdMain.Flags().IntVar(&globalFlags.maxEtcdOps, "max-etcd-ops", 0, "Stop removing keys once a run sent this many requests to etcd (0 means unlimited)")
+	cmdMain.Flags().StringVar(&globalFlags.adminAddr, "admin-addr", "", "If set (in daemon mode), serve the admin API on this address (e.g. ':8080')")
+	cmdMain.Flags().BoolVar(&globalFlags.exporterOnly, "exporter-only", false, "If set, never remove anything, only expose registry metrics on the admin API (requires --interval & --admin-addr)")
+	cmdMain.Flags().BoolVar(&globalFlags.readOnly, "assume-read-only", false, "If set, assume read-only etcd credentials: only report (implies --dry-run), do not probe the permission to remove keys and do not store the run history in etcd")
+	cmdMain.Flags().IntVar(&globalFlags.alertLimit, "alert-threshold", 0, "If set, send an alert when more than this number of obsolete units is found (0 disables)")
+	cmdMain.Flags().Float64Var(&globalFlags.alertGrowth, "alert-growth", 0, "If set, send an alert when the number of obsolete units grew by more than this percentage since the previous run (0 disables)")
+	cmdMain.Flags().DurationVar(&globalFlags.alertBeat, "alert-heartbeat", 0, "If set, send an alert for unchanged garbage again after this duration (0 only alerts when the garbage changed)")
+	cmdMain.Flags().DurationVar(&globalFlags.heartbeatTTL, "heartbeat-ttl", 0, "If set, every successful run refreshes a heartbeat key with this TTL (see 'fleet-cleanup check-heartbeat')")
+	cmdMain.Flags().StringVar(&globalFlags.alertWebhook, "alert-webhook", "", "If set, send alerts to this URL (HTTP POST with JSON body)")
+	cmdMain.Flags().StringVar(&globalFlags.slackWebhook, "slack-webhook", "", "If set, send alerts to this Slack incoming webhook URL")
+	cmdMain.Flags().StringVar(&globalFlags.otlpEndpoint, "otlp-endpoint", "", "If set, export traces of each run to this OTLP/HTTP endpoint (e.g. 'http://localhost:4318/v1/traces')")
+	cmdMain.Flags().StringVar(&globalFlags.sentryDSN, "sentry-dsn", "", "If set, report failed runs to this Sentry DSN")
+	cmdMain.Flags().StringVar(&globalFlags.errorWebhook, "error-webhook", "", "If set, report failed runs to this URL (HTTP POST with JSON body)")
+	cmdMain.Flags().StringSliceVar(&globalFlags.emailTo, "email-to", nil, "If set, email a report of every run that removed keys (or failed to) to these addresses")
+	cmdMain.Flags().StringVar(&globalFlags.emailFrom, "email-from", "", "Sender address of report emails (defaults to fleet-cleanup@<hostname>)")
+	cmdMain.Flags().StringVar(&globalFlags.smtpAddr, "smtp-addr", "", "Address (host:port) of the SMTP server used to send report emails")
+	cmdMain.Flags().StringVar(&globalFlags.smtpUsername, "smtp-username", "", "If set, authenticate at the SMTP server with this username and the password in SMTP_PASSWORD")
+	cmdMain.Flags().IntVar(&globalFlags.historySize, "history-size", defaultHistorySize, "Number of runs to keep in the run history in etcd (0 disables the history)")
+	cmdMain.Flags().StringVar(&globalFlags.historyFile, "history-file", "", "If set, store the run history in this local file instead of etcd")
+	cmdMain.Flags().StringVar(&globalFlags.statusFile, "status-file", "", "If set, write the outcome & counts of the last run as JSON to this local file after every run")
+	cmdMain.Flags().StringVar(&globalFlags.archiveS3URL, "archive-s3-url", "", "If set, upload an archive of all keys to this S3-compatible bucket URL before removing them (credentials from AWS_* environment variables)")
+	cmdMain.Flags().StringVar(&globalFlags.archiveDir, "archive-dir", "", "If set, write an archive of all keys to this directory before removing them")
+	cmdMain.Flags().IntVar(&globalFlags.archiveKeep, "archive-keep", defaultArchiveKeep, "Number of archives to keep in --archive-dir (0 means unlimited)")
+	cmdMain.Flags().BoolVar(&globalFlags.fullReport, "full-report", false, "If set (in daemon mode), report all garbage on every run instead of only the changes since the previous run")
+	cmdMain.Flags().BoolVar(&globalFlags.noColor, "no-color", false, "If set, do not colorize the report (same as --color=never)")
+	cmdMain.Flags().StringVar(&globalFlags.color, "color", colorAuto, "Colorize the report (auto|always|never), auto only colorizes on an interactive terminal without NO_COLOR set")
+	cmdMain.Flags().StringVar(&globalFlags.events, "events", "", "If set, emit machine-readable events to stdout (ndjson)")
+
+	// Plan, apply & browse accept the same flags as a cleanup
+	cmdPlan.Flags().AddFlagSet(cmdMain.Flags())
+	cmdApply.Flags().AddFlagSet(cmdMain.Flags())
+	cmdBrowse.Flags().AddFlagSet(cmdMain.Flags())
 }
 
 func main() {
-	cmdMain.Execute()
+	if err := cmdMain.Execute(); err != nil {
+		os.Exit(exitCodeUsage)
+	}
 }
 
 func cmdMainRun(cmd *cobra.Command, args []string) {
 	// Parse arguments
-	if globalFlags.etcdAddr == "" {
-		Exitf("Please specify --etcd-addr")
+	etcdUrl := parseEtcdURL()
+	if globalFlags.sentryDSN != "" && globalFlags.errorWebhook != "" {
+		Exitf("Please specify either --sentry-dsn or --error-webhook, not both")
 	}
-	etcdUrl, err := url.Parse(globalFlags.etcdAddr)
-	if err != nil {
-		Exitf("--etcd-addr '%s' is not valid: %#v", globalFlags.etcdAddr, err)
+	if globalFlags.adminAddr != "" && globalFlags.interval == 0 {
+		Exitf("--admin-addr requires --interval")
+	}
+	if globalFlags.alertLimit < 0 || globalFlags.alertGrowth < 0 {
+		Exitf("--alert-threshold and --alert-growth cannot be negative")
+	}
+	if len(globalFlags.emailTo) > 0 && globalFlags.smtpAddr == "" {
+		Exitf("--email-to requires --smtp-addr")
+	}
+	if globalFlags.exporterOnly && globalFlags.adminAddr == "" {
+		Exitf("--exporter-only requires --interval and --admin-addr")
+	}
+
+	if globalFlags.color != colorAuto && globalFlags.color != colorAlways && globalFlags.color != colorNever {
+		Exitf("--color '%s' is not valid, expected 'auto', 'always' or 'never'", globalFlags.color)
+	}
+	if globalFlags.emitScript != "" {
+		if err := service.ValidateScriptFormat(globalFlags.emitScript); err != nil {
+			Exitf("--emit-script is not valid: %v", err)
+		}
+		if globalFlags.interval != 0 || planFlags.mode != "" {
+			Exitf("--emit-script cannot be used with --interval, plan, apply or browse")
+		}
+		planFlags.mode = runModeScript
+	}
+	if globalFlags.saveScan != "" || globalFlags.useScan != "" {
+		if globalFlags.saveScan != "" && globalFlags.useScan != "" {
+			Exitf("Please specify either --save-scan or --use-scan, not both")
+		}
+		if globalFlags.interval != 0 || planFlags.mode != "" {
+			Exitf("--save-scan and --use-scan cannot be used with --interval, --emit-script, plan, apply or browse")
+		}
+		if globalFlags.saveScan != "" {
+			planFlags.mode = runModeSaveScan
+		} else {
+			planFlags.mode = runModeUseScan
+		}
+	}
+	if globalFlags.allRegistries && (globalFlags.interval != 0 || planFlags.mode != "" || globalFlags.jsonSummary) {
+		Exitf("--all-registries cannot be used with --interval, --json-summary, --emit-script, --save-scan, --use-scan, plan, apply or browse")
+	}
+	if runReportFormatter() != nil && (globalFlags.interval != 0 || globalFlags.jsonSummary || globalFlags.events != "" || planFlags.mode == runModeBrowse) {
+		// Stdout is reserved for the final run report
+		Exitf("--output %s cannot be used with --interval, --json-summary, --events or browse", globalFlags.output)
+	}
+	if globalFlags.offlineBackup != "" {
+		if globalFlags.interval != 0 || planFlags.mode == runModeApply || planFlags.mode == runModeBrowse || planFlags.mode == runModeUseScan {
+			Exitf("--offline-backup cannot be used with --interval, --use-scan, apply or browse")
+		}
+		// Nothing can be removed from a backup
+		globalFlags.readOnly = true
+	}
+	if globalFlags.annotateTTL < 0 {
+		Exitf("--annotate-ttl cannot be negative")
+	}
+	if globalFlags.canary < 0 {
+		Exitf("--canary cannot be negative")
+	}
+	if globalFlags.annotateTTL > 0 && (globalFlags.dryRun || globalFlags.readOnly || globalFlags.exporterOnly) {
+		Exitf("--annotate-ttl cannot be used with --dry-run, --assume-read-only or --exporter-only, since annotating writes to etcd")
+	}
+	if globalFlags.readOnly && (globalFlags.leaderElect || planFlags.mode == runModeApply) {
+		Exitf("--assume-read-only cannot be used with --leader-election or apply")
+	}
+	if globalFlags.watchOrphans && globalFlags.interval == 0 {
+		Exitf("--watch-orphans requires --interval")
+	}
+	if globalFlags.leaderElect && globalFlags.interval == 0 {
+		Exitf("--leader-election requires --interval")
+	}
+	if globalFlags.splay < 0 {
+		Exitf("--splay cannot be negative")
+	}
+	if globalFlags.splay > 0 && globalFlags.interval == 0 {
+		Exitf("--splay requires --interval")
+	}
+	if globalFlags.leaderTTL < 3*time.Second {
+		Exitf("--leader-ttl must be at least 3s")
+	}
+	if globalFlags.hashesFrom != "" && globalFlags.interval > 0 {
+		Exitf("--hashes-from cannot be used with --interval")
+	}
+	var runOptions service.RunOptions
+	if globalFlags.hashesFrom != "" {
+		hashes, err := readUnitHashes(globalFlags.hashesFrom)
+		if err != nil {
+			Exitf("Failed to read --hashes-from '%s': %#v", globalFlags.hashesFrom, err)
+		}
+		if len(hashes) == 0 {
+			Exitf("No unit hashes found in '%s'", globalFlags.hashesFrom)
+		}
+		runOptions.UnitHashes = hashes
+	}
+
+	var events service.EventListener
+	switch globalFlags.events {
+	case "":
+		// Human readable report
+		out := reportWriter()
+		events = newTextReport(out, !globalFlags.noColor && useColor(globalFlags.color, out), reportVerbosity())
+	case "ndjson":
+		events = service.NewNDJSONEventWriter(os.Stdout)
+	default:
+		Exitf("--events '%s' is not valid, expected 'ndjson'", globalFlags.events)
 	}
 
 	// Set log level
@@ -82,18 +400,465 @@ func cmdMainRun(cmd *cobra.Command, args []string) {
 
 	// Update service config (if needed)
 	serviceLogger := logging.MustGetLogger(projectName)
-	service, err := service.NewService(service.ServiceConfig{
-		EtcdURL: *etcdUrl,
-		DryRun:  globalFlags.dryRun,
-	}, service.ServiceDependencies{
-		Logger: serviceLogger,
-	})
+	notifierLogger := componentLogger(componentNotifier)
+	var tracer *tracing.Tracer
+	if globalFlags.otlpEndpoint != "" {
+		tracer = tracing.NewTracer(tracing.TracerConfig{
+			Endpoint:    globalFlags.otlpEndpoint,
+			ServiceName: projectName,
+		}, tracing.TracerDependencies{
+			Logger: serviceLogger,
+		})
+	}
+	var errorReporter service.ErrorReporter
+	if globalFlags.sentryDSN != "" {
+		var err error
+		errorReporter, err = reporting.NewSentryReporter(reporting.SentryReporterConfig{
+			DSN:         globalFlags.sentryDSN,
+			ServiceName: projectName,
+			Version:     projectVersion,
+		}, reporting.SentryReporterDependencies{
+			Logger: notifierLogger,
+		})
+		if err != nil {
+			Exitf("--sentry-dsn '%s' is not valid: %#v", globalFlags.sentryDSN, err)
+		}
+	} else if globalFlags.errorWebhook != "" {
+		errorReporter = reporting.NewWebhookReporter(reporting.WebhookReporterConfig{
+			URL:     globalFlags.errorWebhook,
+			Version: projectVersion,
+		}, reporting.WebhookReporterDependencies{
+			Logger: notifierLogger,
+		})
+	}
+	var alerters reporting.Alerters
+	if globalFlags.alertWebhook != "" {
+		alerters = append(alerters, reporting.NewWebhookReporter(reporting.WebhookReporterConfig{
+			URL:     globalFlags.alertWebhook,
+			Version: projectVersion,
+		}, reporting.WebhookReporterDependencies{
+			Logger: notifierLogger,
+		}))
+	}
+	if globalFlags.slackWebhook != "" {
+		alerters = append(alerters, reporting.NewSlackReporter(reporting.SlackReporterConfig{
+			URL:         globalFlags.slackWebhook,
+			ServiceName: projectName,
+		}, reporting.SlackReporterDependencies{
+			Logger: notifierLogger,
+		}))
+	}
+	var runReporter service.RunReporter
+	if len(globalFlags.emailTo) > 0 {
+		from := globalFlags.emailFrom
+		if from == "" {
+			hostname, _ := os.Hostname()
+			if hostname == "" {
+				hostname = "localhost"
+			}
+			from = projectName + "@" + hostname
+		}
+		runReporter = reporting.NewEmailReporter(reporting.EmailReporterConfig{
+			SMTPAddr:    globalFlags.smtpAddr,
+			Username:    globalFlags.smtpUsername,
+			Password:    os.Getenv("SMTP_PASSWORD"),
+			From:        from,
+			To:          globalFlags.emailTo,
+			ServiceName: projectName,
+		}, reporting.EmailReporterDependencies{
+			Logger: notifierLogger,
+		})
+	}
+	var metricsRegistry *metrics.Registry
+	if globalFlags.adminAddr != "" {
+		metricsRegistry = metrics.NewRegistry()
+	}
+	var archivers archive.MultiArchiver
+	if globalFlags.archiveS3URL != "" {
+		a, err := archive.NewS3Archiver(archive.S3ArchiverConfig{
+			URL: globalFlags.archiveS3URL,
+		}, archive.S3ArchiverDependencies{
+			Logger: serviceLogger,
+		})
+		if err != nil {
+			Exitf("--archive-s3-url '%s' is not valid: %#v", globalFlags.archiveS3URL, err)
+		}
+		archivers = append(archivers, a)
+	}
+	if globalFlags.archiveDir != "" {
+		a, err := archive.NewDirArchiver(archive.DirArchiverConfig{
+			Dir:  globalFlags.archiveDir,
+			Keep: globalFlags.archiveKeep,
+		}, archive.DirArchiverDependencies{
+			Logger: serviceLogger,
+		})
+		if err != nil {
+			Exitf("--archive-dir '%s' is not valid: %#v", globalFlags.archiveDir, err)
+		}
+		archivers = append(archivers, a)
+	}
+	var archiver service.Archiver
+	if len(archivers) > 0 {
+		archiver = archivers
+	}
+	var cleanupPolicy service.Policy
+	if globalFlags.policyFile != "" {
+		var err error
+		cleanupPolicy, err = policy.LoadFile(globalFlags.policyFile)
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "--policy-file '%s' is not valid: %v", globalFlags.policyFile, err)
+		}
+	}
+	for _, name := range sortedNotifierNames(cleanupPolicy.Notifiers) {
+		notifier, err := reporting.NewNotifier(cleanupPolicy.Notifiers[name], reporting.NotifierConfig{
+			ServiceName: projectName,
+			Version:     projectVersion,
+		}, reporting.NotifierDependencies{
+			Logger: notifierLogger,
+			Stdout: os.Stdout,
+		})
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "Notifier %s in --policy-file '%s' is not valid: %v", name, globalFlags.policyFile, err)
+		}
+		alerters = append(alerters, notifier)
+	}
+	var alerter service.Alerter
+	if len(alerters) > 0 {
+		alerter = alerters
+	} else if globalFlags.alertLimit > 0 || globalFlags.alertGrowth > 0 {
+		Exitf("--alert-threshold and --alert-growth require --alert-webhook, --slack-webhook or a notifier in the policy file")
+	}
+	var shard service.Shard
+	if globalFlags.shard != "" {
+		var err error
+		shard, err = service.ParseShard(globalFlags.shard)
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "--shard '%s' is not valid: %v", globalFlags.shard, err)
+		}
+	}
+	var maintenanceWindow *service.MaintenanceWindow
+	if globalFlags.maintWindow != "" {
+		w, err := service.ParseMaintenanceWindow(globalFlags.maintWindow)
+		if err != nil {
+			ExitWithCodef(exitCodeUsage, "--maintenance-window '%s' is not valid: %v", globalFlags.maintWindow, err)
+		}
+		maintenanceWindow = &w
+	}
+	config := service.ServiceConfig{
+		EtcdURL:            etcdUrl,
+		EtcdTransport:      etcdTransportConfig(),
+		Registry:           registryConfig(),
+		EtcdVersionCheck:   globalFlags.versionCheck,
+		DryRun:             globalFlags.dryRun,
+		CleanLeases:        globalFlags.cleanLeases,
+		CleanStates:        globalFlags.cleanStates,
+		ChurnIndexWindow:   globalFlags.churnWindow,
+		HealthCheck:        globalFlags.healthCheck,
+		MaxRaftIndexLag:    globalFlags.raftIndexLag,
+		MaintenanceWindow:  maintenanceWindow,
+		MaxDelete:          globalFlags.maxDelete,
+		DeleteOrder:        globalFlags.deleteOrder,
+		TemplateUnits:      globalFlags.templateUnits,
+		MaxDuration:        globalFlags.maxDuration,
+		MaxEtcdOps:         globalFlags.maxEtcdOps,
+		JobFilter:          globalFlags.jobFilter,
+		Shard:              shard,
+		ProtectUnitTypes:   globalFlags.protectTypes,
+		HistorySize:        globalFlags.historySize,
+		HistoryFile:        globalFlags.historyFile,
+		StatusFile:         globalFlags.statusFile,
+		Version:            projectVersion,
+		ReportDelta:        globalFlags.interval > 0 && !globalFlags.fullReport,
+		ExporterOnly:       globalFlags.exporterOnly,
+		AssumeReadOnly:     globalFlags.readOnly,
+		ForceSchema:        globalFlags.forceSchema,
+		Rules:              ruleOverrides(),
+		InactiveJobMinAge:  globalFlags.inactiveAge,
+		Policy:             cleanupPolicy,
+		RuleActions:        ruleActions(),
+		TrashTTL:           globalFlags.trashTTL,
+		AnnotateTTL:        globalFlags.annotateTTL,
+		RestoredTTL:        globalFlags.restoredTTL,
+		DeleteTimeout:      globalFlags.deleteTimeout,
+		AdaptivePacing:     globalFlags.pacing,
+		PacingLatency:      globalFlags.pacingLatency,
+		PacingMaxDelay:     globalFlags.pacingMax,
+		Canary:             globalFlags.canary,
+		CanaryObservation:  globalFlags.canaryObserve,
+		OrphanDelay:        globalFlags.orphanDelay,
+		ProfileRun:         globalFlags.profileRun,
+		VerifyDeletes:      globalFlags.verifyDeletes,
+		CacheScan:          globalFlags.scanCache,
+		MinSeverity:        globalFlags.minSeverity,
+		OwnerLabels:        ownerLabels(),
+		LeaderTTL:          globalFlags.leaderTTL,
+		StealLockAfter:     globalFlags.stealLock,
+		AlertThreshold:     globalFlags.alertLimit,
+		AlertGrowthPercent: globalFlags.alertGrowth,
+		AlertHeartbeat:     globalFlags.alertBeat,
+		HeartbeatTTL:       globalFlags.heartbeatTTL,
+	}
+	deps := service.ServiceDependencies{
+		Logger:   serviceLogger,
+		Events:   events,
+		Tracer:   tracer,
+		Errors:   errorReporter,
+		Archiver: archiver,
+		Metrics:  metricsRegistry,
+		Alerts:   alerter,
+		Reports:  runReporter,
+
+		ComponentLoggers: serviceComponentLoggers(),
+	}
+	svc, err := service.NewService(config, deps)
 	if err != nil {
-		Exitf("Failed to create service: %#v", err)
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+
+	if globalFlags.interval == 0 {
+		// Run once
+		var summary service.RunSummary
+		var err error
+		if globalFlags.allRegistries {
+			summary, err = runAllRegistries(svc, config, deps, runOptions, serviceLogger)
+		} else {
+			stopOnSignal(svc, serviceLogger)
+			switch planFlags.mode {
+			case runModePlan:
+				summary, err = createPlan(svc, runOptions)
+			case runModeApply:
+				summary, err = applyPlan(svc)
+			case runModeScript:
+				summary, err = emitScript(svc, runOptions)
+			case runModeSaveScan:
+				summary, err = saveScan(svc, runOptions)
+			case runModeUseScan:
+				summary, err = useScan(svc, runOptions)
+			case runModeBrowse:
+				summary, err = browseRegistry(svc, runOptions, os.Stdin, os.Stdout)
+			default:
+				summary, err = svc.RunWithOptions(runOptions)
+			}
+		}
+		exitCode, message := exitCodeOK, ""
+		if err != nil {
+			exitCode, message = exitCodeForError(err), fmt.Sprintf("Failed to run service: %#v", err)
+		} else if globalFlags.failOnGarbage && summary.Garbage() > 0 {
+			exitCode, message = exitCodeGarbageFound, fmt.Sprintf("Found %d garbage keys (%d obsolete units, %d stale leases and %d orphaned unit states)", summary.Garbage(), summary.ObsoleteUnits, summary.StaleLeases, summary.OrphanStates)
+		}
+		if globalFlags.jsonSummary {
+			// The summary must be the last line on stdout, so report failures on stderr
+			if message != "" {
+				fmt.Fprintln(os.Stderr, message)
+			}
+			writeJSONSummary(os.Stdout, summary, exitCode, err)
+			os.Exit(exitCode)
+		}
+		if f := runReportFormatter(); f != nil {
+			// The report is the only output on stdout, so report failures on stderr
+			if message != "" {
+				fmt.Fprintln(os.Stderr, message)
+			}
+			writeOutput(f, summaryOutput(summary, exitCode, err))
+			os.Exit(exitCode)
+		}
+		if exitCode != exitCodeOK {
+			ExitWithCodef(exitCode, "%s", message)
+		}
+		return
 	}
 
-	if err := service.Run(); err != nil {
-		Exitf("Failed to run service: %#v", err)
+	// Run as daemon
+	if globalFlags.leaderElect {
+		svc.StartLeaderElection()
+	}
+	if globalFlags.watchOrphans {
+		go svc.WatchOrphans()
+	}
+	if globalFlags.adminAddr != "" {
+		server := api.NewServer(api.ServerConfig{
+			Address: globalFlags.adminAddr,
+		}, api.ServerDependencies{
+			Logger:  componentLogger(componentHTTP),
+			Service: svc,
+			Metrics: metricsRegistry,
+		})
+		go func() {
+			if err := server.Run(); err != nil {
+				ExitWithCodef(exitCodeFailure, "Failed to run admin API: %#v", err)
+			}
+		}()
+	}
+	stopped := stopOnSignal(svc, serviceLogger)
+	splay := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		if globalFlags.splay > 0 {
+			delay := time.Duration(splay.Int63n(int64(globalFlags.splay)))
+			serviceLogger.Debugf("Delaying run by %s", delay)
+			if !waitOrStop(stopped, delay) {
+				serviceLogger.Infof("Stopped")
+				return
+			}
+		}
+		summary, err := svc.RunWithOptions(service.RunOptions{})
+		if err != nil {
+			serviceLogger.Errorf("Failed to run service: %#v", err)
+		}
+		if globalFlags.jsonSummary {
+			writeJSONSummary(os.Stdout, summary, exitCodeForError(err), err)
+		}
+		if !waitOrStop(stopped, globalFlags.interval) {
+			serviceLogger.Infof("Stopped")
+			return
+		}
+	}
+}
+
+// waitOrStop waits for the given duration. Returns false if the given channel is closed before that.
+func waitOrStop(stopped <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-stopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// stopOnSignal stops the service when SIGTERM or SIGINT is received.
+// Deletes in progress are finished, no new deletes are started.
+// The returned channel is closed once the service has stopped.
+// A second signal terminates the process immediately.
+func stopOnSignal(svc *service.Service, logger *logging.Logger) <-chan struct{} {
+	return stopAllOnSignal([]*service.Service{svc}, logger)
+}
+
+// stopAllOnSignal stops all given services when SIGTERM or SIGINT is received (see stopOnSignal).
+func stopAllOnSignal(services []*service.Service, logger *logging.Logger) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		logger.Infof("Received %s, finishing deletes in progress", sig)
+		for _, svc := range services {
+			svc.Stop()
+		}
+		close(stopped)
+	}()
+	return stopped
+}
+
+// parseEtcdURL returns the parsed --etcd-addr argument.
+func parseEtcdURL() url.URL {
+	if globalFlags.etcdAddr == "" {
+		Exitf("Please specify --etcd-addr")
+	}
+	etcdUrl, err := url.Parse(globalFlags.etcdAddr)
+	if err != nil {
+		Exitf("--etcd-addr '%s' is not valid: %#v", globalFlags.etcdAddr, err)
+	}
+	if globalFlags.etcdInsecure {
+		if etcdUrl.Scheme != "https" {
+			Exitf("--etcd-insecure-skip-verify requires an https --etcd-addr")
+		}
+		logging.MustGetLogger(projectName).Warningf("TLS certificate verification of etcd is disabled (--etcd-insecure-skip-verify)")
+	}
+	if globalFlags.etcdAuth != "" && globalFlags.etcdTokenFile != "" {
+		Exitf("Please specify either --etcd-auth-header or --etcd-bearer-token-file, not both")
+	}
+	return *etcdUrl
+}
+
+// ruleOverrides returns the rules enabled or disabled by --enable-rule & --disable-rule.
+func ruleOverrides() map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range globalFlags.enableRules {
+		result[name] = true
+	}
+	for _, name := range globalFlags.disableRules {
+		if _, ok := result[name]; ok {
+			Exitf("Rule '%s' cannot be both enabled and disabled", name)
+		}
+		result[name] = false
+	}
+	return result
+}
+
+// ownerLabels returns the labels set by --owner-labels, ignoring empty labels.
+func ownerLabels() []string {
+	result := []string{}
+	for _, label := range strings.Split(globalFlags.ownerLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			result = append(result, label)
+		}
+	}
+	return result
+}
+
+// ruleActions returns the actions of rules set by --rule <name>=<action>.
+func ruleActions() map[string]string {
+	result := make(map[string]string)
+	for _, arg := range globalFlags.ruleActions {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			Exitf("--rule '%s' is not valid, expected <rule>=<action>", arg)
+		}
+		if previous, ok := result[parts[0]]; ok && previous != parts[1] {
+			Exitf("Rule '%s' cannot have both action '%s' and '%s'", parts[0], previous, parts[1])
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result
+}
+
+// sortedNotifierNames returns the names of the given notifiers in sorted order, so alerts are sent in a predictable order.
+func sortedNotifierNames(notifiers map[string]service.NotifierPolicy) []string {
+	var result []string
+	for name := range notifiers {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// etcdTransportConfig returns the etcd transport settings, as set by the --etcd-* flags.
+func etcdTransportConfig() service.TransportConfig {
+	return service.TransportConfig{
+		Proxy:                 globalFlags.etcdProxy,
+		InsecureSkipVerify:    globalFlags.etcdInsecure,
+		AuthHeader:            globalFlags.etcdAuth,
+		BearerTokenFile:       globalFlags.etcdTokenFile,
+		MaxIdleConns:          globalFlags.etcdMaxIdle,
+		TCPKeepAlive:          globalFlags.etcdKeepAlive,
+		ResponseHeaderTimeout: globalFlags.etcdHeaderTO,
+		DisableKeepAlives:     globalFlags.etcdNoReuse,
+		KeyPrefix:             globalFlags.keyPrefix,
+		OfflineBackup:         globalFlags.offlineBackup,
+	}
+}
+
+// registryConfig returns the location of the fleet registry, as set by the registry flags.
+func registryConfig() service.RegistryConfig {
+	return service.RegistryConfig{
+		Prefix:           globalFlags.fleetPrefix,
+		UnitPathTemplate: globalFlags.unitTemplate,
+		JobPathTemplate:  globalFlags.jobTemplate,
+	}
+}
+
+// reportVerbosity returns the verbosity of the report, as set by --quiet & --verbose.
+func reportVerbosity() int {
+	if globalFlags.quiet && globalFlags.verbose {
+		Exitf("Please specify either --quiet or --verbose, not both")
+	}
+	switch {
+	case globalFlags.quiet:
+		return verbosityQuiet
+	case globalFlags.verbose:
+		return verbosityVerbose
+	default:
+		return verbosityNormal
 	}
 }
 
@@ -102,12 +867,16 @@ func showUsage(cmd *cobra.Command, args []string) {
 }
 
 func Exitf(format string, args ...interface{}) {
+	ExitWithCodef(exitCodeUsage, format, args...)
+}
+
+func ExitWithCodef(exitCode int, format string, args ...interface{}) {
 	if !strings.HasSuffix(format, "\n") {
 		format = format + "\n"
 	}
-	fmt.Printf(format, args...)
-	fmt.Println()
-	os.Exit(1)
+	// Written to stderr, since stdout may carry events or a machine readable summary
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(exitCode)
 }
 
 func assert(err error) {
@@ -121,11 +890,3 @@ func assertArgIsSet(arg, argKey string) {
 		Exitf("%s must be set\n", argKey)
 	}
 }
-
-func setLogLevel(logLevel, loggerName string) {
-	level, err := logging.LogLevel(logLevel)
-	if err != nil {
-		Exitf("Invalid log-level '%s': %#v", logLevel, err)
-	}
-	logging.SetLevel(level, loggerName)
-}
@@ -0,0 +1,315 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	typeGauge     = "gauge"
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metric families and writes them in the Prometheus text exposition format.
+// A nil *Registry is valid: it creates nil metrics, which record nothing.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+}
+
+// family is a named metric with zero or more labeled samples.
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64 // Upper bounds of the buckets of a histogram, in increasing order
+
+	mutex   sync.Mutex
+	samples map[string]*sample // Indexed by joined label values
+}
+
+type sample struct {
+	labelValues  []string
+	value        float64  // Value of a gauge or counter, sum of all observations of a histogram
+	count        uint64   // Number of observations of a histogram
+	bucketCounts []uint64 // Number of observations of a histogram per bucket (not cumulative)
+}
+
+// NewRegistry creates a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	family *family
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	family *family
+}
+
+// Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	family *family
+}
+
+// ExponentialBuckets returns count bucket upper bounds, the first one being start and every next one
+// factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// NewGauge registers a new gauge with given name, help text and label names.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	return &Gauge{family: r.register(name, help, typeGauge, labelNames)}
+}
+
+// NewCounter registers a new counter with given name, help text and label names.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	if r == nil {
+		return nil
+	}
+	return &Counter{family: r.register(name, help, typeCounter, labelNames)}
+}
+
+// NewHistogram registers a new histogram with given name, help text, bucket upper bounds (in increasing order)
+// and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if r == nil {
+		return nil
+	}
+	f := r.register(name, help, typeHistogram, labelNames)
+	f.buckets = buckets
+	return &Histogram{family: f}
+}
+
+// Set sets the value of the gauge with given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.family.update(labelValues, func(s *sample) { s.value = value })
+}
+
+// Add adds the given (non-negative) value to the counter with given label values.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if c == nil || value < 0 {
+		return
+	}
+	c.family.update(labelValues, func(s *sample) { s.value += value })
+}
+
+// Inc increments the counter with given label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Observe adds the given value to the histogram with given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.family.update(labelValues, func(s *sample) { s.observe(h.family.buckets, value) })
+}
+
+// Replace replaces all observations of the histogram with given label values by the given values.
+// Use it for histograms that describe a snapshot (e.g. of the latest scan) instead of all observations so far.
+func (h *Histogram) Replace(values []float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.family.update(labelValues, func(s *sample) {
+		s.value, s.count, s.bucketCounts = 0, 0, nil
+		for _, v := range values {
+			s.observe(h.family.buckets, v)
+		}
+	})
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mutex.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mutex.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if err := cw.w.(*bufio.Writer).Flush(); err != nil {
+		return cw.n, maskAny(err)
+	}
+	return cw.n, nil
+}
+
+// register adds a new metric family to the registry.
+func (r *Registry) register(name, help, typ string, labelNames []string) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		samples:    make(map[string]*sample),
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// update calls the given function on the sample with given label values, creating it when needed.
+func (f *family) update(labelValues []string, fn func(*sample)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		f.samples[key] = s
+	}
+	fn(s)
+}
+
+// write writes the family in the Prometheus text exposition format.
+func (f *family) write(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	if len(f.labelNames) == 0 && len(f.samples) == 0 {
+		// Always expose unlabeled metrics
+		if f.typ == typeHistogram {
+			f.writeHistogram(w, &sample{})
+		} else {
+			fmt.Fprintf(w, "%s 0\n", f.name)
+		}
+		return
+	}
+	keys := make([]string, 0, len(f.samples))
+	for k := range f.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.samples[k]
+		if f.typ == typeHistogram {
+			f.writeHistogram(w, s)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of a histogram sample.
+func (f *family) writeHistogram(w io.Writer, s *sample) {
+	names := append(append([]string(nil), f.labelNames...), "le")
+	values := append(append([]string(nil), s.labelValues...), "")
+	var cumulative uint64
+	for i, upper := range f.buckets {
+		if s.bucketCounts != nil {
+			cumulative += s.bucketCounts[i]
+		}
+		values[len(values)-1] = formatValue(upper)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), cumulative)
+	}
+	values[len(values)-1] = "+Inf"
+	fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), s.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues), formatValue(s.value))
+	fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues), s.count)
+}
+
+// observe adds the given value to a histogram sample with given bucket upper bounds.
+func (s *sample) observe(buckets []float64, value float64) {
+	if s.bucketCounts == nil {
+		s.bucketCounts = make([]uint64, len(buckets))
+	}
+	// Index of the first bucket with an upper bound >= value
+	if i := sort.SearchFloat64s(buckets, value); i < len(buckets) {
+		s.bucketCounts[i]++
+	}
+	s.count++
+	s.value += value
+}
+
+// formatLabels returns the label set of a sample, e.g. {kind="unit"}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", n, strconv.Quote(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue returns the text representation of a sample value.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// escapeHelp escapes a help text as required by the text exposition format.
+func escapeHelp(help string) string {
+	return strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1)
+}
+
+// countingWriter counts the number of bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+)
+
+// Values of --color
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// Environment variables set by common CI systems
+var ciEnvVars = []string{"CI", "BUILD_NUMBER", "BUILDKITE", "GITHUB_ACTIONS", "GITLAB_CI", "JENKINS_URL", "TEAMCITY_VERSION", "TF_BUILD"}
+
+// isCI returns true when running in a CI environment.
+func isCI() bool {
+	for _, name := range ciEnvVars {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isInteractive returns true if the given file is a terminal read by a person,
+// i.e. a terminal that is not a dumb terminal and not part of a CI job.
+func isInteractive(f *os.File) bool {
+	return isTerminal(f) && !isCI() && os.Getenv("TERM") != "dumb"
+}
+
+// useColor returns true if output written to the given file must be colorized, according to the given --color mode.
+// In auto mode, only interactive terminals get colors, unless NO_COLOR is set (see https://no-color.org).
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	default:
+		return os.Getenv("NO_COLOR") == "" && isInteractive(f)
+	}
+}
+
+// outputFormat returns the given --output format, or the default format when it is not set:
+// a table on a terminal and in CI logs, JSON when stdout is read by another program.
+func outputFormat(output string) string {
+	switch {
+	case output != "":
+		return output
+	case isTerminal(os.Stdout) || isCI():
+		return outputTable
+	default:
+		return outputJSON
+	}
+}
+
+// outputFormatter returns the formatter of the --output format (see outputFormat) of a command.
+func outputFormatter() formatter {
+	f, ok := formatters[outputFormat(globalFlags.output)]
+	if !ok {
+		Exitf("--output '%s' is not valid, expected 'table', 'json', 'yaml' or 'csv'", globalFlags.output)
+	}
+	return f
+}
+
+// runReportFormatter returns the formatter of the final report of a single cleanup run, or nil when the
+// run only writes the text report. Unlike other commands, a cleanup run writes the text report unless
+// another --output format than table is set explicitly.
+func runReportFormatter() formatter {
+	if globalFlags.output == "" || globalFlags.output == outputTable {
+		return nil
+	}
+	return outputFormatter()
+}
+
+// reportWriter returns where the human readable progress of a cleanup run is written: stdout,
+// unless stdout is reserved for the final run report (see runReportFormatter).
+func reportWriter() *os.File {
+	if runReportFormatter() != nil {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeOutput writes the given output of a command to stdout using the given formatter.
+func writeOutput(f formatter, out output) {
+	if err := f.Format(os.Stdout, out); err != nil {
+		ExitWithCodef(exitCodeFailure, "Failed to write output: %#v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdPause = &cobra.Command{
+		Use:   "pause",
+		Short: "Make all fleet-cleanup instances stop removing keys",
+		Long: "Make all fleet-cleanup instances stop removing keys, by setting a pause key in etcd.\n\n" +
+			"While cleanups are paused, runs only report garbage. Use 'resume' to remove keys again.",
+		Run: cmdPauseRun,
+	}
+	cmdResume = &cobra.Command{
+		Use:   "resume",
+		Short: "Make all fleet-cleanup instances remove keys again after a pause",
+		Run:   cmdResumeRun,
+	}
+	pauseFlags struct {
+		reason string
+		ttl    time.Duration
+	}
+)
+
+func init() {
+	cmdPause.Flags().StringVar(&pauseFlags.reason, "reason", "", "Reason for the pause, shown in the logs of all instances")
+	cmdPause.Flags().DurationVar(&pauseFlags.ttl, "ttl", 0, "If set, resume automatically after this duration")
+	cmdMain.AddCommand(cmdPause)
+	cmdMain.AddCommand(cmdResume)
+}
+
+func cmdPauseRun(cmd *cobra.Command, args []string) {
+	svc := newPauseService()
+	if err := svc.Pause(pauseFlags.reason, pauseFlags.ttl); err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to pause cleanups: %#v", err)
+	}
+	if pauseFlags.ttl > 0 {
+		fmt.Printf("Paused cleanups for %s\n", pauseFlags.ttl)
+	} else {
+		fmt.Println("Paused cleanups until resumed")
+	}
+}
+
+func cmdResumeRun(cmd *cobra.Command, args []string) {
+	svc := newPauseService()
+	resumed, err := svc.Resume()
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to resume cleanups: %#v", err)
+	}
+	if resumed {
+		fmt.Println("Resumed cleanups")
+	} else {
+		fmt.Println("Cleanups were not paused")
+	}
+}
+
+// newPauseService creates a service used to set or remove the pause key or a veto.
+func newPauseService() *service.Service {
+	etcdUrl := parseEtcdURL()
+	setLogLevel(globalFlags.logLevel, projectName)
+
+	svc, err := service.NewService(service.ServiceConfig{
+		EtcdURL:       etcdUrl,
+		EtcdTransport: etcdTransportConfig(),
+		Registry:      registryConfig(),
+	}, service.ServiceDependencies{
+		Logger:           logging.MustGetLogger(projectName),
+		ComponentLoggers: serviceComponentLoggers(),
+	})
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to create service: %#v", err)
+	}
+	return svc
+}
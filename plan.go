@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// Modes of cmdMainRun
+const (
+	runModePlan     = "plan"
+	runModeApply    = "apply"
+	runModeBrowse   = "browse"
+	runModeScript   = "script"
+	runModeSaveScan = "save-scan"
+	runModeUseScan  = "use-scan"
+)
+
+var (
+	cmdPlan = &cobra.Command{
+		Use:   "plan",
+		Short: "Record the keys a cleanup would remove in a plan file",
+		Long: "Record the keys a cleanup would remove in a plan file, without removing anything.\n" +
+			"Accepts the same flags as a cleanup. Use 'fleet-cleanup apply' to remove the keys in the plan.",
+		Run: cmdPlanRun,
+	}
+	cmdApply = &cobra.Command{
+		Use:   "apply <plan file>",
+		Short: "Remove the keys in a plan file that did not change since the plan was created",
+		Run:   cmdApplyRun,
+	}
+	planFlags struct {
+		mode string
+		out  string
+		file string
+	}
+)
+
+func init() {
+	cmdPlan.Flags().StringVar(&planFlags.out, "out", "plan.json", "Path of the plan file to write")
+	cmdMain.AddCommand(cmdPlan)
+	cmdMain.AddCommand(cmdApply)
+}
+
+func cmdPlanRun(cmd *cobra.Command, args []string) {
+	if globalFlags.interval != 0 {
+		Exitf("--interval cannot be used with plan")
+	}
+	planFlags.mode = runModePlan
+	cmdMainRun(cmd, args)
+}
+
+func cmdApplyRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the plan file to apply")
+	}
+	if globalFlags.interval != 0 {
+		Exitf("--interval cannot be used with apply")
+	}
+	planFlags.mode = runModeApply
+	planFlags.file = args[0]
+	cmdMainRun(cmd, nil)
+}
+
+// createPlan creates a plan and writes it to the plan file.
+func createPlan(svc *service.Service, opts service.RunOptions) (service.RunSummary, error) {
+	plan, summary, err := svc.CreatePlan(opts)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	raw, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	if err := ioutil.WriteFile(planFlags.out, raw, 0600); err != nil {
+		return summary, maskAny(err)
+	}
+	fmt.Fprintf(reportWriter(), "Wrote plan %s with %d keys to %s\n", plan.RunID, len(plan.Entries), planFlags.out)
+	return summary, nil
+}
+
+// emitScript creates a plan and writes a script that removes the keys in it (see --emit-script).
+func emitScript(svc *service.Service, opts service.RunOptions) (service.RunSummary, error) {
+	plan, summary, err := svc.CreatePlan(opts)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	var buf bytes.Buffer
+	if err := svc.WriteScript(&buf, plan, globalFlags.emitScript); err != nil {
+		return summary, maskAny(err)
+	}
+	if err := ioutil.WriteFile(globalFlags.scriptOut, buf.Bytes(), 0700); err != nil {
+		return summary, maskAny(err)
+	}
+	fmt.Fprintf(reportWriter(), "Wrote %s script for %d keys of run %s to %s\n", globalFlags.emitScript, len(plan.Entries), plan.RunID, globalFlags.scriptOut)
+	return summary, nil
+}
+
+// saveScan performs a run and writes the garbage it found to the scan file (see --save-scan).
+func saveScan(svc *service.Service, opts service.RunOptions) (service.RunSummary, error) {
+	scan, summary, err := svc.ScanWithOptions(opts)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	raw, err := json.MarshalIndent(scan, "", "  ")
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	if err := ioutil.WriteFile(globalFlags.saveScan, raw, 0600); err != nil {
+		return summary, maskAny(err)
+	}
+	fmt.Fprintf(reportWriter(), "Wrote scan %s with %d keys to %s\n", scan.RunID, len(scan.Entries), globalFlags.saveScan)
+	return summary, nil
+}
+
+// useScan reads the scan file and removes the garbage in it (see --use-scan).
+func useScan(svc *service.Service, opts service.RunOptions) (service.RunSummary, error) {
+	raw, err := ioutil.ReadFile(globalFlags.useScan)
+	if err != nil {
+		Exitf("Failed to read scan '%s': %#v", globalFlags.useScan, err)
+	}
+	var scan service.Scan
+	if err := json.Unmarshal(raw, &scan); err != nil {
+		Exitf("Scan '%s' is not valid: %v", globalFlags.useScan, err)
+	}
+	summary, err := svc.RunWithScan(scan, opts)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	return summary, nil
+}
+
+// applyPlan reads the plan file and removes the keys in it.
+func applyPlan(svc *service.Service) (service.RunSummary, error) {
+	raw, err := ioutil.ReadFile(planFlags.file)
+	if err != nil {
+		Exitf("Failed to read plan '%s': %#v", planFlags.file, err)
+	}
+	var plan service.Plan
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		Exitf("Plan '%s' is not valid: %v", planFlags.file, err)
+	}
+	summary, err := svc.ApplyPlan(plan)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	return summary, nil
+}
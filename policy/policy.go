@@ -0,0 +1,253 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// LoadFile reads a policy from the YAML file with given path.
+//
+// A policy file looks like:
+//
+//	rules:
+//	  orphan-units:
+//	    min-age: 24h
+//	    exclude: ["^/_coreos.com/fleet/unit/0000"]
+//	    max-delete: 50
+//	    action: soft-delete
+//	    protect-unit-types: [template, global]
+//	  stale-leases:
+//	    enabled: false
+//	notifiers:
+//	  ops-slack:
+//	    type: slack
+//	    url: https://hooks.slack.com/services/...
+//	  on-call:
+//	    type: pagerduty
+//	    routing-key: 0123456789abcdef
+func LoadFile(path string) (service.Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return service.Policy{}, maskAny(err)
+	}
+	p, err := Parse(data)
+	if err != nil {
+		return service.Policy{}, maskAny(errgo.WithCausef(err, InvalidPolicyError, "%s", path))
+	}
+	return p, nil
+}
+
+// Parse decodes a policy from the given YAML document.
+// Unknown keys result in an error, so typos do not silently change the behavior of a rule.
+func Parse(data []byte) (service.Policy, error) {
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return service.Policy{}, maskAny(err)
+	}
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return service.Policy{}, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "policy must be a mapping"))
+	}
+	result := service.Policy{Rules: make(map[string]service.RulePolicy)}
+	for _, key := range sortedKeys(root) {
+		switch key {
+		case "rules":
+			rules, ok := root[key].(map[string]interface{})
+			if !ok {
+				if s, isString := root[key].(string); isString && s == "" {
+					continue
+				}
+				return service.Policy{}, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "rules must be a mapping"))
+			}
+			for _, name := range sortedKeys(rules) {
+				rp, err := parseRulePolicy(name, rules[name])
+				if err != nil {
+					return service.Policy{}, maskAny(err)
+				}
+				result.Rules[name] = rp
+			}
+		case "notifiers":
+			notifiers, ok := root[key].(map[string]interface{})
+			if !ok {
+				if s, isString := root[key].(string); isString && s == "" {
+					continue
+				}
+				return service.Policy{}, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "notifiers must be a mapping"))
+			}
+			result.Notifiers = make(map[string]service.NotifierPolicy)
+			for _, name := range sortedKeys(notifiers) {
+				np, err := parseNotifierPolicy(name, notifiers[name])
+				if err != nil {
+					return service.Policy{}, maskAny(err)
+				}
+				result.Notifiers[name] = np
+			}
+		default:
+			return service.Policy{}, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "unknown key '%s'", key))
+		}
+	}
+	return result, nil
+}
+
+// parseRulePolicy decodes the settings of a single rule.
+func parseRulePolicy(name string, value interface{}) (service.RulePolicy, error) {
+	var result service.RulePolicy
+	if s, ok := value.(string); ok && s == "" {
+		return result, nil
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "rule %s must be a mapping", name))
+	}
+	invalid := func(key, format string, args ...interface{}) error {
+		return maskAny(errgo.WithCausef(nil, InvalidPolicyError, "rule %s: %s %s", name, key, fmt.Sprintf(format, args...)))
+	}
+	for _, key := range sortedKeys(fields) {
+		value := fields[key]
+		switch key {
+		case "enabled":
+			s, _ := value.(string)
+			enabled, err := strconv.ParseBool(s)
+			if err != nil {
+				return result, invalid(key, "must be true or false")
+			}
+			result.Enabled = &enabled
+		case "min-age":
+			s, _ := value.(string)
+			d, err := parseDuration(s)
+			if err != nil {
+				return result, invalid(key, "must be a duration (e.g. 12h or 7d)")
+			}
+			result.MinAge = d
+		case "protect-unit-types":
+			list, err := stringList(value)
+			if err != nil {
+				return result, invalid(key, "must be a unit type or list of unit types")
+			}
+			result.ProtectUnitTypes = list
+		case "include", "exclude":
+			list, err := stringList(value)
+			if err != nil {
+				return result, invalid(key, "must be a pattern or list of patterns")
+			}
+			if key == "include" {
+				result.Include = list
+			} else {
+				result.Exclude = list
+			}
+		case "max-delete":
+			s, _ := value.(string)
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return result, invalid(key, "must be a number")
+			}
+			result.MaxDelete = n
+		case "action":
+			s, ok := value.(string)
+			if !ok {
+				return result, invalid(key, "must be one of %s, %s, %s or %s", service.ActionReport, service.ActionSoftDelete, service.ActionDelete, service.ActionRestoreTTL)
+			}
+			result.Action = s
+		default:
+			return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "rule %s: unknown key '%s'", name, key))
+		}
+	}
+	return result, nil
+}
+
+// parseNotifierPolicy decodes the settings of a single notifier.
+func parseNotifierPolicy(name string, value interface{}) (service.NotifierPolicy, error) {
+	var result service.NotifierPolicy
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "notifier %s must be a mapping", name))
+	}
+	for _, key := range sortedKeys(fields) {
+		s, ok := fields[key].(string)
+		if !ok {
+			return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "notifier %s: %s must be a string", name, key))
+		}
+		switch key {
+		case "type":
+			result.Type = s
+		case "url":
+			result.URL = s
+		case "routing-key":
+			result.RoutingKey = s
+		default:
+			return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "notifier %s: unknown key '%s'", name, key))
+		}
+	}
+	if err := result.Validate(); err != nil {
+		return result, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "notifier %s: %s", name, err.Error()))
+	}
+	return result, nil
+}
+
+// parseDuration parses a Go duration, additionally accepting a number of days (e.g. 7d).
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, maskAny(err)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, maskAny(err)
+	}
+	return d, nil
+}
+
+// stringList converts a scalar or sequence of scalars into a list of strings.
+func stringList(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var result []string
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, maskAny(InvalidPolicyError)
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	default:
+		return nil, maskAny(InvalidPolicyError)
+	}
+}
+
+// sortedKeys returns the keys of the given mapping in sorted order, so errors are reported deterministically.
+func sortedKeys(m map[string]interface{}) []string {
+	var result []string
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
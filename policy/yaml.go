@@ -0,0 +1,330 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// This file contains a parser for the subset of YAML used by policy files:
+// block mappings, block sequences, flow sequences ([a, b]), plain & quoted scalars and comments.
+// Anchors, multi-line scalars, flow mappings & multiple documents are not supported.
+
+// yamlLine is a single non-empty line of a YAML document.
+type yamlLine struct {
+	number int
+	indent int
+	text   string // Without indentation & comments
+}
+
+// parseYAML parses the given document into nested map[string]interface{}, []interface{} & string values.
+func parseYAML(data string) (interface{}, error) {
+	lines, err := splitLines(data)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	value, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseBlock parses a mapping or sequence whose entries are indented at the given level.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+// parseMapping parses a block mapping whose keys are indented at the given level.
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	result := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf(line, "unexpected indentation")
+		}
+		if isSequenceItem(line.text) {
+			return nil, p.errorf(line, "unexpected sequence item in mapping")
+		}
+		key, rest, ok := splitKey(line.text)
+		if !ok {
+			return nil, p.errorf(line, "expected 'key: value'")
+		}
+		if _, found := result[key]; found {
+			return nil, p.errorf(line, "duplicate key '%s'", key)
+		}
+		p.pos++
+		value, err := p.parseValue(line, rest, indent)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// parseSequence parses a block sequence whose items are indented at the given level.
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	var result []interface{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent || !isSequenceItem(line.text) {
+			return nil, p.errorf(line, "expected sequence item")
+		}
+		p.pos++
+		value, err := p.parseValue(line, strings.TrimSpace(strings.TrimPrefix(line.text, "-")), indent)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// parseValue parses the value following a key or sequence item indicator on the given line.
+// An empty value starts a nested block (if the next line is indented further).
+func (p *yamlParser) parseValue(line yamlLine, text string, indent int) (interface{}, error) {
+	if text != "" {
+		return parseInlineValue(text, func(format string, args ...interface{}) error {
+			return p.errorf(line, format, args...)
+		})
+	}
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		// Sequences are allowed at the same indentation as their parent key
+		if next.indent > indent || (next.indent == indent && isSequenceItem(next.text) && !isSequenceItem(line.text)) {
+			return p.parseBlock(next.indent)
+		}
+	}
+	return "", nil
+}
+
+// parseInlineValue parses a scalar or flow sequence.
+func parseInlineValue(text string, errorf func(string, ...interface{}) error) (interface{}, error) {
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, errorf("unterminated flow sequence")
+		}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		result := []interface{}{}
+		if inner == "" {
+			return result, nil
+		}
+		items, err := splitFlowItems(inner)
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+		for _, item := range items {
+			value, err := parseScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	}
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || text == "|" || text == ">" {
+		return nil, errorf("unsupported YAML construct '%s'", text)
+	}
+	value, err := parseScalar(text)
+	if err != nil {
+		return nil, errorf("%v", err)
+	}
+	return value, nil
+}
+
+// parseScalar parses a plain, single quoted or double quoted scalar.
+func parseScalar(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted string %s", text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("invalid single quoted string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	default:
+		return text, nil
+	}
+}
+
+// splitFlowItems splits the content of a flow sequence on commas outside of quotes.
+func splitFlowItems(text string) ([]string, error) {
+	var result []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case quote != 0:
+			if n := quotedCharLen(text, i, quote); n > 1 {
+				i += n - 1
+			} else if ch == quote {
+				quote = 0
+			}
+		case (ch == '"' || ch == '\'') && startsScalar(text, i):
+			quote = ch
+		case ch == ',':
+			result = append(result, text[start:i])
+			start = i + 1
+		case ch == '[' || ch == '{':
+			return nil, fmt.Errorf("nested flow collections are not supported")
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	return append(result, text[start:]), nil
+}
+
+// splitKey splits a 'key: value' line.
+func splitKey(text string) (string, string, bool) {
+	var quote rune
+	for i, ch := range text {
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case (ch == '"' || ch == '\'') && i == 0:
+			quote = ch
+		case ch == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key, err := parseScalar(strings.TrimSpace(text[:i]))
+			if err != nil || key == "" {
+				return "", "", false
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// isSequenceItem returns true if the given line starts a sequence item.
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitLines splits the given document into non-empty lines, removing comments.
+func splitLines(data string) ([]yamlLine, error) {
+	var result []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		if raw == "---" {
+			if len(result) > 0 {
+				return nil, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "line %d: multiple documents are not supported", i+1))
+			}
+			continue
+		}
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidPolicyError, "line %d: tabs cannot be used for indentation", i+1))
+		}
+		text = strings.TrimSpace(stripComment(text))
+		if text == "" {
+			continue
+		}
+		result = append(result, yamlLine{
+			number: i + 1,
+			indent: len(raw) - len(strings.TrimLeft(raw, " ")),
+			text:   text,
+		})
+	}
+	return result, nil
+}
+
+// stripComment removes a comment (# preceded by whitespace or at the start of the line) outside of quotes.
+// A quote only starts a quoted scalar at the start of a scalar, so the quote in e.g. "reason: it's old # note" does not.
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case quote != 0:
+			if n := quotedCharLen(text, i, quote); n > 1 {
+				i += n - 1
+			} else if ch == quote {
+				quote = 0
+			}
+		case (ch == '"' || ch == '\'') && startsScalar(text, i):
+			quote = ch
+		case ch == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// startsScalar returns true if the character at index i of the given text is the first character of a scalar,
+// i.e. it is at the start of the text or follows a key (': '), a sequence item indicator ('- ') or a flow indicator.
+func startsScalar(text string, i int) bool {
+	j := i - 1
+	for j >= 0 && (text[j] == ' ' || text[j] == '\t') {
+		j--
+	}
+	if j < 0 {
+		return true
+	}
+	switch text[j] {
+	case '[', '{', ',':
+		return true
+	case ':', '-':
+		// These are only indicators when followed by whitespace
+		return j < i-1
+	default:
+		return false
+	}
+}
+
+// quotedCharLen returns the length of the character at index i of the given text, inside a scalar quoted with given quote.
+// Escape sequences in double quoted scalars and escaped (doubled) quotes in single quoted scalars count as a single character.
+func quotedCharLen(text string, i int, quote byte) int {
+	if i+1 < len(text) && ((quote == '"' && text[i] == '\\') || (quote == '\'' && text[i] == '\'' && text[i+1] == '\'')) {
+		return 2
+	}
+	return 1
+}
+
+func (p *yamlParser) errorf(line yamlLine, format string, args ...interface{}) error {
+	return maskAny(errgo.WithCausef(nil, InvalidPolicyError, "line %d: %s", line.number, fmt.Sprintf(format, args...)))
+}
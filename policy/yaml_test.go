@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected interface{}
+	}{
+		// Scalars
+		{"", map[string]interface{}{}},
+		{"a: b", map[string]interface{}{"a": "b"}},
+		{"a:", map[string]interface{}{"a": ""}},
+		{"a: 'b c'", map[string]interface{}{"a": "b c"}},
+		{`a: "b\tc"`, map[string]interface{}{"a": "b\tc"}},
+		{"a: 'it''s'", map[string]interface{}{"a": "it's"}},
+		{"'a b': c", map[string]interface{}{"a b": "c"}},
+		{"a: http://host:8080/x", map[string]interface{}{"a": "http://host:8080/x"}},
+		// Lists
+		{"a: [b, c]", map[string]interface{}{"a": []interface{}{"b", "c"}}},
+		{"a: []", map[string]interface{}{"a": []interface{}{}}},
+		{"a: ['b, c', \"d\"]", map[string]interface{}{"a": []interface{}{"b, c", "d"}}},
+		{"a: [it's, b]", map[string]interface{}{"a": []interface{}{"it's", "b"}}},
+		{"a:\n  - b\n  - c", map[string]interface{}{"a": []interface{}{"b", "c"}}},
+		{"a:\n- b\n- c", map[string]interface{}{"a": []interface{}{"b", "c"}}},
+		{"- a\n- b", []interface{}{"a", "b"}},
+		// Nesting
+		{"a:\n  b: c\n  d:\n    e: f", map[string]interface{}{"a": map[string]interface{}{"b": "c", "d": map[string]interface{}{"e": "f"}}}},
+		{"a:\n  - b: c\n", map[string]interface{}{"a": []interface{}{"b: c"}}},
+		{"a:\n  b: c\nd: e", map[string]interface{}{"a": map[string]interface{}{"b": "c"}, "d": "e"}},
+		// Comments
+		{"# comment\na: b", map[string]interface{}{"a": "b"}},
+		{"a: b # comment", map[string]interface{}{"a": "b"}},
+		{"a: b#c", map[string]interface{}{"a": "b#c"}},
+		{"a: 'b # c'", map[string]interface{}{"a": "b # c"}},
+		{`a: "b # c"`, map[string]interface{}{"a": "b # c"}},
+		{`a: "b \" # c"`, map[string]interface{}{"a": `b " # c`}},
+		{"a: 'it''s # c'", map[string]interface{}{"a": "it's # c"}},
+		{"reason: it's old # note", map[string]interface{}{"reason": "it's old"}},
+		{"reason: say \"hi # note", map[string]interface{}{"reason": "say \"hi"}},
+		{"a: [b, 'c # d'] # e", map[string]interface{}{"a": []interface{}{"b", "c # d"}}},
+		{"a:\n  # comment\n  b: c", map[string]interface{}{"a": map[string]interface{}{"b": "c"}}},
+		{"---\na: b", map[string]interface{}{"a": "b"}},
+	}
+	for _, test := range tests {
+		value, err := parseYAML(test.doc)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%q: expected %#v, got %#v", test.doc, test.expected, value)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []string{
+		"a: b\n  c: d",
+		"a: b\na: c",
+		"a",
+		"a: [b, c",
+		"a: [b, [c]]",
+		"a: [b, 'c]",
+		"a: 'b",
+		`a: "b`,
+		"a: {b: c}",
+		"a: &anchor b",
+		"a: *anchor",
+		"a: |",
+		"a:\n\tb: c",
+		"a: b\n- c",
+		"- a\nb: c",
+		"a: b\n---\nc: d",
+	}
+	for _, doc := range tests {
+		if _, err := parseYAML(doc); !IsInvalidPolicy(err) {
+			t.Errorf("%q: expected invalid policy error, got %v", doc, err)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"a: b", "a: b"},
+		{"# a", ""},
+		{"a: b # c", "a: b "},
+		{"a: b#c", "a: b#c"},
+		{"a: 'b # c'", "a: 'b # c'"},
+		{"a: it's # c", "a: it's "},
+		{"a: don't 'x # c'", "a: don't 'x "},
+		{"- 'a # b' # c", "- 'a # b' "},
+		{"-'a # b", "-'a "},
+		{"a:'b # c", "a:'b "},
+		{"a: [b, 'c # d']", "a: [b, 'c # d']"},
+		{`a: "b \" # c" # d`, `a: "b \" # c" `},
+		{"a: 'b'' # c' # d", "a: 'b'' # c' "},
+	}
+	for _, test := range tests {
+		if result := stripComment(test.text); result != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.text, test.expected, result)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+// ANSI color codes
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorGreen  = "\x1b[32m"
+	colorReset  = "\x1b[0m"
+)
+
+// Report verbosity levels
+const (
+	verbosityQuiet   = -1 // Only the summary & errors
+	verbosityNormal  = 0
+	verbosityVerbose = 1 // Per-key details, including etcd responses
+)
+
+// jsonSummary is the summary written by --json-summary.
+type jsonSummary struct {
+	SchemaVersion int `json:"schemaVersion"` // See service.ReportSchemaVersion
+	service.RunSummary
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// newJSONSummary creates the summary of a run that ended with the given exit code & error.
+func newJSONSummary(summary service.RunSummary, exitCode int, err error) jsonSummary {
+	s := jsonSummary{
+		SchemaVersion: service.ReportSchemaVersion,
+		RunSummary:    summary,
+		ExitCode:      exitCode,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// writeJSONSummary writes the given summary as JSON on a single line.
+func writeJSONSummary(w io.Writer, summary service.RunSummary, exitCode int, err error) {
+	json.NewEncoder(w).Encode(newJSONSummary(summary, exitCode, err))
+}
+
+// summaryOutput returns the final report of a single run (see runReportFormatter): the same summary as
+// written by --json-summary, as a single row for tabular formats.
+func summaryOutput(summary service.RunSummary, exitCode int, err error) output {
+	s := newJSONSummary(summary, exitCode, err)
+	return output{
+		Value: s,
+		Header: []string{"RUN", "DRY RUN", "JOBS", "UNITS", "OBSOLETE UNITS", "REMOVED UNITS", "LEASES", "STALE LEASES", "REMOVED LEASES",
+			"STATES", "ORPHAN STATES", "REMOVED STATES", "FAILED DELETES", "DURATION", "EXIT CODE", "ERROR"},
+		Rows: [][]string{{
+			s.RunID, strconv.FormatBool(s.DryRun), strconv.Itoa(s.Jobs), strconv.Itoa(s.Units), strconv.Itoa(s.ObsoleteUnits), strconv.Itoa(s.RemovedUnits),
+			strconv.Itoa(s.Leases), strconv.Itoa(s.StaleLeases), strconv.Itoa(s.RemovedLeases),
+			strconv.Itoa(s.States), strconv.Itoa(s.OrphanStates), strconv.Itoa(s.RemovedStates), strconv.Itoa(s.FailedDeletes),
+			s.Duration.String(), strconv.Itoa(s.ExitCode), s.Error,
+		}},
+	}
+}
+
+// textReport writes a human readable report of all events of a run.
+type textReport struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	color     bool
+	verbosity int
+}
+
+// newTextReport creates a text report writing to the given writer.
+// If color is set, lines are colorized by severity.
+func newTextReport(w io.Writer, color bool, verbosity int) *textReport {
+	return &textReport{
+		w:         w,
+		color:     color,
+		verbosity: verbosity,
+	}
+}
+
+// Emit writes a report line for the given event (if relevant).
+func (r *textReport) Emit(e service.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.verbosity <= verbosityQuiet && e.Type != service.EventError && e.Type != service.EventRunSummary {
+		return
+	}
+
+	switch e.Type {
+	case service.EventScanStart:
+		if r.verbosity >= verbosityVerbose {
+			r.println("", "scan started at %s", e.Time.Format(time.RFC3339))
+		}
+	case service.EventCandidateFound:
+		if r.verbosity >= verbosityVerbose {
+			r.println("", "found obsolete %s %s%s (created at index %d, modified at index %d%s)",
+				e.Kind, e.Key, formatJob(e.Job, e.Owners), e.CreatedIndex, e.ModifiedIndex, formatAge(e.Age))
+		}
+	case service.EventCandidateGone:
+		r.println("", "no longer found %s %s%s", e.Kind, e.Key, formatJob(e.Job, e.Owners))
+	case service.EventSkipped:
+		if e.Reason == service.SkipReasonDryRun && e.Action == service.ActionRestoreTTL {
+			r.println(colorRed, "would restore TTL of %s %s", e.Kind, e.Key)
+		} else if e.Reason == service.SkipReasonDryRun {
+			r.println(colorRed, "would remove %s %s%s", e.Kind, e.Key, formatJob(e.Job, e.Owners))
+		} else {
+			r.println(colorYellow, "skipped %s %s%s (%s)", e.Kind, e.Key, formatJob(e.Job, e.Owners), e.Reason)
+		}
+	case service.EventDeleted:
+		if r.verbosity >= verbosityVerbose {
+			r.println(colorRed, "removed %s %s%s (%s)", e.Kind, e.Key, formatJob(e.Job, e.Owners), e.Message)
+		} else {
+			r.println(colorRed, "removed %s %s%s", e.Kind, e.Key, formatJob(e.Job, e.Owners))
+		}
+	case service.EventTTLRestored:
+		r.println(colorRed, "restored TTL of %s %s (%s)", e.Kind, e.Key, e.Message)
+	case service.EventError:
+		if e.Key != "" {
+			r.println(colorRed, "failed to remove %s %s: %s", e.Kind, e.Key, e.Message)
+		} else {
+			r.println(colorRed, "run failed: %s", e.Message)
+		}
+	case service.EventRunSummary:
+		if s := e.Summary; s != nil {
+			r.println(colorGreen, "%d jobs, %d units (%d obsolete, %d removed), %d leases (%d stale, %d removed), %d unit states (%d orphaned, %d removed), %d failed deletes in %s",
+				s.Jobs, s.Units, s.ObsoleteUnits, s.RemovedUnits, s.Leases, s.StaleLeases, s.RemovedLeases, s.States, s.OrphanStates, s.RemovedStates, s.FailedDeletes, s.Duration)
+			if s.BudgetExhausted != "" {
+				r.println(colorYellow, "budget exhausted (%s), %d candidates remain", s.BudgetExhausted, s.Remaining)
+			}
+			if v := s.Verification; v != nil {
+				if v.Failed() {
+					r.println(colorRed, "verification failed: %d removed keys still exist, %d units disappeared unexpectedly", len(v.StillPresent), len(v.Disappeared))
+					for _, key := range v.StillPresent {
+						r.println(colorRed, "  still exists: %s", key)
+					}
+					for _, key := range v.Disappeared {
+						r.println(colorRed, "  disappeared: %s", key)
+					}
+				} else {
+					r.println(colorGreen, "verified that all %d removed keys are gone", v.Checked)
+				}
+			}
+			if c := s.Canary; c != nil {
+				if c.Failed() {
+					r.println(colorRed, "canary failed after removing %d keys, the remaining keys were not removed", c.Removed)
+					for _, a := range c.Anomalies {
+						r.println(colorRed, "  %s", a)
+					}
+				} else {
+					r.println(colorGreen, "canary removed %d keys, no anomalies in %s", c.Removed, c.Observed)
+				}
+			}
+			if s.Shard != "" {
+				r.println("", "garbage restricted to shard %s", s.Shard)
+			}
+			if r.verbosity >= verbosityVerbose {
+				if s.EtcdVersion != "" {
+					r.println("", "etcd version %s", s.EtcdVersion)
+				}
+				for _, rs := range s.Rules {
+					r.println("", "rule %s (%s): %d found, %d removed", rs.Name, rs.Severity, rs.Candidates, rs.Removed)
+				}
+			}
+			if len(s.UnitTypes) > 0 && r.verbosity >= verbosityVerbose {
+				r.println("", "garbage by unit type: %s", formatCounts(s.UnitTypes))
+			}
+			if len(s.Skipped) > 0 && r.verbosity >= verbosityVerbose {
+				r.println("", "garbage not removed: %s", formatCounts(s.Skipped))
+			}
+			if len(s.Severities) > 0 {
+				r.println("", "garbage by severity: %d critical, %d warning, %d info",
+					s.Severities[service.SeverityCritical], s.Severities[service.SeverityWarning], s.Severities[service.SeverityInfo])
+			}
+			if s.Cached {
+				r.println(colorGreen, "nothing changed in etcd, reused the results of the previous run")
+			}
+			if s.RestoredTTLs > 0 {
+				r.println(colorGreen, "restored the TTL of %d keys", s.RestoredTTLs)
+			}
+			if s.Retried > 0 {
+				r.println(colorGreen, "retried %d keys that could not be removed in a previous run", s.Retried)
+			}
+			if n := s.Skipped[service.SkipReasonResurrected]; n > 0 {
+				r.println(colorYellow, "%d keys were modified during the run and kept (resurrected)", n)
+			}
+			if s.PacingDelay > 0 {
+				r.println(colorYellow, "etcd was slow, waited %s between deletes", s.PacingDelay)
+			}
+			if s.Delta {
+				r.println(colorGreen, "since previous run: %d new, %d no longer found", s.NewCandidates, s.GoneCandidates)
+			}
+			if p := s.Profile; p != nil {
+				r.println("", "profile: peak RSS %s, peak heap %s, %d allocations (%s), %d GCs",
+					formatBytes(p.PeakRSSBytes), formatBytes(p.PeakHeapBytes), p.Allocs, formatBytes(p.AllocBytes), p.NumGC)
+				for _, phase := range p.Phases {
+					r.println("", "phase %s: %s", phase.Name, phase.Duration)
+				}
+			}
+		}
+	}
+}
+
+// println writes a single line in the given color (if enabled and not empty).
+func (r *textReport) println(color, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if r.color && color != "" {
+		line = color + line + colorReset
+	}
+	fmt.Fprintln(r.w, line)
+}
+
+// formatJob returns a description of the given job name & owner labels for use in a report line.
+func formatJob(job string, owners map[string]string) string {
+	var parts []string
+	if job != "" {
+		parts = append(parts, fmt.Sprintf("job '%s'", job))
+	}
+	parts = append(parts, service.FormatOwners(owners)...)
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(parts, ", "))
+}
+
+// formatCounts returns the given counts as a list of 'count name' pairs, sorted by name.
+func formatCounts(counts map[string]int) string {
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[name], name))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes returns a human readable description of the given number of bytes.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// formatAge returns a description of the given estimated age for use in a report line.
+func formatAge(age time.Duration) string {
+	if age == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", ~%s old", age)
+}
+
+// isTerminal returns true if the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
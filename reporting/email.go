@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type EmailReporterConfig struct {
+	// Address (host:port) of the SMTP server
+	SMTPAddr string
+	// Username & password used to authenticate at the SMTP server (optional)
+	Username    string
+	Password    string
+	From        string
+	To          []string
+	ServiceName string
+}
+
+type EmailReporterDependencies struct {
+	Logger *logging.Logger
+}
+
+// EmailReporter sends a report of every destructive run by email.
+type EmailReporter struct {
+	EmailReporterConfig
+	EmailReporterDependencies
+}
+
+// NewEmailReporter creates a new reporter that sends run reports through the configured SMTP server.
+func NewEmailReporter(config EmailReporterConfig, deps EmailReporterDependencies) *EmailReporter {
+	return &EmailReporter{
+		EmailReporterConfig:       config,
+		EmailReporterDependencies: deps,
+	}
+}
+
+// ReportRun sends the given run report by email.
+func (r *EmailReporter) ReportRun(report service.Report) {
+	var auth smtp.Auth
+	if r.Username != "" {
+		host, _, err := net.SplitHostPort(r.SMTPAddr)
+		if err != nil {
+			host = r.SMTPAddr
+		}
+		auth = smtp.PlainAuth("", r.Username, r.Password, host)
+	}
+	msg := r.message(report)
+	if err := smtp.SendMail(r.SMTPAddr, auth, r.From, r.To, msg); err != nil {
+		r.Logger.Warningf("Failed to send report email: %#v", err)
+	}
+}
+
+// message builds the email (headers & plain text body) for the given report.
+func (r *EmailReporter) message(report service.Report) []byte {
+	var removed, failed []service.Candidate
+	for _, c := range report.Candidates {
+		switch c.Status {
+		case service.ReportStatusRemoved:
+			removed = append(removed, c)
+		case service.ReportStatusFailed:
+			failed = append(failed, c)
+		}
+	}
+	subject := fmt.Sprintf("[%s] %s: removed %d keys", r.ServiceName, report.Endpoint, len(removed))
+	if len(failed) > 0 {
+		subject += fmt.Sprintf(", %d failed", len(failed))
+	}
+	if report.Error != "" {
+		subject += ", run failed"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", r.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(r.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Cleanup run %s on %s", report.RunID, report.Endpoint)
+	if v := report.Summary.EtcdVersion; v != "" {
+		fmt.Fprintf(&body, " (etcd %s)", v)
+	}
+	body.WriteString("\n")
+	fmt.Fprintf(&body, "Started %s, took %s\n\n", report.Started.Format(time.RFC3339), report.Duration)
+	if report.Error != "" {
+		fmt.Fprintf(&body, "The run failed: %s\n\n", report.Error)
+	}
+	if len(removed) > 0 {
+		fmt.Fprintf(&body, "Removed keys (%d):\n\n", len(removed))
+		w := tabwriter.NewWriter(&body, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tKEY\tJOB\tOWNER\tRULE")
+		for _, c := range removed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Kind, c.Key, c.Job, strings.Join(service.FormatOwners(c.Owners), ","), c.Rule)
+		}
+		w.Flush()
+		body.WriteString("\n")
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&body, "Failed deletes (%d):\n\n", len(failed))
+		w := tabwriter.NewWriter(&body, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tKEY\tOWNER\tERROR")
+		for _, c := range failed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Kind, c.Key, strings.Join(service.FormatOwners(c.Owners), ","), c.Error)
+		}
+		w.Flush()
+		body.WriteString("\n")
+	}
+	// SMTP requires CRLF line endings
+	buf.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"io"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type NotifierConfig struct {
+	ServiceName string
+	Version     string
+}
+
+type NotifierDependencies struct {
+	Logger *logging.Logger
+	Stdout io.Writer // Output of stdout notifiers
+}
+
+// NewNotifier creates the alerter of the given type, configured by the given notifier settings.
+func NewNotifier(np service.NotifierPolicy, config NotifierConfig, deps NotifierDependencies) (service.Alerter, error) {
+	if err := np.Validate(); err != nil {
+		return nil, maskAny(err)
+	}
+	switch np.Type {
+	case service.NotifierWebhook:
+		return NewWebhookReporter(WebhookReporterConfig{
+			URL:     np.URL,
+			Version: config.Version,
+		}, WebhookReporterDependencies{
+			Logger: deps.Logger,
+		}), nil
+	case service.NotifierSlack:
+		return NewSlackReporter(SlackReporterConfig{
+			URL:         np.URL,
+			ServiceName: config.ServiceName,
+		}, SlackReporterDependencies{
+			Logger: deps.Logger,
+		}), nil
+	case service.NotifierPagerDuty:
+		return NewPagerDutyReporter(PagerDutyReporterConfig{
+			RoutingKey:  np.RoutingKey,
+			URL:         np.URL,
+			ServiceName: config.ServiceName,
+			Version:     config.Version,
+		}, PagerDutyReporterDependencies{
+			Logger: deps.Logger,
+		}), nil
+	default: // service.NotifierStdout
+		return NewStdoutReporter(StdoutReporterConfig{
+			Version: config.Version,
+		}, StdoutReporterDependencies{
+			Logger: deps.Logger,
+			Output: deps.Stdout,
+		}), nil
+	}
+}
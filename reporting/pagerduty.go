@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+const (
+	// DefaultPagerDutyURL is the endpoint of the PagerDuty events API v2
+	DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+type PagerDutyReporterConfig struct {
+	// Integration key of the PagerDuty service
+	RoutingKey string
+	// URL of the events API (defaults to DefaultPagerDutyURL)
+	URL         string
+	ServiceName string
+	Version     string
+}
+
+type PagerDutyReporterDependencies struct {
+	Logger *logging.Logger
+}
+
+// PagerDutyReporter triggers PagerDuty incidents for alerts.
+type PagerDutyReporter struct {
+	PagerDutyReporterConfig
+	PagerDutyReporterDependencies
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string        `json:"summary"`
+	Source        string        `json:"source"`
+	Severity      string        `json:"severity"`
+	Timestamp     string        `json:"timestamp"`
+	Component     string        `json:"component"`
+	CustomDetails service.Alert `json:"custom_details"`
+}
+
+// NewPagerDutyReporter creates a new reporter that triggers PagerDuty incidents.
+func NewPagerDutyReporter(config PagerDutyReporterConfig, deps PagerDutyReporterDependencies) *PagerDutyReporter {
+	if config.URL == "" {
+		config.URL = DefaultPagerDutyURL
+	}
+	return &PagerDutyReporter{
+		PagerDutyReporterConfig:       config,
+		PagerDutyReporterDependencies: deps,
+	}
+}
+
+// Alert triggers a PagerDuty incident for the given alert.
+// Alerts for the same etcd cluster are grouped into a single incident.
+func (r *PagerDutyReporter) Alert(alert service.Alert) {
+	event := pagerDutyEvent{
+		RoutingKey:  r.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    r.ServiceName + "/" + alert.Endpoint,
+		Payload: pagerDutyPayload{
+			Summary:       r.ServiceName + " on " + alert.Endpoint + ": " + alert.Message,
+			Source:        alert.Endpoint,
+			Severity:      "warning",
+			Timestamp:     alert.Time.UTC().Format(time.RFC3339),
+			Component:     r.ServiceName + " " + r.Version,
+			CustomDetails: alert,
+		},
+	}
+	if err := postJSON(r.URL, nil, event); err != nil {
+		r.Logger.Warningf("Failed to send alert to PagerDuty: %#v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type SentryReporterConfig struct {
+	DSN         string
+	ServiceName string
+	Version     string
+}
+
+type SentryReporterDependencies struct {
+	Logger *logging.Logger
+}
+
+// SentryReporter reports failed runs to Sentry.
+type SentryReporter struct {
+	SentryReporterConfig
+	SentryReporterDependencies
+
+	storeURL  string
+	publicKey string
+}
+
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Logger    string            `json:"logger"`
+	Platform  string            `json:"platform"`
+	Message   string            `json:"message"`
+	Release   string            `json:"release,omitempty"`
+	Tags      map[string]string `json:"tags"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+// NewSentryReporter creates a new error reporter for the Sentry project identified by the configured DSN.
+func NewSentryReporter(config SentryReporterConfig, deps SentryReporterDependencies) (*SentryReporter, error) {
+	// DSN looks like: https://<public-key>@<host>/<project-id>
+	dsn, err := url.Parse(config.DSN)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if dsn.User == nil || dsn.User.Username() == "" {
+		return nil, maskAny(fmt.Errorf("sentry DSN '%s' has no public key", config.DSN))
+	}
+	projectID := path.Base(dsn.Path)
+	if projectID == "" || projectID == "/" || projectID == "." {
+		return nil, maskAny(fmt.Errorf("sentry DSN '%s' has no project ID", config.DSN))
+	}
+	storeURL := url.URL{
+		Scheme: dsn.Scheme,
+		Host:   dsn.Host,
+		Path:   path.Join(path.Dir(dsn.Path), "api", projectID, "store") + "/",
+	}
+	return &SentryReporter{
+		SentryReporterConfig:       config,
+		SentryReporterDependencies: deps,
+		storeURL:                   storeURL.String(),
+		publicKey:                  dsn.User.Username(),
+	}, nil
+}
+
+// ReportError sends the given error to Sentry.
+func (r *SentryReporter) ReportError(err error, ctx service.ErrorContext) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:     "error",
+		Logger:    r.ServiceName,
+		Platform:  "go",
+		Message:   err.Error(),
+		Release:   r.Version,
+		Tags: map[string]string{
+			"endpoint": ctx.Endpoint,
+			"run_id":   ctx.RunID,
+			"phase":    ctx.Phase,
+		},
+		Extra: map[string]string{
+			"details": errgo.Details(err),
+		},
+	}
+	auth := strings.Join([]string{
+		"Sentry sentry_version=7",
+		"sentry_client=" + r.ServiceName + "/" + r.Version,
+		"sentry_key=" + r.publicKey,
+	}, ", ")
+	if err := postJSON(r.storeURL, map[string]string{"X-Sentry-Auth": auth}, event); err != nil {
+		r.Logger.Warningf("Failed to report error to sentry: %#v", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type SlackReporterConfig struct {
+	// URL of a Slack incoming webhook
+	URL         string
+	ServiceName string
+}
+
+type SlackReporterDependencies struct {
+	Logger *logging.Logger
+}
+
+// SlackReporter sends alerts to a Slack incoming webhook.
+type SlackReporter struct {
+	SlackReporterConfig
+	SlackReporterDependencies
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// NewSlackReporter creates a new reporter that posts to a Slack incoming webhook.
+func NewSlackReporter(config SlackReporterConfig, deps SlackReporterDependencies) *SlackReporter {
+	return &SlackReporter{
+		SlackReporterConfig:       config,
+		SlackReporterDependencies: deps,
+	}
+}
+
+// Alert posts the given alert to Slack.
+func (r *SlackReporter) Alert(alert service.Alert) {
+	msg := slackMessage{
+		Text: fmt.Sprintf(":warning: *%s* on %s: %s", r.ServiceName, alert.Endpoint, alert.Message),
+	}
+	if len(alert.Owners) > 0 {
+		// Tell every team how many units it is leaking
+		var owners []string
+		for owner, count := range alert.Owners {
+			owners = append(owners, fmt.Sprintf("%s: %d", owner, count))
+		}
+		sort.Strings(owners)
+		msg.Text += fmt.Sprintf("\nObsolete units by owner: %s", strings.Join(owners, ", "))
+	}
+	if err := postJSON(r.URL, nil, msg); err != nil {
+		r.Logger.Warningf("Failed to send alert to slack: %#v", err)
+	}
+}
+
+// Alerters passes alerts to multiple alerters.
+type Alerters []service.Alerter
+
+// Alert passes the given alert to all alerters.
+func (l Alerters) Alert(alert service.Alert) {
+	for _, a := range l {
+		a.Alert(alert)
+	}
+}
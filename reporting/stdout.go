@@ -0,0 +1,73 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+type StdoutReporterConfig struct {
+	Version string
+}
+
+type StdoutReporterDependencies struct {
+	Logger *logging.Logger
+	Output io.Writer // Typically os.Stdout
+}
+
+// StdoutReporter writes alerts as a single line JSON document (the same document as sent
+// to a generic webhook) to standard output, for sites that collect the output of the tool.
+type StdoutReporter struct {
+	StdoutReporterConfig
+	StdoutReporterDependencies
+	mutex sync.Mutex
+}
+
+// NewStdoutReporter creates a new reporter that writes alerts to the given output.
+func NewStdoutReporter(config StdoutReporterConfig, deps StdoutReporterDependencies) *StdoutReporter {
+	return &StdoutReporter{
+		StdoutReporterConfig:       config,
+		StdoutReporterDependencies: deps,
+	}
+}
+
+// Alert writes the given alert to the output.
+func (r *StdoutReporter) Alert(alert service.Alert) {
+	payload := struct {
+		service.Alert
+		Type    string `json:"type"`
+		Version string `json:"version"`
+	}{
+		Alert:   alert,
+		Type:    "alert",
+		Version: r.Version,
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		r.Logger.Warningf("Failed to encode alert: %#v", err)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, err := r.Output.Write(append(raw, '\n')); err != nil {
+		r.Logger.Warningf("Failed to write alert: %#v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+const (
+	postTimeout = 10 * time.Second
+)
+
+type WebhookReporterConfig struct {
+	URL     string
+	Version string
+}
+
+type WebhookReporterDependencies struct {
+	Logger *logging.Logger
+}
+
+// WebhookReporter reports failed runs (and alerts) by posting a JSON document to a generic webhook.
+type WebhookReporter struct {
+	WebhookReporterConfig
+	WebhookReporterDependencies
+}
+
+type webhookPayload struct {
+	service.ErrorContext
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error"`
+	Details string    `json:"details,omitempty"`
+	Version string    `json:"version"`
+}
+
+// NewWebhookReporter creates a new error reporter that posts to a webhook.
+func NewWebhookReporter(config WebhookReporterConfig, deps WebhookReporterDependencies) *WebhookReporter {
+	return &WebhookReporter{
+		WebhookReporterConfig:       config,
+		WebhookReporterDependencies: deps,
+	}
+}
+
+// ReportError posts the given error to the webhook.
+func (r *WebhookReporter) ReportError(err error, ctx service.ErrorContext) {
+	payload := webhookPayload{
+		ErrorContext: ctx,
+		Time:         time.Now(),
+		Error:        err.Error(),
+		Details:      errgo.Details(err),
+		Version:      r.Version,
+	}
+	if err := postJSON(r.URL, nil, payload); err != nil {
+		r.Logger.Warningf("Failed to report error to webhook: %#v", err)
+	}
+}
+
+// Alert posts the given alert to the webhook.
+func (r *WebhookReporter) Alert(alert service.Alert) {
+	payload := struct {
+		service.Alert
+		Type    string `json:"type"`
+		Version string `json:"version"`
+	}{
+		Alert:   alert,
+		Type:    "alert",
+		Version: r.Version,
+	}
+	if err := postJSON(r.URL, nil, payload); err != nil {
+		r.Logger.Warningf("Failed to send alert to webhook: %#v", err)
+	}
+}
+
+// postJSON posts the given value as JSON to the given URL.
+func postJSON(url string, headers map[string]string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return maskAny(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return maskAny(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: postTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return maskAny(fmt.Errorf("%s returned status %d", url, resp.StatusCode))
+	}
+	return nil
+}
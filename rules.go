@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdRules = &cobra.Command{
+		Use:   "rules",
+		Short: "List all cleanup rules",
+		Run:   cmdRulesRun,
+	}
+)
+
+func init() {
+	cmdMain.AddCommand(cmdRules)
+}
+
+func cmdRulesRun(cmd *cobra.Command, args []string) {
+	f := outputFormatter()
+	rules := service.Rules()
+	out := output{
+		Value:  rules,
+		Header: []string{"RULE", "DEFAULT", "ACTION", "SEVERITY", "DESCRIPTION"},
+	}
+	for _, r := range rules {
+		enabled := "disabled"
+		if r.Enabled {
+			enabled = "enabled"
+		}
+		action := "remove"
+		if r.ReportOnly {
+			action = "report"
+		}
+		out.Rows = append(out.Rows, []string{r.Name, enabled, action, r.Severity, r.Description})
+	}
+	writeOutput(f, out)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/fleet-cleanup/service"
+)
+
+var (
+	cmdSeed = &cobra.Command{
+		Use:   "seed",
+		Short: "Populate a test etcd with a synthetic fleet registry",
+		Long: "Populate a test etcd with a synthetic fleet registry (machines, jobs with their units, leases & states)\n" +
+			"and garbage (orphaned units, stale leases, orphaned unit states & corrupt job objects),\n" +
+			"to rehearse cleanups and benchmark them before touching production.\n\n" +
+			"Refuses to write into a registry that is not empty, unless --force is given.",
+		Run: cmdSeedRun,
+	}
+	seedFlags service.SeedOptions
+)
+
+func init() {
+	cmdSeed.Flags().IntVar(&seedFlags.Machines, "machines", 3, "Number of registered machines")
+	cmdSeed.Flags().IntVar(&seedFlags.Jobs, "jobs", 100, "Number of launched jobs")
+	cmdSeed.Flags().IntVar(&seedFlags.Orphans, "orphans", 50, "Number of units that are not referenced by a job")
+	cmdSeed.Flags().IntVar(&seedFlags.StaleLeases, "stale-leases", 10, "Number of leases owned by unknown machines")
+	cmdSeed.Flags().IntVar(&seedFlags.OrphanStates, "orphan-states", 10, "Number of unit states of unknown machines & units")
+	cmdSeed.Flags().IntVar(&seedFlags.Corrupt, "corrupt", 0, "Number of jobs with a corrupt job object (no units are removed while these exist)")
+	cmdSeed.Flags().BoolVar(&seedFlags.Force, "force", false, "If set, also write into a registry that is not empty")
+	cmdMain.AddCommand(cmdSeed)
+}
+
+func cmdSeedRun(cmd *cobra.Command, args []string) {
+	if seedFlags.Machines < 0 || seedFlags.Jobs < 0 || seedFlags.Orphans < 0 || seedFlags.StaleLeases < 0 || seedFlags.OrphanStates < 0 || seedFlags.Corrupt < 0 {
+		Exitf("Counts cannot be negative")
+	}
+	svc := newTraceService()
+	result, err := svc.Seed(seedFlags)
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to seed registry: %#v", err)
+	}
+	fmt.Printf("Wrote %d keys to %s\n", result.Keys, result.Prefix)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	notifiedKey = toolPrefix + "/notified"
+)
+
+// Alert describes an unhealthy amount of garbage in the fleet registry.
+type Alert struct {
+	RunID    string    `json:"runID"`
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Message  string    `json:"message"`
+	// Number of obsolete units found in this run and in the previous run (-1 if unknown)
+	ObsoleteUnits         int `json:"obsoleteUnits"`
+	PreviousObsoleteUnits int `json:"previousObsoleteUnits"`
+	// Number of obsolete units by owner label ('label=value', or 'unknown' for units without owner labels)
+	Owners map[string]int `json:"owners,omitempty"`
+}
+
+// Alerter is notified when the amount of garbage exceeds the configured thresholds.
+type Alerter interface {
+	Alert(alert Alert)
+}
+
+// notification records the last alert that was sent.
+type notification struct {
+	Hash string    `json:"hash"` // Hash of the garbage the alert was sent for
+	Time time.Time `json:"time"`
+}
+
+// checkAlerts sends an alert when the number of obsolete units in the given summary exceeds
+// the alert threshold, or grew too fast since the previous run.
+// An alert for the same garbage as the last alert is only sent again after AlertHeartbeat.
+// Runs restricted to an explicit list of unit hashes or to a shard are ignored.
+func (s *Service) checkAlerts(summary RunSummary, candidates []candidate) {
+	if s.current.unitHashes != nil || s.Shard.enabled() {
+		return
+	}
+	previous := s.previousObsoleteUnits
+	s.previousObsoleteUnits = summary.ObsoleteUnits
+	if s.Alerts == nil {
+		return
+	}
+
+	count := summary.ObsoleteUnits
+	var message string
+	switch {
+	case s.AlertThreshold > 0 && count > s.AlertThreshold:
+		message = fmt.Sprintf("%d obsolete units found, exceeding the threshold of %d", count, s.AlertThreshold)
+	case s.AlertGrowthPercent > 0 && previous > 0 && float64(count-previous)*100/float64(previous) > s.AlertGrowthPercent:
+		message = fmt.Sprintf("%d obsolete units found, up from %d in the previous run (more than %g%% growth)", count, previous, s.AlertGrowthPercent)
+	default:
+		return
+	}
+	if !s.severityShown(ruleSeverity(RuleOrphanUnits)) {
+		s.Logger.Debugf("Alert: %s (below the minimum severity, not sent)", message)
+		return
+	}
+	hash := garbageHash(candidates)
+	if last, ok := s.lastNotification(); ok && last.Hash == hash && (s.AlertHeartbeat <= 0 || time.Since(last.Time) < s.AlertHeartbeat) {
+		s.Logger.Infof("Alert: %s (garbage unchanged since the alert at %s, not sent again)", message, last.Time.Format(time.RFC3339))
+		return
+	}
+	s.Logger.Warningf("Alert: %s", message)
+	s.saveNotification(notification{Hash: hash, Time: time.Now()})
+	s.Alerts.Alert(Alert{
+		RunID:                 s.current.id,
+		Time:                  time.Now(),
+		Endpoint:              s.EtcdURL.String(),
+		Message:               message,
+		ObsoleteUnits:         count,
+		PreviousObsoleteUnits: previous,
+		Owners:                countOwners(candidates),
+	})
+}
+
+// garbageHash returns a hash of the keys of all obsolete units in the given candidates.
+func garbageHash(candidates []candidate) string {
+	var keys []string
+	for _, c := range candidates {
+		if c.Kind == kindUnit {
+			keys = append(keys, c.Key)
+		}
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, key := range keys {
+		fmt.Fprintln(h, key)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lastNotification returns the last alert that was sent (by any instance).
+// With read-only credentials, only alerts sent by this instance are known.
+func (s *Service) lastNotification() (notification, bool) {
+	if s.AssumeReadOnly {
+		return s.notified, s.notified.Hash != ""
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), notifiedKey, nil)
+	if client.IsKeyNotFound(err) {
+		return notification{}, false
+	} else if err != nil {
+		s.Logger.Warningf("Failed to load last alert: %#v", maskEtcd(err))
+		return s.notified, s.notified.Hash != ""
+	}
+	var n notification
+	if err := json.Unmarshal([]byte(resp.Node.Value), &n); err != nil {
+		s.Logger.Warningf("Cannot parse last alert '%s': %#v", resp.Node.Value, err)
+		return notification{}, false
+	}
+	return n, true
+}
+
+// saveNotification records the given alert as the last alert that was sent.
+func (s *Service) saveNotification(n notification) {
+	s.notified = n
+	if s.AssumeReadOnly {
+		return
+	}
+	raw, err := json.Marshal(n)
+	if err != nil {
+		s.Logger.Warningf("Failed to encode last alert: %#v", err)
+		return
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), notifiedKey, string(raw), nil); err != nil {
+		s.Logger.Warningf("Failed to store last alert: %#v", maskEtcd(err))
+	}
+}
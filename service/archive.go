@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+)
+
+// ArchiveEntry is a single key (with its value) that is about to be removed.
+type ArchiveEntry struct {
+	Kind          string `json:"kind"`
+	Key           string `json:"key"`
+	Value         string `json:"value"` // Combined unit contents of all child keys for directories
+	Dir           bool   `json:"dir,omitempty"`
+	CreatedIndex  uint64 `json:"created_index"`
+	ModifiedIndex uint64 `json:"modified_index"`
+}
+
+// ArchiveRecord contains all keys that are about to be removed in a single run.
+type ArchiveRecord struct {
+	RunID   string         `json:"run_id"`
+	Time    time.Time      `json:"time"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// Archiver stores a copy of keys before they are removed.
+// When Archive returns an error, no keys are removed.
+type Archiver interface {
+	Archive(record ArchiveRecord) error
+}
+
+// archive passes the given candidates to the archiver.
+func (s *Service) archive(candidates []candidate) error {
+	record := ArchiveRecord{
+		RunID: s.current.id,
+		Time:  time.Now(),
+	}
+	for _, c := range candidates {
+		record.Entries = append(record.Entries, ArchiveEntry{
+			Kind:          c.Kind,
+			Key:           c.Key,
+			Value:         c.Value,
+			Dir:           c.Dir,
+			CreatedIndex:  c.CreatedIndex,
+			ModifiedIndex: c.ModifiedIndex,
+		})
+	}
+	if err := s.Archiver.Archive(record); err != nil {
+		return maskAny(err)
+	}
+	s.Logger.Infof("Archived %d keys", len(record.Entries))
+	return nil
+}
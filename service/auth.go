@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+)
+
+// authTransport adds an Authorization header to every request sent through it.
+type authTransport struct {
+	client.CancelableTransport
+
+	header   func() (string, error)
+	mutex    sync.Mutex
+	inflight map[*http.Request]*http.Request // Original request -> request with header
+}
+
+// newAuthTransport wraps the given transport such that the header returned by the given function is
+// added to every request.
+func newAuthTransport(t client.CancelableTransport, header func() (string, error)) *authTransport {
+	return &authTransport{
+		CancelableTransport: t,
+		header:              header,
+		inflight:            make(map[*http.Request]*http.Request),
+	}
+}
+
+// RoundTrip sends a copy of the given request with the Authorization header added.
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	value, err := t.header()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	// A RoundTripper must not modify the request, so send a copy
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		clone.Header[k] = append([]string(nil), v...)
+	}
+	clone.Header.Set("Authorization", value)
+
+	t.mutex.Lock()
+	t.inflight[req] = clone
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.inflight, req)
+		t.mutex.Unlock()
+	}()
+	return t.CancelableTransport.RoundTrip(clone)
+}
+
+// CancelRequest cancels the copy of the given request.
+func (t *authTransport) CancelRequest(req *http.Request) {
+	t.mutex.Lock()
+	clone, ok := t.inflight[req]
+	t.mutex.Unlock()
+	if ok {
+		t.CancelableTransport.CancelRequest(clone)
+	}
+}
+
+// bearerTokenFile provides a bearer token read from a file.
+// The file is read again when it has been modified, so tokens can be rotated while running as daemon.
+type bearerTokenFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+// Header returns the Authorization header value for the token in the file.
+func (f *bearerTokenFile) Header() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read bearer token file '%s'", f.path))
+	}
+	if f.token == "" || !info.ModTime().Equal(f.modTime) {
+		raw, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return "", maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read bearer token file '%s'", f.path))
+		}
+		token := strings.TrimSpace(string(raw))
+		if token == "" {
+			return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "bearer token file '%s' is empty", f.path))
+		}
+		f.token = token
+		f.modTime = info.ModTime()
+	}
+	return "Bearer " + f.token, nil
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupStore is a read-only copy of the etcd v2 store, loaded from a backup of etcd (see loadBackup).
+// Writes replayed from the WAL of a backup follow the rules of the etcd v2 store, so keys get
+// the same indexes as in the cluster the backup was taken from.
+type backupStore struct {
+	Root         *backupNode
+	CurrentIndex uint64 // etcd index
+
+	raftIndex uint64    // Index of the last raft entry in the backup
+	raftTerm  uint64    // Term of the last raft entry in the backup
+	time      time.Time // Time of the backup, used to derive the TTL of keys
+}
+
+// backupNode is a key or directory in a backupStore.
+// The exported fields match the JSON of the etcd v2 store, as saved in snapshots.
+type backupNode struct {
+	Path          string
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+	ExpireTime    time.Time
+	Value         string
+	Children      map[string]*backupNode // nil for keys
+
+	parent *backupNode
+}
+
+const (
+	backupKeysPrefix    = "/1" // Directory of the v2 keys API in the store
+	backupClusterPrefix = "/0" // Directory of the cluster membership in the store
+)
+
+var (
+	// Expire times before this time are treated as permanent (as etcd does)
+	backupMinExpireTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// newBackupStore creates an empty store, with the namespaces etcd creates.
+func newBackupStore() *backupStore {
+	s := &backupStore{Root: newBackupDir("/", 0, nil)}
+	for _, ns := range []string{backupClusterPrefix, backupKeysPrefix} {
+		s.Root.Children[path.Base(ns)] = newBackupDir(ns, 0, s.Root)
+	}
+	return s
+}
+
+// parseBackupStore parses the JSON of an etcd v2 store, as saved in snapshots.
+func parseBackupStore(raw []byte) (*backupStore, error) {
+	s := &backupStore{}
+	if err := json.Unmarshal(raw, s); err != nil {
+		return nil, maskAny(err)
+	}
+	if s.Root == nil || s.Root.Children == nil {
+		return nil, maskAny(fmt.Errorf("store has no root directory"))
+	}
+	s.Root.link()
+	return s, nil
+}
+
+func newBackupDir(p string, index uint64, parent *backupNode) *backupNode {
+	return &backupNode{Path: p, CreatedIndex: index, ModifiedIndex: index, Children: make(map[string]*backupNode), parent: parent}
+}
+
+// IsDir returns true if the node is a directory.
+func (n *backupNode) IsDir() bool {
+	return n.Children != nil
+}
+
+// IsHidden returns true if the node is not listed in its directory (its name starts with '_').
+func (n *backupNode) IsHidden() bool {
+	return strings.HasPrefix(path.Base(n.Path), "_")
+}
+
+// link sets the parent of all nodes below the given node.
+func (n *backupNode) link() {
+	for _, c := range n.Children {
+		c.parent = n
+		c.link()
+	}
+}
+
+// remove removes the node from its directory.
+func (n *backupNode) remove() {
+	if n.parent != nil && n.parent.Children[path.Base(n.Path)] == n {
+		delete(n.parent.Children, path.Base(n.Path))
+	}
+}
+
+// attached returns true if the node is still part of the store.
+func (n *backupNode) attached() bool {
+	for ; n.parent != nil; n = n.parent {
+		if n.parent.Children[path.Base(n.Path)] != n {
+			return false
+		}
+	}
+	return n.Path == "/"
+}
+
+// sortedChildren returns all children of the node, sorted by key.
+func (n *backupNode) sortedChildren() []*backupNode {
+	names := make([]string, 0, len(n.Children))
+	for name := range n.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*backupNode, 0, len(names))
+	for _, name := range names {
+		result = append(result, n.Children[name])
+	}
+	return result
+}
+
+// get returns the node at the given path, or nil if it does not exist.
+func (s *backupStore) get(p string) *backupNode {
+	n := s.Root
+	for _, name := range strings.Split(cleanStorePath(p), "/") {
+		if name == "" {
+			continue
+		}
+		if !n.IsDir() {
+			return nil
+		}
+		if n = n.Children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// cleanStorePath returns the given path as absolute, clean path.
+func cleanStorePath(p string) string {
+	return path.Clean(path.Join("/", p))
+}
+
+// readOnly returns true if the given (clean) path cannot be changed.
+func readOnlyStorePath(p string) bool {
+	return p == "/" || p == backupClusterPrefix || p == backupKeysPrefix
+}
+
+// The methods below replay writes on the store. Like etcd, a write that fails does not change the etcd index.
+// They return false when the write failed.
+
+// create creates a key or directory, optionally with a unique name in the given directory (POST),
+// or replacing an existing key (set).
+func (s *backupStore) create(p string, dir bool, value string, unique, replace bool, expireTime time.Time) bool {
+	next := s.CurrentIndex + 1
+	if unique {
+		p += fmt.Sprintf("/%020d", next)
+	}
+	p = cleanStorePath(p)
+	if readOnlyStorePath(p) {
+		return false
+	}
+	if expireTime.Before(backupMinExpireTime) {
+		expireTime = time.Time{}
+	}
+
+	// Create missing parent directories (like etcd, these are kept even when the write fails)
+	d := s.Root
+	dirName, name := path.Split(p)
+	for _, component := range strings.Split(dirName, "/") {
+		if component == "" {
+			continue
+		}
+		child, ok := d.Children[component]
+		if !ok {
+			child = newBackupDir(path.Join(d.Path, component), next, d)
+			d.Children[component] = child
+		} else if !child.IsDir() {
+			return false
+		}
+		d = child
+	}
+	if existing, ok := d.Children[name]; ok {
+		if !replace || existing.IsDir() {
+			return false
+		}
+		existing.remove()
+	}
+	n := &backupNode{Path: p, CreatedIndex: next, ModifiedIndex: next, ExpireTime: expireTime, Value: value, parent: d}
+	if dir {
+		n.Value = ""
+		n.Children = make(map[string]*backupNode)
+	}
+	d.Children[name] = n
+	s.CurrentIndex = next
+	return true
+}
+
+// set creates or replaces a key or directory. With refresh, only the TTL of an existing key is changed.
+func (s *backupStore) set(p string, dir bool, value string, refresh bool, expireTime time.Time) bool {
+	existing := s.get(p)
+	if existing == nil && !s.parentsAreDirs(p) {
+		return false
+	}
+	if refresh {
+		if existing == nil {
+			return false
+		}
+		value = existing.Value
+	}
+	return s.create(p, dir, value, false, true, expireTime)
+}
+
+// parentsAreDirs returns false if any parent of the given path is a key.
+func (s *backupStore) parentsAreDirs(p string) bool {
+	n := s.Root
+	dirName, _ := path.Split(cleanStorePath(p))
+	for _, name := range strings.Split(dirName, "/") {
+		if name == "" {
+			continue
+		}
+		if !n.IsDir() {
+			return false
+		}
+		if n = n.Children[name]; n == nil {
+			return true
+		}
+	}
+	return n.IsDir()
+}
+
+// update changes the value and TTL of an existing key, or the TTL of an existing directory.
+func (s *backupStore) update(p string, value string, refresh bool, expireTime time.Time) bool {
+	p = cleanStorePath(p)
+	n := s.get(p)
+	if readOnlyStorePath(p) || n == nil || (n.IsDir() && value != "") {
+		return false
+	}
+	if refresh {
+		value = n.Value
+	}
+	s.CurrentIndex++
+	if !n.IsDir() {
+		n.Value = value
+		n.ModifiedIndex = s.CurrentIndex
+	}
+	n.ExpireTime = expireTime
+	return true
+}
+
+// compareAndSwap changes the value and TTL of an existing key, when its value and/or modified index match.
+func (s *backupStore) compareAndSwap(p, prevValue string, prevIndex uint64, value string, expireTime time.Time) bool {
+	p = cleanStorePath(p)
+	n := s.get(p)
+	if readOnlyStorePath(p) || n == nil || n.IsDir() || !n.matches(prevValue, prevIndex) {
+		return false
+	}
+	s.CurrentIndex++
+	n.Value = value
+	n.ModifiedIndex = s.CurrentIndex
+	n.ExpireTime = expireTime
+	return true
+}
+
+// delete removes a key, or a directory when dir (empty directories) or recursive is set.
+func (s *backupStore) delete(p string, dir, recursive bool) bool {
+	p = cleanStorePath(p)
+	n := s.get(p)
+	if readOnlyStorePath(p) || n == nil {
+		return false
+	}
+	if n.IsDir() && (!(dir || recursive) || (len(n.Children) > 0 && !recursive)) {
+		return false
+	}
+	n.remove()
+	s.CurrentIndex++
+	return true
+}
+
+// compareAndDelete removes an existing key, when its value and/or modified index match.
+func (s *backupStore) compareAndDelete(p, prevValue string, prevIndex uint64) bool {
+	n := s.get(p)
+	if n == nil || n.IsDir() || !n.matches(prevValue, prevIndex) {
+		return false
+	}
+	n.remove()
+	s.CurrentIndex++
+	return true
+}
+
+// matches returns true if the value and modified index of the node match the given ones (if set).
+func (n *backupNode) matches(prevValue string, prevIndex uint64) bool {
+	return (prevValue == "" || n.Value == prevValue) && (prevIndex == 0 || n.ModifiedIndex == prevIndex)
+}
+
+// expire removes all keys and directories that expired at the given time, in order of their expire time.
+func (s *backupStore) expire(cutoff time.Time) {
+	var expiring backupNodesByExpireTime
+	var collect func(n *backupNode)
+	collect = func(n *backupNode) {
+		if !n.ExpireTime.IsZero() && !n.ExpireTime.After(cutoff) {
+			expiring = append(expiring, n)
+		}
+		for _, c := range n.Children {
+			collect(c)
+		}
+	}
+	collect(s.Root)
+	sort.Stable(expiring)
+	for _, n := range expiring {
+		if n.attached() {
+			n.remove()
+			s.CurrentIndex++
+		}
+	}
+}
+
+// backupNodesByExpireTime sorts nodes by their expire time.
+type backupNodesByExpireTime []*backupNode
+
+func (l backupNodesByExpireTime) Len() int           { return len(l) }
+func (l backupNodesByExpireTime) Less(i, j int) bool { return l[i].ExpireTime.Before(l[j].ExpireTime) }
+func (l backupNodesByExpireTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,624 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Record types in the WAL of etcd
+const (
+	walMetadataRecord = 1
+	walEntryRecord    = 2
+	walStateRecord    = 3
+	walCRCRecord      = 4
+	walSnapshotRecord = 5
+)
+
+// Types of raft entries
+const (
+	raftEntryNormal     = 0
+	raftEntryConfChange = 1
+)
+
+// Types of raft configuration changes
+const (
+	raftAddNode    = 0
+	raftRemoveNode = 1
+	raftUpdateNode = 2
+)
+
+var (
+	backupCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALCRCMismatch = errgo.New("CRC mismatch")
+)
+
+// loadBackup reads an etcd v2 backup. The backup is a data directory of etcd (or a copy made with
+// 'etcdctl backup'), from which the latest snapshot is read and all committed entries in the WAL after it
+// are replayed, a single snapshot file (*.snap), or a JSON dump of the v2 store (as contained in snapshots)
+// or of the response to a recursive GET of the keys API.
+func loadBackup(backupPath string) (*backupStore, error) {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read backup '%s'", backupPath))
+	}
+	var s *backupStore
+	if info.IsDir() {
+		s, err = loadBackupDataDir(backupPath)
+	} else if strings.HasSuffix(backupPath, ".snap") {
+		s, err = loadBackupSnapshotFile(backupPath)
+	} else {
+		s, err = loadBackupDump(backupPath)
+	}
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if s.time.IsZero() {
+		s.time = info.ModTime()
+	}
+	return s, nil
+}
+
+// loadBackupDataDir reads the latest snapshot and the WAL in an etcd data directory.
+func loadBackupDataDir(dir string) (*backupStore, error) {
+	// etcd 2.0 stored snapshots & WAL in the data directory itself, later versions in 'member'
+	var snapDir, walDir string
+	for _, base := range []string{filepath.Join(dir, "member"), dir} {
+		if isDir(filepath.Join(base, "wal")) {
+			snapDir, walDir = filepath.Join(base, "snap"), filepath.Join(base, "wal")
+			break
+		}
+	}
+	if walDir == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "'%s' is not an etcd data directory (no wal directory found)", dir))
+	}
+
+	// Latest valid snapshot
+	s := newBackupStore()
+	snapNames, _ := filepath.Glob(filepath.Join(snapDir, "*.snap"))
+	sort.Sort(sort.Reverse(sort.StringSlice(snapNames)))
+	for _, name := range snapNames {
+		loaded, err := loadBackupSnapshotFile(name)
+		if err == nil {
+			s = loaded
+			break
+		}
+		// etcd also falls back to an older snapshot when the latest one is broken
+		if !IsCorruptData(err) {
+			return nil, maskAny(err)
+		}
+	}
+
+	// Replay the WAL
+	walNames, _ := filepath.Glob(filepath.Join(walDir, "*.wal"))
+	sort.Strings(walNames)
+	if len(walNames) == 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no WAL files found in '%s'", walDir))
+	}
+	if err := s.replayWAL(walNames); err != nil {
+		return nil, maskAny(err)
+	}
+	return s, nil
+}
+
+// isDir returns true if the given path is an existing directory.
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// loadBackupSnapshotFile reads a snapshot file of etcd.
+func loadBackupSnapshotFile(name string) (*backupStore, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read snapshot '%s'", name))
+	}
+	// snappb.Snapshot
+	var crc uint64
+	var data []byte
+	err = decodeProtobuf(raw, func(field int, varint uint64, b []byte) {
+		switch field {
+		case 1:
+			crc = varint
+		case 2:
+			data = b
+		}
+	})
+	if err != nil || len(data) == 0 {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid snapshot '%s'", name))
+	}
+	if crc32.Checksum(data, backupCRCTable) != uint32(crc) {
+		return nil, maskAny(errgo.WithCausef(nil, CorruptDataError, "CRC mismatch in snapshot '%s'", name))
+	}
+	// raftpb.Snapshot
+	var storeData, metadata []byte
+	err = decodeProtobuf(data, func(field int, varint uint64, b []byte) {
+		switch field {
+		case 1:
+			storeData = b
+		case 2:
+			metadata = b
+		}
+	})
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid snapshot '%s'", name))
+	}
+	s, err := parseBackupStore(storeData)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid store in snapshot '%s'", name))
+	}
+	// raftpb.SnapshotMetadata
+	err = decodeProtobuf(metadata, func(field int, varint uint64, b []byte) {
+		switch field {
+		case 2:
+			s.raftIndex = varint
+		case 3:
+			s.raftTerm = varint
+		}
+	})
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid snapshot metadata in '%s'", name))
+	}
+	return s, nil
+}
+
+// loadBackupDump reads a JSON dump of the v2 store, or of the response to a recursive GET of the keys API.
+// Note that etcd does not list hidden keys (such as /_coreos.com), so the fleet registry is typically
+// dumped with a GET of its prefix.
+func loadBackupDump(name string) (*backupStore, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read backup '%s'", name))
+	}
+	var probe struct {
+		Root *json.RawMessage `json:"Root"`
+		Node *keysAPINode     `json:"node"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "backup '%s' is not valid JSON", name))
+	}
+	switch {
+	case probe.Root != nil:
+		s, err := parseBackupStore(raw)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid store in backup '%s'", name))
+		}
+		return s, nil
+	case probe.Node != nil:
+		s := newBackupStore()
+		p := cleanStorePath(path.Join(backupKeysPrefix, probe.Node.Key))
+		if p == backupKeysPrefix {
+			for _, n := range probe.Node.Nodes {
+				s.get(backupKeysPrefix).addDumped(n, s)
+			}
+		} else {
+			s.mkdirAll(path.Dir(p)).addDumped(probe.Node, s)
+		}
+		return s, nil
+	default:
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "'%s' is neither a store dump nor a dump of the keys API", name))
+	}
+}
+
+// mkdirAll returns the directory at the given path, creating it (and its parents) when needed.
+func (s *backupStore) mkdirAll(p string) *backupNode {
+	d := s.Root
+	for _, name := range strings.Split(cleanStorePath(p), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := d.Children[name]
+		if !ok || !child.IsDir() {
+			child = newBackupDir(path.Join(d.Path, name), 0, d)
+			d.Children[name] = child
+		}
+		d = child
+	}
+	return d
+}
+
+// keysAPINode is a node in a response of the v2 keys API.
+type keysAPINode struct {
+	Key           string         `json:"key,omitempty"`
+	Value         *string        `json:"value,omitempty"`
+	Dir           bool           `json:"dir,omitempty"`
+	Expiration    *time.Time     `json:"expiration,omitempty"`
+	TTL           int64          `json:"ttl,omitempty"`
+	Nodes         []*keysAPINode `json:"nodes,omitempty"`
+	ModifiedIndex uint64         `json:"modifiedIndex,omitempty"`
+	CreatedIndex  uint64         `json:"createdIndex,omitempty"`
+}
+
+// addDumped adds the given dumped node (and its children) to the directory.
+// The etcd index of the store is set to the highest index found.
+func (d *backupNode) addDumped(dumped *keysAPINode, s *backupStore) {
+	p := path.Join(d.Path, path.Base(dumped.Key))
+	n := &backupNode{Path: p, CreatedIndex: dumped.CreatedIndex, ModifiedIndex: dumped.ModifiedIndex, parent: d}
+	if dumped.Expiration != nil {
+		n.ExpireTime = *dumped.Expiration
+	}
+	if dumped.Dir {
+		n.Children = make(map[string]*backupNode)
+		for _, c := range dumped.Nodes {
+			n.addDumped(c, s)
+		}
+	} else if dumped.Value != nil {
+		n.Value = *dumped.Value
+	}
+	d.Children[path.Base(p)] = n
+	if n.ModifiedIndex > s.CurrentIndex {
+		s.CurrentIndex = n.ModifiedIndex
+	}
+}
+
+// raftEntry is an entry of the raft log, as stored in the WAL.
+type raftEntry struct {
+	Type  uint64
+	Term  uint64
+	Index uint64
+	Data  []byte
+}
+
+// replayWAL reads all records in the given WAL files (in order) and applies all committed entries
+// after the snapshot of the store.
+// A torn record at the end of the last file (e.g. when the backup was copied while etcd was writing)
+// ends the log.
+func (s *backupStore) replayWAL(names []string) error {
+	var entries []raftEntry
+	var commit uint64
+	var crc uint32
+	for i, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return maskAny(errgo.WithCausef(err, InvalidArgumentError, "cannot read WAL '%s'", name))
+		}
+		last := i == len(names)-1
+		err = readWALRecords(f, func(recType uint64, recCRC uint32, data []byte) error {
+			if recType == walCRCRecord {
+				if crc != 0 && recCRC != crc {
+					return errWALCRCMismatch
+				}
+				crc = recCRC
+				return nil
+			}
+			crc = crc32.Update(crc, backupCRCTable, data)
+			if recCRC != crc {
+				return errWALCRCMismatch
+			}
+			switch recType {
+			case walEntryRecord:
+				var e raftEntry
+				if err := decodeProtobuf(data, e.decodeField); err != nil {
+					return err
+				}
+				if e.Index <= s.raftIndex {
+					return nil
+				}
+				// A later entry with the same index replaces the earlier one and all entries after it
+				for len(entries) > 0 && entries[len(entries)-1].Index >= e.Index {
+					entries = entries[:len(entries)-1]
+				}
+				entries = append(entries, e)
+			case walStateRecord:
+				// raftpb.HardState
+				if err := decodeProtobuf(data, func(field int, varint uint64, b []byte) {
+					if field == 3 {
+						commit = varint
+					}
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil && !(last && (err == io.ErrUnexpectedEOF || err == errWALCRCMismatch)) {
+			return maskAny(errgo.WithCausef(err, CorruptDataError, "invalid WAL '%s'", name))
+		}
+	}
+
+	for _, e := range entries {
+		if e.Index > commit {
+			break
+		}
+		switch e.Type {
+		case raftEntryNormal:
+			if err := s.applyEntry(e.Data); err != nil {
+				return maskAny(errgo.WithCausef(err, CorruptDataError, "invalid WAL entry %d", e.Index))
+			}
+		case raftEntryConfChange:
+			if err := s.applyConfChange(e.Data); err != nil {
+				return maskAny(errgo.WithCausef(err, CorruptDataError, "invalid WAL entry %d", e.Index))
+			}
+		}
+		s.raftIndex, s.raftTerm = e.Index, e.Term
+	}
+	return nil
+}
+
+// readWALRecords calls the given function for every record in the given WAL file.
+// Returns io.ErrUnexpectedEOF when the file ends with a torn record, or the error returned by the function.
+func readWALRecords(r io.Reader, fn func(recType uint64, crc uint32, data []byte) error) error {
+	for {
+		var frame int64
+		if err := binary.Read(r, binary.LittleEndian, &frame); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if frame == 0 {
+			// Preallocated space
+			return nil
+		}
+		// The lower 56 bits hold the size of the record, a negative frame holds the padding in its upper byte
+		size := int64(uint64(frame) & ^(uint64(0xff) << 56))
+		var padding int64
+		if frame < 0 {
+			padding = int64((uint64(frame) >> 56) & 0x7)
+		}
+		buf := make([]byte, size+padding)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		// walpb.Record
+		var recType, crc uint64
+		var data []byte
+		if err := decodeProtobuf(buf[:size], func(field int, varint uint64, b []byte) {
+			switch field {
+			case 1:
+				recType = varint
+			case 2:
+				crc = varint
+			case 3:
+				data = b
+			}
+		}); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := fn(recType, uint32(crc), data); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeField decodes a field of a raftpb.Entry.
+func (e *raftEntry) decodeField(field int, varint uint64, b []byte) {
+	switch field {
+	case 1:
+		e.Type = varint
+	case 2:
+		e.Term = varint
+	case 3:
+		e.Index = varint
+	case 4:
+		e.Data = b
+	}
+}
+
+// backupRequest holds the fields of an etcdserverpb.Request needed to replay it on the v2 store.
+type backupRequest struct {
+	Method     string
+	Path       string
+	Val        string
+	Dir        bool
+	PrevValue  string
+	PrevIndex  uint64
+	PrevExist  *bool
+	Expiration int64
+	Recursive  bool
+	Time       int64
+	Refresh    bool
+}
+
+// decodeField decodes a field of an etcdserverpb.Request.
+func (r *backupRequest) decodeField(field int, varint uint64, b []byte) {
+	switch field {
+	case 2:
+		r.Method = string(b)
+	case 3:
+		r.Path = string(b)
+	case 4:
+		r.Val = string(b)
+	case 5:
+		r.Dir = varint != 0
+	case 6:
+		r.PrevValue = string(b)
+	case 7:
+		r.PrevIndex = varint
+	case 8:
+		exists := varint != 0
+		r.PrevExist = &exists
+	case 9:
+		r.Expiration = int64(varint)
+	case 12:
+		r.Recursive = varint != 0
+	case 15:
+		r.Time = int64(varint)
+	case 17:
+		r.Refresh = varint != 0
+	}
+}
+
+// applyEntry applies the request in a normal raft entry to the store, the way etcd applies it.
+// Since etcd 3.0 entries hold an etcdserverpb.InternalRaftRequest, with the v2 request in field 2 and
+// v3 requests (which do not change the v2 store) in other fields. Before that they hold the v2 request itself.
+func (s *backupStore) applyEntry(data []byte) error {
+	if len(data) == 0 {
+		// Empty entry appended by a new leader
+		return nil
+	}
+	var v2 []byte
+	isRequest := false
+	if err := decodeProtobuf(data, func(field int, varint uint64, b []byte) {
+		if field == 2 {
+			v2 = b
+			switch string(b) {
+			case "GET", "HEAD", "POST", "PUT", "DELETE", "QGET", "SYNC":
+				isRequest = true
+			}
+		}
+	}); err != nil {
+		return maskAny(err)
+	}
+	if !isRequest {
+		if v2 == nil {
+			// v3 request
+			return nil
+		}
+		data = v2
+	}
+	var r backupRequest
+	if err := decodeProtobuf(data, r.decodeField); err != nil {
+		return maskAny(err)
+	}
+	var expireTime time.Time
+	if r.Expiration != 0 {
+		expireTime = time.Unix(0, r.Expiration)
+	}
+	switch r.Method {
+	case "POST":
+		s.create(r.Path, r.Dir, r.Val, true, false, expireTime)
+	case "PUT":
+		switch {
+		case r.PrevExist != nil && *r.PrevExist && r.PrevIndex == 0 && r.PrevValue == "":
+			s.update(r.Path, r.Val, r.Refresh, expireTime)
+		case r.PrevExist != nil && *r.PrevExist:
+			s.compareAndSwap(r.Path, r.PrevValue, r.PrevIndex, r.Val, expireTime)
+		case r.PrevExist != nil:
+			s.create(r.Path, r.Dir, r.Val, false, false, expireTime)
+		case r.PrevIndex > 0 || r.PrevValue != "":
+			s.compareAndSwap(r.Path, r.PrevValue, r.PrevIndex, r.Val, expireTime)
+		default:
+			s.set(r.Path, r.Dir, r.Val, r.Refresh, expireTime)
+		}
+	case "DELETE":
+		if r.PrevIndex > 0 || r.PrevValue != "" {
+			s.compareAndDelete(r.Path, r.PrevValue, r.PrevIndex)
+		} else {
+			s.delete(r.Path, r.Dir, r.Recursive)
+		}
+	case "SYNC":
+		t := time.Unix(0, r.Time)
+		s.expire(t)
+		s.time = t
+	}
+	return nil
+}
+
+// applyConfChange applies a change of the cluster membership to the store, the way etcd records
+// members under /0/members and /0/removed_members.
+func (s *backupStore) applyConfChange(data []byte) error {
+	// raftpb.ConfChange
+	var changeType, nodeID uint64
+	var context []byte
+	if err := decodeProtobuf(data, func(field int, varint uint64, b []byte) {
+		switch field {
+		case 2:
+			changeType = varint
+		case 3:
+			nodeID = varint
+		case 4:
+			context = b
+		}
+	}); err != nil {
+		return maskAny(err)
+	}
+	memberKey := path.Join(backupClusterPrefix, "members", fmt.Sprintf("%x", nodeID))
+	removedKey := path.Join(backupClusterPrefix, "removed_members", fmt.Sprintf("%x", nodeID))
+	exists, removed := s.get(memberKey) != nil, s.get(removedKey) != nil
+	switch changeType {
+	case raftAddNode, raftUpdateNode:
+		var member struct {
+			PeerURLs []string `json:"peerURLs"`
+		}
+		if err := json.Unmarshal(context, &member); err != nil {
+			return maskAny(err)
+		}
+		raw, err := json.Marshal(member)
+		if err != nil {
+			return maskAny(err)
+		}
+		raftAttributesKey := path.Join(memberKey, "raftAttributes")
+		if changeType == raftAddNode && !exists && !removed {
+			s.create(raftAttributesKey, false, string(raw), false, false, time.Time{})
+		} else if changeType == raftUpdateNode && exists {
+			s.update(raftAttributesKey, string(raw), false, time.Time{})
+		}
+	case raftRemoveNode:
+		if exists {
+			s.delete(memberKey, true, true)
+			s.create(removedKey, false, "", false, false, time.Time{})
+		}
+	}
+	return nil
+}
+
+// decodeProtobuf calls the given function for every field in the given protobuf message.
+// Varint fields are passed as varint, length-delimited fields as b. Fixed size fields are ignored.
+func decodeProtobuf(data []byte, fn func(field int, varint uint64, b []byte)) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		key, err := binary.ReadUvarint(r)
+		if err != nil {
+			return maskAny(err)
+		}
+		field, wireType := int(key>>3), key&0x7
+		switch wireType {
+		case 0: // varint
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return maskAny(err)
+			}
+			fn(field, v, nil)
+		case 1: // 64-bit
+			if _, err := r.Seek(8, 1); err != nil {
+				return maskAny(err)
+			}
+		case 2: // length-delimited
+			l, err := binary.ReadUvarint(r)
+			if err != nil {
+				return maskAny(err)
+			}
+			if l > uint64(r.Len()) {
+				return maskAny(io.ErrUnexpectedEOF)
+			}
+			b := make([]byte, l)
+			r.Read(b)
+			fn(field, 0, b)
+		case 5: // 32-bit
+			if _, err := r.Seek(4, 1); err != nil {
+				return maskAny(err)
+			}
+		default:
+			return maskAny(fmt.Errorf("unsupported wire type %d", wireType))
+		}
+	}
+	return nil
+}
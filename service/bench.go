@@ -0,0 +1,218 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	benchPrefix = toolPrefix + "/bench"
+	// Keys left behind by an interrupted benchmark expire after this TTL
+	benchKeyTTL = time.Hour
+)
+
+// Phases of a benchmark
+const (
+	BenchPhaseWrite  = "write"  // Create the sandbox keys
+	BenchPhaseRead   = "read"   // Read every sandbox key
+	BenchPhaseScan   = "scan"   // Read the sandbox directory recursively, like a scan of the registry
+	BenchPhaseDelete = "delete" // Remove every sandbox key with a compare-and-delete, like a cleanup
+)
+
+// BenchOptions configures a benchmark.
+type BenchOptions struct {
+	Keys        int // Number of keys to write, read & delete
+	ValueSize   int // Size of every value in bytes
+	Concurrency int // Number of concurrent requests
+}
+
+// BenchResult contains the results of all phases of a benchmark.
+type BenchResult struct {
+	Prefix      string        `json:"prefix"`
+	Keys        int           `json:"keys"`
+	ValueSize   int           `json:"valueSize"`
+	Concurrency int           `json:"concurrency"`
+	Phases      []BenchPhase  `json:"phases"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// BenchPhase contains the throughput & latency of a single phase of a benchmark.
+type BenchPhase struct {
+	Name       string        `json:"name"`
+	Ops        int           `json:"ops"`
+	Errors     int           `json:"errors"`
+	Duration   time.Duration `json:"duration"`
+	OpsPerSec  float64       `json:"opsPerSec"`
+	LatencyP50 time.Duration `json:"latencyP50"`
+	LatencyP90 time.Duration `json:"latencyP90"`
+	LatencyP99 time.Duration `json:"latencyP99"`
+	LatencyMax time.Duration `json:"latencyMax"`
+}
+
+// Bench measures the read & delete throughput of etcd, using keys in a sandbox directory
+// (below the tool prefix) that is removed afterwards. The fleet registry is not touched.
+func (s *Service) Bench(opts BenchOptions) (BenchResult, error) {
+	if opts.Keys < 1 || opts.ValueSize < 0 || opts.Concurrency < 1 {
+		return BenchResult{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "keys & concurrency must be at least 1"))
+	}
+	dir := path.Join(benchPrefix, newRunID())
+	result := BenchResult{
+		Prefix:      dir,
+		Keys:        opts.Keys,
+		ValueSize:   opts.ValueSize,
+		Concurrency: opts.Concurrency,
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	defer func() {
+		if _, err := keysAPI.Delete(context.Background(), dir, &client.DeleteOptions{Recursive: true, Dir: true}); err != nil && !client.IsKeyNotFound(err) {
+			s.Logger.Warningf("Failed to remove benchmark keys at %s: %#v", dir, maskEtcd(err))
+		}
+	}()
+	key := func(i int) string { return path.Join(dir, fmt.Sprintf("%08d", i)) }
+	value := strings.Repeat("x", opts.ValueSize)
+	indexes := make([]uint64, opts.Keys)
+	start := time.Now()
+
+	phase, err := s.benchPhase(BenchPhaseWrite, opts.Keys, opts.Concurrency, func(i int) error {
+		resp, err := keysAPI.Set(context.Background(), key(i), value, &client.SetOptions{TTL: benchKeyTTL})
+		if err != nil {
+			return maskEtcd(err)
+		}
+		indexes[i] = resp.Node.ModifiedIndex
+		return nil
+	})
+	result.Phases = append(result.Phases, phase)
+	if err != nil {
+		return result, maskAny(err)
+	}
+	phase, err = s.benchPhase(BenchPhaseRead, opts.Keys, opts.Concurrency, func(i int) error {
+		_, err := keysAPI.Get(context.Background(), key(i), &client.GetOptions{Quorum: true})
+		return maskEtcd(err)
+	})
+	result.Phases = append(result.Phases, phase)
+	if err != nil {
+		return result, maskAny(err)
+	}
+	phase, err = s.benchPhase(BenchPhaseScan, 1, 1, func(i int) error {
+		_, err := keysAPI.Get(context.Background(), dir, &client.GetOptions{Recursive: true, Quorum: true})
+		return maskEtcd(err)
+	})
+	result.Phases = append(result.Phases, phase)
+	if err != nil {
+		return result, maskAny(err)
+	}
+	phase, err = s.benchPhase(BenchPhaseDelete, opts.Keys, opts.Concurrency, func(i int) error {
+		_, err := keysAPI.Delete(context.Background(), key(i), &client.DeleteOptions{PrevIndex: indexes[i]})
+		return maskEtcd(err)
+	})
+	result.Phases = append(result.Phases, phase)
+	if err != nil {
+		return result, maskAny(err)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// benchPhase performs the given operation for all indexes below n, using the given number of concurrent workers,
+// and returns its throughput & latencies. Returns an error when etcd cannot be reached or refuses access,
+// other errors are counted.
+func (s *Service) benchPhase(name string, n, concurrency int, op func(i int) error) (BenchPhase, error) {
+	var mutex sync.Mutex
+	var latencies []time.Duration
+	var fatal error
+	errors := 0
+	work := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				started := time.Now()
+				err := op(i)
+				latency := time.Since(started)
+				mutex.Lock()
+				latencies = append(latencies, latency)
+				if err != nil {
+					errors++
+					if fatal == nil && (IsEtcdUnreachable(err) || IsPermissionDenied(err)) {
+						fatal = err
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		mutex.Lock()
+		stop := fatal != nil || s.Stopping()
+		mutex.Unlock()
+		if stop {
+			break
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	duration := time.Since(start)
+
+	sort.Sort(durations(latencies))
+	phase := BenchPhase{
+		Name:       name,
+		Ops:        len(latencies),
+		Errors:     errors,
+		Duration:   duration,
+		LatencyP50: percentile(latencies, 50),
+		LatencyP90: percentile(latencies, 90),
+		LatencyP99: percentile(latencies, 99),
+		LatencyMax: percentile(latencies, 100),
+	}
+	if duration > 0 {
+		phase.OpsPerSec = float64(phase.Ops) / duration.Seconds()
+	}
+	if fatal != nil {
+		return phase, maskAny(fatal)
+	}
+	return phase, nil
+}
+
+// percentile returns the given percentile of the given sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+type durations []time.Duration
+
+func (l durations) Len() int           { return len(l) }
+func (l durations) Less(i, j int) bool { return l[i] < l[j] }
+func (l durations) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
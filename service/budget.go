@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+)
+
+// Limits of the run budget
+const (
+	budgetMaxDelete   = "max-delete"
+	budgetMaxDuration = "max-duration"
+	budgetMaxEtcdOps  = "max-etcd-ops"
+)
+
+// budgetExhausted returns the limit of the run budget (max-duration or max-etcd-ops) that the current run reached.
+// Returns an empty string while the budget allows more deletes. The maximum number of deletes is checked by skipReason.
+func (s *Service) budgetExhausted() string {
+	switch {
+	case s.MaxDuration > 0 && time.Since(s.current.started) >= s.MaxDuration:
+		return budgetMaxDuration
+	case s.MaxEtcdOps > 0 && s.requests.count()-s.current.requests >= uint64(s.MaxEtcdOps):
+		return budgetMaxEtcdOps
+	default:
+		return ""
+	}
+}
+
+// recordBudget adds the candidates that were not removed because the run budget was exhausted to the given summary.
+func (s *Service) recordBudget(candidates []candidate, summary *RunSummary) {
+	limit := ""
+	remaining := 0
+	for _, c := range candidates {
+		switch c.Skip {
+		case SkipReasonMaxDelete:
+			if limit == "" {
+				limit = budgetMaxDelete
+			}
+			remaining++
+		case SkipReasonBudgetExhausted:
+			limit = s.current.budgetLimit
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		return
+	}
+	summary.BudgetExhausted = limit
+	summary.Remaining = remaining
+	s.Logger.Warningf("Budget exhausted (%s), %d candidates remain", limit, remaining)
+}
+
+// checkBudget returns true once the run budget of the current run is exhausted.
+// The first limit that is reached is kept for the rest of the run, so all remaining candidates are skipped.
+func (s *Service) checkBudget() bool {
+	if s.current.budgetLimit == "" {
+		if limit := s.budgetExhausted(); limit != "" {
+			s.current.budgetLimit = limit
+			s.Logger.Warningf("Run budget exhausted (%s), not removing more keys", limit)
+		}
+	}
+	return s.current.budgetLimit != ""
+}
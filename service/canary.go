@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+const (
+	// DefaultCanaryObservation is the default time the registry is observed after the canary deletes
+	DefaultCanaryObservation = time.Minute
+)
+
+// CanaryResult describes the outcome of the canary deletes of a run (see ServiceConfig.Canary).
+type CanaryResult struct {
+	Removed   int           `json:"removed"`             // Number of keys removed by the canary
+	Observed  time.Duration `json:"observed"`            // Time the registry was observed after the canary deletes
+	Anomalies []string      `json:"anomalies,omitempty"` // Regressions detected after the canary deletes
+}
+
+// Failed returns true if any anomaly was detected.
+func (c CanaryResult) Failed() bool {
+	return len(c.Anomalies) > 0
+}
+
+// canary tracks the canary deletes of a run while they are in progress.
+type canary struct {
+	states  map[string]uint64 // Modified index of every unit state, before the canary deletes
+	indexes []int             // Indexes of the candidates deleted by the canary
+}
+
+// startCanary prepares the canary deletes of a run that is about to remove the given candidates.
+// Returns nil when no canary is needed: canaries are disabled, the run already had its canary,
+// or there are no more deletes than canaries.
+func (s *Service) startCanary(deletable []candidate) (*canary, error) {
+	if s.Canary <= 0 || s.current.canaryDone {
+		return nil, nil
+	}
+	deletes := 0
+	for _, c := range deletable {
+		if c.Action != ActionRestoreTTL {
+			deletes++
+		}
+	}
+	if deletes <= s.Canary {
+		return nil, nil
+	}
+	states, err := s.loadUnitStates()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	cn := &canary{states: make(map[string]uint64)}
+	for _, st := range states {
+		cn.states[st.Key] = st.ModifiedIndex
+	}
+	s.current.canaryDone = true
+	s.Logger.Infof("Removing %d of %d keys as canary first", s.Canary, deletes)
+	return cn, nil
+}
+
+// observeCanary waits for the configured observation period after the canary deletes and then checks the registry
+// for regressions. The outcome is added to the given summary. Returns true when an anomaly was detected,
+// in which case no further keys must be removed.
+func (s *Service) observeCanary(cn *canary, candidates []candidate, summary *RunSummary) (bool, error) {
+	result := &CanaryResult{}
+	var removed []candidate
+	for _, i := range cn.indexes {
+		if candidates[i].Removed {
+			removed = append(removed, candidates[i])
+		}
+	}
+	result.Removed = len(removed)
+	summary.Canary = result
+
+	s.Logger.Infof("Removed %d keys as canary, observing the registry for %s", result.Removed, s.CanaryObservation)
+	span := s.current.trace.StartChild("canary")
+	start := time.Now()
+	select {
+	case <-time.After(s.CanaryObservation):
+	case <-s.stop:
+	}
+	result.Observed = time.Since(start)
+	result.Observed -= result.Observed % time.Millisecond
+	if s.Stopping() {
+		span.End(nil)
+		return false, nil
+	}
+	anomalies, err := s.canaryAnomalies(cn, removed)
+	span.SetAttribute("anomalies", len(anomalies))
+	span.End(err)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	result.Anomalies = anomalies
+	for _, a := range anomalies {
+		s.Logger.Errorf("Canary: %s", a)
+	}
+	if result.Failed() {
+		return true, nil
+	}
+	s.Logger.Infof("No anomalies after canary, removing the remaining keys")
+	return false, nil
+}
+
+// canaryAnomalies looks for regressions after the canary removed the given keys: an unhealthy etcd cluster,
+// jobs that reference a removed unit and machines that published a state of a removed unit since the canary started.
+func (s *Service) canaryAnomalies(cn *canary, removed []candidate) ([]string, error) {
+	var anomalies []string
+	if err := s.clusterHealth(); err != nil {
+		anomalies = append(anomalies, fmt.Sprintf("etcd cluster is unhealthy: %s", err))
+	}
+
+	removedUnits := make(map[string]struct{})
+	for _, c := range removed {
+		if c.Kind == kindUnit {
+			removedUnits[path.Base(c.Key)] = struct{}{}
+		}
+	}
+	if len(removedUnits) == 0 {
+		return anomalies, nil
+	}
+	jobs, _, _, err := s.loadObjectsFromEtcd()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, j := range jobs {
+		if _, ok := removedUnits[j.Hash()]; ok {
+			anomalies = append(anomalies, fmt.Sprintf("job %s references removed unit %s", j.Name, j.Hash()))
+		}
+	}
+	states, err := s.loadUnitStates()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, st := range states {
+		if _, ok := removedUnits[st.UnitHash]; !ok {
+			continue
+		}
+		if index, ok := cn.states[st.Key]; ok && index == st.ModifiedIndex {
+			continue
+		}
+		anomalies = append(anomalies, fmt.Sprintf("machine %s published a state of removed unit %s (%s)", st.MachineID, st.UnitHash, st.Name))
+	}
+	return anomalies, nil
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+// Kinds of keys that can be removed
+const (
+	kindUnit  = "unit"
+	kindLease = "lease"
+	kindState = "unit-state"
+	kindJob   = "job"
+)
+
+// candidate is a key that was found to be garbage.
+type candidate struct {
+	Rule          string // Name of the rule that found the candidate
+	Kind          string
+	Key           string
+	Value         string
+	Job           string // Job name(s) of a unit (if known)
+	Detail        string // Additional description used in log messages
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+	Dir           bool              // Set when the key is a directory (units of some fleet versions)
+	Action        string            // Action to perform on the candidate (see Action* constants)
+	Severity      string            // See Severity* constants
+	Owners        map[string]string // Owner labels (see ServiceConfig.OwnerLabels)
+	UnitTypes     []string          // Types of the unit (see UnitType* constants, e.g. service or global)
+	Skip          string            // If set, the candidate is never removed for this reason
+	Known         bool              // Set when the candidate was already reported in the previous run
+	Retry         bool              // Set when the candidate could not be removed in a previous run
+	Removed       bool
+	Restored      bool   // Set when the TTL of the candidate was restored (see ActionRestoreTTL)
+	Error         string // Set when removing the candidate failed
+}
+
+// notRemovedReason returns the reason why the candidate was not removed (or restored), or "" when it was.
+func (c candidate) notRemovedReason() string {
+	switch {
+	case c.Removed || c.Restored:
+		return ""
+	case c.Error != "":
+		return SkipReasonDeleteFailed
+	case c.Skip != "":
+		return c.Skip
+	default:
+		return SkipReasonNotAttempted
+	}
+}
+
+// failed returns true if removing the candidate failed or timed out.
+func (c candidate) failed() bool {
+	return c.Error != "" || c.Skip == SkipReasonTimeout
+}
+
+// countSkipped returns the number of the given candidates that were not removed (or restored), by reason.
+func countSkipped(candidates []candidate) map[string]int {
+	var result map[string]int
+	for _, c := range candidates {
+		if reason := c.notRemovedReason(); reason != "" {
+			if result == nil {
+				result = make(map[string]int)
+			}
+			result[reason]++
+		}
+	}
+	return result
+}
+
+// foundCandidate completes the given candidate found by the current rule, reports it and returns it.
+func (s *Service) foundCandidate(c candidate) candidate {
+	c.Rule = s.current.rule
+	if c.Severity == "" {
+		c.Severity = ruleSeverity(c.Rule)
+	}
+	c.Owners = s.candidateOwners(c)
+	if c.Kind != kindJob {
+		c.UnitTypes = s.candidateUnitTypes(c)
+	}
+	return s.reportCandidate(c)
+}
+
+// reportCandidate reports the given candidate (unless already reported in the previous run) and returns it.
+func (s *Service) reportCandidate(c candidate) candidate {
+	c.Known = s.wasReported(c.Key)
+	if c.Known {
+		return c
+	}
+	s.emit(Event{
+		Type:          EventCandidateFound,
+		Rule:          c.Rule,
+		Kind:          c.Kind,
+		Key:           c.Key,
+		Job:           c.Job,
+		Severity:      c.Severity,
+		Owners:        c.Owners,
+		UnitTypes:     c.UnitTypes,
+		CreatedIndex:  c.CreatedIndex,
+		ModifiedIndex: c.ModifiedIndex,
+		Age:           s.indexClock.Age(c.ModifiedIndex),
+	})
+	return c
+}
+
+// describe returns a description of the candidate for use in log messages.
+func (s *Service) describe(c candidate) string {
+	details := formatIndexes(c.CreatedIndex, c.ModifiedIndex, s.indexClock.Age(c.ModifiedIndex))
+	if c.Job != "" {
+		details = fmt.Sprintf("job '%s', %s", c.Job, details)
+	}
+	if c.Detail != "" {
+		details = fmt.Sprintf("%s, %s", c.Detail, details)
+	}
+	if c.Dir {
+		details = "directory, " + details
+	}
+	return fmt.Sprintf("%s at %s (%s)", c.Kind, c.Key, details)
+}
+
+// planRemoval returns for every given candidate the reason why it will not be removed in the current run.
+// An empty reason means that the candidate will be removed.
+func (s *Service) planRemoval(candidates []candidate) []string {
+	reasons := make([]string, len(candidates))
+	if s.skipReason() == "" {
+		s.checkBudget()
+	}
+	planned := 0
+	plannedPerRule := make(map[string]int)
+	for i, c := range candidates {
+		reason := c.Skip
+		if reason == "" {
+			reason = s.skipReason()
+		}
+		if reason == "" && s.current.maxDelete > 0 && s.current.results.deletedCount()+planned >= s.current.maxDelete {
+			reason = SkipReasonMaxDelete
+		}
+		if p, ok := s.policies[c.Rule]; ok && reason == "" && p.MaxDelete > 0 && plannedPerRule[c.Rule] >= p.MaxDelete {
+			reason = SkipReasonMaxDelete
+		}
+		if reason == "" {
+			planned++
+			plannedPerRule[c.Rule]++
+		}
+		reasons[i] = reason
+	}
+	return reasons
+}
+
+// removeCandidates archives and then removes all given candidates (as far as allowed
+// in the current run). Candidates that are not removed are reported as skipped.
+// Removed candidates are marked as such. Vetoed candidates are never removed, and when annotating
+// (see ServiceConfig.AnnotateTTL) a marker is stored for every candidate instead of removing it.
+// With a canary (see ServiceConfig.Canary), the remaining candidates are only removed when no anomalies
+// were found after removing the first ones.
+func (s *Service) removeCandidates(candidates []candidate, summary *RunSummary) (err error) {
+	results := s.current.results
+	if err := s.skipVetoedCandidates(candidates); err != nil {
+		return maskAny(err)
+	}
+	reasons := s.planRemoval(candidates)
+
+	if s.current.planning {
+		// Add to plan instead of removing
+		for i, c := range candidates {
+			if reasons[i] == "" {
+				s.current.plan = append(s.current.plan, newPlanEntry(c))
+				reasons[i] = SkipReasonPlanned
+			}
+		}
+	} else if s.AnnotateTTL > 0 {
+		// Store a marker instead of removing
+		for i, c := range candidates {
+			if reasons[i] != "" {
+				continue
+			}
+			if err := s.annotateCandidate(c); err != nil {
+				return maskAny(err)
+			}
+			s.Logger.Debugf("Annotated obsolete %s", s.describe(c))
+			reasons[i] = SkipReasonAnnotated
+		}
+	} else if err := s.skipReferencedUnits(candidates, reasons); err != nil {
+		return maskAny(err)
+	}
+
+	// Archive everything we are about to remove
+	var deletable []candidate
+	for i, c := range candidates {
+		if reasons[i] == "" {
+			deletable = append(deletable, c)
+		}
+	}
+	if len(deletable) > 0 && s.Archiver != nil {
+		span := s.startPhase("archive")
+		err := s.archive(deletable)
+		span.SetAttribute("keys", len(deletable))
+		span.End(err)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	cn, err := s.startCanary(deletable)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	span := s.startPhase("delete")
+	defer func() {
+		results.flush(summary)
+		span.SetAttribute("removed", summary.RemovedUnits+summary.RemovedLeases+summary.RemovedStates)
+		span.End(err)
+	}()
+	var timedOut []int
+	canaryFailed := false
+	lockLost := 0
+	for i, c := range candidates {
+		if reasons[i] == "" && c.Action != ActionRestoreTTL {
+			if cn != nil && len(cn.indexes) == s.Canary {
+				failed, err := s.observeCanary(cn, candidates, summary)
+				if err != nil {
+					return maskAny(err)
+				}
+				canaryFailed, cn = failed, nil
+			}
+			if canaryFailed {
+				reasons[i] = SkipReasonCanaryFailed
+			} else {
+				s.waitForPacer(summary)
+			}
+		}
+		if reasons[i] == "" && s.runLockLost() {
+			// Another run took over the lock, leave the remaining keys to that run
+			s.current.locked = true
+			reasons[i] = SkipReasonLocked
+			lockLost++
+		}
+		if reasons[i] == "" && (s.Stopping() || !s.IsLeader() || s.checkBudget()) {
+			// Finish the delete in progress, but do not start new ones
+			reasons[i] = s.skipReason()
+		}
+		if reason := reasons[i]; reason != "" {
+			candidates[i].Skip = reason
+			s.Logger.Debugf("Obsolete %s", s.describe(c))
+			if !c.Known {
+				s.emit(Event{Type: EventSkipped, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Job: c.Job, Action: c.Action, Reason: reason, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+			}
+			continue
+		}
+		if c.Action == ActionRestoreTTL {
+			s.Logger.Debugf("Restoring TTL of %s", s.describe(c))
+			if err := s.restoreTTL(&candidates[i], results); err != nil {
+				return maskAny(err)
+			}
+			continue
+		}
+		if cn != nil {
+			cn.indexes = append(cn.indexes, i)
+		}
+		start := time.Now()
+		if c.Action == ActionSoftDelete {
+			s.Logger.Debugf("Moving obsolete %s to trash", s.describe(c))
+			if err := s.trashKey(c); err != nil {
+				s.observeDelete(start, true)
+				s.Logger.Errorf("Failed to move %s at %s to trash: %#v", c.Kind, c.Key, err)
+				s.emit(Event{Type: EventError, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Message: err.Error(), Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+				candidates[i].Error = err.Error()
+				results.failed(candidates[i])
+				if IsEtcdUnreachable(err) {
+					return maskAny(err)
+				}
+				continue
+			}
+		} else {
+			s.Logger.Debugf("Removing obsolete %s", s.describe(c))
+		}
+		// Only remove the key when it has not been modified since it was found
+		if err := s.deleteKey(&candidates[i], results); err != nil {
+			return maskAny(err)
+		}
+		s.observeDelete(start, candidates[i].failed())
+		if candidates[i].Skip == SkipReasonTimeout {
+			timedOut = append(timedOut, i)
+		}
+	}
+
+	if canaryFailed {
+		return maskAny(errgo.WithCausef(nil, CanaryFailedError, "%d anomalies detected after removing %d keys as canary", len(summary.Canary.Anomalies), summary.Canary.Removed))
+	}
+	if lockLost > 0 {
+		return maskAny(errgo.WithCausef(nil, RunLockedError, "run lock was taken over by another run, %d keys were not removed", lockLost))
+	}
+
+	// Retry deletes that timed out, now that all other deletes are done
+	for _, i := range timedOut {
+		s.waitForPacer(summary)
+		if s.Stopping() || !s.IsLeader() || s.checkBudget() || s.runLockLost() {
+			break
+		}
+		c := &candidates[i]
+		s.Logger.Infof("Retrying remove of %s at %s after timeout", c.Kind, c.Key)
+		c.Skip = ""
+		start := time.Now()
+		if err := s.deleteKey(c, results); err != nil {
+			return maskAny(err)
+		}
+		s.observeDelete(start, c.failed())
+	}
+	return nil
+}
+
+// skipReferencedUnits sets the skip reason of all units (about to be removed) that are referenced
+// by a job that was created after the units were found to be obsolete.
+// Fleet does not modify a unit when a job with the same unit is created, so this is not detected when removing the unit.
+func (s *Service) skipReferencedUnits(candidates []candidate, reasons []string) error {
+	check := false
+	for i, c := range candidates {
+		if reasons[i] == "" && c.Kind == kindUnit {
+			check = true
+			break
+		}
+	}
+	if !check {
+		return nil
+	}
+	span := s.startPhase("check-references")
+	jobs, corrupt, _, err := s.loadObjectsFromEtcd()
+	span.End(err)
+	if err != nil {
+		return maskAny(err)
+	}
+	if len(corrupt) > 0 {
+		// The corrupt objects may refer to any of the units
+		s.Logger.Warningf("%d job object(s) cannot be parsed, not removing obsolete units", len(corrupt))
+		for i, c := range candidates {
+			if reasons[i] == "" && c.Kind == kindUnit {
+				reasons[i] = SkipReasonCorruptJobs
+			}
+		}
+		return nil
+	}
+	referenced := make(map[string]struct{})
+	for _, j := range jobs {
+		referenced[j.Hash()] = struct{}{}
+	}
+	for i, c := range candidates {
+		if reasons[i] != "" || c.Kind != kindUnit {
+			continue
+		}
+		if _, ok := referenced[path.Base(c.Key)]; ok {
+			s.Logger.Warningf("Obsolete unit at %s is referenced again, not removing it", c.Key)
+			reasons[i] = SkipReasonReferenced
+		}
+	}
+	return nil
+}
+
+// trashKey stores a copy of the given candidate in the trash, where it expires after the configured TTL.
+func (s *Service) trashKey(c candidate) error {
+	keysAPI := client.NewKeysAPI(s.client)
+	key := path.Join(trashPrefix, s.current.id, c.Key)
+	if _, err := keysAPI.Set(context.Background(), key, c.Value, &client.SetOptions{TTL: s.TrashTTL}); err != nil {
+		return maskEtcd(err)
+	}
+	return nil
+}
+
+// deleteKey removes the key of the given candidate, marking it as removed on success.
+// If the candidate has a modified index, the key is only removed when it has not been modified since
+// that index, a modified key is skipped as resurrected. Keys that no longer exist are skipped. Directories are removed recursively (see deleteDir).
+// A delete that takes longer than the configured delete timeout is skipped, so it does not hold up other deletes.
+// The outcome is recorded in the given collector, a failed delete is logged as well. An error is only
+// returned when etcd cannot be reached or refuses access, since further deletes would fail as well.
+func (s *Service) deleteKey(c *candidate, results *resultCollector) error {
+	keysAPI := client.NewKeysAPI(s.client)
+	ctx := context.Background()
+	if s.DeleteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DeleteTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	var resp *client.Response
+	var err error
+	if c.Dir {
+		resp, err = s.deleteDir(ctx, *c)
+	} else {
+		resp, err = keysAPI.Delete(ctx, c.Key, &client.DeleteOptions{PrevIndex: c.ModifiedIndex})
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// The delete may still be applied, in which case a retry finds the key gone
+		s.Logger.Warningf("Remove of %s at %s timed out after %s, skipping it", c.Kind, c.Key, time.Since(started))
+		s.emit(Event{Type: EventSkipped, Kind: c.Kind, Key: c.Key, Reason: SkipReasonTimeout, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Skip = SkipReasonTimeout
+		return nil
+	}
+	if c.ModifiedIndex != 0 && client.IsKeyNotFound(err) {
+		s.Logger.Infof("Obsolete %s at %s no longer exists", c.Kind, c.Key)
+		s.emit(Event{Type: EventSkipped, Kind: c.Kind, Key: c.Key, Reason: SkipReasonGone, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Skip = SkipReasonGone
+		return nil
+	}
+	if e, ok := err.(client.Error); ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeNotFile) {
+		// A key that is no longer a plain value (ErrorCodeNotFile) has been replaced by a directory
+		if c.Retry {
+			// Changed since it failed to be removed, leave it to the rules to find it again
+			s.Logger.Infof("Obsolete %s at %s was modified after index %d, not retrying", c.Kind, c.Key, c.ModifiedIndex)
+			s.emit(Event{Type: EventSkipped, Kind: c.Kind, Key: c.Key, Reason: SkipReasonModified, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+			c.Skip = SkipReasonModified
+			return nil
+		}
+		// Changed since it was found (e.g. a job with the same unit was submitted again), so it may no longer be garbage
+		s.Logger.Warningf("Obsolete %s at %s was modified after index %d, skipping it", c.Kind, c.Key, c.ModifiedIndex)
+		s.emit(Event{Type: EventSkipped, Kind: c.Kind, Key: c.Key, Reason: SkipReasonResurrected, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Skip = SkipReasonResurrected
+		return nil
+	}
+	if err != nil {
+		err = maskEtcd(err)
+		if IsPermissionDenied(err) {
+			err = errgo.WithCausef(err, PermissionDeniedError, "etcd refused to remove %s at %s, the credentials appear to be read-only", c.Kind, c.Key)
+		}
+		s.Logger.Errorf("Failed to remove %s at %s: %#v", c.Kind, c.Key, err)
+		s.emit(Event{Type: EventError, Kind: c.Kind, Key: c.Key, Message: err.Error(), Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Error = err.Error()
+		results.failed(*c)
+		if IsEtcdUnreachable(err) || IsPermissionDenied(err) {
+			// Further deletes would fail as well
+			return maskAny(err)
+		}
+		return nil
+	}
+	s.emit(Event{Type: EventDeleted, Kind: c.Kind, Key: c.Key, Dir: c.Dir, Message: fmt.Sprintf("etcd %s at index %d", resp.Action, resp.Index), Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+	c.Removed = true
+	results.removed(*c)
+	return nil
+}
+
+// deleteDir removes the directory of the given candidate recursively.
+// etcd does not support a compare-and-delete of directories, so the directory is read (with quorum) first
+// and only removed when it is still a directory and none of its keys were modified since the candidate's
+// modified index. This is not atomic: the recursive delete is unconditional, so keys written to the directory
+// between the read and the delete are removed as well, without being reported as resurrected.
+// A failed check is returned as an etcd 'compare failed' error, like a failed compare-and-delete of a key.
+func (s *Service) deleteDir(ctx context.Context, c candidate) (*client.Response, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(ctx, c.Key, &client.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Node.Dir || (c.ModifiedIndex != 0 && maxModifiedIndex(resp.Node) > c.ModifiedIndex) {
+		return nil, client.Error{Code: client.ErrorCodeTestFailed, Message: "Compare failed", Cause: c.Key, Index: resp.Index}
+	}
+	return keysAPI.Delete(ctx, c.Key, &client.DeleteOptions{Dir: true, Recursive: true})
+}
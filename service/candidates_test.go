@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// fakeResponse is a canned response of fakeKeysTransport.
+type fakeResponse struct {
+	status int
+	body   interface{}
+}
+
+// fakeKeysTransport answers keys API requests with a canned response per HTTP method,
+// after the given delay, and records the methods of all requests.
+type fakeKeysTransport struct {
+	mutex     sync.Mutex
+	delay     time.Duration
+	responses map[string]fakeResponse
+	methods   []string
+}
+
+func (t *fakeKeysTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	t.methods = append(t.methods, req.Method)
+	r, ok := t.responses[req.Method]
+	t.mutex.Unlock()
+	if !ok {
+		r = fakeResponse{http.StatusInternalServerError, etcdErrorBody{ErrorCode: 300, Message: "unexpected " + req.Method}}
+	}
+	time.Sleep(t.delay)
+	raw, err := json.Marshal(r.body)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Etcd-Index", "30")
+	return &http.Response{
+		StatusCode: r.status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(raw)),
+		Request:    req,
+	}, nil
+}
+
+func (t *fakeKeysTransport) CancelRequest(req *http.Request) {}
+
+func (t *fakeKeysTransport) count(method string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := 0
+	for _, m := range t.methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeleteKeyOutcomes(t *testing.T) {
+	const key = defaultFleetPrefix + "/unit/0100"
+	deleted := fakeResponse{http.StatusOK, map[string]interface{}{"action": "delete", "node": map[string]interface{}{"key": key, "modifiedIndex": 30}}}
+	keyNotFound := fakeResponse{http.StatusNotFound, etcdErrorBody{ErrorCode: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}}
+	testFailed := fakeResponse{http.StatusPreconditionFailed, etcdErrorBody{ErrorCode: client.ErrorCodeTestFailed, Message: "Compare failed", Cause: key}}
+	notFile := fakeResponse{http.StatusForbidden, etcdErrorBody{ErrorCode: client.ErrorCodeNotFile, Message: "Not a file", Cause: key}}
+	unauthorized := fakeResponse{http.StatusUnauthorized, etcdErrorBody{ErrorCode: client.ErrorCodeUnauthorized, Message: "The request requires user authentication"}}
+	dir := func(modifiedIndex uint64) fakeResponse {
+		return fakeResponse{http.StatusOK, map[string]interface{}{"action": "get", "node": map[string]interface{}{
+			"key": key, "dir": true, "modifiedIndex": 10,
+			"nodes": []interface{}{map[string]interface{}{"key": key + "/object", "value": "x", "modifiedIndex": modifiedIndex}},
+		}}}
+	}
+	file := fakeResponse{http.StatusOK, map[string]interface{}{"action": "get", "node": map[string]interface{}{"key": key, "value": "x", "modifiedIndex": 10}}}
+
+	tests := []struct {
+		name      string
+		dir       bool
+		retry     bool
+		delay     time.Duration
+		responses map[string]fakeResponse
+		skip      string
+		removed   bool
+		failed    bool
+		err       func(error) bool
+		deletes   int
+	}{
+		{name: "removed", responses: map[string]fakeResponse{"DELETE": deleted}, removed: true, deletes: 1},
+		{name: "timeout", delay: 200 * time.Millisecond, responses: map[string]fakeResponse{"DELETE": deleted}, skip: SkipReasonTimeout, deletes: 1},
+		{name: "gone", responses: map[string]fakeResponse{"DELETE": keyNotFound}, skip: SkipReasonGone, deletes: 1},
+		{name: "resurrected", responses: map[string]fakeResponse{"DELETE": testFailed}, skip: SkipReasonResurrected, deletes: 1},
+		{name: "replaced by directory", responses: map[string]fakeResponse{"DELETE": notFile}, skip: SkipReasonResurrected, deletes: 1},
+		{name: "modified after failed delete", retry: true, responses: map[string]fakeResponse{"DELETE": testFailed}, skip: SkipReasonModified, deletes: 1},
+		{name: "permission denied", responses: map[string]fakeResponse{"DELETE": unauthorized}, failed: true, err: IsPermissionDenied, deletes: 1},
+		{name: "dir removed", dir: true, responses: map[string]fakeResponse{"GET": dir(10), "DELETE": deleted}, removed: true, deletes: 1},
+		{name: "dir gone", dir: true, responses: map[string]fakeResponse{"GET": keyNotFound}, skip: SkipReasonGone},
+		{name: "dir modified", dir: true, responses: map[string]fakeResponse{"GET": dir(20), "DELETE": deleted}, skip: SkipReasonResurrected},
+		{name: "dir replaced by key", dir: true, responses: map[string]fakeResponse{"GET": file, "DELETE": deleted}, skip: SkipReasonResurrected},
+	}
+
+	dump := writeRegistryDump(t, nil)
+	defer os.Remove(dump)
+	for _, test := range tests {
+		s, err := NewService(ServiceConfig{
+			EtcdURL:       url.URL{Scheme: "http", Host: "127.0.0.1:2379"},
+			EtcdTransport: TransportConfig{OfflineBackup: dump},
+			DeleteTimeout: 50 * time.Millisecond,
+		}, ServiceDependencies{})
+		if err != nil {
+			t.Fatalf("failed to create service: %#v", err)
+		}
+		transport := &fakeKeysTransport{delay: test.delay, responses: test.responses}
+		s.client, err = client.New(client.Config{Endpoints: []string{"http://127.0.0.1:2379"}, Transport: transport})
+		if err != nil {
+			t.Fatalf("failed to create client: %#v", err)
+		}
+
+		c := candidate{Kind: kindUnit, Key: key, ModifiedIndex: 10, Dir: test.dir, Retry: test.retry}
+		results := newResultCollector()
+		err = s.deleteKey(&c, results)
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: expected no error, got %#v", test.name, err)
+		case test.err != nil && !test.err(err):
+			t.Errorf("%s: expected a typed error, got %#v", test.name, err)
+		}
+		if c.Skip != test.skip {
+			t.Errorf("%s: expected skip reason '%s', got '%s'", test.name, test.skip, c.Skip)
+		}
+		if c.Removed != test.removed {
+			t.Errorf("%s: expected removed=%v, got %v", test.name, test.removed, c.Removed)
+		}
+		if failed := c.Error != ""; failed != test.failed {
+			t.Errorf("%s: expected failed=%v, got %v (%s)", test.name, test.failed, failed, c.Error)
+		}
+		if n := transport.count("DELETE"); n != test.deletes {
+			t.Errorf("%s: expected %d delete requests, got %d", test.name, test.deletes, n)
+		}
+		if test.dir && transport.count("GET") != 1 {
+			t.Errorf("%s: expected the directory to be read before it is removed", test.name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+)
+
+// resultCollector collects the outcome of removing (or restoring) candidates during a run.
+// It is safe for concurrent use, so candidates can be removed by multiple goroutines without
+// losing counts. The collected counts are added to a run summary by flush.
+type resultCollector struct {
+	mutex   sync.Mutex
+	deleted int            // Number of keys removed or restored in the run (never reset)
+	pending RunSummary     // Counts that have not been added to a summary yet
+	rules   map[string]int // Number of removed keys by rule that have not been added to a summary yet
+}
+
+// newResultCollector creates an empty result collector.
+func newResultCollector() *resultCollector {
+	return &resultCollector{
+		rules: make(map[string]int),
+	}
+}
+
+// removed records that the key of the given candidate was removed.
+func (rc *resultCollector) removed(c candidate) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.deleted++
+	rc.rules[c.Rule]++
+	switch c.Kind {
+	case kindUnit:
+		rc.pending.RemovedUnits++
+	case kindLease:
+		rc.pending.RemovedLeases++
+	case kindState:
+		rc.pending.RemovedStates++
+	}
+}
+
+// restored records that the TTL of the key of the given candidate was restored.
+func (rc *resultCollector) restored(c candidate) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.deleted++
+	rc.pending.RestoredTTLs++
+}
+
+// failed records that removing (or restoring) the key of the given candidate failed.
+func (rc *resultCollector) failed(c candidate) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.pending.FailedDeletes++
+}
+
+// deletedCount returns the number of keys removed or restored in the run so far.
+func (rc *resultCollector) deletedCount() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.deleted
+}
+
+// flush adds all counts collected since the previous flush to the given summary.
+func (rc *resultCollector) flush(summary *RunSummary) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	summary.RemovedUnits += rc.pending.RemovedUnits
+	summary.RemovedLeases += rc.pending.RemovedLeases
+	summary.RemovedStates += rc.pending.RemovedStates
+	summary.RestoredTTLs += rc.pending.RestoredTTLs
+	summary.FailedDeletes += rc.pending.FailedDeletes
+	for name, count := range rc.rules {
+		if rs := summary.rule(name); rs != nil {
+			rs.Removed += count
+		}
+	}
+	rc.pending = RunSummary{}
+	rc.rules = make(map[string]int)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestResultCollectorConcurrent(t *testing.T) {
+	const workers = 8
+	const perWorker = 500
+
+	rc := newResultCollector()
+	summary := RunSummary{Rules: []RuleResult{{Name: RuleOrphanUnits}, {Name: RuleStaleLeases}}}
+	var summaryMutex sync.Mutex
+	flush := func() {
+		summaryMutex.Lock()
+		defer summaryMutex.Unlock()
+		rc.flush(&summary)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				rc.removed(candidate{Rule: RuleOrphanUnits, Kind: kindUnit})
+				rc.removed(candidate{Rule: RuleStaleLeases, Kind: kindLease})
+				rc.restored(candidate{Rule: RuleMissingTTL, Kind: kindMachine})
+				rc.failed(candidate{Rule: RuleOrphanUnits, Kind: kindUnit})
+				if i%50 == 0 {
+					flush()
+					rc.deletedCount()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	flush()
+
+	const total = workers * perWorker
+	if summary.RemovedUnits != total || summary.RemovedLeases != total || summary.RestoredTTLs != total || summary.FailedDeletes != total {
+		t.Errorf("expected %d removed units, removed leases, restored TTLs & failed deletes, got %d, %d, %d & %d",
+			total, summary.RemovedUnits, summary.RemovedLeases, summary.RestoredTTLs, summary.FailedDeletes)
+	}
+	if n := summary.rule(RuleOrphanUnits).Removed; n != total {
+		t.Errorf("expected %d removed keys of rule %s, got %d", total, RuleOrphanUnits, n)
+	}
+	if n := summary.rule(RuleStaleLeases).Removed; n != total {
+		t.Errorf("expected %d removed keys of rule %s, got %d", total, RuleStaleLeases, n)
+	}
+	if n := rc.deletedCount(); n != 3*total {
+		t.Errorf("expected %d deleted keys, got %d", 3*total, n)
+	}
+
+	// Counts are only added once
+	rc.flush(&summary)
+	if summary.RemovedUnits != total {
+		t.Errorf("expected %d removed units after second flush, got %d", total, summary.RemovedUnits)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+// Delta reporting: when enabled, garbage that was already reported in the previous run is not
+// reported again. Garbage that disappeared since the previous run is reported instead.
+
+// wasReported returns true when delta reporting is enabled and the given key was
+// reported as garbage in the previous run.
+func (s *Service) wasReported(key string) bool {
+	if !s.ReportDelta || s.reported == nil {
+		return false
+	}
+	_, ok := s.reported[key]
+	return ok
+}
+
+// reportGone reports all garbage of the previous run that is no longer found.
+func (s *Service) reportGone(candidates []candidate, summary *RunSummary) {
+	if !s.ReportDelta || s.reported == nil {
+		return
+	}
+	current := make(map[string]struct{})
+	for _, c := range candidates {
+		current[c.Key] = struct{}{}
+	}
+	for key, c := range s.reported {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		summary.GoneCandidates++
+		s.emit(Event{Type: EventCandidateGone, Kind: c.Kind, Key: c.Key, Job: c.Job, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+	}
+}
+
+// rememberReported remembers all given candidates that have not been removed,
+// such that they are not reported again in the next run.
+func (s *Service) rememberReported(candidates []candidate) {
+	if !s.ReportDelta {
+		return
+	}
+	s.reported = make(map[string]candidate)
+	for _, c := range candidates {
+		if !c.Removed {
+			s.reported[c.Key] = c
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Every registry that was cleaned is recorded under this directory (see recordRegistry), since registries
+	// below a hidden key (e.g. /_coreos.com) cannot be found by listing the etcd root.
+	registriesPrefix = toolPrefix + "/registries"
+)
+
+// Sources of a discovered registry
+const (
+	RegistrySourceWellKnown = "well-known" // The prefix used by fleet itself
+	RegistrySourceRecorded  = "recorded"   // Recorded by an earlier run (see registriesPrefix)
+	RegistrySourceScan      = "scan"       // Found by listing the etcd root
+)
+
+// wellKnownPrefixes are the fleet prefixes that are always checked.
+var wellKnownPrefixes = []string{defaultFleetPrefix}
+
+// registryDirs are the names of the directories of a fleet registry (with the default path templates).
+var registryDirs = []string{"job", "unit", "machines", "lease", "states"}
+
+// DiscoveredRegistry is a fleet registry found by DiscoverRegistries.
+type DiscoveredRegistry struct {
+	Registry   RegistryConfig `json:"registry"`
+	Sources    []string       `json:"sources"`              // How the registry was found (see RegistrySource* constants)
+	Configured bool           `json:"configured,omitempty"` // Set for the registry the service is configured for
+	Jobs       int            `json:"jobs"`
+	Units      int            `json:"units"`
+	Machines   int            `json:"machines"`
+}
+
+// DiscoverRegistries returns all fleet registries in etcd, sorted by prefix.
+// It checks the well-known fleet prefix, the registries recorded by earlier runs and all visible directories
+// (and their subdirectories) in the etcd root that look like a fleet registry.
+// Registries below another hidden key (starting with '_') are only found when they were recorded.
+func (s *Service) DiscoverRegistries() ([]DiscoveredRegistry, error) {
+	found := make(map[string]*DiscoveredRegistry)
+	add := func(config RegistryConfig, source string) {
+		if config.Prefix == "" {
+			config.Prefix = defaultFleetPrefix
+		}
+		if r, ok := found[config.Prefix]; ok {
+			r.Sources = appendUnique(r.Sources, source)
+			if r.Registry.UnitPathTemplate == "" && r.Registry.JobPathTemplate == "" {
+				// Recorded path templates win over the defaults assumed for other sources
+				r.Registry = config
+			}
+			return
+		}
+		found[config.Prefix] = &DiscoveredRegistry{Registry: config, Sources: []string{source}}
+	}
+	for _, prefix := range wellKnownPrefixes {
+		add(RegistryConfig{Prefix: prefix}, RegistrySourceWellKnown)
+	}
+	recorded, err := s.recordedRegistries()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, config := range recorded {
+		add(config, RegistrySourceRecorded)
+	}
+	scanned, err := s.scanRootForRegistries()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, prefix := range scanned {
+		add(RegistryConfig{Prefix: prefix}, RegistrySourceScan)
+	}
+
+	result := []DiscoveredRegistry{}
+	keysAPI := client.NewKeysAPI(s.client)
+	for _, r := range found {
+		paths, err := newRegistryPaths(r.Registry)
+		if err != nil {
+			s.Logger.Warningf("Ignoring invalid registry at %s: %#v", r.Registry.Prefix, err)
+			continue
+		}
+		counts := make([]int, 3)
+		exists := false
+		for i, dir := range []string{paths.job, paths.unit, paths.machines} {
+			resp, err := keysAPI.Get(context.Background(), dir, nil)
+			if client.IsKeyNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, maskEtcd(err)
+			}
+			exists = true
+			counts[i] = len(resp.Node.Nodes)
+		}
+		if !exists {
+			s.registryLogger.Debugf("No fleet registry at %s", r.Registry.Prefix)
+			continue
+		}
+		r.Jobs, r.Units, r.Machines = counts[0], counts[1], counts[2]
+		r.Configured = paths.fleet == s.paths.fleet
+		result = append(result, *r)
+	}
+	sort.Sort(discoveredRegistriesByPrefix(result))
+	return result, nil
+}
+
+// recordedRegistries returns the registries recorded by earlier runs.
+// A recorded value is either the JSON encoded RegistryConfig or just the prefix.
+func (s *Service) recordedRegistries() ([]RegistryConfig, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), registriesPrefix, &client.GetOptions{Sort: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskEtcd(err)
+	}
+	var result []RegistryConfig
+	for _, n := range resp.Node.Nodes {
+		var config RegistryConfig
+		value := strings.TrimSpace(n.Value)
+		if strings.HasPrefix(value, "{") {
+			if err := json.Unmarshal([]byte(value), &config); err != nil {
+				s.Logger.Warningf("Failed to parse recorded registry '%s' at %s: %#v", n.Value, n.Key, err)
+				continue
+			}
+		} else {
+			config.Prefix = value
+		}
+		if config.Prefix == "" {
+			continue
+		}
+		result = append(result, config)
+	}
+	return result, nil
+}
+
+// scanRootForRegistries returns the prefixes of all visible directories (and their subdirectories) in the
+// etcd root that look like a fleet registry.
+func (s *Service) scanRootForRegistries() ([]string, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	list := func(dir string) ([]*client.Node, error) {
+		resp, err := keysAPI.Get(context.Background(), dir, &client.GetOptions{Sort: true})
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, maskEtcd(err)
+		}
+		return resp.Node.Nodes, nil
+	}
+	roots, err := list("/")
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []string
+	for _, root := range roots {
+		if !root.Dir {
+			continue
+		}
+		children, err := list(root.Key)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		if looksLikeRegistry(children) {
+			result = append(result, root.Key)
+		}
+		for _, c := range children {
+			if !c.Dir {
+				continue
+			}
+			grandChildren, err := list(c.Key)
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			if looksLikeRegistry(grandChildren) {
+				result = append(result, c.Key)
+			}
+		}
+	}
+	return result, nil
+}
+
+// looksLikeRegistry returns true when at least two of the given nodes are directories of a fleet registry.
+func looksLikeRegistry(nodes []*client.Node) bool {
+	matches := 0
+	for _, n := range nodes {
+		if !n.Dir {
+			continue
+		}
+		for _, name := range registryDirs {
+			if path.Base(n.Key) == name {
+				matches++
+			}
+		}
+	}
+	return matches >= 2
+}
+
+// recordRegistry records the registry of the service, so DiscoverRegistries finds it later.
+// The well-known registry is not recorded, and a registry is recorded once per process.
+// Nothing is recorded with read-only credentials or when creating a plan.
+func (s *Service) recordRegistry() error {
+	if s.registryRecorded || s.AssumeReadOnly || s.current.planning {
+		return nil
+	}
+	config := s.Registry
+	if config.Prefix == "" {
+		config.Prefix = defaultFleetPrefix
+	}
+	defaultUnits := config.UnitPathTemplate == "" || config.UnitPathTemplate == defaultUnitPathTemplate
+	defaultJobs := config.JobPathTemplate == "" || config.JobPathTemplate == defaultJobPathTemplate
+	if config.Prefix == defaultFleetPrefix && defaultUnits && defaultJobs {
+		s.registryRecorded = true
+		return nil
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	key := path.Join(registriesPrefix, url.QueryEscape(config.Prefix))
+	if _, err := keysAPI.Set(context.Background(), key, string(raw), nil); err != nil {
+		return maskEtcd(err)
+	}
+	s.registryRecorded = true
+	return nil
+}
+
+type discoveredRegistriesByPrefix []DiscoveredRegistry
+
+func (l discoveredRegistriesByPrefix) Len() int { return len(l) }
+func (l discoveredRegistriesByPrefix) Less(i, j int) bool {
+	return l[i].Registry.Prefix < l[j].Registry.Prefix
+}
+func (l discoveredRegistriesByPrefix) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// DuplicateUnitGroup is a set of units (stored under different hashes) with the same normalized content.
+type DuplicateUnitGroup struct {
+	ContentHash string          `json:"contentHash"` // SHA1 of the normalized unit content
+	Bytes       int             `json:"bytes"`       // Total size of all units in the group
+	Units       []DuplicateUnit `json:"units"`
+}
+
+// DuplicateUnit is a single unit in a DuplicateUnitGroup.
+type DuplicateUnit struct {
+	Hash          string   `json:"hash"`
+	Key           string   `json:"key"`
+	Jobs          []string `json:"jobs"`                    // Jobs that reference the unit
+	LastKnownJobs []string `json:"lastKnownJobs,omitempty"` // For obsolete units, the jobs that referenced it in an earlier run (if known)
+	ModifiedIndex uint64   `json:"modifiedIndex"`
+}
+
+type duplicateUnitGroupsBySize []DuplicateUnitGroup
+
+func (l duplicateUnitGroupsBySize) Len() int { return len(l) }
+func (l duplicateUnitGroupsBySize) Less(i, j int) bool {
+	if len(l[i].Units) != len(l[j].Units) {
+		return len(l[i].Units) > len(l[j].Units)
+	}
+	return l[i].ContentHash < l[j].ContentHash
+}
+func (l duplicateUnitGroupsBySize) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+// FindDuplicateUnits groups all units in the registry by their normalized content and returns
+// all groups with more than one unit, largest group first. Nothing is removed.
+func (s *Service) FindDuplicateUnits() ([]DuplicateUnitGroup, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	units, objects, _, err := s.loadUnitsAndObjects()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	jobs := make(map[string][]string)
+	for _, j := range objects {
+		jobs[j.Hash()] = append(jobs[j.Hash()], j.Name)
+	}
+
+	groups := make(map[string]*DuplicateUnitGroup)
+	for _, u := range units {
+		hash := normalizedUnitHash(u.Value)
+		g, ok := groups[hash]
+		if !ok {
+			g = &DuplicateUnitGroup{ContentHash: hash}
+			groups[hash] = g
+		}
+		du := DuplicateUnit{
+			Hash:          u.Hash,
+			Key:           s.paths.unitKey(u.Hash),
+			Jobs:          jobs[u.Hash],
+			ModifiedIndex: u.ModifiedIndex,
+		}
+		if du.Jobs == nil {
+			du.Jobs = []string{}
+			du.LastKnownJobs = s.jobNames[u.Hash]
+		}
+		sort.Strings(du.Jobs)
+		g.Units = append(g.Units, du)
+		g.Bytes += len(u.Value)
+	}
+
+	result := []DuplicateUnitGroup{}
+	for _, g := range groups {
+		if len(g.Units) < 2 {
+			continue
+		}
+		sort.Sort(duplicateUnitsByHash(g.Units))
+		result = append(result, *g)
+	}
+	sort.Sort(duplicateUnitGroupsBySize(result))
+	return result, nil
+}
+
+type duplicateUnitsByHash []DuplicateUnit
+
+func (l duplicateUnitsByHash) Len() int           { return len(l) }
+func (l duplicateUnitsByHash) Less(i, j int) bool { return l[i].Hash < l[j].Hash }
+func (l duplicateUnitsByHash) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// normalizedUnitHash returns a hash of the content of the given unit value, ignoring differences
+// that do not change the meaning of the unit file: comments, blank lines and surrounding whitespace.
+func normalizedUnitHash(value string) string {
+	var lines []string
+	for _, line := range strings.Split(unitContent(value), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 && !strings.HasPrefix(line, "[") {
+			// Normalize "Key = Value" to "Key=Value"
+			line = strings.TrimSpace(line[:i]) + "=" + strings.TrimSpace(line[i+1:])
+		}
+		lines = append(lines, line)
+	}
+	h := sha1.Sum([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(h[:])
+}
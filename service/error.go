@@ -15,9 +15,133 @@
 package service
 
 import (
+	"net"
+
+	"github.com/coreos/etcd/client"
 	"github.com/juju/errgo"
+	"golang.org/x/net/context"
 )
 
 var (
+	// EtcdUnreachableError is the cause of errors caused by etcd not being reachable (in time).
+	EtcdUnreachableError = errgo.New("etcd unreachable")
+	// PermissionDeniedError is the cause of errors caused by etcd refusing access to a key.
+	PermissionDeniedError = errgo.New("permission denied")
+	// CorruptDataError is the cause of errors caused by fleet data that cannot be parsed.
+	CorruptDataError = errgo.New("corrupt data")
+	// DeleteFailedError is the cause of errors caused by one or more keys that could not be removed.
+	DeleteFailedError = errgo.New("delete failed")
+	// InvalidArgumentError is the cause of errors caused by an invalid configuration or argument.
+	InvalidArgumentError = errgo.New("invalid argument")
+	// ModifiedError is the cause of errors caused by a key that was modified after it was found to be garbage.
+	ModifiedError = errgo.New("modified")
+	// UnknownSchemaError is the cause of errors caused by a fleet registry with an unknown layout.
+	UnknownSchemaError = errgo.New("unknown registry schema")
+	// ClusterUnhealthyError is the cause of errors caused by an etcd cluster that is not healthy enough to remove keys.
+	ClusterUnhealthyError = errgo.New("cluster unhealthy")
+	// UnsupportedVersionError is the cause of errors caused by an etcd server version outside the tested range.
+	UnsupportedVersionError = errgo.New("unsupported etcd version")
+	// VerificationFailedError is the cause of errors caused by removed keys that still exist, or keys that disappeared unexpectedly.
+	VerificationFailedError = errgo.New("verification failed")
+	// CanaryFailedError is the cause of errors caused by anomalies detected after the canary deletes of a run.
+	CanaryFailedError = errgo.New("canary failed")
+	// RunLockedError is the cause of errors caused by a run lock that was taken over by another run while removing keys.
+	RunLockedError = errgo.New("run locked")
+
 	maskAny = errgo.MaskFunc(errgo.Any)
 )
+
+// IsEtcdUnreachable returns true if the cause of the given error is EtcdUnreachableError.
+func IsEtcdUnreachable(err error) bool {
+	return errgo.Cause(err) == EtcdUnreachableError
+}
+
+// IsPermissionDenied returns true if the cause of the given error is PermissionDeniedError.
+func IsPermissionDenied(err error) bool {
+	return errgo.Cause(err) == PermissionDeniedError
+}
+
+// IsCorruptData returns true if the cause of the given error is CorruptDataError.
+func IsCorruptData(err error) bool {
+	return errgo.Cause(err) == CorruptDataError
+}
+
+// IsDeleteFailed returns true if the cause of the given error is DeleteFailedError.
+func IsDeleteFailed(err error) bool {
+	return errgo.Cause(err) == DeleteFailedError
+}
+
+// IsInvalidArgument returns true if the cause of the given error is InvalidArgumentError.
+func IsInvalidArgument(err error) bool {
+	return errgo.Cause(err) == InvalidArgumentError
+}
+
+// IsUnknownSchema returns true if the cause of the given error is UnknownSchemaError.
+func IsUnknownSchema(err error) bool {
+	return errgo.Cause(err) == UnknownSchemaError
+}
+
+// IsClusterUnhealthy returns true if the cause of the given error is ClusterUnhealthyError.
+func IsClusterUnhealthy(err error) bool {
+	return errgo.Cause(err) == ClusterUnhealthyError
+}
+
+// IsUnsupportedVersion returns true if the cause of the given error is UnsupportedVersionError.
+func IsUnsupportedVersion(err error) bool {
+	return errgo.Cause(err) == UnsupportedVersionError
+}
+
+// IsVerificationFailed returns true if the cause of the given error is VerificationFailedError.
+func IsVerificationFailed(err error) bool {
+	return errgo.Cause(err) == VerificationFailedError
+}
+
+// IsCanaryFailed returns true if the cause of the given error is CanaryFailedError.
+func IsCanaryFailed(err error) bool {
+	return errgo.Cause(err) == CanaryFailedError
+}
+
+// IsRunLocked returns true if the cause of the given error is RunLockedError.
+func IsRunLocked(err error) bool {
+	return errgo.Cause(err) == RunLockedError
+}
+
+// IsModified returns true if the cause of the given error is ModifiedError.
+func IsModified(err error) bool {
+	return errgo.Cause(err) == ModifiedError
+}
+
+// maskEtcd masks an error returned by the etcd client, setting its cause
+// to one of the typed errors above when the error can be classified.
+func maskEtcd(err error) error {
+	if cause := etcdErrorCause(err); cause != nil {
+		return errgo.WithCausef(err, cause, "%s", cause)
+	}
+	return maskAny(err)
+}
+
+// etcdErrorCause classifies an error returned by the etcd client.
+// Returns nil if the error cannot be classified.
+func etcdErrorCause(err error) error {
+	switch e := err.(type) {
+	case client.Error:
+		if e.Code == client.ErrorCodeUnauthorized {
+			return PermissionDeniedError
+		}
+		return nil
+	case *client.ClusterError:
+		for _, inner := range e.Errors {
+			if cause := etcdErrorCause(inner); cause == PermissionDeniedError {
+				return cause
+			}
+		}
+		return EtcdUnreachableError
+	case net.Error:
+		return EtcdUnreachableError
+	}
+	switch err {
+	case context.DeadlineExceeded, client.ErrNoEndpoints, client.ErrClusterUnavailable:
+		return EtcdUnreachableError
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+// ErrorContext describes the circumstances in which a run failed.
+type ErrorContext struct {
+	Endpoint string `json:"endpoint"`
+	RunID    string `json:"runID"`
+	Phase    string `json:"phase"`
+}
+
+// ErrorReporter is notified of every failed run.
+type ErrorReporter interface {
+	ReportError(err error, ctx ErrorContext)
+}
+
+// reportError sends the given error to the error reporter (if any).
+func (s *Service) reportError(err error) {
+	if s.Errors == nil {
+		return
+	}
+	s.Errors.ReportError(err, ErrorContext{
+		Endpoint: s.EtcdURL.String(),
+		RunID:    s.current.id,
+		Phase:    s.current.phase,
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+
+	"github.com/pulcy/fleet-cleanup/metrics"
+)
+
+// Classes of failed etcd requests
+const (
+	etcdErrorTimeout     = "timeout"            // No (timely) response
+	etcdErrorRefused     = "connection-refused" // etcd (or the proxy in front of it) is not listening
+	etcdErrorNetwork     = "network"            // Any other connection failure
+	etcdErrorNotFound    = "not-found"          // Key does not exist (HTTP 404)
+	etcdErrorConflict    = "conflict"           // Compare failed or key exists (HTTP 412)
+	etcdErrorPermission  = "permission"         // HTTP 401 or 403
+	etcdErrorUnavailable = "unavailable"        // HTTP 5xx
+	etcdErrorOther       = "other"              // Any other HTTP 4xx
+)
+
+// etcdErrorCounter counts failed etcd requests by class.
+type etcdErrorCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int // Counts since the last reset
+	metric *metrics.Counter
+}
+
+// newEtcdErrorCounter creates a counter that also increments the given metric (if any).
+func newEtcdErrorCounter(metric *metrics.Counter) *etcdErrorCounter {
+	return &etcdErrorCounter{
+		counts: make(map[string]int),
+		metric: metric,
+	}
+}
+
+// add counts a failed request of the given class.
+func (c *etcdErrorCounter) add(class string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[class]++
+	c.metric.Inc(class)
+}
+
+// reset returns the counts since the previous reset (nil if there are none) and starts counting from zero.
+func (c *etcdErrorCounter) reset() map[string]int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.counts) == 0 {
+		return nil
+	}
+	result := c.counts
+	c.counts = make(map[string]int)
+	return result
+}
+
+// countingTransport counts all etcd requests and successful writes, and classifies & counts failed requests.
+type countingTransport struct {
+	client.CancelableTransport
+	counter  *etcdErrorCounter
+	writes   *requestCounter
+	requests *requestCounter
+	logger   Logger
+}
+
+// RoundTrip performs the given request, counting it when it fails.
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.add()
+	start := time.Now()
+	resp, err := t.CancelableTransport.RoundTrip(req)
+	if err != nil {
+		if class := classifyTransportError(err); class != "" {
+			t.counter.add(class)
+			t.logger.Debugf("etcd %s %s failed after %s: %v", req.Method, req.URL.RequestURI(), time.Since(start), err)
+		}
+		return resp, err
+	}
+	t.logger.Debugf("etcd %s %s: %d in %s", req.Method, req.URL.RequestURI(), resp.StatusCode, time.Since(start))
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		t.counter.add(etcdErrorNotFound)
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		t.counter.add(etcdErrorConflict)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		t.counter.add(etcdErrorPermission)
+	case resp.StatusCode >= 500:
+		t.counter.add(etcdErrorUnavailable)
+	case resp.StatusCode >= 400:
+		t.counter.add(etcdErrorOther)
+	case req.Method != "GET" && req.Method != "HEAD":
+		t.writes.add()
+	}
+	return resp, nil
+}
+
+// classifyTransportError returns the class of the given transport error.
+// Returns an empty string for canceled requests (e.g. watches that are stopped).
+func classifyTransportError(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "request canceled"):
+		return ""
+	case strings.Contains(msg, "connection refused"):
+		return etcdErrorRefused
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return etcdErrorTimeout
+	}
+	return etcdErrorNetwork
+}
+
+// formatEtcdErrors formats the given counts as "class=count, ..." in sorted order.
+func formatEtcdErrors(counts map[string]int) string {
+	var parts []string
+	for class, count := range counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", class, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
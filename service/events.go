@@ -0,0 +1,219 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventScanStart      = "scan-start"
+	EventCandidateFound = "candidate-found"
+	EventCandidateGone  = "candidate-gone"
+	EventDeleted        = "deleted"
+	EventTTLRestored    = "ttl-restored"
+	EventSkipped        = "skipped"
+	EventError          = "error"
+	EventRunSummary     = "run-summary"
+)
+
+// Event describes a significant action performed by the service.
+type Event struct {
+	Type      string            `json:"type"`
+	Time      time.Time         `json:"time"`
+	Rule      string            `json:"rule,omitempty"`
+	Kind      string            `json:"kind,omitempty"`
+	Key       string            `json:"key,omitempty"`
+	Dir       bool              `json:"dir,omitempty"` // Set when the removed key was a directory (only set for deleted keys)
+	Job       string            `json:"job,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Action    string            `json:"action,omitempty"` // Action that was skipped (only set for skipped candidates)
+	Reason    string            `json:"reason,omitempty"`
+	Severity  string            `json:"severity,omitempty"`  // Severity of the candidate (see Severity* constants)
+	Owners    map[string]string `json:"owners,omitempty"`    // Owner labels of the candidate (see ServiceConfig.OwnerLabels)
+	UnitTypes []string          `json:"unitTypes,omitempty"` // Unit types of the candidate (see UnitType* constants)
+	Summary   *RunSummary       `json:"summary,omitempty"`
+
+	// etcd indexes of the key (for candidates) and its estimated age
+	CreatedIndex  uint64        `json:"createdIndex,omitempty"`
+	ModifiedIndex uint64        `json:"modifiedIndex,omitempty"`
+	Age           time.Duration `json:"age,omitempty"`
+}
+
+// Reasons for not removing a candidate (see EventSkipped)
+const (
+	SkipReasonDryRun               = "dry-run"
+	SkipReasonPostponed            = "postponed"
+	SkipReasonPaused               = "paused"
+	SkipReasonBudgetExhausted      = "budget-exhausted"
+	SkipReasonOutsideWindow        = "outside-maintenance-window"
+	SkipReasonMaxDelete            = "max-delete-reached"
+	SkipReasonLeaseCleanupDisabled = "lease-cleanup-disabled"
+	SkipReasonStateCleanupDisabled = "state-cleanup-disabled"
+	SkipReasonReportOnly           = "report-only"
+	SkipReasonExcluded             = "excluded-by-policy"
+	SkipReasonTooYoung             = "min-age-not-reached"
+	SkipReasonStopping             = "stopping"
+	SkipReasonNotLeader            = "not-leader"
+	SkipReasonLocked               = "locked"
+	SkipReasonPlanned              = "planned"
+	SkipReasonGone                 = "gone"
+	SkipReasonReferenced           = "referenced"
+	SkipReasonModified             = "modified"    // A key that failed to be removed earlier was modified since
+	SkipReasonResurrected          = "resurrected" // The key was modified between the scan and its delete, e.g. a job was submitted again
+	SkipReasonTimeout              = "timeout"
+	SkipReasonProtectedUnitType    = "protected-unit-type"
+	SkipReasonDeleteFailed         = "delete-failed" // Removing the candidate failed (see Candidate.Error)
+	SkipReasonNotAttempted         = "not-attempted" // The run ended before the candidate could be removed, e.g. because it failed
+	SkipReasonAnnotated            = "annotated"     // A marker was stored instead of removing the candidate (see ServiceConfig.AnnotateTTL)
+	SkipReasonVetoed               = "vetoed"        // An operator vetoed the removal (see Service.Veto)
+	SkipReasonCanaryFailed         = "canary-failed" // Anomalies were detected after the canary deletes (see ServiceConfig.Canary)
+	SkipReasonCorruptJobs          = "corrupt-jobs"  // Job objects that cannot be parsed exist, these may refer to the unit
+)
+
+// RunSummary contains the results of a single cleanup run.
+type RunSummary struct {
+	RunID         string        `json:"runID"`
+	DryRun        bool          `json:"dryRun"`
+	Postponed     bool          `json:"postponed"`
+	Paused        bool          `json:"paused,omitempty"` // Set when an operator paused all cleanups (see Service.Pause)
+	Jobs          int           `json:"jobs"`
+	Units         int           `json:"units"`
+	ObsoleteUnits int           `json:"obsoleteUnits"`
+	RemovedUnits  int           `json:"removedUnits"`
+	Leases        int           `json:"leases"`
+	StaleLeases   int           `json:"staleLeases"`
+	RemovedLeases int           `json:"removedLeases"`
+	States        int           `json:"states"`
+	OrphanStates  int           `json:"orphanStates"`
+	RemovedStates int           `json:"removedStates"`
+	FailedDeletes int           `json:"failedDeletes"`
+	RestoredTTLs  int           `json:"restoredTTLs,omitempty"` // Number of keys whose TTL was restored (see ActionRestoreTTL)
+	Retried       int           `json:"retried"`                // Number of keys that could not be removed in a previous run and were retried
+	RegistryBytes int64         `json:"registryBytes"`
+	Duration      time.Duration `json:"duration"`
+	Rules         []RuleResult  `json:"rules,omitempty"`
+
+	// Number of candidates by severity (see Severity* constants)
+	Severities map[string]int `json:"severities,omitempty"`
+
+	// Number of candidates by unit type (see UnitType* constants)
+	UnitTypes map[string]int `json:"unitTypes,omitempty"`
+
+	// Number of candidates that were not removed (or restored), by reason (see SkipReason* constants)
+	Skipped map[string]int `json:"skipped,omitempty"`
+
+	// Set when the results of the previous run were reused, since nothing changed in etcd
+	Cached bool `json:"cached,omitempty"`
+
+	// Version of the etcd server (if known)
+	EtcdVersion string `json:"etcdVersion,omitempty"`
+
+	// Outcome of verifying the removed keys, only set when verifying deletes (see ServiceConfig.VerifyDeletes)
+	Verification *VerifyResult `json:"verification,omitempty"`
+
+	// Outcome of the canary deletes, only set when the run had a canary (see ServiceConfig.Canary)
+	Canary *CanaryResult `json:"canary,omitempty"`
+
+	// Limit of the run budget that was reached (max-delete, max-duration or max-etcd-ops) and the number of
+	// candidates that were not removed because of it
+	BudgetExhausted string `json:"budgetExhausted,omitempty"`
+	Remaining       int    `json:"remaining,omitempty"`
+
+	// Part of the registry the run was restricted to (e.g. "2/4", see ServiceConfig.Shard)
+	Shard string `json:"shard,omitempty"`
+
+	// Resource usage of the run, only set when profiling runs (see ServiceConfig.ProfileRun)
+	Profile *RunProfile `json:"profile,omitempty"`
+
+	// Total time waited between deletes because etcd was slow, only set with adaptive pacing (see ServiceConfig.AdaptivePacing)
+	PacingDelay time.Duration `json:"pacingDelay,omitempty"`
+
+	// Number of failed etcd requests by class (timeout, connection-refused, network, not-found, conflict, permission, unavailable, other)
+	EtcdErrors map[string]int `json:"etcdErrors,omitempty"`
+
+	// Only set when reporting the delta since the previous run
+	Delta          bool `json:"delta,omitempty"`
+	NewCandidates  int  `json:"newCandidates,omitempty"`
+	GoneCandidates int  `json:"goneCandidates,omitempty"`
+}
+
+// RuleResult contains the results of a single cleanup rule in a run.
+type RuleResult struct {
+	Name       string `json:"name"`
+	Severity   string `json:"severity"`
+	Candidates int    `json:"candidates"`
+	Removed    int    `json:"removed"`
+}
+
+// Garbage returns the number of keys found by all rules.
+func (s RunSummary) Garbage() int {
+	total := 0
+	for _, rs := range s.Rules {
+		total += rs.Candidates
+	}
+	return total
+}
+
+// rule returns the summary of the rule with given name, or nil if the rule did not run.
+func (s *RunSummary) rule(name string) *RuleResult {
+	for i := range s.Rules {
+		if s.Rules[i].Name == name {
+			return &s.Rules[i]
+		}
+	}
+	return nil
+}
+
+// EventListener is notified of all events emitted by the service.
+type EventListener interface {
+	Emit(e Event)
+}
+
+// NewNDJSONEventWriter creates an EventListener that writes every event as a
+// single line of JSON to the given writer.
+func NewNDJSONEventWriter(w io.Writer) EventListener {
+	return &ndjsonEventWriter{encoder: json.NewEncoder(w)}
+}
+
+type ndjsonEventWriter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func (w *ndjsonEventWriter) Emit(e Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.encoder.Encode(e)
+}
+
+// emit sends the given event to the event listener (if any).
+func (s *Service) emit(e Event) {
+	if s.Events == nil {
+		return
+	}
+	if e.Type != EventError && e.Severity != "" && !s.severityShown(e.Severity) {
+		// Garbage below the minimum severity is not reported
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.Events.Emit(e)
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+// Verdicts of a rule about a unit (see RuleVerdict)
+const (
+	VerdictDisabled = "disabled" // The rule does not run in the current configuration
+	VerdictKeep     = "keep"     // The rule found no garbage related to the unit
+	VerdictGarbage  = "garbage"  // The rule found a key related to the unit
+)
+
+// UnitExplanation contains everything known about a single unit, as returned by ExplainUnit.
+type UnitExplanation struct {
+	Hash           string           `json:"hash"`
+	Key            string           `json:"key"`
+	Exists         bool             `json:"exists"`
+	Dir            bool             `json:"dir,omitempty"`
+	Size           int              `json:"size"` // Size of the value(s) of the unit in etcd
+	CreatedIndex   uint64           `json:"createdIndex,omitempty"`
+	ModifiedIndex  uint64           `json:"modifiedIndex,omitempty"`
+	Age            time.Duration    `json:"age,omitempty"` // Estimated time since the unit was last modified
+	Content        string           `json:"content,omitempty"`
+	UnitTypes      []string         `json:"unitTypes,omitempty"`
+	Jobs           []string         `json:"jobs"`                     // Jobs whose object refers to the unit
+	StateJobs      []string         `json:"stateJobs,omitempty"`      // Jobs with a unit state of the unit
+	HistoricalJobs []string         `json:"historicalJobs,omitempty"` // Jobs that referred to the unit earlier (if known)
+	Templates      []string         `json:"templates,omitempty"`      // Templates that used the unit (see ServiceConfig.TemplateUnits)
+	Marker         *CandidateMarker `json:"marker,omitempty"`         // Set when a run annotated the unit as a candidate
+	Veto           *Veto            `json:"veto,omitempty"`
+	Verdicts       []RuleVerdict    `json:"verdicts"`
+}
+
+// RuleVerdict is the conclusion of a single cleanup rule about a unit or a key related to it
+// (a unit state, lease or job of the unit).
+type RuleVerdict struct {
+	Rule    string `json:"rule"`
+	Verdict string `json:"verdict"` // See Verdict* constants
+	Kind    string `json:"kind,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Action  string `json:"action,omitempty"` // Action the rule performs on the key
+	Reason  string `json:"reason"`           // Why the key is (not) garbage, or why it would not be removed
+}
+
+// ExplainUnit returns everything known about the unit with given hash (or key): the jobs that refer to it
+// (now or earlier), its indexes & content, and the verdict of every cleanup rule about the unit and the keys
+// related to it, as a run with the current configuration would reach it. Nothing is written to etcd.
+func (s *Service) ExplainUnit(hashOrKey string) (UnitExplanation, error) {
+	hash := path.Base(hashOrKey)
+	if hash == "" || hash == "." || hash == "/" || (strings.HasPrefix(hashOrKey, "/") && path.Dir(hashOrKey) != s.paths.unit) {
+		return UnitExplanation{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid unit hash '%s'", hashOrKey))
+	}
+
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	dryRun := true
+	current, err := newRunState(s.ServiceConfig, RunOptions{DryRun: &dryRun})
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	current.explaining = true
+	current.trace = s.Tracer.StartTrace("explain")
+	s.current = current
+	e, err := s.explainUnit(hash)
+	s.current.trace.End(err)
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	return e, nil
+}
+
+// explainUnit builds the explanation of the unit with given hash.
+// The caller must hold the run mutex and have set up the current run state.
+func (s *Service) explainUnit(hash string) (UnitExplanation, error) {
+	schema, _, err := s.registrySchema()
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	s.current.schema = schema
+	e := UnitExplanation{
+		Hash: hash,
+		Key:  s.paths.unitKey(hash),
+		Jobs: []string{},
+	}
+
+	// Unit & the jobs referring to it
+	units, objects, _, err := s.loadUnitsAndObjects()
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	var value string
+	for _, u := range units {
+		if u.Hash == hash {
+			value = u.Value
+			e.Exists = true
+			e.Dir = u.Dir
+			e.Size = len(u.Value)
+			e.CreatedIndex = u.CreatedIndex
+			e.ModifiedIndex = u.ModifiedIndex
+			e.Age = s.indexClock.Age(u.ModifiedIndex)
+			e.Content = unitContent(u.Value)
+		}
+	}
+	for _, j := range objects {
+		if j.Hash() == hash {
+			e.Jobs = append(e.Jobs, j.Name)
+		}
+	}
+	sort.Strings(e.Jobs)
+	var stateNames map[string][]string
+	if schema.HasStates {
+		stateNames, err = s.loadUnitStateNames()
+		if err != nil {
+			return UnitExplanation{}, maskAny(err)
+		}
+		e.StateJobs = stateNames[hash]
+		sort.Strings(e.StateJobs)
+	}
+
+	// Earlier references
+	var instances map[string]int
+	if s.TemplateUnits != TemplateUnitsHash {
+		templates, err := s.updateTemplateLinks(units, objects)
+		if err != nil {
+			return UnitExplanation{}, maskAny(err)
+		}
+		e.Templates = templates[hash]
+		instances = templateInstances(objects)
+	}
+	e.HistoricalJobs = appendUniqueAll(nil, s.jobNames[hash])
+	if e.Marker, err = s.loadCandidateMarker(hash); err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	if e.Marker != nil && e.Marker.Job != "" {
+		e.HistoricalJobs = appendUniqueAll(e.HistoricalJobs, strings.Split(e.Marker.Job, ","))
+	}
+	e.HistoricalJobs = appendUniqueAll(e.HistoricalJobs, e.Templates)
+	e.HistoricalJobs = withoutAll(e.HistoricalJobs, e.Jobs)
+	sort.Strings(e.HistoricalJobs)
+	allJobs := appendUniqueAll(appendUniqueAll(append([]string(nil), e.Jobs...), e.StateJobs), e.HistoricalJobs)
+	if e.Exists {
+		e.UnitTypes = s.candidateUnitTypes(candidate{Kind: kindUnit, Key: e.Key, Value: value, Job: strings.Join(allJobs, ",")})
+	}
+	vetoes, err := s.loadVetoes()
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	if v, ok := vetoes[hash]; ok {
+		e.Veto = &v
+	}
+
+	// Verdicts of the rules
+	jobs := make(map[string]bool)
+	for _, name := range appendUniqueAll(append([]string(nil), e.Jobs...), e.StateJobs) {
+		jobs[name] = true
+	}
+	enabled := make(map[string]bool)
+	for _, r := range s.enabledRules() {
+		enabled[r.Name] = true
+	}
+	var summary RunSummary
+	scan := s.newRegistryScan(&summary)
+	activeUnits, err := s.activeJobUnits(scan, stateNames)
+	if err != nil {
+		return UnitExplanation{}, maskAny(err)
+	}
+	for _, r := range rules {
+		if !enabled[r.Name] {
+			e.Verdicts = append(e.Verdicts, RuleVerdict{Rule: r.Name, Verdict: VerdictDisabled, Reason: "rule is disabled"})
+			continue
+		}
+		s.current.rule = r.Name
+		candidates, err := r.find(s, scan, &summary)
+		if err != nil {
+			return UnitExplanation{}, maskAny(err)
+		}
+		found := false
+		for _, c := range s.ruleCandidates(r, candidates, &summary) {
+			if !s.relatedToUnit(c, hash, jobs) {
+				continue
+			}
+			found = true
+			reason := c.Skip
+			if reason == "" {
+				if _, ok := vetoes[s.CandidateID(c.Key)]; ok {
+					reason = SkipReasonVetoed
+				}
+			}
+			detail := c.Detail
+			if detail == "" {
+				detail = r.Description
+			}
+			if reason != "" {
+				detail = fmt.Sprintf("%s; not removed: %s", detail, reason)
+			}
+			e.Verdicts = append(e.Verdicts, RuleVerdict{Rule: r.Name, Verdict: VerdictGarbage, Kind: c.Kind, Key: c.Key, Action: c.Action, Reason: detail})
+		}
+		if !found {
+			e.Verdicts = append(e.Verdicts, RuleVerdict{Rule: r.Name, Verdict: VerdictKeep, Reason: s.keepReason(r.Name, e, allJobs, instances, activeUnits[hash])})
+		}
+	}
+	return e, nil
+}
+
+// relatedToUnit returns true if the given candidate is the unit with given hash, or a unit state, lease or
+// job of one of the given jobs using the unit.
+func (s *Service) relatedToUnit(c candidate, hash string, jobs map[string]bool) bool {
+	switch c.Kind {
+	case kindUnit:
+		return c.Key == s.paths.unitKey(hash)
+	case kindState:
+		var state unitStateObject
+		if err := json.Unmarshal([]byte(c.Value), &state); err == nil && state.UnitHash != "" {
+			return state.UnitHash == hash
+		}
+		return jobs[c.Job]
+	case kindJob:
+		return jobs[c.Job]
+	case kindLease:
+		return jobs[path.Base(c.Key)]
+	}
+	return false
+}
+
+// keepReason returns why the rule with given name found no garbage related to the explained unit,
+// which was used by the given jobs.
+func (s *Service) keepReason(rule string, e UnitExplanation, jobNames []string, instances map[string]int, activeJobs []string) string {
+	switch {
+	case !e.Exists && rule == RuleOrphanUnits:
+		return "unit does not exist"
+	case rule != RuleOrphanUnits:
+		return "no related keys found"
+	case len(e.Jobs) > 0:
+		return fmt.Sprintf("referenced by %s", strings.Join(e.Jobs, ", "))
+	case len(activeJobs) > 0:
+		return fmt.Sprintf("running for active job(s) %s", strings.Join(activeJobs, ", "))
+	case !s.Shard.Includes(e.Hash):
+		return fmt.Sprintf("outside shard %s", s.Shard)
+	}
+	if template, n := usedTemplate(jobNames, instances); template != "" {
+		return fmt.Sprintf("kept while template %s has %d instances", template, n)
+	}
+	return "not found by the rule"
+}
+
+// withoutAll returns the given list without the given values.
+func withoutAll(list, values []string) []string {
+	skip := make(map[string]bool)
+	for _, v := range values {
+		skip[v] = true
+	}
+	var result []string
+	for _, x := range list {
+		if !skip[x] {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+// loadCandidateMarker returns the marker of the candidate with given identifier, or nil if there is none.
+func (s *Service) loadCandidateMarker(id string) (*CandidateMarker, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), path.Join(candidatesPrefix, id), nil)
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskEtcd(err)
+	}
+	var marker CandidateMarker
+	if err := json.Unmarshal([]byte(resp.Node.Value), &marker); err != nil {
+		return nil, maskAny(err)
+	}
+	return &marker, nil
+}
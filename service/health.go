@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	healthCheckTimeout = 10 * time.Second
+)
+
+// checkClusterHealth verifies that the etcd cluster is healthy: all members must be reachable,
+// the cluster must have a leader and no member may lag too far behind the others.
+// Returns an error with cause ClusterUnhealthyError if any problem is found.
+func (s *Service) checkClusterHealth() error {
+	if !s.HealthCheck {
+		return nil
+	}
+	span := s.startPhase("check-health")
+	err := s.clusterHealth()
+	span.End(err)
+	if err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// clusterHealth performs the actual health check.
+func (s *Service) clusterHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	membersAPI := client.NewMembersAPI(s.client)
+	members, err := membersAPI.List(ctx)
+	if err != nil {
+		return maskEtcd(err)
+	}
+	if len(members) == 0 {
+		return maskAny(errgo.WithCausef(nil, ClusterUnhealthyError, "etcd cluster has no members"))
+	}
+	var problems []string
+	if leader, err := membersAPI.Leader(ctx); err != nil || leader == nil {
+		problems = append(problems, "no leader")
+	}
+
+	// Every member must be reachable & (almost) up to date
+	indexes := make(map[string]uint64)
+	var maxIndex uint64
+	for _, m := range members {
+		name := m.Name
+		if name == "" {
+			name = m.ID
+		}
+		index, err := s.memberRaftIndex(ctx, m)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("member %s is unhealthy: %v", name, err))
+			continue
+		}
+		indexes[name] = index
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+	for name, index := range indexes {
+		if lag := maxIndex - index; s.MaxRaftIndexLag > 0 && lag > s.MaxRaftIndexLag {
+			problems = append(problems, fmt.Sprintf("member %s is %d raft indexes behind", name, lag))
+		}
+	}
+
+	if len(problems) > 0 {
+		return maskAny(errgo.WithCausef(nil, ClusterUnhealthyError, "etcd cluster is unhealthy (%d members): %s", len(members), strings.Join(problems, ", ")))
+	}
+	s.registryLogger.Debugf("etcd cluster is healthy (%d members, raft index %d)", len(members), maxIndex)
+	return nil
+}
+
+// memberRaftIndex returns the raft index of the given member.
+func (s *Service) memberRaftIndex(ctx context.Context, m client.Member) (uint64, error) {
+	if len(m.ClientURLs) == 0 {
+		return 0, fmt.Errorf("no client URLs")
+	}
+	resp, err := ctxhttp.Get(ctx, &http.Client{Transport: s.transport}, strings.TrimSuffix(m.ClientURLs[0], "/")+"/v2/keys/")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get("X-Raft-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid raft index '%s'", resp.Header.Get("X-Raft-Index"))
+	}
+	return index, nil
+}
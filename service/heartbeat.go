@@ -0,0 +1,90 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	heartbeatKey = toolPrefix + "/heartbeat"
+)
+
+// Heartbeat is stored with a TTL by every successful run (see ServiceConfig.HeartbeatTTL), so
+// monitoring notices when cleanups stop running.
+type Heartbeat struct {
+	RunID    string        `json:"runID"`
+	Time     time.Time     `json:"time"`
+	Hostname string        `json:"hostname,omitempty"`
+	Version  string        `json:"version"`
+	DryRun   bool          `json:"dryRun"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// heartbeatKey returns the key of the heartbeat. Every shard has its own heartbeat.
+func (s *Service) heartbeatKey() string {
+	if !s.Shard.enabled() {
+		return heartbeatKey
+	}
+	return fmt.Sprintf("%s-shard-%d-of-%d", heartbeatKey, s.Shard.Index, s.Shard.Count)
+}
+
+// writeHeartbeat refreshes the heartbeat after a successful run.
+// Nothing is written when heartbeats are disabled, with read-only credentials or when creating a plan.
+func (s *Service) writeHeartbeat(summary RunSummary) error {
+	if s.HeartbeatTTL <= 0 || s.AssumeReadOnly || s.current.planning {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	raw, err := json.Marshal(Heartbeat{
+		RunID:    s.current.id,
+		Time:     time.Now(),
+		Hostname: hostname,
+		Version:  s.Version,
+		DryRun:   summary.DryRun,
+		TTL:      s.HeartbeatTTL,
+	})
+	if err != nil {
+		return maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), s.heartbeatKey(), string(raw), &client.SetOptions{TTL: s.HeartbeatTTL}); err != nil {
+		return maskEtcd(err)
+	}
+	return nil
+}
+
+// LastHeartbeat returns the heartbeat of the last successful run.
+// Returns false if there is no heartbeat, i.e. no run succeeded within the heartbeat TTL.
+func (s *Service) LastHeartbeat() (Heartbeat, bool, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), s.heartbeatKey(), nil)
+	if client.IsKeyNotFound(err) {
+		return Heartbeat{}, false, nil
+	} else if err != nil {
+		return Heartbeat{}, false, maskEtcd(err)
+	}
+	var hb Heartbeat
+	if err := json.Unmarshal([]byte(resp.Node.Value), &hb); err != nil {
+		return Heartbeat{}, false, maskAny(err)
+	}
+	return hb, true, nil
+}
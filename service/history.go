@@ -0,0 +1,216 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	toolPrefix    = "/_pulcy/fleet-cleanup"
+	historyPrefix = toolPrefix + "/history"
+	trashPrefix   = toolPrefix + "/trash"
+)
+
+// RunRecord is a compact record of a single run, stored in the run history.
+type RunRecord struct {
+	RunSummary
+	Time     time.Time `json:"time"`
+	Version  string    `json:"version"`
+	Hostname string    `json:"hostname,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Succeeded returns true if the recorded run did not fail.
+func (r RunRecord) Succeeded() bool {
+	return r.Error == ""
+}
+
+// historyStore persists run records.
+type historyStore interface {
+	// Append adds the given record and removes the oldest records
+	// when the history contains more than size records.
+	Append(record RunRecord, size int) error
+	// List returns the most recent records (newest first), at most limit records if limit > 0.
+	List(limit int) ([]RunRecord, error)
+}
+
+// history returns the store used for the run history.
+func (s *Service) history() historyStore {
+	if s.HistoryFile != "" {
+		return fileHistoryStore{path: s.HistoryFile}
+	}
+	return etcdHistoryStore{service: s}
+}
+
+// recordRun stores a record of the given run in the run history.
+// Dry runs (including plans) are only recorded in a local history file,
+// they never write to etcd.
+func (s *Service) recordRun(start time.Time, summary RunSummary, runErr error) error {
+	if s.HistorySize <= 0 || s.HistoryFile == "" && (s.AssumeReadOnly || s.current.dryRun) {
+		return nil
+	}
+	record := RunRecord{
+		RunSummary: summary,
+		Time:       start,
+		Version:    s.Version,
+	}
+	record.RunID = s.current.id
+	record.Duration = time.Since(start)
+	record.Hostname, _ = os.Hostname()
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+	if err := s.history().Append(record, s.HistorySize); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// History returns the most recent records of the run history (newest first).
+// If limit is > 0, at most limit records are returned.
+func (s *Service) History(limit int) ([]RunRecord, error) {
+	records, err := s.history().List(limit)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return records, nil
+}
+
+// etcdHistoryStore stores the run history in etcd, one in-order key per run.
+type etcdHistoryStore struct {
+	service *Service
+}
+
+func (h etcdHistoryStore) Append(record RunRecord, size int) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	keysAPI := client.NewKeysAPI(h.service.client)
+	if _, err := keysAPI.CreateInOrder(context.Background(), historyPrefix, string(raw), nil); err != nil {
+		return maskEtcd(err)
+	}
+
+	// Prune old records
+	resp, err := keysAPI.Get(context.Background(), historyPrefix, &client.GetOptions{Sort: true})
+	if err != nil {
+		return maskEtcd(err)
+	}
+	if resp.Node != nil && len(resp.Node.Nodes) > size {
+		obsolete := resp.Node.Nodes[:len(resp.Node.Nodes)-size]
+		for _, n := range obsolete {
+			if _, err := keysAPI.Delete(context.Background(), n.Key, &client.DeleteOptions{}); err != nil && !client.IsKeyNotFound(err) {
+				return maskEtcd(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h etcdHistoryStore) List(limit int) ([]RunRecord, error) {
+	keysAPI := client.NewKeysAPI(h.service.client)
+	resp, err := keysAPI.Get(context.Background(), historyPrefix, &client.GetOptions{Sort: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, maskEtcd(err)
+	}
+
+	result := []RunRecord{}
+	if resp.Node != nil {
+		for i := len(resp.Node.Nodes) - 1; i >= 0; i-- {
+			if limit > 0 && len(result) >= limit {
+				break
+			}
+			n := resp.Node.Nodes[i]
+			var record RunRecord
+			if err := json.Unmarshal([]byte(n.Value), &record); err != nil {
+				h.service.Logger.Warningf("Failed to parse run record '%s' at %s: %#v", n.Value, n.Key, err)
+				continue
+			}
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// fileHistoryStore stores the run history in a local JSON file (oldest record first).
+type fileHistoryStore struct {
+	path string
+}
+
+func (h fileHistoryStore) Append(record RunRecord, size int) error {
+	records, err := h.load()
+	if err != nil {
+		return maskAny(err)
+	}
+	records = append(records, record)
+	if len(records) > size {
+		records = records[len(records)-size:]
+	}
+	raw, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	// Write to a temporary file first, so the history is never left half-written
+	tmpPath := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, raw, 0644); err != nil {
+		return maskAny(err)
+	}
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+func (h fileHistoryStore) List(limit int) ([]RunRecord, error) {
+	records, err := h.load()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	result := []RunRecord{}
+	for i := len(records) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, records[i])
+	}
+	return result, nil
+}
+
+// load reads all records from the file. A missing file is an empty history.
+func (h fileHistoryStore) load() ([]RunRecord, error) {
+	raw, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	var records []RunRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid history file '%s'", h.path))
+	}
+	return records, nil
+}
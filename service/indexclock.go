@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum time between the first and last observation before ages are estimated
+	minIndexClockPeriod = time.Minute
+)
+
+// indexClock estimates the age of etcd keys from their modified index.
+// It observes the cluster index over time (across runs in daemon mode) and
+// uses the average index rate to convert an index difference into a duration.
+type indexClock struct {
+	mutex      sync.Mutex
+	firstIndex uint64
+	firstTime  time.Time
+	lastIndex  uint64
+	lastTime   time.Time
+}
+
+// Observe records the given cluster index at the current time.
+func (c *indexClock) Observe(index uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if c.firstTime.IsZero() || index < c.firstIndex {
+		// First observation, or etcd was restored from backup
+		c.firstIndex, c.firstTime = index, now
+	}
+	if index >= c.lastIndex {
+		c.lastIndex, c.lastTime = index, now
+	}
+}
+
+// Age returns the estimated age of a key with given modified index.
+// Returns 0 when no estimate can be made (yet).
+func (c *indexClock) Age(modifiedIndex uint64) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	period := c.lastTime.Sub(c.firstTime)
+	if period < minIndexClockPeriod || c.lastIndex <= c.firstIndex || modifiedIndex > c.lastIndex {
+		return 0
+	}
+	indexesPerSecond := float64(c.lastIndex-c.firstIndex) / period.Seconds()
+	seconds := float64(c.lastIndex-modifiedIndex) / indexesPerSecond
+	return time.Duration(seconds) * time.Second
+}
+
+// formatIndexes returns a human readable description of the given indexes and estimated age.
+func formatIndexes(createdIndex, modifiedIndex uint64, age time.Duration) string {
+	if age > 0 {
+		return fmt.Sprintf("created at %d, modified at %d, ~%s ago", createdIndex, modifiedIndex, age)
+	}
+	return fmt.Sprintf("created at %d, modified at %d", createdIndex, modifiedIndex)
+}
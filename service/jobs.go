@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/client"
+)
+
+const (
+	jobTargetStateInactive = "inactive"
+)
+
+// findBrokenJobs returns all jobs without a valid job object, or whose unit no longer exists.
+func (s *Service) findBrokenJobs(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	units, _, err := scan.UnitsAndJobs()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	nodes, err := scan.JobNodes()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	existing := make(map[string]struct{})
+	for _, unit := range units {
+		existing[unit.Hash] = struct{}{}
+	}
+
+	var result []candidate
+	for _, n := range nodes {
+		name := path.Base(n.Key)
+		if !s.current.includesJob(name) || !s.Shard.Includes(name) {
+			continue
+		}
+		var detail string
+		severity := SeverityCritical
+		if object := childNode(n, "object"); object == nil {
+			detail = "job has no object"
+		} else if data, err := parseJobObject(object.Value); err != nil {
+			detail = fmt.Sprintf("job object cannot be parsed: %v", err)
+		} else if _, ok := existing[data.Hash()]; !ok {
+			detail = fmt.Sprintf("unit %s does not exist", data.Hash())
+			severity = SeverityWarning
+		} else {
+			continue
+		}
+		result = append(result, s.foundCandidate(candidate{
+			Kind:          kindJob,
+			Key:           n.Key,
+			Job:           name,
+			Detail:        detail,
+			Severity:      severity,
+			CreatedIndex:  n.CreatedIndex,
+			ModifiedIndex: maxModifiedIndex(n),
+		}))
+	}
+	return result, nil
+}
+
+// findInactiveJobs returns all jobs with target state inactive that have not changed for at least
+// the configured minimum age. Since the age of a key is estimated from the rate at which the etcd
+// index grows, no jobs are found until that rate is known (in daemon mode only).
+func (s *Service) findInactiveJobs(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	nodes, err := scan.JobNodes()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	var result []candidate
+	for _, n := range nodes {
+		name := path.Base(n.Key)
+		if !s.current.includesJob(name) || !s.Shard.Includes(name) {
+			continue
+		}
+		target := childNode(n, "target-state")
+		if target == nil || target.Value != jobTargetStateInactive {
+			continue
+		}
+		modifiedIndex := maxModifiedIndex(n)
+		age := s.indexClock.Age(modifiedIndex)
+		if age == 0 {
+			s.rulesLogger.Debugf("Age of inactive job %s is not known yet", name)
+			continue
+		}
+		if age < s.InactiveJobMinAge {
+			continue
+		}
+		result = append(result, s.foundCandidate(candidate{
+			Kind:          kindJob,
+			Key:           n.Key,
+			Job:           name,
+			Detail:        fmt.Sprintf("inactive for ~%s", age),
+			CreatedIndex:  n.CreatedIndex,
+			ModifiedIndex: modifiedIndex,
+		}))
+	}
+	return result, nil
+}
+
+// activeJobUnits returns the hashes of all units that agents report running for jobs with target state
+// loaded or launched, mapped to the names of those jobs.
+// It cross-checks the job objects, so that units of active jobs are kept even when their job object
+// is missing, incomplete or not (yet) updated. Returns nil when the registry has no unit states.
+func (s *Service) activeJobUnits(scan *registryScan, stateNames map[string][]string) (map[string][]string, error) {
+	if !s.current.schema.HasStates {
+		return nil, nil
+	}
+	_, objects, err := scan.UnitsAndJobs()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	nodes, err := scan.JobNodes()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	active := make(map[string]string) // job name -> target state
+	for _, n := range nodes {
+		target := childNode(n, "target-state")
+		if target != nil && (target.Value == jobTargetStateLoaded || target.Value == jobTargetStateLaunched) {
+			active[path.Base(n.Key)] = target.Value
+		}
+	}
+	referenced := make(map[string]string)
+	for _, j := range objects {
+		referenced[j.Name] = j.Hash()
+	}
+
+	result := make(map[string][]string)
+	resolved := make(map[string]struct{})
+	for hash, names := range stateNames {
+		for _, name := range names {
+			state, ok := active[name]
+			if !ok {
+				continue
+			}
+			result[hash] = appendUnique(result[hash], name)
+			resolved[name] = struct{}{}
+			if referenced[name] != hash {
+				s.rulesLogger.Debugf("Unit %s is running for %s job %s, but not referenced by its job object", hash, state, name)
+			}
+		}
+	}
+	for name := range active {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		if hash, ok := referenced[name]; !ok || hash == "" {
+			s.rulesLogger.Warningf("Job %s is active, but has no valid job object and no unit state", name)
+		}
+	}
+	return result, nil
+}
+
+// childNode returns the direct child of the given node with given name, or nil if not found.
+func childNode(n *client.Node, name string) *client.Node {
+	for _, c := range n.Nodes {
+		if path.Base(c.Key) == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeRegistryDump writes a dump of the keys API with the given fleet keys (by path below the fleet prefix)
+// to a temporary file and returns its name.
+func writeRegistryDump(t *testing.T, keys map[string]string) string {
+	root := map[string]interface{}{"key": defaultFleetPrefix, "dir": true}
+	dirs := map[string]map[string]interface{}{defaultFleetPrefix: root}
+	var mkdir func(p string) map[string]interface{}
+	mkdir = func(p string) map[string]interface{} {
+		if d, ok := dirs[p]; ok {
+			return d
+		}
+		d := map[string]interface{}{"key": p, "dir": true}
+		parent := mkdir(path.Dir(p))
+		nodes, _ := parent["nodes"].([]interface{})
+		parent["nodes"] = append(nodes, d)
+		dirs[p] = d
+		return d
+	}
+	for key, value := range keys {
+		p := defaultFleetPrefix + key
+		parent := mkdir(path.Dir(p))
+		nodes, _ := parent["nodes"].([]interface{})
+		parent["nodes"] = append(nodes, map[string]interface{}{"key": p, "value": value, "createdIndex": 1, "modifiedIndex": 1})
+	}
+	raw, err := json.Marshal(map[string]interface{}{"action": "get", "node": root})
+	if err != nil {
+		t.Fatalf("failed to encode dump: %#v", err)
+	}
+	f, err := ioutil.TempFile("", "fleet-cleanup-test")
+	if err != nil {
+		t.Fatalf("failed to create dump: %#v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(raw); err != nil {
+		t.Fatalf("failed to write dump: %#v", err)
+	}
+	return f.Name()
+}
+
+// runOffline performs a dry run on the given fleet keys and returns the reasons of all candidates by key.
+func runOffline(t *testing.T, keys map[string]string) map[string]Candidate {
+	dump := writeRegistryDump(t, keys)
+	defer os.Remove(dump)
+	s, err := NewService(ServiceConfig{
+		EtcdURL:       url.URL{Scheme: "http", Host: "127.0.0.1:2379"},
+		EtcdTransport: TransportConfig{OfflineBackup: dump},
+		DryRun:        true,
+		Rules:         map[string]bool{RuleBrokenJobs: true},
+	}, ServiceDependencies{})
+	if err != nil {
+		t.Fatalf("failed to create service: %#v", err)
+	}
+	if _, err := s.RunWithOptions(RunOptions{}); err != nil {
+		t.Fatalf("run failed: %#v", err)
+	}
+	report, ok := s.LastReport()
+	if !ok {
+		t.Fatalf("run has no report")
+	}
+	result := make(map[string]Candidate)
+	for _, c := range report.Candidates {
+		result[c.Key] = c
+	}
+	return result
+}
+
+func TestCorruptJobObjectsBlockUnitRemoval(t *testing.T) {
+	keys := map[string]string{
+		"/machines/m1/object":                            `{"ID": "m1"}`,
+		"/job/a.service/object":                          `{"Name": "a.service", "UnitHash": "AQAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		"/unit/0100000000000000000000000000000000000000": `{"Raw": "[Service]"}`,
+		"/unit/0200000000000000000000000000000000000000": `{"Raw": "[Service]"}`,
+	}
+	orphan := defaultFleetPrefix + "/unit/0200000000000000000000000000000000000000"
+
+	candidates := runOffline(t, keys)
+	if c, ok := candidates[orphan]; !ok || c.Reason != SkipReasonDryRun {
+		t.Errorf("expected orphan unit to be skipped with reason %s, got %#v", SkipReasonDryRun, c)
+	}
+
+	keys["/job/b.service/object"] = `{"Name": "b.service", "UnitHash": `
+	candidates = runOffline(t, keys)
+	if c, ok := candidates[orphan]; !ok || c.Reason != SkipReasonCorruptJobs {
+		t.Errorf("expected orphan unit to be skipped with reason %s, got %#v", SkipReasonCorruptJobs, c)
+	}
+	if c, ok := candidates[defaultFleetPrefix+"/job/b.service"]; !ok || c.Rule != RuleBrokenJobs || c.Severity != SeverityCritical {
+		t.Errorf("expected corrupt job to be reported by %s with severity %s, got %#v", RuleBrokenJobs, SeverityCritical, c)
+	}
+}
+
+func TestActiveJobUnitsAreKept(t *testing.T) {
+	const (
+		hash     = "0100000000000000000000000000000000000000"
+		newHash  = "0200000000000000000000000000000000000000"
+		newB64   = "AgAAAAAAAAAAAAAAAAAAAAAAAAA="
+		stateKey = "/states/a.service/m1"
+	)
+	state := `{"loadState": "loaded", "activeState": "active", "subState": "running", "unitHash": "` + hash + `"}`
+	tests := []struct {
+		name string
+		keys map[string]string
+		kept bool
+	}{
+		{
+			name: "missing job object",
+			keys: map[string]string{
+				"/job/a.service/target-state": jobTargetStateLaunched,
+				stateKey:                      state,
+			},
+			kept: true,
+		},
+		{
+			name: "stale hash in job object",
+			keys: map[string]string{
+				"/job/a.service/object":       `{"Name": "a.service", "UnitHash": "` + newB64 + `"}`,
+				"/job/a.service/target-state": jobTargetStateLoaded,
+				"/unit/" + newHash:            `{"Raw": "[Service]"}`,
+				stateKey:                      state,
+			},
+			kept: true,
+		},
+		{
+			name: "target state inactive",
+			keys: map[string]string{
+				"/job/a.service/object":       `{"Name": "a.service", "UnitHash": "` + newB64 + `"}`,
+				"/job/a.service/target-state": "inactive",
+				"/unit/" + newHash:            `{"Raw": "[Service]"}`,
+				stateKey:                      state,
+			},
+			kept: false,
+		},
+		{
+			name: "no unit state",
+			keys: map[string]string{
+				"/job/a.service/target-state": jobTargetStateLaunched,
+			},
+			kept: false,
+		},
+	}
+	for _, test := range tests {
+		test.keys["/machines/m1/object"] = `{"ID": "m1"}`
+		test.keys["/unit/"+hash] = `{"Raw": "[Service]"}`
+		candidates := runOffline(t, test.keys)
+		c, found := candidates[defaultFleetPrefix+"/unit/"+hash]
+		if test.kept && found {
+			t.Errorf("%s: expected unit of active job to be kept, got candidate %#v", test.name, c)
+		} else if !test.kept && (!found || c.Reason != SkipReasonDryRun) {
+			t.Errorf("%s: expected unit to be a candidate with reason %s, got %#v (found=%v)", test.name, SkipReasonDryRun, c, found)
+		}
+		if c, ok := candidates[defaultFleetPrefix+"/unit/"+newHash]; ok {
+			t.Errorf("%s: expected referenced unit to be kept, got candidate %#v", test.name, c)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	jobTargetStateLaunched = "launched"
+	jobTargetStateLoaded   = "loaded"
+)
+
+// JobTraces holds all keys in the registry that belong to a single job, as found by FindJobTraces.
+type JobTraces struct {
+	Job         string      `json:"job"`
+	TargetState string      `json:"targetState,omitempty"`
+	UnitHash    string      `json:"unitHash,omitempty"`
+	SharedWith  []string    `json:"sharedWith,omitempty"` // Other jobs using the same unit, in which case the unit is kept
+	Keys        []TracedKey `json:"keys"`                 // In the order in which they are removed
+}
+
+// Active returns true if fleet is supposed to run the job.
+func (t JobTraces) Active() bool {
+	return t.TargetState == jobTargetStateLaunched || t.TargetState == jobTargetStateLoaded
+}
+
+// FindJobTraces returns all keys in the registry of the job with given name: its job directory (object,
+// target state & schedule), its lease, its unit states and its unit, unless another job uses the same unit.
+// Unlike the cleanup rules, this also finds keys of jobs that still exist, e.g. partially destroyed ones.
+func (s *Service) FindJobTraces(name string) (JobTraces, error) {
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return JobTraces{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid job name '%s'", name))
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	ctx := context.Background()
+	traces := JobTraces{Job: name}
+	hashes := make(map[string]struct{})
+
+	// Job directory
+	jobDir := path.Join(s.paths.job, name)
+	resp, err := keysAPI.Get(ctx, jobDir, &client.GetOptions{Recursive: true})
+	if err == nil {
+		traces.Keys = append(traces.Keys, TracedKey{Kind: kindJob, Key: jobDir, Dir: resp.Node.Dir, ModifiedIndex: maxModifiedIndex(resp.Node)})
+		if target := childNode(resp.Node, "target-state"); target != nil {
+			traces.TargetState = target.Value
+		}
+		if object := childNode(resp.Node, "object"); object != nil {
+			if data, err := parseJobObject(object.Value); err == nil && len(data.UnitHash) > 0 {
+				traces.UnitHash = data.Hash()
+			}
+		}
+	} else if !client.IsKeyNotFound(err) {
+		return JobTraces{}, maskEtcd(err)
+	}
+
+	// Lease
+	leaseKey := path.Join(s.paths.lease, name)
+	resp, err = keysAPI.Get(ctx, leaseKey, nil)
+	if err == nil {
+		traces.Keys = append(traces.Keys, TracedKey{Kind: kindLease, Key: leaseKey, ModifiedIndex: resp.Node.ModifiedIndex})
+	} else if !client.IsKeyNotFound(err) {
+		return JobTraces{}, maskEtcd(err)
+	}
+
+	// Unit states (also used to find the unit of a job without object)
+	statesDir := path.Join(s.paths.states, name)
+	resp, err = keysAPI.Get(ctx, statesDir, &client.GetOptions{Recursive: true})
+	if err == nil {
+		traces.Keys = append(traces.Keys, TracedKey{Kind: kindState, Key: statesDir, Dir: resp.Node.Dir, ModifiedIndex: maxModifiedIndex(resp.Node)})
+		for _, n := range resp.Node.Nodes {
+			var state unitStateObject
+			if err := json.Unmarshal([]byte(n.Value), &state); err == nil && state.UnitHash != "" {
+				hashes[state.UnitHash] = struct{}{}
+			}
+		}
+	} else if !client.IsKeyNotFound(err) {
+		return JobTraces{}, maskEtcd(err)
+	}
+
+	// Unit
+	if traces.UnitHash == "" && len(hashes) == 1 {
+		for h := range hashes {
+			traces.UnitHash = h
+		}
+	}
+	if traces.UnitHash == "" {
+		return traces, nil
+	}
+	sharedWith, err := s.jobsUsingUnit(traces.UnitHash, name)
+	if err != nil {
+		return JobTraces{}, maskAny(err)
+	}
+	if len(sharedWith) > 0 {
+		traces.SharedWith = sharedWith
+		return traces, nil
+	}
+	unitKey := s.paths.unitKey(traces.UnitHash)
+	resp, err = keysAPI.Get(ctx, unitKey, &client.GetOptions{Recursive: true})
+	if err == nil {
+		traces.Keys = append(traces.Keys, TracedKey{Kind: kindUnit, Key: unitKey, Dir: resp.Node.Dir, ModifiedIndex: maxModifiedIndex(resp.Node)})
+	} else if !client.IsKeyNotFound(err) {
+		return JobTraces{}, maskEtcd(err)
+	}
+	return traces, nil
+}
+
+// jobsUsingUnit returns the names of all jobs (except the given one) whose object refers to the unit with given hash.
+// A job object that cannot be parsed may refer to any unit, so it is returned as well.
+func (s *Service) jobsUsingUnit(hash, except string) ([]string, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), s.paths.job, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskEtcd(err)
+	}
+	var result []string
+	for _, n := range resp.Node.Nodes {
+		name := path.Base(n.Key)
+		object := childNode(n, "object")
+		if name == except || object == nil {
+			continue
+		}
+		if data, err := parseJobObject(object.Value); err != nil {
+			s.Logger.Warningf("Object of job %s cannot be parsed, assuming it uses unit %s", name, hash)
+			result = append(result, name)
+		} else if data.Hash() == hash {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// RemoveJobTraces removes the given keys of a job, as found by FindJobTraces.
+// Keys (other than directories) that were modified since they were found are not removed.
+// The traces are updated with the keys that were removed. Removal stops at the first failure.
+func (s *Service) RemoveJobTraces(traces *JobTraces) error {
+	if err := s.removeTracedKeys(traces.Keys, "job "+traces.Job); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
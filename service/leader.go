@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	leaderKey        = toolPrefix + "/leader"
+	defaultLeaderTTL = 30 * time.Second
+)
+
+// leaderElection holds the state of the leader election among daemon replicas.
+type leaderElection struct {
+	enabled  bool
+	id       string // Value of the leader key while we are the leader
+	isLeader int32  // Set (atomically) to 1 while we are the leader
+}
+
+// StartLeaderElection starts campaigning for leadership among all instances that use the same etcd cluster.
+// Only the leader removes keys, runs of other instances (standbys) only report.
+// The leader key expires after LeaderTTL, so a standby takes over when the leader dies.
+// Leadership is released when Stop is called.
+// Call this before the first run.
+func (s *Service) StartLeaderElection() {
+	if s.LeaderTTL <= 0 {
+		s.LeaderTTL = defaultLeaderTTL
+	}
+	hostname, _ := os.Hostname()
+	s.election.enabled = true
+	s.election.id = hostname + "-" + newRunID()
+	s.updateLeadership()
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		for {
+			select {
+			case <-s.stop:
+				s.resign()
+				return
+			case <-time.After(s.LeaderTTL / 3):
+				s.updateLeadership()
+			}
+		}
+	}()
+}
+
+// IsLeader returns true if this instance is allowed to remove keys,
+// that is when it is the leader or leader election is not used.
+func (s *Service) IsLeader() bool {
+	return !s.election.enabled || atomic.LoadInt32(&s.election.isLeader) != 0
+}
+
+// updateLeadership refreshes the leader key when we are the leader, or tries to create it otherwise.
+func (s *Service) updateLeadership() {
+	keysAPI := client.NewKeysAPI(s.client)
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaderTTL/3)
+	defer cancel()
+	if s.IsLeader() {
+		opts := &client.SetOptions{PrevValue: s.election.id, TTL: s.LeaderTTL}
+		if _, err := keysAPI.Set(ctx, leaderKey, s.election.id, opts); err != nil {
+			// We cannot be sure that we are still the leader, so stop removing keys
+			s.Logger.Warningf("Lost leadership: %#v", maskEtcd(err))
+			s.setLeader(false)
+		}
+		return
+	}
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist, TTL: s.LeaderTTL}
+	if _, err := keysAPI.Set(ctx, leaderKey, s.election.id, opts); err != nil {
+		if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeNodeExist {
+			s.Logger.Debugf("Standby, another instance is the leader")
+		} else {
+			s.Logger.Warningf("Failed to campaign for leadership: %#v", maskEtcd(err))
+		}
+		return
+	}
+	s.Logger.Infof("Became the leader (%s)", s.election.id)
+	s.setLeader(true)
+}
+
+// resign removes the leader key (if we are the leader), so a standby can take over immediately.
+func (s *Service) resign() {
+	if !s.IsLeader() {
+		return
+	}
+	s.setLeader(false)
+	keysAPI := client.NewKeysAPI(s.client)
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaderTTL/3)
+	defer cancel()
+	if _, err := keysAPI.Delete(ctx, leaderKey, &client.DeleteOptions{PrevValue: s.election.id}); err != nil {
+		s.Logger.Warningf("Failed to release leadership: %#v", maskEtcd(err))
+		return
+	}
+	s.Logger.Infof("Released leadership")
+}
+
+func (s *Service) setLeader(leader bool) {
+	var value int32
+	if leader {
+		value = 1
+	}
+	atomic.StoreInt32(&s.election.isLeader, value)
+	s.metrics.leader.Set(float64(value))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+type leaseObject struct {
+	Key           string `json:"-"`
+	Value         string `json:"-"`
+	CreatedIndex  uint64 `json:"-"`
+	ModifiedIndex uint64 `json:"-"`
+	MachineID     string `json:"MachineID"`
+	Version       int    `json:"Version"`
+}
+
+// findStaleLeases returns all leases owned by machines that are no longer registered in fleet.
+// Runs restricted to an explicit list of unit hashes skip this rule, since leases do not refer to units.
+func (s *Service) findStaleLeases(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	if s.current.unitHashes != nil {
+		s.rulesLogger.Debugf("Run is restricted to unit hashes, skipping lease cleanup")
+		return nil, nil
+	}
+	machines, err := scan.Machines()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if len(machines) == 0 {
+		// Without any known machine, every lease would be considered stale
+		s.rulesLogger.Warningf("No machines found in %s, skipping lease cleanup", s.paths.machines)
+		return nil, nil
+	}
+	leases, err := s.loadLeases()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	summary.Leases = len(leases)
+	for _, l := range leases {
+		summary.RegistryBytes += int64(len(l.Value))
+	}
+
+	var result []candidate
+	for _, l := range leases {
+		if _, ok := machines[l.MachineID]; ok {
+			continue
+		}
+		if name := path.Base(l.Key); !s.current.includesJob(name) || !s.Shard.Includes(name) {
+			// Leases are stored under the name of their job
+			continue
+		}
+		// Found stale lease
+		summary.StaleLeases++
+		result = append(result, s.foundCandidate(candidate{
+			Kind:          kindLease,
+			Key:           l.Key,
+			Value:         l.Value,
+			Detail:        fmt.Sprintf("owned by unknown machine %s", l.MachineID),
+			CreatedIndex:  l.CreatedIndex,
+			ModifiedIndex: l.ModifiedIndex,
+		}))
+	}
+	return result, nil
+}
+
+// Load all leases stored by fleet
+func (s *Service) loadLeases() ([]leaseObject, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+
+	resp, err := keysAPI.Get(context.Background(), s.paths.lease, &client.GetOptions{})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, maskEtcd(err)
+	}
+	s.indexClock.Observe(resp.Index)
+
+	result := []leaseObject{}
+	if resp.Node != nil {
+		for _, n := range resp.Node.Nodes {
+			if n.Dir {
+				continue
+			}
+			var data leaseObject
+			if err := json.Unmarshal([]byte(n.Value), &data); err != nil {
+				s.rulesLogger.Warningf("Failed to parse lease '%s' at %s: %#v", n.Value, n.Key, err)
+				continue
+			}
+			data.Key = n.Key
+			data.Value = n.Value
+			data.CreatedIndex = n.CreatedIndex
+			data.ModifiedIndex = n.ModifiedIndex
+			if data.MachineID == "" {
+				s.rulesLogger.Debugf("Lease at %s (%s) has no owner", n.Key, path.Base(n.Key))
+				continue
+			}
+			result = append(result, data)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+)
+
+// RegistryListing is a snapshot of all jobs and units in the registry.
+type RegistryListing struct {
+	Jobs  []RegistryJob  `json:"jobs"`
+	Units []RegistryUnit `json:"units"`
+}
+
+// RegistryJob is a single job in a RegistryListing.
+type RegistryJob struct {
+	Name        string `json:"name"`
+	UnitHash    string `json:"unitHash"`
+	UnitMissing bool   `json:"unitMissing,omitempty"` // Set if the unit of the job does not exist
+}
+
+// RegistryUnit is a single unit in a RegistryListing.
+type RegistryUnit struct {
+	Hash          string   `json:"hash"`
+	Key           string   `json:"key"`
+	Jobs          []string `json:"jobs"`                    // Jobs that reference the unit
+	LastKnownJobs []string `json:"lastKnownJobs,omitempty"` // For obsolete units, the jobs that referenced it in an earlier run (if known)
+	Content       string   `json:"content"`                 // The unit file
+	ModifiedIndex uint64   `json:"modifiedIndex"`
+	Dir           bool     `json:"dir,omitempty"` // Set when the unit is stored as a directory
+}
+
+// ListRegistry returns all jobs and units in the registry, sorted by name & hash. Nothing is removed.
+func (s *Service) ListRegistry() (RegistryListing, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	units, objects, _, err := s.loadUnitsAndObjects()
+	if err != nil {
+		return RegistryListing{}, maskAny(err)
+	}
+	jobs := make(map[string][]string)
+	for _, j := range objects {
+		jobs[j.Hash()] = append(jobs[j.Hash()], j.Name)
+	}
+	exists := make(map[string]bool)
+	listing := RegistryListing{
+		Jobs:  []RegistryJob{},
+		Units: []RegistryUnit{},
+	}
+	for _, u := range units {
+		exists[u.Hash] = true
+		ru := RegistryUnit{
+			Hash:          u.Hash,
+			Key:           s.paths.unitKey(u.Hash),
+			Jobs:          jobs[u.Hash],
+			Content:       unitContent(u.Value),
+			ModifiedIndex: u.ModifiedIndex,
+			Dir:           u.Dir,
+		}
+		if ru.Jobs == nil {
+			ru.Jobs = []string{}
+			ru.LastKnownJobs = s.jobNames[u.Hash]
+		}
+		sort.Strings(ru.Jobs)
+		listing.Units = append(listing.Units, ru)
+	}
+	for _, j := range objects {
+		listing.Jobs = append(listing.Jobs, RegistryJob{
+			Name:        j.Name,
+			UnitHash:    j.Hash(),
+			UnitMissing: !exists[j.Hash()],
+		})
+	}
+	sort.Sort(registryJobsByName(listing.Jobs))
+	sort.Sort(registryUnitsByHash(listing.Units))
+	return listing, nil
+}
+
+type registryJobsByName []RegistryJob
+
+func (l registryJobsByName) Len() int           { return len(l) }
+func (l registryJobsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l registryJobsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type registryUnitsByHash []RegistryUnit
+
+func (l registryUnitsByHash) Len() int           { return len(l) }
+func (l registryUnitsByHash) Less(i, j int) bool { return l[i].Hash < l[j].Hash }
+func (l registryUnitsByHash) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
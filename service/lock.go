@@ -0,0 +1,222 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	runLockKey = toolPrefix + "/lock"
+)
+
+// runLockOwner describes the run holding the run lock.
+type runLockOwner struct {
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	RunID     string    `json:"runID"`
+	Started   time.Time `json:"started"`
+	Refreshed time.Time `json:"refreshed,omitempty"` // Last time the run refreshed the lock (see runLockHeartbeat)
+}
+
+func (o runLockOwner) String() string {
+	return fmt.Sprintf("run %s (pid %d on %s, started at %s)", o.RunID, o.PID, o.Hostname, o.Started.Format(time.RFC3339))
+}
+
+// lastSeen returns the last time the owner was known to be alive.
+func (o runLockOwner) lastSeen() time.Time {
+	if o.Refreshed.After(o.Started) {
+		return o.Refreshed
+	}
+	return o.Started
+}
+
+// runLockHeartbeat refreshes the run lock while it is held, so that a long run does not lose its lock
+// to another run after StealLockAfter.
+type runLockHeartbeat struct {
+	stop  chan struct{}
+	done  chan struct{}
+	lost  chan struct{} // Closed when the lock was taken over by another run
+	value string        // Current value of the lock, only valid after done is closed
+}
+
+// lockRun acquires the run lock. When it is held by another run, the current run
+// is marked as locked, so it only reports.
+func (s *Service) lockRun() error {
+	span := s.startPhase("lock")
+	owner, err := s.acquireRunLock()
+	span.End(err)
+	if err != nil {
+		return maskAny(err)
+	}
+	if owner != nil {
+		s.current.locked = true
+		s.Logger.Warningf("Skipping deletions: run lock is held by %s", owner)
+	} else if s.StealLockAfter > 0 {
+		s.current.lockHeartbeat = s.startRunLockHeartbeat(s.current.lock, s.StealLockAfter/3)
+	}
+	return nil
+}
+
+// acquireRunLock tries to acquire the run lock, which is held while a run removes keys.
+// If the lock is held by a run that has not refreshed it for more than StealLockAfter, the lock is taken over.
+// Returns the owner of the lock if it is held by another run.
+func (s *Service) acquireRunLock() (*runLockOwner, error) {
+	hostname, _ := os.Hostname()
+	raw, err := json.Marshal(runLockOwner{
+		Hostname: hostname,
+		PID:      os.Getpid(),
+		RunID:    s.current.id,
+		Started:  time.Now(),
+	})
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	value := string(raw)
+
+	keysAPI := client.NewKeysAPI(s.client)
+	var resp *client.Response
+	for resp == nil {
+		if _, err := keysAPI.Set(context.Background(), s.runLockKey(), value, &client.SetOptions{PrevExist: client.PrevNoExist}); err == nil {
+			s.current.lock = value
+			return nil, nil
+		} else if e, ok := err.(client.Error); !ok || e.Code != client.ErrorCodeNodeExist {
+			return nil, maskEtcd(err)
+		}
+		// Lock is held by another run
+		resp, err = keysAPI.Get(context.Background(), s.runLockKey(), nil)
+		if client.IsKeyNotFound(err) {
+			// Released in the mean time, try again
+			resp = nil
+		} else if err != nil {
+			return nil, maskEtcd(err)
+		}
+	}
+	var owner runLockOwner
+	if err := json.Unmarshal([]byte(resp.Node.Value), &owner); err != nil {
+		// Take over an unreadable lock as if it is stale
+		s.Logger.Warningf("Cannot parse run lock '%s': %#v", resp.Node.Value, err)
+	}
+	if s.StealLockAfter <= 0 || time.Since(owner.lastSeen()) < s.StealLockAfter {
+		return &owner, nil
+	}
+	if _, err := keysAPI.Set(context.Background(), s.runLockKey(), value, &client.SetOptions{PrevIndex: resp.Node.ModifiedIndex}); err != nil {
+		if e, ok := err.(client.Error); ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeKeyNotFound) {
+			// Another run changed the lock first
+			return &owner, nil
+		}
+		return nil, maskEtcd(err)
+	}
+	s.Logger.Warningf("Took over stale run lock of %s", owner)
+	s.current.lock = value
+	return nil, nil
+}
+
+// startRunLockHeartbeat refreshes the run lock with given value at the given interval, until it is stopped
+// by releaseRunLock.
+func (s *Service) startRunLockHeartbeat(value string, interval time.Duration) *runLockHeartbeat {
+	hb := &runLockHeartbeat{
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		lost:  make(chan struct{}),
+		value: value,
+	}
+	go func() {
+		defer close(hb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hb.stop:
+				return
+			case <-ticker.C:
+				refreshed, err := s.refreshRunLock(hb.value)
+				if err == nil {
+					hb.value = refreshed
+				} else if e, ok := errgo.Cause(err).(client.Error); ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeKeyNotFound) {
+					s.Logger.Errorf("Run lock was taken over by another run")
+					close(hb.lost)
+					return
+				} else {
+					s.Logger.Warningf("Failed to refresh run lock: %#v", err)
+				}
+			}
+		}
+	}()
+	return hb
+}
+
+// runLockLost returns true if the run lock of the current run was taken over by another run
+// after it was acquired.
+func (s *Service) runLockLost() bool {
+	hb := s.current.lockHeartbeat
+	if hb == nil {
+		return false
+	}
+	select {
+	case <-hb.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// refreshRunLock sets the refresh time of the run lock with given value, returning the new value.
+func (s *Service) refreshRunLock(value string) (string, error) {
+	var owner runLockOwner
+	if err := json.Unmarshal([]byte(value), &owner); err != nil {
+		return "", maskAny(err)
+	}
+	owner.Refreshed = time.Now()
+	raw, err := json.Marshal(owner)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), s.runLockKey(), string(raw), &client.SetOptions{PrevValue: value}); err != nil {
+		return "", maskAny(err)
+	}
+	return string(raw), nil
+}
+
+// releaseRunLock releases the run lock, if it is held by the current run.
+func (s *Service) releaseRunLock() {
+	if hb := s.current.lockHeartbeat; hb != nil {
+		lost := s.runLockLost()
+		close(hb.stop)
+		<-hb.done
+		s.current.lock = hb.value
+		s.current.lockHeartbeat = nil
+		if lost {
+			// The lock belongs to another run now
+			s.current.lock = ""
+		}
+	}
+	if s.current.lock == "" {
+		return
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Delete(context.Background(), s.runLockKey(), &client.DeleteOptions{PrevValue: s.current.lock}); err != nil {
+		s.Logger.Warningf("Failed to release run lock: %#v", maskEtcd(err))
+	}
+	s.current.lock = ""
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"log"
+)
+
+// Components of the service with their own logger (see ServiceDependencies.ComponentLoggers)
+const (
+	ComponentRegistry = "registry" // Requests to etcd & loading the fleet registry
+	ComponentRules    = "rules"    // Evaluation of the cleanup rules
+)
+
+// Logger is the logging interface used by the service.
+// A *logging.Logger (github.com/op/go-logging), as used by the fleet-cleanup command, satisfies it.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewStdLogger creates a Logger that writes to the given standard library logger,
+// prefixing every message with its level.
+// If debug is false, debug messages are dropped.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	return &stdLogger{logger: l, debug: debug}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	debug  bool
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	if l.debug {
+		l.output("DEBUG", format, args)
+	}
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{})    { l.output("INFO", format, args) }
+func (l *stdLogger) Warningf(format string, args ...interface{}) { l.output("WARN", format, args) }
+func (l *stdLogger) Errorf(format string, args ...interface{})   { l.output("ERROR", format, args) }
+
+func (l *stdLogger) output(level, format string, args []interface{}) {
+	l.logger.Output(3, fmt.Sprintf("[%-5s] ", level)+fmt.Sprintf(format, args...))
+}
+
+// componentLogger returns the logger of the given component, or the logger of the service
+// when the component has no logger of its own.
+func (deps ServiceDependencies) componentLogger(component string) Logger {
+	if l, ok := deps.ComponentLoggers[component]; ok && l != nil {
+		return l
+	}
+	return deps.Logger
+}
+
+// nopLogger drops all messages. It is used when no logger is given.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{})   {}
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})   {}
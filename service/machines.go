@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Load the ID's of all machines registered in fleet
+func (s *Service) loadMachineIDs() (map[string]struct{}, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+
+	resp, err := keysAPI.Get(context.Background(), s.paths.machines, &client.GetOptions{})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return map[string]struct{}{}, nil
+		}
+		return nil, maskEtcd(err)
+	}
+
+	result := make(map[string]struct{})
+	if resp.Node != nil {
+		for _, n := range resp.Node.Nodes {
+			result[path.Base(n.Key)] = struct{}{}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	kindMachine  = "machine"
+	kindSchedule = "schedule"
+)
+
+// MachineTraces holds all keys in the registry that refer to a single machine, as found by FindMachineTraces.
+type MachineTraces struct {
+	Machine    string      `json:"machine"`
+	Registered bool        `json:"registered"` // Set when the machine is still registered in fleet (its object has not expired)
+	Keys       []TracedKey `json:"keys"`       // In the order in which they are removed
+}
+
+// FindMachineTraces returns all keys in the registry of the machine with given ID: the schedule entries
+// (job targets) pointing at it, the unit states it published and its machine directory.
+func (s *Service) FindMachineTraces(id string) (MachineTraces, error) {
+	if id == "" || strings.Contains(id, "/") || id == "." || id == ".." {
+		return MachineTraces{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid machine ID '%s'", id))
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	ctx := context.Background()
+	traces := MachineTraces{Machine: id}
+
+	// Schedule entries
+	resp, err := keysAPI.Get(ctx, s.paths.job, &client.GetOptions{Recursive: true, Sort: true})
+	if err == nil {
+		for _, n := range resp.Node.Nodes {
+			if target := childNode(n, "target"); target != nil && target.Value == id {
+				traces.Keys = append(traces.Keys, TracedKey{Kind: kindSchedule, Key: target.Key, ModifiedIndex: target.ModifiedIndex})
+			}
+		}
+	} else if !client.IsKeyNotFound(err) {
+		return MachineTraces{}, maskEtcd(err)
+	}
+
+	// Unit states
+	resp, err = keysAPI.Get(ctx, s.paths.states, &client.GetOptions{Recursive: true, Sort: true})
+	if err == nil {
+		for _, n := range resp.Node.Nodes {
+			if state := childNode(n, id); state != nil {
+				traces.Keys = append(traces.Keys, TracedKey{Kind: kindState, Key: state.Key, ModifiedIndex: state.ModifiedIndex})
+			}
+		}
+	} else if !client.IsKeyNotFound(err) {
+		return MachineTraces{}, maskEtcd(err)
+	}
+
+	// Machine directory
+	machineDir := path.Join(s.paths.machines, id)
+	resp, err = keysAPI.Get(ctx, machineDir, &client.GetOptions{Recursive: true})
+	if err == nil {
+		traces.Registered = childNode(resp.Node, "object") != nil
+		traces.Keys = append(traces.Keys, TracedKey{Kind: kindMachine, Key: machineDir, Dir: resp.Node.Dir, ModifiedIndex: maxModifiedIndex(resp.Node)})
+	} else if !client.IsKeyNotFound(err) {
+		return MachineTraces{}, maskEtcd(err)
+	}
+	return traces, nil
+}
+
+// RemoveMachineTraces removes the given keys of a machine, as found by FindMachineTraces.
+// Keys (other than directories) that were modified since they were found are not removed.
+// The traces are updated with the keys that were removed. Removal stops at the first failure.
+func (s *Service) RemoveMachineTraces(traces *MachineTraces) error {
+	if err := s.removeTracedKeys(traces.Keys, "machine "+traces.Machine); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	candidatesPrefix = toolPrefix + "/candidates"
+	vetoesPrefix     = toolPrefix + "/vetoes"
+)
+
+// CandidateMarker is stored (with a TTL) for every candidate of a run that annotates candidates instead of
+// removing them (see ServiceConfig.AnnotateTTL), so other tooling and operators can see what is about to be removed.
+type CandidateMarker struct {
+	Key      string            `json:"key"`
+	Kind     string            `json:"kind"`
+	Rule     string            `json:"rule"`
+	Job      string            `json:"job,omitempty"`
+	Severity string            `json:"severity"`
+	Owners   map[string]string `json:"owners,omitempty"`
+	RunID    string            `json:"runID"`
+	Time     time.Time         `json:"time"`
+	VetoKey  string            `json:"vetoKey"` // Setting this key keeps the candidate from being removed (see Service.Veto)
+}
+
+// Veto is stored at the veto key of a candidate by operators (or other tooling) to keep it from being removed.
+type Veto struct {
+	Key      string    `json:"key,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// CandidateID returns the identifier of the given key (or identifier) in the candidate markers & vetoes:
+// the hash of a unit, or the SHA1 of any other key. Arguments that are not a key (not starting with '/')
+// are assumed to be an identifier already and returned as is.
+func (s *Service) CandidateID(keyOrID string) string {
+	if !strings.HasPrefix(keyOrID, "/") {
+		return keyOrID
+	}
+	if path.Dir(keyOrID) == s.paths.unit {
+		return path.Base(keyOrID)
+	}
+	hash := sha1.Sum([]byte(keyOrID))
+	return hex.EncodeToString(hash[:])
+}
+
+// annotateCandidate stores a marker for the given candidate, which expires after the configured TTL.
+func (s *Service) annotateCandidate(c candidate) error {
+	id := s.CandidateID(c.Key)
+	raw, err := json.Marshal(CandidateMarker{
+		Key:      c.Key,
+		Kind:     c.Kind,
+		Rule:     c.Rule,
+		Job:      c.Job,
+		Severity: c.Severity,
+		Owners:   c.Owners,
+		RunID:    s.current.id,
+		Time:     time.Now(),
+		VetoKey:  path.Join(vetoesPrefix, id),
+	})
+	if err != nil {
+		return maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), path.Join(candidatesPrefix, id), string(raw), &client.SetOptions{TTL: s.AnnotateTTL}); err != nil {
+		return maskEtcd(err)
+	}
+	return nil
+}
+
+// Veto keeps the given key (or candidate identifier, see CandidateID) from being removed until Unveto is called.
+// If ttl is positive, the veto expires automatically after ttl. Returns the identifier of the veto.
+func (s *Service) Veto(keyOrID, reason string, ttl time.Duration) (string, error) {
+	id := s.CandidateID(keyOrID)
+	hostname, _ := os.Hostname()
+	veto := Veto{
+		Reason:   reason,
+		Hostname: hostname,
+		Time:     time.Now(),
+	}
+	if strings.HasPrefix(keyOrID, "/") {
+		veto.Key = keyOrID
+	}
+	raw, err := json.Marshal(veto)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), path.Join(vetoesPrefix, id), string(raw), &client.SetOptions{TTL: ttl}); err != nil {
+		return "", maskEtcd(err)
+	}
+	return id, nil
+}
+
+// Unveto removes the veto of the given key (or candidate identifier).
+// Returns false if there was no veto.
+func (s *Service) Unveto(keyOrID string) (bool, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Delete(context.Background(), path.Join(vetoesPrefix, s.CandidateID(keyOrID)), nil); client.IsKeyNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, maskEtcd(err)
+	}
+	return true, nil
+}
+
+// loadVetoes returns all vetoes by candidate identifier. The veto keys may be set by hand (e.g. with etcdctl),
+// in which case a value that is not a JSON object is used as the reason.
+func (s *Service) loadVetoes() (map[string]Veto, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), vetoesPrefix, nil)
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskEtcd(err)
+	}
+	result := make(map[string]Veto)
+	for _, n := range resp.Node.Nodes {
+		var v Veto
+		if err := json.Unmarshal([]byte(n.Value), &v); err != nil {
+			v = Veto{Reason: n.Value}
+		}
+		result[path.Base(n.Key)] = v
+	}
+	return result, nil
+}
+
+// skipVetoedCandidates sets the skip reason of all given candidates (that are not skipped already) that were
+// vetoed by an operator.
+func (s *Service) skipVetoedCandidates(candidates []candidate) error {
+	check := false
+	for _, c := range candidates {
+		if c.Skip == "" {
+			check = true
+			break
+		}
+	}
+	if !check {
+		return nil
+	}
+	span := s.startPhase("check-vetoes")
+	vetoes, err := s.loadVetoes()
+	span.End(err)
+	if err != nil {
+		return maskAny(err)
+	}
+	for i, c := range candidates {
+		if c.Skip != "" {
+			continue
+		}
+		if v, ok := vetoes[s.CandidateID(c.Key)]; ok {
+			reason := v.Reason
+			if reason == "" {
+				reason = "no reason given"
+			}
+			s.Logger.Infof("Obsolete %s at %s is vetoed (%s), not removing it", c.Kind, c.Key, reason)
+			candidates[i].Skip = SkipReasonVetoed
+		}
+	}
+	return nil
+}
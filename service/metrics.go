@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/pulcy/fleet-cleanup/metrics"
+)
+
+// serviceMetrics holds all metrics exposed by the service.
+// All metrics are nil (and record nothing) when no metrics registry is configured.
+type serviceMetrics struct {
+	jobs          *metrics.Gauge
+	units         *metrics.Gauge
+	orphanUnits   *metrics.Gauge
+	leases        *metrics.Gauge
+	staleLeases   *metrics.Gauge
+	states        *metrics.Gauge
+	orphanStates  *metrics.Gauge
+	registryBytes *metrics.Gauge
+	removed       *metrics.Counter
+	failedDeletes *metrics.Counter
+	skipped       *metrics.Counter
+	runs          *metrics.Counter
+	lastRun       *metrics.Gauge
+	lastSuccess   *metrics.Gauge
+	lastDuration  *metrics.Gauge
+	leader        *metrics.Gauge
+	paused        *metrics.Gauge
+	etcdErrors    *metrics.Counter
+	pacingDelay   *metrics.Gauge
+	unitBytes     *metrics.Histogram
+	unitJobs      *metrics.Histogram
+	orphanQueue   *metrics.Gauge
+}
+
+// newServiceMetrics registers all service metrics in the given registry.
+func newServiceMetrics(r *metrics.Registry) serviceMetrics {
+	return serviceMetrics{
+		jobs:          r.NewGauge("fleet_jobs_total", "Number of jobs in the fleet registry"),
+		units:         r.NewGauge("fleet_units_total", "Number of units in the fleet registry"),
+		orphanUnits:   r.NewGauge("fleet_orphan_units", "Number of units that are no longer referenced by a job"),
+		leases:        r.NewGauge("fleet_leases_total", "Number of leases in the fleet registry"),
+		staleLeases:   r.NewGauge("fleet_stale_leases", "Number of leases owned by unknown machines"),
+		states:        r.NewGauge("fleet_unit_states_total", "Number of unit states in the fleet registry"),
+		orphanStates:  r.NewGauge("fleet_orphan_unit_states", "Number of unit states of unknown machines or units"),
+		registryBytes: r.NewGauge("fleet_registry_bytes", "Total size of all unit, job, lease & unit state values in the fleet registry"),
+		removed:       r.NewCounter("fleet_cleanup_removed_total", "Number of keys removed", "kind"),
+		failedDeletes: r.NewCounter("fleet_cleanup_failed_deletes_total", "Number of keys that could not be removed"),
+		skipped:       r.NewCounter("fleet_cleanup_skipped_total", "Number of candidates that were not removed, by reason", "reason"),
+		runs:          r.NewCounter("fleet_cleanup_runs_total", "Number of cleanup runs", "result"),
+		lastRun:       r.NewGauge("fleet_cleanup_last_run_timestamp_seconds", "Time of the last cleanup run"),
+		lastSuccess:   r.NewGauge("fleet_cleanup_last_run_success", "1 if the last cleanup run succeeded, 0 otherwise"),
+		lastDuration:  r.NewGauge("fleet_cleanup_last_run_duration_seconds", "Duration of the last cleanup run"),
+		etcdErrors:    r.NewCounter("fleet_cleanup_etcd_errors_total", "Number of failed etcd requests", "class"),
+		leader:        r.NewGauge("fleet_cleanup_leader", "1 if this instance is the leader (with --leader-election), 0 otherwise"),
+		paused:        r.NewGauge("fleet_cleanup_paused", "1 if cleanups were paused by an operator during the last run, 0 otherwise"),
+		pacingDelay:   r.NewGauge("fleet_cleanup_pacing_delay_seconds", "Delay between deletes set by adaptive pacing (0 at full speed)"),
+		unitBytes:     r.NewHistogram("fleet_unit_bytes", "Size of the unit values in the fleet registry, as of the last scan", metrics.ExponentialBuckets(256, 2, 13)),
+		unitJobs:      r.NewHistogram("fleet_unit_jobs", "Number of jobs using each unit in the fleet registry, as of the last scan", []float64{0, 1, 2, 3, 5, 10, 20, 50}),
+		orphanQueue:   r.NewGauge("fleet_cleanup_orphan_queue", "Number of orphaned units waiting for the orphan delay to expire (with the orphan watch)"),
+	}
+}
+
+// observeUnits replaces the unit histograms by the sizes of the given units and the number of given jobs using them.
+func (m serviceMetrics) observeUnits(units []unitNode, jobs []jobObject) {
+	if m.unitBytes == nil {
+		return
+	}
+	jobCounts := make(map[string]int)
+	for _, j := range jobs {
+		jobCounts[j.Hash()]++
+	}
+	sizes := make([]float64, 0, len(units))
+	counts := make([]float64, 0, len(units))
+	for _, u := range units {
+		sizes = append(sizes, float64(len(u.Value)))
+		counts = append(counts, float64(jobCounts[u.Hash]))
+	}
+	m.unitBytes.Replace(sizes)
+	m.unitJobs.Replace(counts)
+}
+
+// observeRun updates all metrics with the results of a run.
+func (m serviceMetrics) observeRun(start time.Time, summary RunSummary, err error) {
+	m.lastRun.Set(float64(start.Unix()))
+	m.lastDuration.Set(time.Since(start).Seconds())
+	m.removed.Add(float64(summary.RemovedUnits), kindUnit)
+	m.removed.Add(float64(summary.RemovedLeases), kindLease)
+	m.removed.Add(float64(summary.RemovedStates), kindState)
+	m.failedDeletes.Add(float64(summary.FailedDeletes))
+	for reason, count := range summary.Skipped {
+		m.skipped.Add(float64(count), reason)
+	}
+	if summary.Paused {
+		m.paused.Set(1)
+	} else {
+		m.paused.Set(0)
+	}
+	if err == nil {
+		m.lastSuccess.Set(1)
+		m.runs.Inc("success")
+	} else {
+		m.lastSuccess.Set(0)
+		m.runs.Inc("failure")
+	}
+	if err != nil && !IsDeleteFailed(err) {
+		// The scan did not complete, keep the registry gauges of the last completed scan
+		return
+	}
+	m.jobs.Set(float64(summary.Jobs))
+	m.units.Set(float64(summary.Units))
+	m.orphanUnits.Set(float64(summary.ObsoleteUnits - summary.RemovedUnits))
+	m.leases.Set(float64(summary.Leases))
+	m.staleLeases.Set(float64(summary.StaleLeases - summary.RemovedLeases))
+	m.states.Set(float64(summary.States))
+	m.orphanStates.Set(float64(summary.OrphanStates - summary.RemovedStates))
+	m.registryBytes.Set(float64(summary.RegistryBytes))
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offlineTransport serves the etcd API from a backup of etcd, so a cleanup can be evaluated
+// without connecting to etcd. It serves the v2 keys API (reads only), the version and the members
+// of the cluster, for every etcd endpoint. Writes are refused as unauthorized.
+type offlineTransport struct {
+	store *backupStore
+
+	mutex   sync.Mutex
+	watches map[*http.Request]chan struct{} // Watches wait until they are canceled
+}
+
+// newOfflineTransport creates a transport serving the backup at the given path (see loadBackup).
+func newOfflineTransport(backupPath string) (*offlineTransport, error) {
+	s, err := loadBackup(backupPath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return &offlineTransport{
+		store:   s,
+		watches: make(map[*http.Request]chan struct{}),
+	}, nil
+}
+
+// etcdErrorBody is the body of an error response of the v2 keys API.
+type etcdErrorBody struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause,omitempty"`
+	Index     uint64 `json:"index"`
+}
+
+// RoundTrip serves the given request from the backup.
+func (t *offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.store
+	switch {
+	case req.URL.Path == "/version":
+		version := s.get(path.Join(backupClusterPrefix, "version"))
+		if version == nil || version.IsDir() {
+			return t.respond(req, http.StatusNotFound, nil)
+		}
+		return t.respond(req, http.StatusOK, map[string]string{"etcdserver": version.Value, "etcdcluster": version.Value})
+	case req.URL.Path == "/v2/members":
+		return t.respond(req, http.StatusOK, map[string]interface{}{"members": t.members()})
+	case strings.HasPrefix(req.URL.Path, keysAPIPath+"/") || req.URL.Path == keysAPIPath:
+		// Continued below
+	default:
+		// Includes the leader, which is not known
+		return t.respond(req, http.StatusNotFound, nil)
+	}
+
+	key := cleanStorePath(strings.TrimPrefix(req.URL.Path, keysAPIPath))
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return t.respond(req, http.StatusUnauthorized, etcdErrorBody{ErrorCode: 110, Message: "The request requires user authentication", Cause: "offline backup is read-only", Index: s.CurrentIndex})
+	}
+	query := req.URL.Query()
+	if query.Get("wait") == "true" {
+		// Nothing changes in a backup
+		t.wait(req)
+		return nil, fmt.Errorf("watch canceled")
+	}
+	n := s.get(path.Join(backupKeysPrefix, key))
+	if n == nil {
+		return t.respond(req, http.StatusNotFound, etcdErrorBody{ErrorCode: 100, Message: "Key not found", Cause: key, Index: s.CurrentIndex})
+	}
+	node := t.apiNode(n, query.Get("recursive") == "true", true)
+	return t.respond(req, http.StatusOK, map[string]interface{}{"action": "get", "node": node})
+}
+
+// CancelRequest cancels a watch.
+func (t *offlineTransport) CancelRequest(req *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if c, ok := t.watches[req]; ok {
+		close(c)
+		delete(t.watches, req)
+	}
+}
+
+// wait blocks until the given request is canceled.
+func (t *offlineTransport) wait(req *http.Request) {
+	c := make(chan struct{})
+	t.mutex.Lock()
+	t.watches[req] = c
+	t.mutex.Unlock()
+	select {
+	case <-c:
+	case <-req.Cancel:
+	}
+}
+
+// apiNode converts the given node to a node of the keys API. Like etcd, directories list their
+// (non-hidden) children, and all levels below them when recursive is set.
+func (t *offlineTransport) apiNode(n *backupNode, recursive, top bool) *keysAPINode {
+	result := &keysAPINode{
+		Key:           strings.TrimPrefix(n.Path, backupKeysPrefix),
+		CreatedIndex:  n.CreatedIndex,
+		ModifiedIndex: n.ModifiedIndex,
+	}
+	if !n.ExpireTime.IsZero() {
+		expiration := n.ExpireTime.UTC()
+		result.Expiration = &expiration
+		// Remaining TTL at the time of the backup, rounded up (like etcd does)
+		remaining := n.ExpireTime.Sub(t.store.time)
+		result.TTL = int64(remaining / time.Second)
+		if remaining%time.Second > 0 {
+			result.TTL++
+		}
+	}
+	if !n.IsDir() {
+		value := n.Value
+		result.Value = &value
+		return result
+	}
+	result.Dir = true
+	if recursive || top {
+		for _, c := range n.sortedChildren() {
+			if !c.IsHidden() {
+				result.Nodes = append(result.Nodes, t.apiNode(c, recursive, false))
+			}
+		}
+	}
+	return result
+}
+
+// members returns the members of the cluster, as recorded by etcd in the store.
+func (t *offlineTransport) members() []map[string]interface{} {
+	result := []map[string]interface{}{}
+	dir := t.store.get(path.Join(backupClusterPrefix, "members"))
+	if dir == nil || !dir.IsDir() {
+		return result
+	}
+	for _, m := range dir.sortedChildren() {
+		var raftAttributes struct {
+			PeerURLs []string `json:"peerURLs"`
+		}
+		var attributes struct {
+			Name       string   `json:"name"`
+			ClientURLs []string `json:"clientURLs"`
+		}
+		if n := m.Children["raftAttributes"]; n != nil {
+			json.Unmarshal([]byte(n.Value), &raftAttributes)
+		}
+		if n := m.Children["attributes"]; n != nil {
+			json.Unmarshal([]byte(n.Value), &attributes)
+		}
+		result = append(result, map[string]interface{}{
+			"id":         path.Base(m.Path),
+			"name":       attributes.Name,
+			"peerURLs":   raftAttributes.PeerURLs,
+			"clientURLs": attributes.ClientURLs,
+		})
+	}
+	return result
+}
+
+// respond creates a JSON response with the given status & body, and the index headers of etcd.
+func (t *offlineTransport) respond(req *http.Request, status int, body interface{}) (*http.Response, error) {
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return nil, maskAny(err)
+		}
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Etcd-Index", strconv.FormatUint(t.store.CurrentIndex, 10))
+	header.Set("X-Raft-Index", strconv.FormatUint(t.store.raftIndex, 10))
+	header.Set("X-Raft-Term", strconv.FormatUint(t.store.raftTerm, 10))
+	header.Set("Content-Length", strconv.Itoa(len(raw)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(raw)),
+		ContentLength: int64(len(raw)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/pulcy/fleet-cleanup/tracing"
+)
+
+// RunOptions overrides parts of the service configuration for a single run.
+// Fields that are not set use the values of the service configuration.
+type RunOptions struct {
+	// Overrides ServiceConfig.DryRun.
+	// Options can only narrow a run, so a value of false is ignored.
+	DryRun *bool `json:"dryRun,omitempty"`
+	// Overrides ServiceConfig.MaxDelete.
+	// Options can only narrow a run, so the value is capped to ServiceConfig.MaxDelete (if set).
+	MaxDelete *int `json:"maxDelete,omitempty"`
+	// If set, only units with one of these hashes are considered for removal
+	UnitHashes []string `json:"unitHashes,omitempty"`
+	// Narrows ServiceConfig.JobFilter: jobs must match both filters.
+	JobFilter *string `json:"jobFilter,omitempty"`
+}
+
+// runState holds the settings & progress of the current run.
+type runState struct {
+	id            string
+	phase         string
+	rule          string // Name of the rule that is running
+	dryRun        bool
+	maxDelete     int
+	unitHashes    map[string]struct{}
+	jobFilters    []*regexp.Regexp // A job is in scope when it matches all of these
+	schema        registrySchema
+	postponed     bool
+	paused        bool              // Set when an operator paused all cleanups (see Service.Pause)
+	outsideWindow bool              // Set when the run started outside the maintenance window
+	locked        bool              // Set when the run lock is held by another run
+	lock          string            // Value of the run lock while it is held by this run
+	lockHeartbeat *runLockHeartbeat // Refreshes the run lock while it is held by this run
+	planning      bool              // Set when creating a plan, candidates are added to plan instead of being removed
+	plan          []PlanEntry
+	results       *resultCollector  // Outcome of the deletes of this run
+	started       time.Time         // Start of the run, for the run budget
+	requests      uint64            // Number of etcd requests sent before the run started, for the run budget
+	budgetLimit   string            // Limit of the run budget that was reached (see budgetExhausted)
+	candidates    []candidate       // Candidates found by the rules, including the outcome of removing them
+	phases        []PhaseTiming     // Phases that have started so far
+	profiler      *runProfiler      // Only set when profiling runs
+	etcdVersion   string            // Version of the etcd server (if known)
+	cacheable     bool              // Set when the results of this run may be reused by (& may reuse those of) other runs
+	jobUnits      map[string]string // Unit values by job name, set once all units are loaded
+	units         []unitNode        // Units loaded by the scan of this run (if any)
+	savedScan     *Scan             // If set, the candidates are taken from this scan instead of running the rules
+	explaining    bool              // Set when explaining a unit (see Service.ExplainUnit), nothing is written to etcd
+	canaryDone    bool              // Set once the canary deletes of this run have started (see ServiceConfig.Canary)
+	trace         *tracing.Span
+}
+
+// newRunState creates the state for a new run, based on the given config and options.
+func newRunState(config ServiceConfig, opts RunOptions) (runState, error) {
+	rs := runState{
+		id:        newRunID(),
+		results:   newResultCollector(),
+		dryRun:    config.DryRun,
+		maxDelete: config.MaxDelete,
+	}
+	if opts.DryRun != nil && *opts.DryRun {
+		rs.dryRun = true
+	}
+	if config.ExporterOnly || config.AssumeReadOnly {
+		// Never remove anything
+		rs.dryRun = true
+	}
+	if config.MaintenanceWindow != nil && !config.MaintenanceWindow.Contains(time.Now()) {
+		rs.outsideWindow = true
+	}
+	if opts.MaxDelete != nil {
+		n := *opts.MaxDelete
+		switch {
+		case n < 0:
+			return runState{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid max delete %d", n))
+		case n == 0 && config.MaxDelete > 0:
+			// 0 means unlimited, which would lift the configured limit
+			return runState{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "max delete cannot be unlimited, the configured limit is %d", config.MaxDelete))
+		case config.MaxDelete == 0 || n < config.MaxDelete:
+			rs.maxDelete = n
+		}
+	}
+	// Runs with overrides never share their results with other runs
+	rs.cacheable = config.CacheScan && opts.DryRun == nil && opts.MaxDelete == nil && opts.JobFilter == nil && len(opts.UnitHashes) == 0
+	if config.ProfileRun {
+		rs.profiler = newRunProfiler()
+	}
+	var jobFilters []string
+	if config.JobFilter != "" {
+		jobFilters = append(jobFilters, config.JobFilter)
+	}
+	if opts.JobFilter != nil {
+		if *opts.JobFilter == "" {
+			// Would remove the configured filter
+			return runState{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "job filter cannot be empty"))
+		}
+		jobFilters = append(jobFilters, *opts.JobFilter)
+	}
+	for _, jobFilter := range jobFilters {
+		re, err := regexp.Compile(jobFilter)
+		if err != nil {
+			return runState{}, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid job filter '%s'", jobFilter))
+		}
+		rs.jobFilters = append(rs.jobFilters, re)
+	}
+	if len(opts.UnitHashes) > 0 {
+		rs.unitHashes = make(map[string]struct{})
+		for _, h := range opts.UnitHashes {
+			rs.unitHashes[h] = struct{}{}
+		}
+	}
+	return rs, nil
+}
+
+// reportOnly returns true when the current run must not remove any keys.
+func (rs runState) reportOnly() bool {
+	return rs.dryRun || rs.postponed || rs.paused || rs.outsideWindow
+}
+
+// includesUnit returns true when the unit with given hash is within the scope of the current run.
+func (rs runState) includesUnit(hash string) bool {
+	if rs.unitHashes == nil {
+		return true
+	}
+	_, ok := rs.unitHashes[hash]
+	return ok
+}
+
+// includesJob returns true when a job with given name is within the scope of the current run.
+func (rs runState) includesJob(name string) bool {
+	for _, re := range rs.jobFilters {
+		if !re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// includesAnyJob returns true when one of the jobs with given names is within the scope of the current run.
+// Without a job filter, all units are in scope (even when no job name is known).
+func (rs runState) includesAnyJob(names []string) bool {
+	if len(rs.jobFilters) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if rs.includesJob(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRunID creates a random identifier for a run.
+func newRunID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
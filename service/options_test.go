@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+)
+
+func boolPtr(b bool) *bool { return &b }
+func intPtr(n int) *int    { return &n }
+
+func TestNewRunStateDryRun(t *testing.T) {
+	tests := []struct {
+		configDryRun bool
+		override     *bool
+		expected     bool
+	}{
+		{false, nil, false},
+		{true, nil, true},
+		{false, boolPtr(true), true},
+		{true, boolPtr(true), true},
+		// Options cannot disable a configured dry run
+		{true, boolPtr(false), true},
+		{false, boolPtr(false), false},
+	}
+	for i, test := range tests {
+		rs, err := newRunState(ServiceConfig{DryRun: test.configDryRun}, RunOptions{DryRun: test.override})
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %#v", i, err)
+		}
+		if rs.dryRun != test.expected {
+			t.Errorf("test %d: expected dryRun %v, got %v", i, test.expected, rs.dryRun)
+		}
+	}
+}
+
+func TestNewRunStateMaxDelete(t *testing.T) {
+	tests := []struct {
+		configMaxDelete int
+		override        *int
+		expected        int
+		invalid         bool
+	}{
+		{0, nil, 0, false},
+		{10, nil, 10, false},
+		{0, intPtr(5), 5, false},
+		{10, intPtr(5), 5, false},
+		{10, intPtr(10), 10, false},
+		// Options cannot raise the configured limit
+		{10, intPtr(20), 10, false},
+		{10, intPtr(0), 0, true},
+		{0, intPtr(0), 0, false},
+		{0, intPtr(-1), 0, true},
+		{10, intPtr(-1), 0, true},
+	}
+	for i, test := range tests {
+		rs, err := newRunState(ServiceConfig{MaxDelete: test.configMaxDelete}, RunOptions{MaxDelete: test.override})
+		if test.invalid {
+			if !IsInvalidArgument(err) {
+				t.Errorf("test %d: expected invalid argument error, got %#v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %#v", i, err)
+		}
+		if rs.maxDelete != test.expected {
+			t.Errorf("test %d: expected maxDelete %d, got %d", i, test.expected, rs.maxDelete)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+
+	"github.com/juju/errgo"
+)
+
+// Orders in which candidates are removed (see ServiceConfig.DeleteOrder)
+const (
+	DeleteOrderRule    = "rule"    // In the order in which the rules found them (default)
+	DeleteOrderOldest  = "oldest"  // Least recently modified first
+	DeleteOrderLargest = "largest" // Largest value first
+	DeleteOrderName    = "name"    // By key
+)
+
+// validateDeleteOrder returns an error if the given delete order is not valid.
+// An empty order is valid and means DeleteOrderRule.
+func validateDeleteOrder(order string) error {
+	switch order {
+	case "", DeleteOrderRule, DeleteOrderOldest, DeleteOrderLargest, DeleteOrderName:
+		return nil
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid delete order '%s', expected %s, %s, %s or %s",
+			order, DeleteOrderRule, DeleteOrderOldest, DeleteOrderLargest, DeleteOrderName))
+	}
+}
+
+// candidateOrder sorts candidates, keeping the order of candidates that are equal.
+type candidateOrder struct {
+	candidates []candidate
+	less       func(a, b candidate) bool
+}
+
+func (o candidateOrder) Len() int           { return len(o.candidates) }
+func (o candidateOrder) Less(i, j int) bool { return o.less(o.candidates[i], o.candidates[j]) }
+func (o candidateOrder) Swap(i, j int) {
+	o.candidates[i], o.candidates[j] = o.candidates[j], o.candidates[i]
+}
+
+// sortCandidates sorts the given candidates in the configured delete order, so runs that are capped
+// (e.g. by --max-delete) make predictable progress.
+func (s *Service) sortCandidates(candidates []candidate) {
+	var less func(a, b candidate) bool
+	switch s.DeleteOrder {
+	case DeleteOrderOldest:
+		less = func(a, b candidate) bool { return a.ModifiedIndex < b.ModifiedIndex }
+	case DeleteOrderLargest:
+		less = func(a, b candidate) bool { return len(a.Value) > len(b.Value) }
+	case DeleteOrderName:
+		less = func(a, b candidate) bool { return a.Key < b.Key }
+	default:
+		return
+	}
+	sort.Stable(candidateOrder{candidates: candidates, less: less})
+}
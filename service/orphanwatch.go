@@ -0,0 +1,356 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultOrphanDelay is the default time a unit must stay orphaned before the orphan watch removes it
+	DefaultOrphanDelay = 10 * time.Minute
+
+	// Time to wait before loading the registry again after the orphan watch failed
+	orphanWatchRetryDelay = 10 * time.Second
+)
+
+// orphanWatch tracks the units & jobs of the registry using etcd watches, and queues units that became
+// orphaned until they stayed orphaned for the orphan delay (see Service.WatchOrphans).
+type orphanWatch struct {
+	s     *Service
+	jobs  map[string]string    // Unit hash by job name
+	users map[string]int       // Number of jobs by unit hash
+	units map[string]struct{}  // Hashes of all units
+	queue map[string]time.Time // Time at which a queued unit is removed, by unit hash
+}
+
+// WatchOrphans watches the units & jobs of the fleet registry and removes units that stay orphaned for the
+// configured orphan delay, for near real-time cleanups that do not remove the units of jobs that are destroyed
+// and submitted again shortly after. A unit is queued when its last job is removed (or when it is created
+// without a job) and dequeued as soon as a job uses it again. Units whose delay expired are removed by a run
+// restricted to these units, so all checks of a normal run apply. Returns when the service is stopped.
+func (s *Service) WatchOrphans() {
+	w := &orphanWatch{
+		s:     s,
+		queue: make(map[string]time.Time),
+	}
+	for {
+		err := w.run()
+		if s.Stopping() {
+			return
+		}
+		s.registryLogger.Warningf("Orphan watch failed, loading the registry again in %s: %#v", orphanWatchRetryDelay, err)
+		select {
+		case <-time.After(orphanWatchRetryDelay):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// run loads the registry and processes changes of units & jobs until a watch fails or the service is stopped.
+func (w *orphanWatch) run() error {
+	s := w.s
+	index, err := w.load()
+	if err != nil {
+		return maskAny(err)
+	}
+	s.registryLogger.Infof("Watching for orphaned units after index %d, %d units queued", index, len(w.queue))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *client.Response)
+	errs := make(chan error, 2)
+	keysAPI := client.NewKeysAPI(s.client)
+	for _, dir := range []string{s.paths.unit, s.paths.job} {
+		watcher := keysAPI.Watcher(dir, &client.WatcherOptions{AfterIndex: index, Recursive: true})
+		go func() {
+			for {
+				resp, err := watcher.Next(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case events <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(w.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case resp := <-events:
+			w.apply(resp)
+		case err := <-errs:
+			return maskEtcd(err)
+		case <-ticker.C:
+			w.removeDue()
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+// load reads all jobs & units and queues every orphaned unit that is not queued yet.
+// Queued units that are no longer orphaned are dequeued. Returns the index to watch from.
+func (w *orphanWatch) load() (uint64, error) {
+	s := w.s
+	// Load jobs first, so no change of units is missed when watching from the index of the jobs
+	jobs, _, index, err := s.loadObjectsFromEtcd()
+	if err != nil {
+		return 0, maskAny(err)
+	}
+	units, err := s.loadUnitNames()
+	if err != nil {
+		return 0, maskAny(err)
+	}
+	w.jobs = make(map[string]string)
+	w.users = make(map[string]int)
+	w.units = make(map[string]struct{})
+	for _, j := range jobs {
+		w.jobs[j.Name] = j.Hash()
+		w.users[j.Hash()]++
+	}
+	for _, u := range units {
+		w.units[u.Hash] = struct{}{}
+	}
+	for hash := range w.queue {
+		if !w.orphaned(hash) {
+			delete(w.queue, hash)
+		}
+	}
+	for hash := range w.units {
+		if w.orphaned(hash) {
+			w.enqueue(hash)
+		}
+	}
+	return index, nil
+}
+
+// apply updates the tracked units & jobs with the given watch response.
+func (w *orphanWatch) apply(resp *client.Response) {
+	if resp.Node == nil {
+		return
+	}
+	paths := w.s.paths
+	key := resp.Node.Key
+	deleted := false
+	switch resp.Action {
+	case "delete", "expire", "compareAndDelete":
+		deleted = true
+	}
+	switch {
+	case strings.HasPrefix(key, paths.unit+"/"):
+		// Some fleet versions store a unit as a directory with child keys
+		parts := strings.SplitN(strings.TrimPrefix(key, paths.unit+"/"), "/", 2)
+		hash := parts[0]
+		if !deleted {
+			w.units[hash] = struct{}{}
+			if w.orphaned(hash) {
+				w.enqueue(hash)
+			}
+		} else if len(parts) == 1 {
+			delete(w.units, hash)
+			w.dequeue(hash)
+		}
+	case strings.HasPrefix(key, paths.job+"/"):
+		parts := strings.SplitN(strings.TrimPrefix(key, paths.job+"/"), "/", 2)
+		name := parts[0]
+		isObject := len(parts) == 2 && parts[1] == "object"
+		if deleted && (len(parts) == 1 || isObject) {
+			w.removeJob(name)
+		} else if !deleted && isObject && !resp.Node.Dir {
+			j, err := parseJobObject(resp.Node.Value)
+			if err != nil {
+				w.s.registryLogger.Warningf("Failed to parse job object '%s' at %s: %#v", resp.Node.Value, key, err)
+				return
+			}
+			w.setJob(name, j.Hash())
+		}
+	}
+}
+
+// setJob records that the job with given name uses the unit with given hash, dequeuing that unit.
+func (w *orphanWatch) setJob(name, hash string) {
+	if old, ok := w.jobs[name]; ok {
+		if old == hash {
+			return
+		}
+		w.removeJob(name)
+	}
+	w.jobs[name] = hash
+	w.users[hash]++
+	if _, ok := w.queue[hash]; ok {
+		w.s.Logger.Infof("Unit %s is used by job %s again, no longer removing it", hash, name)
+		w.dequeue(hash)
+	}
+}
+
+// removeJob records that the job with given name was removed, queuing its unit when no other job uses it.
+func (w *orphanWatch) removeJob(name string) {
+	hash, ok := w.jobs[name]
+	if !ok {
+		return
+	}
+	delete(w.jobs, name)
+	w.users[hash]--
+	if w.users[hash] <= 0 {
+		delete(w.users, hash)
+	}
+	if w.orphaned(hash) {
+		w.enqueue(hash)
+	}
+}
+
+// orphaned returns true if the unit with given hash exists and no job uses it.
+func (w *orphanWatch) orphaned(hash string) bool {
+	_, exists := w.units[hash]
+	return exists && w.users[hash] == 0
+}
+
+// enqueue queues the unit with given hash for removal once the orphan delay expires (unless already queued).
+func (w *orphanWatch) enqueue(hash string) {
+	if _, ok := w.queue[hash]; ok {
+		return
+	}
+	w.s.Logger.Debugf("Unit %s is orphaned, removing it in %s unless a job uses it again", hash, w.s.OrphanDelay)
+	w.queue[hash] = time.Now().Add(w.s.OrphanDelay)
+	w.s.metrics.orphanQueue.Set(float64(len(w.queue)))
+}
+
+// dequeue removes the unit with given hash from the queue (if queued).
+func (w *orphanWatch) dequeue(hash string) {
+	delete(w.queue, hash)
+	w.s.metrics.orphanQueue.Set(float64(len(w.queue)))
+}
+
+// removeDue removes all queued units whose orphan delay expired, using a run restricted to these units.
+// Units that the run skipped for a transient reason (e.g. a dry run or the max delete), or did not get to
+// because it failed, are queued again for another orphan delay. All others are dequeued, including units
+// that turned out not to be garbage (e.g. used by an active job or outside the shard).
+func (w *orphanWatch) removeDue() {
+	s := w.s
+	now := time.Now()
+	var due []string
+	for hash, t := range w.queue {
+		if !now.Before(t) {
+			due = append(due, hash)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Strings(due)
+	s.Logger.Infof("Removing %d units that stayed orphaned for %s", len(due), s.OrphanDelay)
+	retry, err := s.removeUnits(due)
+	if err != nil {
+		s.Logger.Errorf("Failed to remove orphaned units: %#v", err)
+	}
+	next := time.Now().Add(s.OrphanDelay)
+	requeued := 0
+	for _, hash := range due {
+		if _, ok := retry[hash]; ok {
+			w.queue[hash] = next
+			requeued++
+		} else {
+			w.dequeue(hash)
+		}
+	}
+	if requeued > 0 {
+		s.Logger.Infof("%d of %d orphaned units were not removed, trying again in %s", requeued, len(due), s.OrphanDelay)
+	}
+}
+
+// orphanRetryReasons are the reasons for not removing a unit that may no longer apply after another orphan delay.
+var orphanRetryReasons = map[string]bool{
+	SkipReasonDryRun:          true,
+	SkipReasonPostponed:       true,
+	SkipReasonPaused:          true,
+	SkipReasonBudgetExhausted: true,
+	SkipReasonOutsideWindow:   true,
+	SkipReasonMaxDelete:       true,
+	SkipReasonTooYoung:        true,
+	SkipReasonStopping:        true,
+	SkipReasonNotLeader:       true,
+	SkipReasonLocked:          true,
+	SkipReasonTimeout:         true,
+	SkipReasonDeleteFailed:    true,
+	SkipReasonNotAttempted:    true,
+	SkipReasonCanaryFailed:    true,
+	SkipReasonCorruptJobs:     true,
+}
+
+// removeUnits performs a single cleanup restricted to the units with given hashes (like RunWithOptions).
+// Returns the hashes of the units that should be tried again: units found to be obsolete that were skipped
+// for a transient reason (see orphanRetryReasons) and, when the run failed, units it did not find.
+func (s *Service) removeUnits(hashes []string) (map[string]struct{}, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, RunOptions{UnitHashes: hashes})
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	_, runErr := s.runWithState(current, s.run)
+	keys := make(map[string]string)
+	for _, hash := range hashes {
+		keys[s.paths.unitKey(hash)] = hash
+	}
+	retry := make(map[string]struct{})
+	found := make(map[string]struct{})
+	for _, c := range s.current.candidates {
+		hash, ok := keys[c.Key]
+		if !ok || c.Kind != kindUnit {
+			continue
+		}
+		found[hash] = struct{}{}
+		if orphanRetryReasons[c.notRemovedReason()] {
+			retry[hash] = struct{}{}
+		}
+	}
+	if runErr != nil {
+		// The run may have failed before it found these units
+		for _, hash := range hashes {
+			if _, ok := found[hash]; !ok {
+				retry[hash] = struct{}{}
+			}
+		}
+		return retry, maskAny(runErr)
+	}
+	return retry, nil
+}
+
+// checkInterval returns the interval at which the queue is checked for units whose delay expired.
+func (w *orphanWatch) checkInterval() time.Duration {
+	interval := w.s.OrphanDelay / 10
+	switch {
+	case interval < time.Second:
+		return time.Second
+	case interval > 30*time.Second:
+		return 30 * time.Second
+	default:
+		return interval
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultOwnerLabels are the labels read from units when ServiceConfig.OwnerLabels is not set.
+var DefaultOwnerLabels = []string{"owner", "team"}
+
+// unitOwners returns the values of the given labels found in the [X-Fleet] section of the given unit value,
+// indexed by label. A label is set either by an option with the same name (e.g. 'Owner=alice') or
+// by a machine metadata requirement (e.g. 'MachineMetadata=team=payments'). Labels are case-insensitive.
+// Returns nil if none of the labels is set.
+func unitOwners(value string, labels []string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	var owners map[string]string
+	set := func(name, value string, override bool) {
+		for _, label := range labels {
+			if !strings.EqualFold(name, label) || value == "" {
+				continue
+			}
+			if _, found := owners[label]; found && !override {
+				continue
+			}
+			if owners == nil {
+				owners = make(map[string]string)
+			}
+			owners[label] = value
+		}
+	}
+	for _, o := range parseUnitOptions(value) {
+		if o.Section != "X-Fleet" {
+			continue
+		}
+		if o.Name != "MachineMetadata" {
+			// An explicit option wins over machine metadata
+			set(o.Name, strings.Trim(o.Value, `"`), true)
+			continue
+		}
+		for _, requirement := range strings.Fields(o.Value) {
+			requirement = strings.Trim(requirement, `"`)
+			if j := strings.Index(requirement, "="); j > 0 {
+				set(requirement[:j], requirement[j+1:], false)
+			}
+		}
+	}
+	return owners
+}
+
+// candidateOwners returns the owner labels of the given candidate: those of the unit for unit candidates,
+// or those of the unit of its job for other candidates. Returns nil if no owner is known.
+func (s *Service) candidateOwners(c candidate) map[string]string {
+	job := c.Job
+	switch c.Kind {
+	case kindUnit:
+		return unitOwners(c.Value, s.OwnerLabels)
+	case kindLease:
+		// Leases are stored under the name of their job
+		job = path.Base(c.Key)
+	}
+	if value, ok := s.current.jobUnits[job]; ok {
+		return unitOwners(value, s.OwnerLabels)
+	}
+	return nil
+}
+
+// FormatOwners returns the given owner labels as a sorted list of 'label=value' pairs.
+func FormatOwners(owners map[string]string) []string {
+	result := make([]string, 0, len(owners))
+	for label, value := range owners {
+		result = append(result, fmt.Sprintf("%s=%s", label, value))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// countOwners returns the number of obsolete units in the given candidates by owner label
+// ('label=value'). Units without any owner label are counted as 'unknown'.
+// Returns nil if no unit has an owner label.
+func countOwners(candidates []candidate) map[string]int {
+	counts := make(map[string]int)
+	known := false
+	for _, c := range candidates {
+		if c.Kind != kindUnit {
+			continue
+		}
+		if len(c.Owners) == 0 {
+			counts["unknown"]++
+			continue
+		}
+		known = true
+		for _, owner := range FormatOwners(c.Owners) {
+			counts[owner]++
+		}
+	}
+	if !known {
+		return nil
+	}
+	return counts
+}
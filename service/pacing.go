@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+)
+
+const (
+	// DefaultPacingLatency is the delete latency above which adaptive pacing backs off,
+	// when ServiceConfig.PacingLatency is not set.
+	DefaultPacingLatency = 200 * time.Millisecond
+	// DefaultPacingMaxDelay is the maximum delay between deletes with adaptive pacing,
+	// when ServiceConfig.PacingMaxDelay is not set.
+	DefaultPacingMaxDelay = 5 * time.Second
+
+	pacingMinDelay     = 10 * time.Millisecond // Shorter delays are dropped, i.e. deletes run at full speed again
+	pacingWeight       = 0.3                   // Weight of the latest delete in the moving averages
+	pacingMaxErrorRate = 0.2                   // Error rate (moving average) above which pacing backs off
+)
+
+// pacer adapts the delay between deletes to the health of etcd: the delay doubles while the moving average of
+// the delete latency is above a threshold or deletes keep failing, and halves (down to no delay at all) once
+// etcd is fast again. It is only used by a single run at a time.
+type pacer struct {
+	threshold time.Duration
+	maxDelay  time.Duration
+
+	latency   float64 // Moving average of the delete latency in seconds
+	errorRate float64 // Moving average of failed deletes (between 0 and 1)
+	delay     time.Duration
+}
+
+func newPacer(threshold, maxDelay time.Duration) *pacer {
+	return &pacer{
+		threshold: threshold,
+		maxDelay:  maxDelay,
+	}
+}
+
+// observe records the latency and outcome of a single delete and returns the delay before the next delete.
+func (p *pacer) observe(latency time.Duration, failed bool) time.Duration {
+	p.latency = pacingWeight*latency.Seconds() + (1-pacingWeight)*p.latency
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	p.errorRate = pacingWeight*failure + (1-pacingWeight)*p.errorRate
+
+	if p.slow() {
+		p.delay *= 2
+		if p.delay < pacingMinDelay {
+			p.delay = pacingMinDelay
+		}
+		if p.delay > p.maxDelay {
+			p.delay = p.maxDelay
+		}
+	} else {
+		p.delay /= 2
+		if p.delay < pacingMinDelay {
+			p.delay = 0
+		}
+	}
+	return p.delay
+}
+
+// slow returns true when the moving averages show that etcd is slow or failing.
+func (p *pacer) slow() bool {
+	return p.latency > p.threshold.Seconds() || p.errorRate > pacingMaxErrorRate
+}
+
+// averageLatency returns the moving average of the delete latency, in whole milliseconds.
+func (p *pacer) averageLatency() time.Duration {
+	latency := time.Duration(p.latency * float64(time.Second))
+	return latency - latency%time.Millisecond
+}
+
+// waitForPacer waits for the delay set by adaptive pacing (if enabled) before the next delete,
+// adding the time waited to the given summary. Returns early when the service is stopped.
+func (s *Service) waitForPacer(summary *RunSummary) {
+	if s.pacer == nil || s.pacer.delay == 0 {
+		return
+	}
+	start := time.Now()
+	select {
+	case <-time.After(s.pacer.delay):
+	case <-s.stop:
+	}
+	summary.PacingDelay += time.Since(start)
+}
+
+// observeDelete records the latency and outcome of a delete that started at the given time in the pacer (if enabled).
+func (s *Service) observeDelete(start time.Time, failed bool) {
+	if s.pacer == nil {
+		return
+	}
+	previous := s.pacer.delay
+	delay := s.pacer.observe(time.Since(start), failed)
+	s.metrics.pacingDelay.Set(delay.Seconds())
+	switch {
+	case previous == 0 && delay > 0:
+		s.Logger.Warningf("etcd is slowing down (delete latency ~%s, %.0f%% failed), pacing deletes", s.pacer.averageLatency(), s.pacer.errorRate*100)
+	case previous > 0 && delay == 0:
+		s.Logger.Infof("etcd recovered (delete latency ~%s), deleting at full speed", s.pacer.averageLatency())
+	}
+}
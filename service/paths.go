@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	defaultFleetPrefix      = "/_coreos.com/fleet"
+	defaultUnitPathTemplate = "unit/" + unitHashPlaceholder
+	defaultJobPathTemplate  = "job/" + jobNamePlaceholder
+
+	unitHashPlaceholder = "{hash}"
+	jobNamePlaceholder  = "{name}"
+)
+
+// RegistryConfig holds the location of the fleet registry in etcd.
+// Fields that are not set use the layout of fleet itself.
+type RegistryConfig struct {
+	// Root of the fleet registry (defaults to /_coreos.com/fleet)
+	Prefix string `json:"prefix"`
+	// Key of a unit relative to Prefix, ending with "/{hash}" (defaults to unit/{hash})
+	UnitPathTemplate string `json:"unitPathTemplate,omitempty"`
+	// Directory of a job relative to Prefix, ending with "/{name}" (defaults to job/{name})
+	JobPathTemplate string `json:"jobPathTemplate,omitempty"`
+}
+
+// registryPaths holds the etcd keys of the directories of the fleet registry.
+type registryPaths struct {
+	fleet    string
+	unit     string // Directory containing all units
+	job      string // Directory containing all jobs
+	machines string
+	lease    string
+	states   string
+}
+
+// newRegistryPaths validates the given config and returns the paths of the registry it describes.
+func newRegistryPaths(config RegistryConfig) (registryPaths, error) {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultFleetPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") || path.Clean(prefix) != prefix || prefix == "/" {
+		return registryPaths{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid fleet prefix '%s', expected an absolute path like %s", prefix, defaultFleetPrefix))
+	}
+	unitDir, err := parsePathTemplate(config.UnitPathTemplate, defaultUnitPathTemplate, unitHashPlaceholder)
+	if err != nil {
+		return registryPaths{}, maskAny(err)
+	}
+	jobDir, err := parsePathTemplate(config.JobPathTemplate, defaultJobPathTemplate, jobNamePlaceholder)
+	if err != nil {
+		return registryPaths{}, maskAny(err)
+	}
+	if unitDir == jobDir {
+		return registryPaths{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "units and jobs cannot be stored in the same directory '%s'", unitDir))
+	}
+	return registryPaths{
+		fleet:    prefix,
+		unit:     path.Join(prefix, unitDir),
+		job:      path.Join(prefix, jobDir),
+		machines: path.Join(prefix, "machines"),
+		lease:    path.Join(prefix, "lease"),
+		states:   path.Join(prefix, "states"),
+	}, nil
+}
+
+// parsePathTemplate validates the given path template and returns the directory it describes.
+// A valid template is a relative path whose last element is the given placeholder, e.g. "unit/{hash}".
+func parsePathTemplate(template, defaultTemplate, placeholder string) (string, error) {
+	if template == "" {
+		template = defaultTemplate
+	}
+	dir, last := path.Split(template)
+	dir = strings.TrimSuffix(dir, "/")
+	switch {
+	case last != placeholder:
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid path template '%s', expected it to end with '/%s', e.g. '%s'", template, placeholder, defaultTemplate))
+	case strings.Contains(dir, placeholder):
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid path template '%s', '%s' can only be used once", template, placeholder))
+	case dir == "" || strings.HasPrefix(dir, "/") || path.Clean(dir) != dir || dir == ".." || strings.HasPrefix(dir, "../"):
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid path template '%s', expected a directory relative to the fleet prefix, e.g. '%s'", template, defaultTemplate))
+	}
+	switch dir {
+	case "machines", "lease", "states":
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid path template '%s', '%s' is used for other fleet keys", template, dir))
+	}
+	return dir, nil
+}
+
+// unitKey returns the key of the unit with given hash.
+func (p registryPaths) unitKey(hash string) string {
+	return path.Join(p.unit, hash)
+}
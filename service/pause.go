@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	pauseKey = toolPrefix + "/pause"
+)
+
+// Pause is stored at the pause key by operators to stop all instances (and all shards) from removing keys.
+// While the key exists, runs only report garbage.
+type Pause struct {
+	Reason   string    `json:"reason,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Pause makes all instances stop removing keys until Resume is called.
+// If ttl is positive, the pause expires automatically after ttl.
+func (s *Service) Pause(reason string, ttl time.Duration) error {
+	hostname, _ := os.Hostname()
+	raw, err := json.Marshal(Pause{
+		Reason:   reason,
+		Hostname: hostname,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Set(context.Background(), pauseKey, string(raw), &client.SetOptions{TTL: ttl}); err != nil {
+		return maskEtcd(err)
+	}
+	return nil
+}
+
+// Resume removes the pause key, so instances remove keys again.
+// Returns false if cleanups were not paused.
+func (s *Service) Resume() (bool, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	if _, err := keysAPI.Delete(context.Background(), pauseKey, nil); client.IsKeyNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, maskEtcd(err)
+	}
+	return true, nil
+}
+
+// Paused returns the pause set by an operator.
+// Returns false if cleanups are not paused. The pause key may be set by hand (e.g. with etcdctl),
+// in which case a value that is not a JSON object is used as the reason.
+func (s *Service) Paused() (Pause, bool, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), pauseKey, nil)
+	if client.IsKeyNotFound(err) {
+		return Pause{}, false, nil
+	} else if err != nil {
+		return Pause{}, false, maskEtcd(err)
+	}
+	var p Pause
+	if err := json.Unmarshal([]byte(resp.Node.Value), &p); err != nil {
+		p = Pause{Reason: resp.Node.Value}
+	}
+	return p, true, nil
+}
+
+// checkPause marks the current run as paused when an operator has set the pause key.
+func (s *Service) checkPause() error {
+	span := s.startPhase("check-pause")
+	p, paused, err := s.Paused()
+	span.End(err)
+	if err != nil {
+		return maskAny(err)
+	}
+	s.current.paused = paused
+	if paused {
+		reason := p.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		s.Logger.Warningf("Cleanups are paused (%s), not removing anything", reason)
+	}
+	return nil
+}
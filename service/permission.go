@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Name of a key (in the unit directory) that never exists, used to probe the permission to remove keys
+	deleteProbeName = ".fleet-cleanup-probe"
+)
+
+// checkDeletePermission verifies that the etcd credentials allow removing keys from the fleet registry,
+// by removing a key that does not exist. etcd checks permissions before looking up the key,
+// so a read-only role is refused while others get a "key not found" error.
+// Returns an error with cause PermissionDeniedError if keys cannot be removed.
+func (s *Service) checkDeletePermission() error {
+	if s.AssumeReadOnly {
+		return nil
+	}
+	span := s.startPhase("check-permission")
+	keysAPI := client.NewKeysAPI(s.client)
+	_, err := keysAPI.Delete(context.Background(), path.Join(s.paths.unit, deleteProbeName), nil)
+	if err == nil || client.IsKeyNotFound(err) {
+		span.End(nil)
+		return nil
+	}
+	err = maskEtcd(err)
+	span.End(err)
+	if IsPermissionDenied(err) {
+		return maskAny(errgo.WithCausef(err, PermissionDeniedError, "etcd refused to remove keys under %s, the credentials appear to be read-only", s.paths.fleet))
+	}
+	return maskAny(err)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Plan is a list of keys to remove, created by CreatePlan and executed by ApplyPlan.
+type Plan struct {
+	RunID    string      `json:"runID"`
+	Created  time.Time   `json:"created"`
+	Version  string      `json:"version"`
+	Endpoint string      `json:"endpoint"`
+	Entries  []PlanEntry `json:"entries"`
+}
+
+// PlanEntry is a single key in a plan.
+type PlanEntry struct {
+	Rule          string `json:"rule"`
+	Kind          string `json:"kind"`
+	Key           string `json:"key"`
+	Job           string `json:"job,omitempty"`
+	Action        string `json:"action"`
+	Value         string `json:"value"`
+	Dir           bool   `json:"dir,omitempty"`
+	CreatedIndex  uint64 `json:"createdIndex"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+}
+
+// newPlanEntry creates a plan entry for the given candidate.
+func newPlanEntry(c candidate) PlanEntry {
+	return PlanEntry{
+		Rule:          c.Rule,
+		Kind:          c.Kind,
+		Key:           c.Key,
+		Job:           c.Job,
+		Action:        c.Action,
+		Value:         c.Value,
+		Dir:           c.Dir,
+		CreatedIndex:  c.CreatedIndex,
+		ModifiedIndex: c.ModifiedIndex,
+	}
+}
+
+// candidate returns the candidate described by the plan entry.
+func (e PlanEntry) candidate() candidate {
+	return candidate{
+		Rule:          e.Rule,
+		Kind:          e.Kind,
+		Key:           e.Key,
+		Value:         e.Value,
+		Job:           e.Job,
+		CreatedIndex:  e.CreatedIndex,
+		ModifiedIndex: e.ModifiedIndex,
+		Dir:           e.Dir,
+		Action:        e.Action,
+		Severity:      ruleSeverity(e.Rule),
+	}
+}
+
+// CreatePlan performs a run that records the keys that would be removed in a plan, instead of removing them.
+func (s *Service) CreatePlan(opts RunOptions) (Plan, RunSummary, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, opts)
+	if err != nil {
+		return Plan{}, RunSummary{}, maskAny(err)
+	}
+	current.planning = true
+	current.outsideWindow = false // The maintenance window applies when the plan is applied
+	current.cacheable = false     // Plan entries are only collected by a full scan
+	if s.AssumeReadOnly && !s.ExporterOnly && opts.DryRun == nil {
+		// Creating a plan removes nothing, so read-only credentials (or an offline backup) suffice
+		current.dryRun = s.DryRun
+	}
+	summary, err := s.runWithState(current, s.run)
+	if err != nil {
+		return Plan{}, summary, maskAny(err)
+	}
+	plan := Plan{
+		RunID:    summary.RunID,
+		Created:  time.Now(),
+		Version:  s.Version,
+		Endpoint: s.EtcdURL.String(),
+		Entries:  s.current.plan,
+	}
+	return plan, summary, nil
+}
+
+// ApplyPlan removes all keys in the given plan. A key is only removed when it
+// has not been modified since the plan was created, other keys are skipped as resurrected.
+func (s *Service) ApplyPlan(plan Plan) (RunSummary, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, RunOptions{})
+	if err != nil {
+		return RunSummary{}, maskAny(err)
+	}
+	if plan.Endpoint != s.EtcdURL.String() {
+		s.Logger.Warningf("Plan %s was created for %s, applying it to %s", plan.RunID, plan.Endpoint, s.EtcdURL.String())
+	}
+	summary, err := s.runWithState(current, func() (RunSummary, error) { return s.applyPlan(plan) })
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	return summary, nil
+}
+
+// applyPlan removes all keys in the given plan, returning a summary of the results.
+func (s *Service) applyPlan(plan Plan) (RunSummary, error) {
+	start := time.Now()
+	summary := RunSummary{
+		RunID:  s.current.id,
+		DryRun: s.current.dryRun,
+	}
+	var candidates []candidate
+	for _, e := range plan.Entries {
+		if e.Action != ActionDelete && e.Action != ActionSoftDelete && e.Action != ActionRestoreTTL {
+			return summary, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "plan contains %s with invalid action '%s'", e.Key, e.Action))
+		}
+		if e.ModifiedIndex == 0 {
+			return summary, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "plan contains %s without modified index", e.Key))
+		}
+		switch e.Kind {
+		case kindUnit:
+			summary.ObsoleteUnits++
+		case kindLease:
+			if e.Rule != RuleMissingTTL {
+				summary.StaleLeases++
+			}
+		case kindMachine:
+			// Only found by the missing-ttl rule
+		case kindState:
+			summary.OrphanStates++
+		default:
+			return summary, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "plan contains %s with invalid kind '%s'", e.Key, e.Kind))
+		}
+		if rs := summary.rule(e.Rule); rs != nil {
+			rs.Candidates++
+		} else {
+			summary.Rules = append(summary.Rules, RuleResult{Name: e.Rule, Candidates: 1})
+		}
+		candidates = append(candidates, e.candidate())
+	}
+
+	if err := s.checkPause(); err != nil {
+		return summary, maskAny(err)
+	}
+	summary.Paused = s.current.paused
+	if s.skipReason() == "" {
+		if err := s.checkClusterHealth(); err != nil {
+			return summary, maskAny(err)
+		}
+		if err := s.checkDeletePermission(); err != nil {
+			return summary, maskAny(err)
+		}
+		if err := s.lockRun(); err != nil {
+			return summary, maskAny(err)
+		}
+		defer s.releaseRunLock()
+	}
+	s.sortCandidates(candidates)
+	s.current.candidates = candidates
+	err := s.removeCandidates(candidates, &summary)
+	s.recordBudget(candidates, &summary)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	s.Logger.Infof("Applied plan %s: removed %d of %d keys", plan.RunID, summary.RemovedUnits+summary.RemovedLeases+summary.RemovedStates, len(candidates))
+	if s.VerifyDeletes {
+		if err := s.verifyDeletes(candidates, &summary); err != nil {
+			return summary, maskAny(err)
+		}
+	}
+
+	summary.Duration = time.Since(start)
+	if summary.FailedDeletes > 0 {
+		return summary, maskAny(errgo.WithCausef(nil, DeleteFailedError, "failed to remove %d keys", summary.FailedDeletes))
+	}
+	return summary, nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Actions performed on the candidates of a rule
+const (
+	ActionReport     = "report"      // Only report candidates
+	ActionSoftDelete = "soft-delete" // Move candidates to the trash, then remove them
+	ActionDelete     = "delete"      // Remove candidates
+	ActionRestoreTTL = "restore-ttl" // Set a TTL on candidates, so they expire unless refreshed by their owner (missing-ttl only)
+)
+
+// Types of notifiers that receive alerts
+const (
+	NotifierWebhook   = "webhook"   // Post a JSON document to a generic webhook
+	NotifierSlack     = "slack"     // Post a message to a Slack incoming webhook
+	NotifierPagerDuty = "pagerduty" // Trigger a PagerDuty incident (events API v2)
+	NotifierStdout    = "stdout"    // Write a JSON document to standard output
+)
+
+// Policy holds per-rule settings, typically loaded from a policy file.
+type Policy struct {
+	Rules map[string]RulePolicy `json:"rules,omitempty"`
+	// Notifiers that receive alerts, by name
+	Notifiers map[string]NotifierPolicy `json:"notifiers,omitempty"`
+}
+
+// NotifierPolicy holds the settings of a single notifier.
+type NotifierPolicy struct {
+	// Type of the notifier (webhook|slack|pagerduty|stdout)
+	Type string `json:"type"`
+	// URL to post alerts to (webhook & slack, optional for pagerduty)
+	URL string `json:"url,omitempty"`
+	// Integration key of the PagerDuty service (pagerduty only)
+	RoutingKey string `json:"routingKey,omitempty"`
+}
+
+// Validate returns an error when the notifier settings are incomplete.
+func (np NotifierPolicy) Validate() error {
+	switch np.Type {
+	case NotifierWebhook, NotifierSlack:
+		if np.URL == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "%s notifier requires a url", np.Type))
+		}
+	case NotifierPagerDuty:
+		if np.RoutingKey == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "%s notifier requires a routing-key", np.Type))
+		}
+	case NotifierStdout:
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "type '%s' is not valid, expected %s, %s, %s or %s", np.Type, NotifierWebhook, NotifierSlack, NotifierPagerDuty, NotifierStdout))
+	}
+	return nil
+}
+
+// RulePolicy holds the settings of a single cleanup rule.
+// Fields that are not set use the defaults of the rule.
+type RulePolicy struct {
+	// Enables (true) or disables (false) the rule
+	Enabled *bool `json:"enabled,omitempty"`
+	// Candidates that have changed more recently are not removed.
+	// Since ages are estimated, candidates with an unknown age are not removed either.
+	MinAge time.Duration `json:"minAge,omitempty"`
+	// If set, only candidates whose key or job name matches one of these regular expressions are removed
+	Include []string `json:"include,omitempty"`
+	// Candidates whose key or job name matches one of these regular expressions are not removed
+	Exclude []string `json:"exclude,omitempty"`
+	// Maximum number of candidates of this rule to remove in a single run (0 means unlimited)
+	MaxDelete int `json:"maxDelete,omitempty"`
+	// Action to perform on candidates (report|soft-delete|delete|restore-ttl)
+	Action string `json:"action,omitempty"`
+	// Candidates of units with one of these types (e.g. template or global) are not removed
+	ProtectUnitTypes []string `json:"protectUnitTypes,omitempty"`
+}
+
+// withActions returns a copy of the policy in which the actions of the given rules are replaced.
+func (p Policy) withActions(actions map[string]string) Policy {
+	if len(actions) == 0 {
+		return p
+	}
+	result := Policy{Rules: make(map[string]RulePolicy), Notifiers: p.Notifiers}
+	for name, rp := range p.Rules {
+		result.Rules[name] = rp
+	}
+	for name, action := range actions {
+		rp := result.Rules[name]
+		rp.Action = action
+		result.Rules[name] = rp
+	}
+	return result
+}
+
+// compiledRulePolicy is a validated RulePolicy.
+type compiledRulePolicy struct {
+	RulePolicy
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// compilePolicy validates the given policy and compiles all patterns in it.
+func compilePolicy(p Policy) (map[string]compiledRulePolicy, error) {
+	result := make(map[string]compiledRulePolicy)
+	for name, rp := range p.Rules {
+		if _, ok := findRule(name); !ok {
+			return nil, maskAny(validateRules(map[string]bool{name: true}))
+		}
+		if err := validateAction(rp.Action); err != nil {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "rule %s: %s", name, err))
+		}
+		if r, _ := findRule(name); r.ReportOnly && rp.Action != "" && rp.Action != ActionReport {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "rule %s only supports action %s", name, ActionReport))
+		}
+		if rp.Action == ActionRestoreTTL && name != RuleMissingTTL {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "rule %s does not support action %s", name, ActionRestoreTTL))
+		}
+		if rp.MinAge < 0 || rp.MaxDelete < 0 {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "rule %s: min-age and max-delete cannot be negative", name))
+		}
+		include, err := compilePatterns(rp.Include)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "rule %s: invalid include pattern", name))
+		}
+		exclude, err := compilePatterns(rp.Exclude)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "rule %s: invalid exclude pattern", name))
+		}
+		result[name] = compiledRulePolicy{
+			RulePolicy: rp,
+			include:    include,
+			exclude:    exclude,
+		}
+	}
+	return result, nil
+}
+
+// validateAction checks that the given action is known. An empty action is valid (uses the rule default).
+func validateAction(action string) error {
+	switch action {
+	case "", ActionReport, ActionSoftDelete, ActionDelete, ActionRestoreTTL:
+		return nil
+	default:
+		return errgo.Newf("unknown action '%s', expected %s, %s, %s or %s", action, ActionReport, ActionSoftDelete, ActionDelete, ActionRestoreTTL)
+	}
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// matches returns true when the key or job name of the given candidate matches one of the given patterns.
+func matches(patterns []*regexp.Regexp, c candidate) bool {
+	for _, re := range patterns {
+		if re.MatchString(c.Key) || (c.Job != "" && re.MatchString(c.Job)) {
+			return true
+		}
+	}
+	return false
+}
+
+// policySkipReason returns the reason why the given rule policy does not allow the given candidate
+// to be removed. Returns an empty string when the candidate can be removed.
+func (s *Service) policySkipReason(p compiledRulePolicy, c candidate) string {
+	if len(p.include) > 0 && !matches(p.include, c) {
+		return SkipReasonExcluded
+	}
+	if matches(p.exclude, c) {
+		return SkipReasonExcluded
+	}
+	if hasUnitType(c.UnitTypes, p.ProtectUnitTypes) {
+		return SkipReasonProtectedUnitType
+	}
+	if p.MinAge > 0 {
+		if age := s.indexClock.Age(c.ModifiedIndex); age == 0 || age < p.MinAge {
+			return SkipReasonTooYoung
+		}
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+)
+
+const keysAPIPath = "/v2/keys"
+
+// prefixTransport adds a prefix to all keys sent to etcd and removes it from all keys received,
+// so the registry can be accessed through a proxy that stores all keys below an extra prefix
+// (e.g. a namespaced etcd grpc-proxy).
+type prefixTransport struct {
+	client.CancelableTransport
+
+	prefix   string
+	mutex    sync.Mutex
+	inflight map[*http.Request]*http.Request // Original request -> request with prefixed key
+}
+
+// newPrefixTransport wraps the given transport such that the given prefix is added to all keys.
+func newPrefixTransport(t client.CancelableTransport, prefix string) *prefixTransport {
+	return &prefixTransport{
+		CancelableTransport: t,
+		prefix:              prefix,
+		inflight:            make(map[*http.Request]*http.Request),
+	}
+}
+
+// normalizeKeyPrefix returns the given key prefix without trailing slashes, or an error if it is not valid.
+func normalizeKeyPrefix(prefix string) (string, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key prefix '%s' must start with '/'", prefix))
+	}
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" || path.Clean(prefix) != prefix {
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid key prefix '%s'", prefix))
+	}
+	return prefix, nil
+}
+
+// RoundTrip sends a copy of the given request with the prefix added to its key, and removes the prefix
+// from all keys in the response.
+func (t *prefixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, keysAPIPath+"/") && req.URL.Path != keysAPIPath {
+		// Not a key (e.g. version or members)
+		return t.CancelableTransport.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request, so send a copy
+	clone := new(http.Request)
+	*clone = *req
+	u := *req.URL
+	u.Path = keysAPIPath + t.prefix + strings.TrimPrefix(req.URL.Path, keysAPIPath)
+	u.RawPath = ""
+	clone.URL = &u
+
+	t.mutex.Lock()
+	t.inflight[req] = clone
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.inflight, req)
+		t.mutex.Unlock()
+	}()
+	resp, err := t.CancelableTransport.RoundTrip(clone)
+	if err != nil {
+		return resp, err
+	}
+
+	// Remove the prefix from all keys in the response (the body is read here, so watches can still be canceled)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		body = t.stripPrefix(body)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// CancelRequest cancels the copy of the given request.
+func (t *prefixTransport) CancelRequest(req *http.Request) {
+	t.mutex.Lock()
+	clone, ok := t.inflight[req]
+	t.mutex.Unlock()
+	if ok {
+		t.CancelableTransport.CancelRequest(clone)
+	}
+}
+
+// stripPrefix removes the prefix from all keys (and the key in the cause of errors) in the given JSON response.
+// A body that cannot be parsed is returned as is.
+func (t *prefixTransport) stripPrefix(body []byte) []byte {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // Keep indexes exact
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for name, x := range v {
+				if s, ok := x.(string); ok && (name == "key" || name == "cause") {
+					if s == t.prefix {
+						v[name] = "/"
+					} else if strings.HasPrefix(s, t.prefix+"/") {
+						v[name] = strings.TrimPrefix(s, t.prefix)
+					}
+					continue
+				}
+				strip(x)
+			}
+		case []interface{}:
+			for _, x := range v {
+				strip(x)
+			}
+		}
+	}
+	strip(value)
+	result, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return result
+}
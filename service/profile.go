@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"runtime"
+	"time"
+)
+
+// RunProfile contains resource usage of a single run (see ServiceConfig.ProfileRun).
+type RunProfile struct {
+	PeakRSSBytes  uint64        `json:"peakRSSBytes"`  // Peak resident set size of the process so far (0 if unknown)
+	PeakHeapBytes uint64        `json:"peakHeapBytes"` // Largest heap size seen at the start & end of the phases of the run
+	AllocBytes    uint64        `json:"allocBytes"`    // Bytes allocated during the run
+	Allocs        uint64        `json:"allocs"`        // Number of allocations during the run
+	NumGC         uint32        `json:"numGC"`         // Number of garbage collections during the run
+	Phases        []PhaseTiming `json:"phases"`
+}
+
+// runProfiler tracks the resource usage of a run.
+type runProfiler struct {
+	start    runtime.MemStats
+	peakHeap uint64
+}
+
+// newRunProfiler creates a profiler that measures from now on.
+func newRunProfiler() *runProfiler {
+	p := &runProfiler{}
+	runtime.ReadMemStats(&p.start)
+	p.peakHeap = p.start.HeapAlloc
+	return p
+}
+
+// sample updates the peak heap size.
+// Reading the memory statistics briefly stops the world, so this is only done between phases.
+func (p *runProfiler) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > p.peakHeap {
+		p.peakHeap = m.HeapAlloc
+	}
+}
+
+// finish returns the resource usage since the profiler was created.
+func (p *runProfiler) finish(phases []PhaseTiming) *RunProfile {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > p.peakHeap {
+		p.peakHeap = m.HeapAlloc
+	}
+	return &RunProfile{
+		PeakRSSBytes:  peakRSS(),
+		PeakHeapBytes: p.peakHeap,
+		AllocBytes:    m.TotalAlloc - p.start.TotalAlloc,
+		Allocs:        m.Mallocs - p.start.Mallocs,
+		NumGC:         m.NumGC - p.start.NumGC,
+		Phases:        phases,
+	}
+}
+
+// phaseTimings returns the phases of the current run with their durations.
+// Every phase lasts until the next one starts, the last one until the given end.
+func (s *Service) phaseTimings(end time.Time) []PhaseTiming {
+	phases := make([]PhaseTiming, len(s.current.phases))
+	copy(phases, s.current.phases)
+	for i := range phases {
+		phaseEnd := end
+		if i+1 < len(phases) {
+			phaseEnd = phases[i+1].Started
+		}
+		phases[i].Duration = phaseEnd.Sub(phases[i].Started)
+	}
+	return phases
+}
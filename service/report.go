@@ -0,0 +1,179 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"time"
+)
+
+// ReportSchemaVersion is the version of the JSON schema of Report, Candidate, RuleResult & RunSummary.
+// It is incremented on every change that is not backwards compatible (e.g. a renamed or removed field),
+// adding a field does not change the version.
+const ReportSchemaVersion = 2
+
+const (
+	ReportStatusRemoved  = "removed"
+	ReportStatusRestored = "restored" // The TTL of the key was restored (see ActionRestoreTTL)
+	ReportStatusSkipped  = "skipped"
+	ReportStatusFailed   = "failed"
+	ReportStatusFound    = "found" // Neither removed nor skipped, e.g. because the run failed before removing it
+)
+
+// Report contains the full results of a single cleanup run.
+// It is the stable schema of all JSON reports, both of the CLI and of programs embedding the service.
+type Report struct {
+	SchemaVersion int            `json:"schemaVersion"` // See ReportSchemaVersion
+	RunID         string         `json:"runID"`
+	Endpoint      string         `json:"endpoint"`
+	Started       time.Time      `json:"started"`
+	Duration      time.Duration  `json:"duration"`
+	Error         string         `json:"error,omitempty"`
+	Summary       RunSummary     `json:"summary"`
+	Candidates    []Candidate    `json:"candidates"`
+	Protected     map[string]int `json:"protected"` // Number of candidates that were not removed, by reason (see Candidate.Reason)
+	Errors        []string       `json:"errors"`
+	Phases        []PhaseTiming  `json:"phases"`
+}
+
+// Candidate describes a single key found by a cleanup rule and what happened to it.
+type Candidate struct {
+	Rule          string            `json:"rule"`
+	Kind          string            `json:"kind"`
+	Key           string            `json:"key"`
+	Job           string            `json:"job,omitempty"`
+	CreatedIndex  uint64            `json:"createdIndex"`
+	ModifiedIndex uint64            `json:"modifiedIndex"`
+	Dir           bool              `json:"dir,omitempty"` // Set when the key is a directory
+	Action        string            `json:"action,omitempty"`
+	Severity      string            `json:"severity"`
+	Owners        map[string]string `json:"owners,omitempty"` // Owner labels (see ServiceConfig.OwnerLabels)
+	UnitTypes     []string          `json:"unitTypes,omitempty"`
+	Status        string            `json:"status"`
+	Reason        string            `json:"reason,omitempty"` // Reason why the key was not removed (see SkipReason* constants)
+	Error         string            `json:"error,omitempty"`  // Error message of a failed delete
+}
+
+// PhaseTiming contains the start & duration of a single phase of a run.
+type PhaseTiming struct {
+	Name     string        `json:"name"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RunReporter is notified of the report of every run that removed (or failed to remove) keys, and of every failed
+// run that was allowed to remove keys.
+type RunReporter interface {
+	ReportRun(report Report)
+}
+
+// LastReport returns the report of the latest run.
+// Returns false if no run has finished yet.
+func (s *Service) LastReport() (Report, bool) {
+	s.reportMutex.Lock()
+	defer s.reportMutex.Unlock()
+	if s.lastReport == nil {
+		return Report{}, false
+	}
+	return *s.lastReport, true
+}
+
+// recordReport creates a report of the current run and stores it as the latest report.
+// The report is passed to the run reporter (if any) when the run removed or failed to remove keys
+// of at least the minimum severity.
+func (s *Service) recordReport(start time.Time, summary RunSummary, runErr error) {
+	end := time.Now()
+	report := &Report{
+		SchemaVersion: ReportSchemaVersion,
+		RunID:         s.current.id,
+		Endpoint:      s.EtcdURL.String(),
+		Started:       start,
+		Duration:      end.Sub(start),
+		Summary:       summary,
+		Candidates:    []Candidate{},
+		Protected:     make(map[string]int),
+		Errors:        []string{},
+		Phases:        s.phaseTimings(end),
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+		report.Errors = append(report.Errors, runErr.Error())
+	}
+	for _, c := range s.current.candidates {
+		rc := Candidate{
+			Rule:          c.Rule,
+			Kind:          c.Kind,
+			Key:           c.Key,
+			Job:           c.Job,
+			CreatedIndex:  c.CreatedIndex,
+			ModifiedIndex: c.ModifiedIndex,
+			Dir:           c.Dir,
+			Action:        c.Action,
+			Severity:      c.Severity,
+			Owners:        c.Owners,
+			UnitTypes:     c.UnitTypes,
+			Reason:        c.notRemovedReason(),
+			Error:         c.Error,
+		}
+		switch {
+		case c.Removed:
+			rc.Status = ReportStatusRemoved
+		case c.Restored:
+			rc.Status = ReportStatusRestored
+		case c.Error != "":
+			rc.Status = ReportStatusFailed
+			report.Errors = append(report.Errors, c.Error)
+		case c.Skip != "":
+			rc.Status = ReportStatusSkipped
+		default:
+			rc.Status = ReportStatusFound
+		}
+		if rc.Reason != "" {
+			report.Protected[rc.Reason]++
+		}
+		report.Candidates = append(report.Candidates, rc)
+	}
+	sort.Sort(reportCandidatesByKey(report.Candidates))
+
+	s.reportMutex.Lock()
+	s.lastReport = report
+	s.reportMutex.Unlock()
+
+	if s.Reports == nil || s.current.planning {
+		return
+	}
+	// Only notify about garbage of at least the minimum severity
+	notified := *report
+	notified.Candidates = []Candidate{}
+	changed := 0
+	for _, c := range report.Candidates {
+		if !s.severityShown(c.Severity) {
+			continue
+		}
+		notified.Candidates = append(notified.Candidates, c)
+		if c.Status == ReportStatusRemoved || c.Status == ReportStatusFailed {
+			changed++
+		}
+	}
+	if changed > 0 || (runErr != nil && !s.current.reportOnly()) {
+		s.Reports.ReportRun(notified)
+	}
+}
+
+type reportCandidatesByKey []Candidate
+
+func (l reportCandidatesByKey) Len() int           { return len(l) }
+func (l reportCandidatesByKey) Less(i, j int) bool { return l[i].Key < l[j].Key }
+func (l reportCandidatesByKey) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	retryQueueKey = toolPrefix + "/retry"
+)
+
+// retryFailedDeletes removes all keys that could not be removed in a previous run.
+// It returns the retried candidates, including the outcome of removing them.
+func (s *Service) retryFailedDeletes(summary *RunSummary) ([]candidate, error) {
+	span := s.startPhase("load-retry-queue")
+	entries, err := s.loadRetryQueue()
+	span.End(err)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	retries := make([]candidate, 0, len(entries))
+	for _, e := range entries {
+		if (e.Kind != kindUnit && e.Kind != kindLease && e.Kind != kindState) || (e.Action != ActionDelete && e.Action != ActionSoftDelete) {
+			s.Logger.Warningf("Ignoring invalid retry queue entry for %s (kind '%s', action '%s')", e.Key, e.Kind, e.Action)
+			continue
+		}
+		c := e.candidate()
+		c.Retry = true
+		retries = append(retries, c)
+	}
+	s.Logger.Infof("Retrying %d keys that could not be removed in a previous run", len(retries))
+	summary.Retried = len(retries)
+	if err := s.removeCandidates(retries, summary); err != nil {
+		return retries, maskAny(err)
+	}
+	return retries, nil
+}
+
+// updateRetryQueue replaces the retry queue with all given candidates that could not be removed.
+// Retried candidates that are skipped stay in the queue, unless they no longer exist,
+// were modified or are referenced again.
+func (s *Service) updateRetryQueue(candidates []candidate) {
+	var entries []PlanEntry
+	index := make(map[string]int)
+	for _, c := range candidates {
+		keep := c.Error != "" || c.Skip == SkipReasonTimeout
+		if c.Retry && !c.Removed {
+			switch c.Skip {
+			case SkipReasonGone, SkipReasonModified, SkipReasonReferenced:
+			default:
+				keep = true
+			}
+		}
+		if !keep {
+			continue
+		}
+		if i, ok := index[c.Key]; ok {
+			// Found again in this run, keep the latest version
+			entries[i] = newPlanEntry(c)
+			continue
+		}
+		index[c.Key] = len(entries)
+		entries = append(entries, newPlanEntry(c))
+	}
+	if len(entries) > 0 {
+		s.Logger.Warningf("Queued %d keys to retry in the next run", len(entries))
+	}
+	if err := s.saveRetryQueue(entries); err != nil {
+		s.Logger.Warningf("Failed to update retry queue: %#v", err)
+	}
+}
+
+// loadRetryQueue reads the entries of the retry queue. A missing queue is empty.
+func (s *Service) loadRetryQueue() ([]PlanEntry, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), retryQueueKey, nil)
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, maskEtcd(err)
+	}
+	var entries []PlanEntry
+	if err := json.Unmarshal([]byte(resp.Node.Value), &entries); err != nil {
+		// Do not get stuck on a corrupt queue, the keys will be found again by later runs
+		s.Logger.Warningf("Cannot parse retry queue '%s', ignoring it: %#v", resp.Node.Value, err)
+		return nil, nil
+	}
+	return entries, nil
+}
+
+// saveRetryQueue stores the given entries in the retry queue. The queue is removed when it is empty.
+func (s *Service) saveRetryQueue(entries []PlanEntry) error {
+	keysAPI := client.NewKeysAPI(s.client)
+	if len(entries) == 0 {
+		if _, err := keysAPI.Delete(context.Background(), retryQueueKey, nil); err != nil && !client.IsKeyNotFound(err) {
+			return maskEtcd(err)
+		}
+		return nil
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return maskAny(err)
+	}
+	if _, err := keysAPI.Set(context.Background(), retryQueueKey, string(raw), nil); err != nil {
+		return maskEtcd(err)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// rule detects a single class of garbage in the fleet registry.
+type rule struct {
+	Name        string
+	Description string
+	// Set when the rule runs unless explicitly disabled
+	Enabled bool
+	// Set when candidates of this rule are only reported, never removed
+	ReportOnly bool
+	// If set, returns the reason why candidates of this rule are only reported in the current configuration
+	cleanupDisabled func(s *Service) string
+	// find returns all candidates of this rule
+	find func(s *Service, scan *registryScan, summary *RunSummary) ([]candidate, error)
+}
+
+// Rule names
+const (
+	RuleOrphanUnits  = "orphan-units"
+	RuleStaleLeases  = "stale-leases"
+	RuleOrphanStates = "orphan-states"
+	RuleMissingTTL   = "missing-ttl"
+	RuleBrokenJobs   = "broken-jobs"
+	RuleInactiveJobs = "old-inactive-jobs"
+)
+
+// Severity of the candidates of each rule, unless set by the rule itself
+var ruleSeverities = map[string]string{
+	RuleOrphanUnits:  SeverityWarning,
+	RuleStaleLeases:  SeverityInfo,
+	RuleOrphanStates: SeverityInfo,
+	RuleMissingTTL:   SeverityWarning,
+	RuleBrokenJobs:   SeverityCritical,
+	RuleInactiveJobs: SeverityInfo,
+}
+
+// rules contains all cleanup rules, in the order in which they run.
+var rules = []rule{
+	{
+		Name:        RuleOrphanUnits,
+		Description: "Units that are no longer referenced by a job",
+		Enabled:     true,
+		find:        (*Service).findObsoleteUnits,
+	},
+	{
+		Name:        RuleStaleLeases,
+		Description: "Leases owned by machines that are no longer registered (removed with --clean-leases)",
+		Enabled:     true,
+		find:        (*Service).findStaleLeases,
+		cleanupDisabled: func(s *Service) string {
+			if !s.CleanLeases {
+				return SkipReasonLeaseCleanupDisabled
+			}
+			return ""
+		},
+	},
+	{
+		Name:        RuleOrphanStates,
+		Description: "Unit states of machines that are no longer registered or of units without a job (removed with --clean-states)",
+		Enabled:     true,
+		find:        (*Service).findOrphanStates,
+		cleanupDisabled: func(s *Service) string {
+			if !s.CleanStates {
+				return SkipReasonStateCleanupDisabled
+			}
+			return ""
+		},
+	},
+	{
+		Name:        RuleMissingTTL,
+		Description: "Machine presence keys and leases without a TTL, e.g. after restoring etcd from a backup (fixed with --rule missing-ttl=restore-ttl)",
+		Enabled:     true,
+		find:        (*Service).findMissingTTLs,
+		cleanupDisabled: func(s *Service) string {
+			// Only fixed when an action is set explicitly
+			return SkipReasonReportOnly
+		},
+	},
+	{
+		Name:        RuleBrokenJobs,
+		Description: "Jobs without a valid object or whose unit no longer exists",
+		ReportOnly:  true,
+		find:        (*Service).findBrokenJobs,
+	},
+	{
+		Name:        RuleInactiveJobs,
+		Description: "Jobs with target state inactive that have not changed for a long time",
+		ReportOnly:  true,
+		find:        (*Service).findInactiveJobs,
+	},
+}
+
+// RuleInfo describes a cleanup rule.
+type RuleInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Severity    string `json:"severity"`
+	Enabled     bool   `json:"enabled"` // Enabled by default
+	ReportOnly  bool   `json:"reportOnly"`
+}
+
+// Rules returns a description of all cleanup rules.
+func Rules() []RuleInfo {
+	var result []RuleInfo
+	for _, r := range rules {
+		result = append(result, RuleInfo{
+			Name:        r.Name,
+			Description: r.Description,
+			Severity:    ruleSeverity(r.Name),
+			Enabled:     r.Enabled,
+			ReportOnly:  r.ReportOnly,
+		})
+	}
+	return result
+}
+
+// validateRules checks that all rules in the given map exist.
+func validateRules(enabled map[string]bool) error {
+	var unknown []string
+	for name := range enabled {
+		if _, ok := findRule(name); !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		var names []string
+		for _, r := range rules {
+			names = append(names, r.Name)
+		}
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown rule(s) %s, expected one of %s", strings.Join(unknown, ", "), strings.Join(names, ", ")))
+	}
+	return nil
+}
+
+// findRule returns the rule with given name.
+func findRule(name string) (rule, bool) {
+	for _, r := range rules {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return rule{}, false
+}
+
+// enabledRules returns all rules that run in the current configuration.
+func (s *Service) enabledRules() []rule {
+	var result []rule
+	for _, r := range rules {
+		enabled := r.Enabled
+		if p, ok := s.policies[r.Name]; ok && p.Enabled != nil {
+			enabled = *p.Enabled
+		}
+		if override, ok := s.Rules[r.Name]; ok {
+			enabled = override
+		}
+		if enabled {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// ruleAction returns the action to perform on candidates of the given rule.
+// When the action is ActionReport, the reason for only reporting candidates is returned as well.
+func (s *Service) ruleAction(r rule) (string, string) {
+	if r.ReportOnly {
+		return ActionReport, SkipReasonReportOnly
+	}
+	if p, ok := s.policies[r.Name]; ok && p.Action != "" {
+		if p.Action == ActionReport {
+			return ActionReport, SkipReasonReportOnly
+		}
+		return p.Action, ""
+	}
+	if r.cleanupDisabled != nil {
+		if reason := r.cleanupDisabled(s); reason != "" {
+			return ActionReport, reason
+		}
+	}
+	return ActionDelete, ""
+}
+
+// runRules runs all enabled rules, returning the candidates of all of them.
+func (s *Service) runRules(summary *RunSummary) ([]candidate, error) {
+	scan := s.newRegistryScan(summary)
+	var result []candidate
+	for _, r := range s.enabledRules() {
+		span := s.startPhase("rule-" + r.Name)
+		s.current.rule = r.Name
+		candidates, err := r.find(s, scan, summary)
+		span.SetAttribute("candidates", len(candidates))
+		span.End(err)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, s.ruleCandidates(r, candidates, summary)...)
+	}
+	return result, nil
+}
+
+// ruleCandidates sets the action (and skip reason) of the given candidates found by the given rule,
+// and adds them to the given summary.
+func (s *Service) ruleCandidates(r rule, candidates []candidate, summary *RunSummary) []candidate {
+	action, reason := s.ruleAction(r)
+	policy, hasPolicy := s.policies[r.Name]
+	for i, c := range candidates {
+		candidates[i].Action = action
+		if c.Skip != "" {
+			continue
+		}
+		if action == ActionReport {
+			candidates[i].Skip = reason
+		} else if hasUnitType(c.UnitTypes, s.ProtectUnitTypes) {
+			candidates[i].Skip = SkipReasonProtectedUnitType
+		} else if hasPolicy {
+			candidates[i].Skip = s.policySkipReason(policy, c)
+		}
+	}
+	summary.Rules = append(summary.Rules, RuleResult{Name: r.Name, Severity: ruleSeverity(r.Name), Candidates: len(candidates)})
+	for _, c := range candidates {
+		if summary.Severities == nil {
+			summary.Severities = make(map[string]int)
+		}
+		summary.Severities[c.Severity]++
+		for _, t := range c.UnitTypes {
+			if summary.UnitTypes == nil {
+				summary.UnitTypes = make(map[string]int)
+			}
+			summary.UnitTypes[t]++
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	engineLeaderLease = "engine-leader"
+)
+
+// checkRescheduling inspects the fleet engine leader lease and the recent churn
+// in the job registry. It returns a non-empty reason when fleet appears to be
+// rescheduling jobs, in which case deletions should be postponed.
+func (s *Service) checkRescheduling() (string, error) {
+	if s.ChurnIndexWindow == 0 {
+		// Safety check disabled
+		return "", nil
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+
+	// Check engine leader
+	leaseKey := path.Join(s.paths.lease, engineLeaderLease)
+	resp, err := keysAPI.Get(context.Background(), leaseKey, &client.GetOptions{})
+	if client.IsKeyNotFound(err) {
+		return fmt.Sprintf("no fleet engine leader found at %s", leaseKey), nil
+	} else if err != nil {
+		return "", maskEtcd(err)
+	}
+	if resp.Node != nil && resp.Index-resp.Node.CreatedIndex < s.ChurnIndexWindow {
+		return fmt.Sprintf("fleet engine leader changed recently (at index %d, now %d)", resp.Node.CreatedIndex, resp.Index), nil
+	}
+
+	// Check job churn
+	resp, err = keysAPI.Get(context.Background(), s.paths.job, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", maskEtcd(err)
+	}
+	if lastModified := maxModifiedIndex(resp.Node); resp.Index-lastModified < s.ChurnIndexWindow {
+		return fmt.Sprintf("jobs changed recently (at index %d, now %d)", lastModified, resp.Index), nil
+	}
+
+	return "", nil
+}
+
+// maxModifiedIndex returns the highest modified index of the given node and all its children.
+func maxModifiedIndex(n *client.Node) uint64 {
+	if n == nil {
+		return 0
+	}
+	result := n.ModifiedIndex
+	for _, c := range n.Nodes {
+		if idx := maxModifiedIndex(c); idx > result {
+			result = idx
+		}
+	}
+	return result
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Scan contains the garbage found by a run, created by ScanWithOptions and removed by RunWithScan,
+// so an expensive scan of the registry can be done once and its garbage removed later (or elsewhere).
+type Scan struct {
+	RunID         string      `json:"runID"`
+	Created       time.Time   `json:"created"`
+	Version       string      `json:"version"`
+	Endpoint      string      `json:"endpoint"`
+	Jobs          int         `json:"jobs"`
+	Units         int         `json:"units"`
+	Leases        int         `json:"leases"`
+	States        int         `json:"states"`
+	RegistryBytes int64       `json:"registryBytes"`
+	Entries       []ScanEntry `json:"entries"`
+}
+
+// ScanEntry is a single key found by a rule in a scan.
+type ScanEntry struct {
+	Rule          string            `json:"rule"`
+	Kind          string            `json:"kind"`
+	Key           string            `json:"key"`
+	Job           string            `json:"job,omitempty"`
+	Value         string            `json:"value"`
+	Detail        string            `json:"detail,omitempty"`
+	Severity      string            `json:"severity"`
+	Owners        map[string]string `json:"owners,omitempty"`
+	UnitTypes     []string          `json:"unitTypes,omitempty"`
+	CreatedIndex  uint64            `json:"createdIndex"`
+	ModifiedIndex uint64            `json:"modifiedIndex"`
+	Dir           bool              `json:"dir,omitempty"`
+}
+
+// newScanEntry creates a scan entry for the given candidate.
+func newScanEntry(c candidate) ScanEntry {
+	return ScanEntry{
+		Rule:          c.Rule,
+		Kind:          c.Kind,
+		Key:           c.Key,
+		Job:           c.Job,
+		Value:         c.Value,
+		Detail:        c.Detail,
+		Severity:      c.Severity,
+		Owners:        c.Owners,
+		UnitTypes:     c.UnitTypes,
+		CreatedIndex:  c.CreatedIndex,
+		ModifiedIndex: c.ModifiedIndex,
+		Dir:           c.Dir,
+	}
+}
+
+// candidate returns the candidate described by the scan entry.
+func (e ScanEntry) candidate() candidate {
+	return candidate{
+		Rule:          e.Rule,
+		Kind:          e.Kind,
+		Key:           e.Key,
+		Value:         e.Value,
+		Job:           e.Job,
+		Detail:        e.Detail,
+		CreatedIndex:  e.CreatedIndex,
+		ModifiedIndex: e.ModifiedIndex,
+		Dir:           e.Dir,
+		Severity:      e.Severity,
+		Owners:        e.Owners,
+		UnitTypes:     e.UnitTypes,
+	}
+}
+
+// validate returns an error when the scan entry cannot be used to remove its key.
+func (e ScanEntry) validate() error {
+	if _, ok := ruleSeverities[e.Rule]; !ok {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "scan contains %s of unknown rule '%s'", e.Key, e.Rule))
+	}
+	switch e.Kind {
+	case kindUnit, kindLease, kindState, kindMachine:
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "scan contains %s with invalid kind '%s'", e.Key, e.Kind))
+	}
+	if e.ModifiedIndex == 0 {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "scan contains %s without modified index", e.Key))
+	}
+	return nil
+}
+
+// ScanWithOptions performs a single cleanup (like RunWithOptions) and returns the garbage it found as a scan.
+func (s *Service) ScanWithOptions(opts RunOptions) (Scan, RunSummary, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, opts)
+	if err != nil {
+		return Scan{}, RunSummary{}, maskAny(err)
+	}
+	summary, err := s.runWithState(current, s.run)
+	if err != nil {
+		return Scan{}, summary, maskAny(err)
+	}
+	scan := Scan{
+		RunID:         summary.RunID,
+		Created:       time.Now(),
+		Version:       s.Version,
+		Endpoint:      s.EtcdURL.String(),
+		Jobs:          summary.Jobs,
+		Units:         summary.Units,
+		Leases:        summary.Leases,
+		States:        summary.States,
+		RegistryBytes: summary.RegistryBytes,
+	}
+	for _, c := range s.current.candidates {
+		if !c.Retry {
+			scan.Entries = append(scan.Entries, newScanEntry(c))
+		}
+	}
+	return scan, summary, nil
+}
+
+// RunWithScan performs a single cleanup of the garbage in the given scan, instead of scanning the registry.
+// The current rules, actions & policies apply, and a key is only removed when it has not been modified since the scan.
+func (s *Service) RunWithScan(scan Scan, opts RunOptions) (RunSummary, error) {
+	for _, e := range scan.Entries {
+		if err := e.validate(); err != nil {
+			return RunSummary{}, maskAny(err)
+		}
+	}
+
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, opts)
+	if err != nil {
+		return RunSummary{}, maskAny(err)
+	}
+	current.savedScan = &scan
+	current.cacheable = false // The scan may be outdated
+	if scan.Endpoint != s.EtcdURL.String() {
+		s.Logger.Warningf("Scan %s was created for %s, using it for %s", scan.RunID, scan.Endpoint, s.EtcdURL.String())
+	}
+	age := time.Since(scan.Created)
+	s.Logger.Infof("Using scan %s with %d keys, created %s ago", scan.RunID, len(scan.Entries), age-age%time.Second)
+	summary, err := s.runWithState(current, s.run)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	return summary, nil
+}
+
+// savedScanCandidates returns the candidates of all enabled rules in the given scan, as if the rules found them.
+func (s *Service) savedScanCandidates(scan Scan, summary *RunSummary) ([]candidate, error) {
+	summary.Jobs = scan.Jobs
+	summary.Units = scan.Units
+	summary.Leases = scan.Leases
+	summary.States = scan.States
+	summary.RegistryBytes = scan.RegistryBytes
+
+	found := make(map[string][]candidate)
+	for _, e := range scan.Entries {
+		found[e.Rule] = append(found[e.Rule], e.candidate())
+	}
+	var result []candidate
+	for _, r := range s.enabledRules() {
+		s.current.rule = r.Name
+		candidates := found[r.Name]
+		for i, c := range candidates {
+			switch r.Name {
+			case RuleOrphanUnits:
+				summary.ObsoleteUnits++
+			case RuleStaleLeases:
+				summary.StaleLeases++
+			case RuleOrphanStates:
+				summary.OrphanStates++
+			}
+			candidates[i] = s.reportCandidate(c)
+		}
+		result = append(result, s.ruleCandidates(r, candidates, summary)...)
+	}
+	return result, nil
+}
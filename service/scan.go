@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// registryScan holds the parts of the fleet registry loaded during a single run.
+// Every part is loaded at most once, when the first rule needs it.
+type registryScan struct {
+	s       *Service
+	summary *RunSummary
+
+	unitsLoaded bool
+	units       []unitNode
+	jobs        []jobObject
+	corruptJobs []string // Keys of job objects that cannot be parsed
+	jobNames    map[string]struct{}
+
+	machinesLoaded bool
+	machines       map[string]struct{}
+
+	jobNodesLoaded bool
+	jobNodes       []*client.Node
+}
+
+// newRegistryScan creates an empty scan, counting loaded keys in the given summary.
+func (s *Service) newRegistryScan(summary *RunSummary) *registryScan {
+	return &registryScan{
+		s:       s,
+		summary: summary,
+	}
+}
+
+// UnitsAndJobs returns all units & job objects.
+func (sc *registryScan) UnitsAndJobs() ([]unitNode, []jobObject, error) {
+	if sc.unitsLoaded {
+		return sc.units, sc.jobs, nil
+	}
+	s := sc.s
+	units, objects, corrupt, err := s.loadUnitsAndObjects()
+	if err != nil {
+		return nil, nil, maskAny(err)
+	}
+	sc.units, sc.jobs, sc.corruptJobs, sc.unitsLoaded = units, objects, corrupt, true
+	s.current.units = units
+	s.metrics.observeUnits(units, objects)
+
+	sc.summary.Units = len(units)
+	for _, unit := range units {
+		sc.summary.RegistryBytes += int64(len(unit.Value))
+	}
+	sc.jobNames = make(map[string]struct{})
+	values := make(map[string]string)
+	for _, unit := range units {
+		values[unit.Hash] = unit.Value
+	}
+	s.current.jobUnits = make(map[string]string)
+	for _, j := range objects {
+		if value, ok := values[j.Hash()]; ok {
+			s.current.jobUnits[j.Name] = value
+		}
+		sc.jobNames[j.Name] = struct{}{}
+		sc.summary.RegistryBytes += int64(j.Size)
+		s.jobNames[j.Hash()] = appendUnique(s.jobNames[j.Hash()], j.Name)
+		if s.current.includesJob(j.Name) {
+			sc.summary.Jobs++
+		}
+	}
+
+	// Forget job names of units that no longer exist
+	existing := make(map[string]struct{})
+	for _, unit := range units {
+		existing[unit.Hash] = struct{}{}
+	}
+	for hash := range s.jobNames {
+		if _, ok := existing[hash]; !ok {
+			delete(s.jobNames, hash)
+		}
+	}
+	return units, objects, nil
+}
+
+// JobNames returns the names of all jobs.
+func (sc *registryScan) JobNames() (map[string]struct{}, error) {
+	if _, _, err := sc.UnitsAndJobs(); err != nil {
+		return nil, maskAny(err)
+	}
+	return sc.jobNames, nil
+}
+
+// Machines returns the IDs of all registered machines.
+func (sc *registryScan) Machines() (map[string]struct{}, error) {
+	if sc.machinesLoaded {
+		return sc.machines, nil
+	}
+	machines, err := sc.s.loadMachineIDs()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	sc.machines, sc.machinesLoaded = machines, true
+	return machines, nil
+}
+
+// JobNodes returns the directories of all jobs, including all keys in them.
+func (sc *registryScan) JobNodes() ([]*client.Node, error) {
+	if sc.jobNodesLoaded {
+		return sc.jobNodes, nil
+	}
+	keysAPI := client.NewKeysAPI(sc.s.client)
+	resp, err := keysAPI.Get(context.Background(), sc.s.paths.job, &client.GetOptions{Recursive: true})
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, maskEtcd(err)
+	}
+	if err == nil && resp.Node != nil {
+		sc.s.indexClock.Observe(resp.Index)
+		for _, n := range resp.Node.Nodes {
+			if n.Dir {
+				sc.jobNodes = append(sc.jobNodes, n)
+			}
+		}
+	}
+	sc.jobNodesLoaded = true
+	return sc.jobNodes, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+)
+
+// requestCounter counts requests sent to etcd by this process.
+type requestCounter struct {
+	n uint64
+}
+
+// add counts a single request.
+func (c *requestCounter) add() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+// count returns the number of requests so far.
+func (c *requestCounter) count() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// scanCache holds the results of a scan that can be reused while the registry does not change.
+type scanCache struct {
+	index      uint64 // etcd index at the start of the scan
+	writes     uint64 // Number of writes by this process before the scan started
+	summary    RunSummary
+	candidates []candidate
+}
+
+// Skip reasons that a later run with the same registry contents & configuration gives again
+var stableSkipReasons = map[string]bool{
+	SkipReasonDryRun:               true,
+	SkipReasonReportOnly:           true,
+	SkipReasonExcluded:             true,
+	SkipReasonLeaseCleanupDisabled: true,
+	SkipReasonStateCleanupDisabled: true,
+	SkipReasonReferenced:           true,
+	SkipReasonProtectedUnitType:    true,
+}
+
+// cachedScan returns the results of the previous scan when nothing changed in etcd since it started,
+// which is the case when the etcd index only advanced by the writes of this process.
+func (s *Service) cachedScan(index, writes uint64) (*scanCache, bool) {
+	c := s.scanCache
+	if c == nil || !s.current.cacheable || index == 0 || index < c.index || writes < c.writes {
+		return nil, false
+	}
+	if index-c.index != writes-c.writes {
+		return nil, false
+	}
+	return c, true
+}
+
+// updateScanCache stores the results of the current run for reuse by later runs, as long as a later run
+// would come to the same results: nothing was removed and nothing is left that a later run could remove.
+// Otherwise the cache is cleared.
+func (s *Service) updateScanCache(index, writes uint64, summary RunSummary, candidates []candidate) {
+	s.scanCache = nil
+	if !s.current.cacheable || index == 0 {
+		return
+	}
+	for _, c := range candidates {
+		if c.Removed || c.Error != "" || !stableSkipReasons[c.Skip] {
+			return
+		}
+	}
+	s.scanCache = &scanCache{
+		index:      index,
+		writes:     writes,
+		summary:    summary,
+		candidates: append([]candidate(nil), candidates...),
+	}
+}
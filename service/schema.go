@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+// registrySchema describes the layout of the fleet registry.
+type registrySchema struct {
+	// Name of the schema, the oldest fleet version using this layout
+	Name string
+	// Set when fleet agents publish unit states under /states (instead of in the job directory)
+	HasStates bool
+}
+
+var (
+	// Units stored by hash under /unit, jobs under /job, no unit states under /states
+	schema09 = registrySchema{Name: "0.9"}
+	// Same as 0.9, with unit states published under /states (also used by fleet 1.x)
+	schema011 = registrySchema{Name: "0.11", HasStates: true}
+
+	knownSchemas = []registrySchema{schema09, schema011}
+)
+
+// parseSchema returns the known schema with given name.
+func parseSchema(name string) (registrySchema, error) {
+	for _, schema := range knownSchemas {
+		if schema.Name == name {
+			return schema, nil
+		}
+	}
+	var names []string
+	for _, schema := range knownSchemas {
+		names = append(names, schema.Name)
+	}
+	return registrySchema{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown schema '%s', expected one of %s", name, strings.Join(names, ", ")))
+}
+
+// registrySchema returns the schema of the fleet registry and the etcd index at which it was detected.
+// Unless a schema is forced in the configuration, it is detected by probing the top-level
+// directories of the registry. An error is returned when the layout is not recognized.
+// The returned index is 0 when the schema is forced.
+func (s *Service) registrySchema() (registrySchema, uint64, error) {
+	if s.ForceSchema != "" {
+		schema, err := parseSchema(s.ForceSchema)
+		if err != nil {
+			return registrySchema{}, 0, maskAny(err)
+		}
+		return schema, 0, nil
+	}
+
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Get(context.Background(), s.paths.fleet, &client.GetOptions{})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return registrySchema{}, 0, maskAny(errgo.WithCausef(nil, UnknownSchemaError, "no fleet registry found at %s, use --force-schema to run anyway", s.paths.fleet))
+		}
+		return registrySchema{}, 0, maskEtcd(err)
+	}
+	dirs := make(map[string]bool)
+	if resp.Node != nil {
+		for _, n := range resp.Node.Nodes {
+			dirs[path.Base(n.Key)] = true
+		}
+	}
+
+	switch {
+	case dirs["payload"] && !dirs["unit"]:
+		// Before 0.9, units were stored by name under /payload
+		return registrySchema{}, 0, maskAny(errgo.WithCausef(nil, UnknownSchemaError, "fleet registry at %s stores units under /payload (fleet < 0.9), which is not supported", s.paths.fleet))
+	case !dirs["unit"] && !dirs["job"] && !dirs["machines"]:
+		return registrySchema{}, 0, maskAny(errgo.WithCausef(nil, UnknownSchemaError, "fleet registry at %s has an unknown layout (no unit, job or machines directory), use --force-schema to run anyway", s.paths.fleet))
+	case dirs["states"]:
+		return schema011, resp.Index, nil
+	default:
+		// Without published unit states, 0.9 & later versions cannot be told apart.
+		// That is fine, since there are no unit states to clean up anyway.
+		return schema09, resp.Index, nil
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Formats of deletion scripts (see Service.WriteScript)
+const (
+	ScriptEtcdctl   = "etcdctl"  // etcdctl (v2 API) rm commands
+	ScriptEtcdctlV3 = "etcdctl3" // etcdctl (v3 API) del commands
+)
+
+// ValidateScriptFormat returns an error with cause InvalidArgumentError when the given script format is not supported.
+func ValidateScriptFormat(format string) error {
+	switch format {
+	case ScriptEtcdctl, ScriptEtcdctlV3:
+		return nil
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown script format '%s', expected '%s' or '%s'", format, ScriptEtcdctl, ScriptEtcdctlV3))
+	}
+}
+
+// WriteScript writes a shell script that removes all keys in the given plan using etcdctl, for sites
+// that must make changes with their standard tooling. Nothing is removed by fleet-cleanup itself.
+// etcdctl scripts only remove a key when it has not been modified since the plan was created
+// and copy soft-deleted keys to the trash first. etcdctl3 scripts cannot check this and only support deletes.
+func (s *Service) WriteScript(w io.Writer, plan Plan, format string) error {
+	if err := ValidateScriptFormat(format); err != nil {
+		return maskAny(err)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#!/bin/sh")
+	fmt.Fprintf(bw, "# Removes %d keys found by fleet-cleanup %s in run %s at %s\n", len(plan.Entries), plan.Version, plan.RunID, plan.Created.Format(time.RFC3339))
+	fmt.Fprintf(bw, "# Created against %s, review before running.\n", plan.Endpoint)
+	if format == ScriptEtcdctl {
+		fmt.Fprintln(bw, "# A key that was modified since then is not removed: etcdctl fails with 'Compare failed' and the script stops.")
+	} else {
+		fmt.Fprintln(bw, "# Keys are removed even when they were modified since then.")
+		fmt.Fprintln(bw, "export ETCDCTL_API=3")
+	}
+	fmt.Fprintln(bw, "set -e")
+	for _, e := range plan.Entries {
+		fmt.Fprintln(bw)
+		desc := fmt.Sprintf("# %s: %s", e.Rule, e.Kind)
+		if e.Job != "" {
+			desc += fmt.Sprintf(" of job '%s'", e.Job)
+		}
+		fmt.Fprintf(bw, "%s (created at index %d, modified at index %d)\n", desc, e.CreatedIndex, e.ModifiedIndex)
+		switch format {
+		case ScriptEtcdctl:
+			if e.Action == ActionSoftDelete {
+				ttl := ""
+				if s.TrashTTL > 0 {
+					ttl = fmt.Sprintf("--ttl %d ", int64(s.TrashTTL.Seconds()))
+				}
+				fmt.Fprintf(bw, "etcdctl set %s%s %s >/dev/null\n", ttl, shellQuote(path.Join(trashPrefix, plan.RunID, e.Key)), shellQuote(e.Value))
+			}
+			if e.Action == ActionRestoreTTL {
+				fmt.Fprintf(bw, "etcdctl set --ttl %d --swap-with-index %d %s %s >/dev/null\n", int64(s.RestoredTTL.Seconds()), e.ModifiedIndex, shellQuote(e.Key), shellQuote(e.Value))
+				continue
+			}
+			fmt.Fprintf(bw, "etcdctl rm --with-index %d %s\n", e.ModifiedIndex, shellQuote(e.Key))
+		case ScriptEtcdctlV3:
+			if e.Action == ActionSoftDelete || e.Action == ActionRestoreTTL {
+				return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "%s scripts do not support the %s action (of %s)", format, e.Action, e.Key))
+			}
+			fmt.Fprintf(bw, "etcdctl del %s\n", shellQuote(e.Key))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// shellQuote quotes the given value for use as a single argument in a shell command.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Seeded machines expire after this TTL, like the machines of a real cluster that stopped
+	seedMachineTTL = 24 * time.Hour
+)
+
+// SeedOptions describes the synthetic registry written by Seed.
+type SeedOptions struct {
+	Machines     int  // Number of registered machines (at least 1 when there are jobs)
+	Jobs         int  // Number of launched jobs, each with its unit, lease & unit state
+	Orphans      int  // Number of units that are not referenced by a job (orphan-units)
+	StaleLeases  int  // Number of leases owned by unknown machines (stale-leases)
+	OrphanStates int  // Number of unit states of unknown machines & units (orphan-states)
+	Corrupt      int  // Number of jobs whose object cannot be parsed (broken-jobs)
+	Force        bool // If set, seed a registry that is not empty
+}
+
+// SeedResult describes what Seed wrote.
+type SeedResult struct {
+	Prefix string `json:"prefix"`
+	Keys   int    `json:"keys"`
+}
+
+// Seed populates the fleet registry with a synthetic keyspace containing the given number of jobs & garbage,
+// so cleanups can be rehearsed (and benchmarked) on a test cluster.
+// Unless forced, it refuses to write into a registry that already contains keys.
+func (s *Service) Seed(opts SeedOptions) (SeedResult, error) {
+	result := SeedResult{Prefix: s.paths.fleet}
+	if opts.Machines < 1 && opts.Jobs > 0 {
+		opts.Machines = 1
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	if !opts.Force {
+		resp, err := keysAPI.Get(context.Background(), s.paths.fleet, nil)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return result, maskEtcd(err)
+		}
+		if err == nil && (!resp.Node.Dir || len(resp.Node.Nodes) > 0) {
+			return result, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "registry at %s is not empty", s.paths.fleet))
+		}
+	}
+	set := func(key, value string, ttl time.Duration) error {
+		if _, err := keysAPI.Set(context.Background(), key, value, &client.SetOptions{TTL: ttl}); err != nil {
+			return maskEtcd(err)
+		}
+		result.Keys++
+		return nil
+	}
+
+	machineID := func(i int) string { return fmt.Sprintf("seed%028d", i) }
+	for i := 0; i < opts.Machines; i++ {
+		id := machineID(i)
+		raw, _ := json.Marshal(map[string]interface{}{"ID": id, "PublicIP": fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), "Metadata": map[string]string{"role": "seed"}})
+		if err := set(path.Join(s.paths.machines, id, "object"), string(raw), seedMachineTTL); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	if opts.Machines > 0 {
+		if err := set(path.Join(s.paths.lease, "engine-leader"), seedLease(machineID(0)), seedMachineTTL); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	for i := 0; i < opts.Jobs; i++ {
+		name := fmt.Sprintf("seed-%04d.service", i)
+		machine := machineID(i % opts.Machines)
+		unit := seedUnit(name)
+		hash := seedHash(unit)
+		job := path.Join(s.paths.job, name)
+		keys := [][3]string{
+			{s.paths.unitKey(hex.EncodeToString(hash)), seedUnitValue(unit)},
+			{path.Join(job, "object"), seedJobObject(name, hash)},
+			{path.Join(job, "target-state"), "launched"},
+			{path.Join(job, "target"), machine},
+			{path.Join(s.paths.states, name, machine), seedUnitState(hash, machine)},
+		}
+		for _, k := range keys {
+			if err := set(k[0], k[1], 0); err != nil {
+				return result, maskAny(err)
+			}
+		}
+		if err := set(path.Join(s.paths.lease, name), seedLease(machine), seedMachineTTL); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	for i := 0; i < opts.Orphans; i++ {
+		unit := seedUnit(fmt.Sprintf("seed-orphan-%04d.service", i))
+		if err := set(s.paths.unitKey(hex.EncodeToString(seedHash(unit))), seedUnitValue(unit), 0); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	for i := 0; i < opts.StaleLeases; i++ {
+		name := fmt.Sprintf("seed-stale-%04d.service", i)
+		if err := set(path.Join(s.paths.lease, name), seedLease(fmt.Sprintf("gone%028d", i)), 0); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	for i := 0; i < opts.OrphanStates; i++ {
+		name := fmt.Sprintf("seed-gone-%04d.service", i)
+		machine := fmt.Sprintf("gone%028d", i)
+		if err := set(path.Join(s.paths.states, name, machine), seedUnitState(seedHash(seedUnit(name)), machine), 0); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	for i := 0; i < opts.Corrupt; i++ {
+		job := path.Join(s.paths.job, fmt.Sprintf("seed-corrupt-%04d.service", i))
+		if err := set(path.Join(job, "object"), `{"Name": "seed-corrupt", "UnitHash": `, 0); err != nil {
+			return result, maskAny(err)
+		}
+		if err := set(path.Join(job, "target-state"), "launched", 0); err != nil {
+			return result, maskAny(err)
+		}
+	}
+	return result, nil
+}
+
+// seedUnit returns the unit file of the seeded job with given name.
+func seedUnit(name string) string {
+	return fmt.Sprintf("[Unit]\nDescription=Seeded unit %s\n\n[Service]\nExecStart=/bin/sleep 86400\n\n[X-Fleet]\nOwner=seed\n", name)
+}
+
+// seedHash returns the fleet hash (sha1) of the given unit file.
+func seedHash(unit string) []byte {
+	h := sha1.Sum([]byte(unit))
+	return h[:]
+}
+
+func seedUnitValue(unit string) string {
+	raw, _ := json.Marshal(map[string]string{"Raw": unit})
+	return string(raw)
+}
+
+func seedJobObject(name string, hash []byte) string {
+	raw, _ := json.Marshal(map[string]string{"Name": name, "UnitHash": base64.StdEncoding.EncodeToString(hash)})
+	return string(raw)
+}
+
+func seedUnitState(hash []byte, machine string) string {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"loadState":    "loaded",
+		"activeState":  "active",
+		"subState":     "running",
+		"machineState": map[string]string{"ID": machine},
+		"unitHash":     hex.EncodeToString(hash),
+	})
+	return string(raw)
+}
+
+func seedLease(machine string) string {
+	return fmt.Sprintf(`{"MachineID":%q,"Version":1}`, machine)
+}
@@ -17,72 +17,550 @@ package service
 import (
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"net/url"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/etcd/client"
-	"github.com/op/go-logging"
+	"github.com/juju/errgo"
 	"golang.org/x/net/context"
+
+	"github.com/pulcy/fleet-cleanup/metrics"
+	"github.com/pulcy/fleet-cleanup/tracing"
 )
 
 type ServiceConfig struct {
-	EtcdURL url.URL
-	DryRun  bool
+	EtcdURL       url.URL
+	EtcdTransport TransportConfig
+	Registry      RegistryConfig
+	DryRun        bool
+	CleanLeases   bool
+	CleanStates   bool
+	// If the registry changed within this number of etcd indexes, fleet is
+	// considered to be rescheduling and deletions are postponed (0 disables this check).
+	ChurnIndexWindow uint64
+	// If set, a run reuses the results of the previous run when nothing changed in etcd since then
+	CacheScan bool
+	// Garbage below this severity is not reported in events & notifications (see Severity* constants, defaults to info)
+	MinSeverity string
+	// Labels read from the [X-Fleet] section of units to annotate garbage with its owners (nil defaults to DefaultOwnerLabels)
+	OwnerLabels []string
+	// How to handle an etcd server version outside the tested range (warn|strict|off, defaults to warn)
+	EtcdVersionCheck string
+	// If set, runs only remove keys when the etcd cluster is healthy
+	HealthCheck bool
+	// If set, keys are only removed inside this window; outside it runs only report
+	MaintenanceWindow *MaintenanceWindow
+	// Maximum number of raft indexes a member may be behind the other members to be considered healthy (0 means unlimited)
+	MaxRaftIndexLag uint64
+	// Maximum number of keys to remove in a single run (0 means unlimited)
+	MaxDelete int
+	// Order in which candidates are removed (see DeleteOrder* constants, defaults to DeleteOrderRule)
+	DeleteOrder string
+	// Treatment of units of template jobs (see TemplateUnits* constants, defaults to TemplateUnitsInstances)
+	TemplateUnits string
+	// Stop removing keys once a run took this long (0 means unlimited)
+	MaxDuration time.Duration
+	// Stop removing keys once a run sent this many requests to etcd (0 means unlimited)
+	MaxEtcdOps int
+	// If set, only units whose (last known) job name matches this regular expression are considered
+	JobFilter string
+	// Candidates of units with one of these types (e.g. template or global) are never removed, by any rule
+	ProtectUnitTypes []string
+	// If set, only garbage in this part of the registry is considered (see Shard)
+	Shard Shard
+	// Number of run records to keep in the run history (0 disables the history)
+	HistorySize int
+	// If set, the run history is stored in this local file instead of etcd
+	HistoryFile string
+	// If set, the status of the last run is written to this local file after every run
+	StatusFile string
+	// Version of the tool, stored in the run history
+	Version string
+	// If set, garbage that was already reported in the previous run is not reported again
+	ReportDelta bool
+	// If set, the service never removes anything, it only scans the registry (for metrics)
+	ExporterOnly bool
+	// If set, the etcd credentials are assumed to be read-only: runs never remove anything,
+	// the permission to remove keys is not probed and the run history is not stored in etcd
+	AssumeReadOnly bool
+	// If set, the registry schema is not detected, but assumed to be this schema (e.g. "0.11")
+	ForceSchema string
+	// Enables (true) or disables (false) cleanup rules by name, other rules use their default
+	Rules map[string]bool
+	// Minimum age of inactive jobs found by the old-inactive-jobs rule
+	InactiveJobMinAge time.Duration
+	// Per-rule settings
+	Policy Policy
+	// Actions (report|soft-delete|delete) by rule name, overriding the actions in Policy
+	RuleActions map[string]string
+	// Take over the run lock of a run that started longer ago than this (0 never takes it over)
+	StealLockAfter time.Duration
+	// Time to live of the leader key (see StartLeaderElection)
+	LeaderTTL time.Duration
+	// Time to keep soft-deleted keys in the trash (0 keeps them until removed manually)
+	TrashTTL time.Duration
+	// If set, runs store a marker with this TTL for every candidate instead of removing it (see CandidateMarker)
+	AnnotateTTL time.Duration
+	// Record resource usage (peak memory, allocations & phase timings) of every run in its summary
+	ProfileRun bool
+	// If set, the registry is read again after keys were removed, to verify that they are gone and nothing else disappeared
+	VerifyDeletes bool
+	// TTL set on keys that lost their TTL by the restore-ttl action of the missing-ttl rule (defaults to DefaultRestoredTTL)
+	RestoredTTL time.Duration
+	// Maximum duration of a single delete, slower deletes are skipped & retried at the end of the run (0 disables)
+	DeleteTimeout time.Duration
+	// If set, the delay between deletes adapts to etcd: deletes slow down while etcd is slow or failing (see pacer)
+	AdaptivePacing bool
+	// Delete latency above which adaptive pacing backs off (defaults to DefaultPacingLatency)
+	PacingLatency time.Duration
+	// Maximum delay between deletes with adaptive pacing (defaults to DefaultPacingMaxDelay)
+	PacingMaxDelay time.Duration
+	// If set, runs that remove more keys first remove this many, observe the registry & only continue when no anomalies are found
+	Canary int
+	// Time the registry is observed after the canary deletes (defaults to DefaultCanaryObservation)
+	CanaryObservation time.Duration
+	// Time a unit must stay orphaned before the orphan watch removes it (defaults to DefaultOrphanDelay, see WatchOrphans)
+	OrphanDelay time.Duration
+	// Send an alert when more than this number of obsolete units is found (0 disables)
+	AlertThreshold int
+	// Send an alert when the number of obsolete units grew by more than this percentage since the previous run (0 disables)
+	AlertGrowthPercent float64
+	// Send an alert for the same garbage as the last alert again after this duration (0 never sends it again)
+	AlertHeartbeat time.Duration
+	// Every successful run refreshes a heartbeat key with this TTL, so monitoring notices when runs stop (0 disables)
+	HeartbeatTTL time.Duration
 }
 
 type ServiceDependencies struct {
-	Logger *logging.Logger
+	Logger   Logger            // Optional, defaults to discarding all messages
+	Events   EventListener     // Optional
+	Tracer   *tracing.Tracer   // Optional
+	Errors   ErrorReporter     // Optional
+	Archiver Archiver          // Optional
+	Metrics  *metrics.Registry // Optional
+	Alerts   Alerter           // Optional
+	Reports  RunReporter       // Optional
+
+	// Optional, loggers by component (see Component* constants), components without a logger use Logger
+	ComponentLoggers map[string]Logger
 }
 
 type Service struct {
 	ServiceConfig
 	ServiceDependencies
 
-	client client.Client
+	client    client.Client
+	transport client.CancelableTransport
+	paths     registryPaths
+	writes    *requestCounter
+	requests  *requestCounter // All requests sent to etcd, used for the run budget
+	scanCache *scanCache      // Results of the last scan, if they can be reused
+
+	runMutex    sync.Mutex
+	stopped     int32         // Set (atomically) to 1 by Stop
+	stop        chan struct{} // Closed by Stop
+	background  sync.WaitGroup
+	election    leaderElection
+	current     runState
+	jobNames    map[string][]string // Job names of units seen in previous runs, indexed by unit hash
+	indexClock  indexClock
+	reported    map[string]candidate // Garbage reported (and not removed) in the previous run, indexed by key
+	metrics     serviceMetrics
+	policies    map[string]compiledRulePolicy
+	etcdErrors  *etcdErrorCounter
+	notified    notification // Last alert sent by this instance
+	etcdVersion string       // Last detected etcd server version
+
+	reportMutex sync.Mutex
+	lastReport  *Report // Report of the latest run
+
+	previousObsoleteUnits int // Number of obsolete units found in the previous run (-1 if unknown)
+
+	registryRecorded bool // Set once the registry has been recorded (see recordRegistry)
+
+	pacer *pacer // Only set with adaptive pacing
+
+	registryLogger Logger // Logger of requests to etcd & loading the registry (see ComponentRegistry)
+	rulesLogger    Logger // Logger of the cleanup rules (see ComponentRules)
+}
+
+// unitNode is a unit stored by fleet
+type unitNode struct {
+	Hash          string
+	Value         string
+	CreatedIndex  uint64
+	ModifiedIndex uint64 // Highest modified index of the unit (and its child keys for directories)
+	Dir           bool   // Set when the unit is stored as a directory with child keys
 }
 
 type jobObject struct {
 	Name     string `json:"Name"`
 	UnitHash []byte `json:"UnitHash"`
+	Size     int    `json:"-"` // Size of the raw object
 }
 
 func (j jobObject) Hash() string {
 	return hex.EncodeToString(j.UnitHash)
 }
 
+// storedJob is a job object together with the etcd key & index it was loaded from.
+type storedJob struct {
+	jobObject
+	Key           string
+	ModifiedIndex uint64
+}
+
 // NewService creates a new service instance.
 func NewService(config ServiceConfig, deps ServiceDependencies) (*Service, error) {
+	transport, err := newTransport(config.EtcdTransport)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	paths, err := newRegistryPaths(config.Registry)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if deps.Logger == nil {
+		deps.Logger = nopLogger{}
+	}
+	serviceMetrics := newServiceMetrics(deps.Metrics)
+	etcdErrors := newEtcdErrorCounter(serviceMetrics.etcdErrors)
+	writes, requests := &requestCounter{}, &requestCounter{}
+	registryLogger := deps.componentLogger(ComponentRegistry)
+	transport = &countingTransport{CancelableTransport: transport, counter: etcdErrors, writes: writes, requests: requests, logger: registryLogger}
 	cfg := client.Config{
-		Transport: client.DefaultTransport,
+		Transport: transport,
 	}
 	if config.EtcdURL.Host != "" {
-		cfg.Endpoints = append(cfg.Endpoints, "http://"+config.EtcdURL.Host)
+		scheme := config.EtcdURL.Scheme
+		if scheme != "https" {
+			scheme = "http"
+		}
+		cfg.Endpoints = append(cfg.Endpoints, scheme+"://"+config.EtcdURL.Host)
 	}
 	c, err := client.New(cfg)
 	if err != nil {
-		return nil, maskAny(err)
+		return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid etcd configuration"))
 	}
 	s := &Service{
 		ServiceConfig:       config,
 		ServiceDependencies: deps,
 		client:              c,
+		transport:           transport,
+		paths:               paths,
+		writes:              writes,
+		requests:            requests,
+		jobNames:            make(map[string][]string),
+		metrics:             serviceMetrics,
+		etcdErrors:          etcdErrors,
+		stop:                make(chan struct{}),
+		registryLogger:      registryLogger,
+		rulesLogger:         deps.componentLogger(ComponentRules),
+
+		previousObsoleteUnits: -1,
+	}
+	if config.OwnerLabels == nil {
+		s.OwnerLabels = DefaultOwnerLabels
+	}
+	if config.RestoredTTL <= 0 {
+		s.RestoredTTL = DefaultRestoredTTL
+	}
+	if config.PacingLatency <= 0 {
+		s.PacingLatency = DefaultPacingLatency
+	}
+	if config.PacingMaxDelay <= 0 {
+		s.PacingMaxDelay = DefaultPacingMaxDelay
+	}
+	if config.CanaryObservation <= 0 {
+		s.CanaryObservation = DefaultCanaryObservation
+	}
+	if config.OrphanDelay <= 0 {
+		s.OrphanDelay = DefaultOrphanDelay
+	}
+	if config.AdaptivePacing {
+		s.pacer = newPacer(s.PacingLatency, s.PacingMaxDelay)
+	}
+	if err := config.Shard.validate(); err != nil {
+		return nil, maskAny(err)
+	}
+	if config.JobFilter != "" {
+		if _, err := regexp.Compile(config.JobFilter); err != nil {
+			return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid job filter '%s'", config.JobFilter))
+		}
+	}
+	if err := validateRules(config.Rules); err != nil {
+		return nil, maskAny(err)
+	}
+	policies, err := compilePolicy(config.Policy.withActions(config.RuleActions))
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	s.policies = policies
+	if err := validateSeverity(config.MinSeverity); err != nil {
+		return nil, maskAny(err)
+	}
+	if err := validateDeleteOrder(config.DeleteOrder); err != nil {
+		return nil, maskAny(err)
+	}
+	if err := validateTemplateUnits(config.TemplateUnits); err != nil {
+		return nil, maskAny(err)
+	}
+	if err := validateEtcdVersionCheck(config.EtcdVersionCheck); err != nil {
+		return nil, maskAny(err)
+	}
+	if config.ForceSchema != "" {
+		if _, err := parseSchema(config.ForceSchema); err != nil {
+			return nil, maskAny(err)
+		}
 	}
 	return s, nil
 }
 
 // Run performs a single cleanup
 func (s *Service) Run() error {
-	// Load unit names (hex)
-	unitHashes, err := s.loadUnitNames()
-	if err != nil {
+	if _, err := s.RunWithOptions(RunOptions{}); err != nil {
 		return maskAny(err)
 	}
+	return nil
+}
 
-	// Load job objects
-	objects, err := s.loadObjects()
+// RunWithOptions performs a single cleanup, using the given options to override
+// the service configuration for this run only.
+// Runs are serialized, so it is safe to call this from multiple goroutines.
+func (s *Service) RunWithOptions(opts RunOptions) (RunSummary, error) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	current, err := newRunState(s.ServiceConfig, opts)
 	if err != nil {
-		return maskAny(err)
+		return RunSummary{}, maskAny(err)
+	}
+	summary, err := s.runWithState(current, s.run)
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	return summary, nil
+}
+
+// runWithState performs the given run function with the given state, recording its results.
+// The caller must hold the run mutex.
+func (s *Service) runWithState(current runState, run func() (RunSummary, error)) (RunSummary, error) {
+	s.current = current
+	s.current.trace = s.Tracer.StartTrace("run")
+	start := time.Now()
+	s.current.started = start
+	s.current.requests = s.requests.count()
+	s.etcdErrors.reset()
+	var summary RunSummary
+	err := s.checkEtcdVersion()
+	if err == nil {
+		summary, err = run()
+	}
+	summary.EtcdVersion = s.current.etcdVersion
+	summary.Skipped = countSkipped(s.current.candidates)
+	summary.Shard = s.Shard.String()
+	summary.EtcdErrors = s.etcdErrors.reset()
+	if s.current.profiler != nil {
+		summary.Profile = s.current.profiler.finish(s.phaseTimings(time.Now()))
+	}
+	if counts := summary.EtcdErrors; len(counts) > 0 {
+		if len(counts) == 1 && counts[etcdErrorNotFound] > 0 {
+			// Missing keys are expected
+			s.registryLogger.Debugf("Failed etcd requests: %s", formatEtcdErrors(counts))
+		} else {
+			s.registryLogger.Infof("Failed etcd requests: %s", formatEtcdErrors(counts))
+		}
+	}
+	s.current.trace.SetAttribute("dry-run", summary.DryRun)
+	s.current.trace.End(err)
+	s.metrics.observeRun(start, summary, err)
+	s.recordReport(start, summary, err)
+	if err := s.recordRun(start, summary, err); err != nil {
+		s.Logger.Warningf("Failed to record run in history: %#v", err)
+	}
+	if err := s.writeStatus(start, summary, err); err != nil {
+		s.Logger.Warningf("Failed to write status file: %#v", err)
+	}
+	if err != nil {
+		s.emit(Event{Type: EventError, Message: err.Error()})
+		s.reportError(err)
+		return summary, maskAny(err)
+	}
+	if err := s.writeHeartbeat(summary); err != nil {
+		s.Logger.Warningf("Failed to write heartbeat: %#v", err)
+	}
+	if err := s.recordRegistry(); err != nil {
+		s.Logger.Warningf("Failed to record registry: %#v", err)
+	}
+	s.emit(Event{Type: EventRunSummary, Summary: &summary})
+	return summary, nil
+}
+
+// Stop makes the service stop removing keys. A delete that is in progress is finished,
+// all remaining candidates of the current run are skipped and later runs only report.
+// Stop blocks until the current run (if any) has finished and leadership has been released.
+func (s *Service) Stop() {
+	if atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		close(s.stop)
+	}
+	s.runMutex.Lock()
+	s.runMutex.Unlock()
+	s.background.Wait()
+}
+
+// Stopping returns true once Stop has been called.
+func (s *Service) Stopping() bool {
+	return atomic.LoadInt32(&s.stopped) != 0
+}
+
+// run performs a single cleanup, returning a summary of the results.
+func (s *Service) run() (RunSummary, error) {
+	start := time.Now()
+	s.emit(Event{Type: EventScanStart})
+
+	// Detect registry layout
+	span := s.startPhase("detect-schema")
+	writes := s.writes.count()
+	schema, index, err := s.registrySchema()
+	span.End(err)
+	if err != nil {
+		return RunSummary{}, maskAny(err)
+	}
+	s.current.schema = schema
+	s.registryLogger.Debugf("Using fleet registry schema %s", schema.Name)
+
+	// Reuse the previous scan when nothing changed
+	if c, ok := s.cachedScan(index, writes); ok {
+		s.Logger.Infof("Nothing changed in etcd since index %d, reusing the results of the previous scan", c.index)
+		summary := c.summary
+		summary.RunID = s.current.id
+		summary.DryRun = s.current.dryRun
+		summary.Cached = true
+		summary.Rules = append([]RuleResult(nil), c.summary.Rules...)
+		s.current.candidates = append([]candidate(nil), c.candidates...)
+		s.checkAlerts(summary, s.current.candidates)
+		summary.Duration = time.Since(start)
+		return summary, nil
+	}
+
+	// Check for ongoing rescheduling
+	span = s.startPhase("check-rescheduling")
+	reason, err := s.checkRescheduling()
+	span.End(err)
+	if err != nil {
+		return RunSummary{}, maskAny(err)
+	}
+	s.current.postponed = reason != ""
+	if s.current.postponed {
+		s.Logger.Warningf("Postponing deletions: %s", reason)
+	}
+	if err := s.checkPause(); err != nil {
+		return RunSummary{}, maskAny(err)
+	}
+	if s.current.outsideWindow && !s.current.planning {
+		s.Logger.Infof("Outside maintenance window %s, not removing anything", s.MaintenanceWindow)
+	}
+
+	// Make sure etcd is healthy & no other run removes keys at the same time
+	if s.skipReason() == "" && !s.current.planning {
+		if err := s.checkClusterHealth(); err != nil {
+			return RunSummary{}, maskAny(err)
+		}
+		if err := s.checkDeletePermission(); err != nil {
+			return RunSummary{}, maskAny(err)
+		}
+		if err := s.lockRun(); err != nil {
+			return RunSummary{}, maskAny(err)
+		}
+		defer s.releaseRunLock()
+	}
+
+	summary := RunSummary{
+		RunID:     s.current.id,
+		DryRun:    s.current.dryRun,
+		Postponed: s.current.postponed,
+		Paused:    s.current.paused,
+	}
+
+	// Retry keys that could not be removed in a previous run
+	var retries []candidate
+	retrying := s.skipReason() == "" && !s.current.planning
+	if retrying {
+		retries, err = s.retryFailedDeletes(&summary)
+		s.current.candidates = retries
+		if err != nil {
+			return summary, maskAny(err)
+		}
+	}
+
+	// Find garbage
+	var candidates []candidate
+	if s.current.savedScan != nil {
+		candidates, err = s.savedScanCandidates(*s.current.savedScan, &summary)
+	} else {
+		candidates, err = s.runRules(&summary)
+	}
+	if err != nil {
+		return summary, maskAny(err)
+	}
+	s.checkAlerts(summary, candidates)
+	if s.ReportDelta {
+		summary.Delta = true
+		for _, c := range candidates {
+			if !c.Known {
+				summary.NewCandidates++
+			}
+		}
+		s.reportGone(candidates, &summary)
+	}
+
+	// Remove garbage
+	s.sortCandidates(candidates)
+	err = s.removeCandidates(candidates, &summary)
+	s.current.candidates = append(retries, candidates...)
+	s.recordBudget(s.current.candidates, &summary)
+	s.rememberReported(candidates)
+	if retrying {
+		s.updateRetryQueue(s.current.candidates)
+	}
+	if err != nil {
+		s.scanCache = nil
+		return summary, maskAny(err)
+	}
+
+	for _, rs := range summary.Rules {
+		if s.current.reportOnly() {
+			s.rulesLogger.Infof("Rule %s found %d keys", rs.Name, rs.Candidates)
+		} else {
+			s.rulesLogger.Infof("Rule %s found %d keys, removed %d", rs.Name, rs.Candidates, rs.Removed)
+		}
+	}
+
+	if s.VerifyDeletes {
+		if err := s.verifyDeletes(s.current.candidates, &summary); err != nil {
+			s.scanCache = nil
+			return summary, maskAny(err)
+		}
+	}
+
+	summary.Duration = time.Since(start)
+	s.updateScanCache(index, writes, summary, s.current.candidates)
+	if summary.FailedDeletes > 0 {
+		return summary, maskAny(errgo.WithCausef(nil, DeleteFailedError, "failed to remove %d keys", summary.FailedDeletes))
+	}
+	return summary, nil
+}
+
+// findObsoleteUnits returns all units that are no longer referenced by a job
+func (s *Service) findObsoleteUnits(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	units, objects, err := scan.UnitsAndJobs()
+	if err != nil {
+		return nil, maskAny(err)
 	}
 
 	// Derive valid hashes
@@ -91,66 +569,232 @@ func (s *Service) Run() error {
 		validHashes[j.Hash()] = j
 	}
 
-	// Remove obsolete units
-	keysAPI := client.NewKeysAPI(s.client)
-	removed := 0
-	for _, unit := range unitHashes {
-		if _, ok := validHashes[unit]; ok {
+	// Load job names of units with a published state
+	var stateNames map[string][]string
+	if s.current.schema.HasStates {
+		stateNames, err = s.loadUnitStateNames()
+		if err != nil {
+			return nil, maskAny(err)
+		}
+	}
+
+	// Cross-check against the target state of jobs, so units of active jobs are never obsolete
+	activeUnits, err := s.activeJobUnits(scan, stateNames)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	// Link units to the templates that used them
+	var templates map[string][]string
+	var instances map[string]int
+	if s.TemplateUnits != TemplateUnitsHash {
+		templates, err = s.updateTemplateLinks(units, objects)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		instances = templateInstances(objects)
+	}
+
+	// Job objects that cannot be parsed may refer to any unit, so no unit is removed while these exist
+	var skip string
+	if len(scan.corruptJobs) > 0 {
+		s.rulesLogger.Warningf("%d job object(s) cannot be parsed (see rule %s), not removing obsolete units", len(scan.corruptJobs), RuleBrokenJobs)
+		skip = SkipReasonCorruptJobs
+	}
+
+	// Find obsolete units
+	var result []candidate
+	for _, unit := range units {
+		if _, ok := validHashes[unit.Hash]; ok {
 			continue
 		}
-		// Found obsolete unit
-		key := fmt.Sprintf("/_coreos.com/fleet/unit/%s", unit)
-		if s.DryRun {
-			s.Logger.Infof("Obsolete unit at %s", key)
-		} else {
-			s.Logger.Infof("Removing obsolete unit at %s", key)
-			if _, err := keysAPI.Delete(context.Background(), key, &client.DeleteOptions{}); err != nil {
-				s.Logger.Errorf("Failed to remove obsolete unit at %s: %#v", key, err)
-				return maskAny(err)
-			}
-			removed++
+		if names, ok := activeUnits[unit.Hash]; ok {
+			s.rulesLogger.Infof("Unit %s is not referenced by any job object, but kept since active job(s) %s run it", unit.Hash, strings.Join(names, ","))
+			continue
+		}
+		if !s.current.includesUnit(unit.Hash) || !s.Shard.Includes(unit.Hash) {
+			continue
+		}
+		jobNames := appendUniqueAll(appendUniqueAll(appendUniqueAll(nil, s.jobNames[unit.Hash]), templates[unit.Hash]), stateNames[unit.Hash])
+		if !s.current.includesAnyJob(jobNames) {
+			continue
 		}
+		if template, n := usedTemplate(jobNames, instances); template != "" {
+			s.rulesLogger.Debugf("Unit %s of template %s is not referenced, but kept since the template has %d instances", unit.Hash, template, n)
+			continue
+		}
+		// Found obsolete unit
+		summary.ObsoleteUnits++
+		result = append(result, s.foundCandidate(candidate{
+			Kind:          kindUnit,
+			Key:           s.paths.unitKey(unit.Hash),
+			Value:         unit.Value,
+			Job:           strings.Join(jobNames, ","),
+			Skip:          skip,
+			CreatedIndex:  unit.CreatedIndex,
+			ModifiedIndex: unit.ModifiedIndex,
+			Dir:           unit.Dir,
+		}))
 	}
+	return result, nil
+}
 
-	if s.DryRun {
-		s.Logger.Infof("Found %d jobs, %d obsolete units can be removed", len(objects), removed)
-	} else {
-		s.Logger.Infof("Found %d jobs, removed %d obsolete units", len(objects), removed)
+// startPhase records the start of a new phase of the current run.
+// It returns a trace span for the phase, which must be ended by the caller.
+func (s *Service) startPhase(name string) *tracing.Span {
+	s.current.phase = name
+	s.current.phases = append(s.current.phases, PhaseTiming{Name: name, Started: time.Now()})
+	if s.current.profiler != nil {
+		s.current.profiler.sample()
+	}
+	return s.current.trace.StartChild(name)
+}
+
+// skipReason returns the reason why the current run is not allowed to remove (more) keys.
+// Returns an empty string when keys can be removed.
+func (s *Service) skipReason() string {
+	switch {
+	case s.current.dryRun:
+		return SkipReasonDryRun
+	case s.Stopping():
+		return SkipReasonStopping
+	case !s.IsLeader():
+		return SkipReasonNotLeader
+	case s.current.postponed:
+		return SkipReasonPostponed
+	case s.current.paused:
+		return SkipReasonPaused
+	case s.current.outsideWindow:
+		return SkipReasonOutsideWindow
+	case s.current.locked:
+		return SkipReasonLocked
+	case s.current.maxDelete > 0 && s.current.results.deletedCount() >= s.current.maxDelete:
+		return SkipReasonMaxDelete
+	case s.current.budgetLimit != "":
+		return SkipReasonBudgetExhausted
+	default:
+		return ""
 	}
-	return nil
+}
+
+// Load all unit names and all job objects stored by fleet concurrently.
+// The keys of job objects that cannot be parsed are returned as well.
+func (s *Service) loadUnitsAndObjects() ([]unitNode, []jobObject, []string, error) {
+	var wg sync.WaitGroup
+	var units []unitNode
+	var objects []jobObject
+	var corrupt []string
+	var unitsErr, objectsErr error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		span := s.current.trace.StartChild("load-units")
+		units, unitsErr = s.loadUnitNames()
+		span.SetAttribute("units", len(units))
+		span.End(unitsErr)
+		s.registryLogger.Debugf("Loaded %d units in %s", len(units), time.Since(start))
+	}()
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		span := s.current.trace.StartChild("load-jobs")
+		objects, corrupt, objectsErr = s.loadObjects()
+		span.SetAttribute("jobs", len(objects))
+		span.End(objectsErr)
+		s.registryLogger.Debugf("Loaded %d jobs in %s", len(objects), time.Since(start))
+	}()
+	wg.Wait()
+
+	if unitsErr != nil {
+		return nil, nil, nil, maskAny(unitsErr)
+	}
+	if objectsErr != nil {
+		return nil, nil, nil, maskAny(objectsErr)
+	}
+	return units, objects, corrupt, nil
 }
 
 // Load all unit names stored by fleet
-func (s *Service) loadUnitNames() ([]string, error) {
+func (s *Service) loadUnitNames() ([]unitNode, error) {
 	keysAPI := client.NewKeysAPI(s.client)
 
-	// Load unit names (hex)
-	resp, err := keysAPI.Get(context.Background(), "/_coreos.com/fleet/unit", &client.GetOptions{})
+	// Load unit names (hex), recursively since some fleet versions store units as a directory
+	resp, err := keysAPI.Get(context.Background(), s.paths.unit, &client.GetOptions{Recursive: true, Sort: true})
 	if err != nil {
-		return nil, maskAny(err)
+		return nil, maskEtcd(err)
 	}
 
-	result := []string{}
+	s.indexClock.Observe(resp.Index)
+
+	result := []unitNode{}
 	if resp.Node != nil {
 		for _, n := range resp.Node.Nodes {
-			name := path.Base(n.Key)
-			result = append(result, name)
+			unit := unitNode{
+				Hash:          path.Base(n.Key),
+				Value:         n.Value,
+				CreatedIndex:  n.CreatedIndex,
+				ModifiedIndex: n.ModifiedIndex,
+			}
+			if n.Dir {
+				unit.Dir = true
+				unit.Value = unitDirValue(n)
+				unit.ModifiedIndex = maxModifiedIndex(n)
+			}
+			result = append(result, unit)
 		}
 	}
 	return result, nil
 }
 
-// Load all job objects stored by fleet
-func (s *Service) loadObjects() ([]jobObject, error) {
+// unitDirValue returns the combined unit contents of all child keys of a unit stored as a directory.
+// The child keys must be sorted.
+func unitDirValue(n *client.Node) string {
+	var contents []string
+	var collect func(n *client.Node)
+	collect = func(n *client.Node) {
+		if !n.Dir {
+			contents = append(contents, unitContent(n.Value))
+			return
+		}
+		for _, c := range n.Nodes {
+			collect(c)
+		}
+	}
+	collect(n)
+	return strings.Join(contents, "\n")
+}
+
+// Load all job objects stored by fleet.
+// The keys of job objects that cannot be parsed are returned as well.
+func (s *Service) loadObjects() ([]jobObject, []string, error) {
+	objects, corrupt, _, err := s.loadObjectsFromEtcd()
+	if err != nil {
+		return nil, nil, maskAny(err)
+	}
+
+	result := make([]jobObject, 0, len(objects))
+	for _, j := range objects {
+		result = append(result, j.jobObject)
+	}
+	return result, corrupt, nil
+}
+
+// Load all job objects stored by fleet from etcd.
+// Returns the loaded objects, the keys of objects that cannot be parsed and the etcd index at which they were loaded.
+// Objects that cannot be parsed do not fail the load, they are reported by the broken-jobs rule.
+func (s *Service) loadObjectsFromEtcd() ([]storedJob, []string, uint64, error) {
 	keysAPI := client.NewKeysAPI(s.client)
 
 	// Load unit names (hex)
-	resp, err := keysAPI.Get(context.Background(), "/_coreos.com/fleet/job", &client.GetOptions{Recursive: true})
+	resp, err := keysAPI.Get(context.Background(), s.paths.job, &client.GetOptions{Recursive: true})
 	if err != nil {
-		return nil, maskAny(err)
+		return nil, nil, 0, maskEtcd(err)
 	}
 
-	result := []jobObject{}
+	result := []storedJob{}
+	var corrupt []string
 	if resp.Node != nil {
 		// For over jobs
 		for _, n := range resp.Node.Nodes {
@@ -161,15 +805,25 @@ func (s *Service) loadObjects() ([]jobObject, error) {
 					continue
 				}
 				// found object, parse it
-				raw := c.Value
-				var data jobObject
-				if err := json.Unmarshal([]byte(raw), &data); err != nil {
-					s.Logger.Errorf("Failed to parse '%s': %#v", raw, err)
-					return nil, maskAny(err)
+				data, err := parseJobObject(c.Value)
+				if err != nil {
+					s.registryLogger.Errorf("Failed to parse '%s' at %s: %#v", c.Value, c.Key, err)
+					corrupt = append(corrupt, c.Key)
+					continue
 				}
-				result = append(result, data)
+				result = append(result, storedJob{Key: c.Key, ModifiedIndex: c.ModifiedIndex, jobObject: data})
 			}
 		}
 	}
-	return result, nil
+	return result, corrupt, resp.Index, nil
+}
+
+// parseJobObject parses the raw value of a job object key.
+func parseJobObject(raw string) (jobObject, error) {
+	var data jobObject
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return jobObject{}, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid job object"))
+	}
+	data.Size = len(raw)
+	return data, nil
 }
@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/juju/errgo"
+)
+
+// Severities of garbage, from low to high
+const (
+	SeverityInfo     = "info"     // Harmless leftovers, e.g. leases & unit states of removed machines
+	SeverityWarning  = "warning"  // Garbage that slows fleet down, e.g. obsolete units
+	SeverityCritical = "critical" // Data that fleet cannot handle, e.g. corrupt job objects
+)
+
+var severityLevels = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+// validateSeverity returns an error if the given severity is not valid.
+// An empty severity is valid and means SeverityInfo.
+func validateSeverity(severity string) error {
+	if _, ok := severityLevels[severity]; !ok && severity != "" {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid severity '%s', expected %s, %s or %s",
+			severity, SeverityInfo, SeverityWarning, SeverityCritical))
+	}
+	return nil
+}
+
+// ruleSeverity returns the severity of candidates of the rule with given name.
+func ruleSeverity(name string) string {
+	if severity, ok := ruleSeverities[name]; ok {
+		return severity
+	}
+	return SeverityInfo
+}
+
+// severityShown returns true if garbage with given severity is reported & notified,
+// given the configured minimum severity.
+func (s *Service) severityShown(severity string) bool {
+	return severityLevels[severity] >= severityLevels[s.MinSeverity]
+}
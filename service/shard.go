@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// Shard selects a deterministic part of the registry, so multiple instances (each with a different shard)
+// can each clean a disjoint part of a large registry.
+// Units are assigned to a shard by their hash, leases, unit states and jobs by their job name.
+type Shard struct {
+	Index int // 1-based index of the shard
+	Count int // Total number of shards, 0 or 1 disables sharding
+}
+
+// ParseShard parses a shard in the format 'i/n' (e.g. '2/4').
+func ParseShard(value string) (Shard, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return Shard{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid shard '%s', expected <index>/<count>", value))
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Shard{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid shard index '%s'", parts[0]))
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Shard{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid shard count '%s'", parts[1]))
+	}
+	sh := Shard{Index: index, Count: count}
+	if err := sh.validate(); err != nil {
+		return Shard{}, maskAny(err)
+	}
+	return sh, nil
+}
+
+// validate returns an error if the shard is not valid.
+func (sh Shard) validate() error {
+	if sh.Count == 0 && sh.Index == 0 {
+		return nil
+	}
+	if sh.Count < 1 {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "shard count must be at least 1"))
+	}
+	if sh.Index < 1 || sh.Index > sh.Count {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "shard index must be between 1 and %d", sh.Count))
+	}
+	return nil
+}
+
+func (sh Shard) String() string {
+	if !sh.enabled() {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", sh.Index, sh.Count)
+}
+
+// enabled returns true when the registry is split in multiple shards.
+func (sh Shard) enabled() bool {
+	return sh.Count > 1
+}
+
+// Includes returns true when the given unit hash or job name belongs to this shard.
+func (sh Shard) Includes(name string) bool {
+	if !sh.enabled() {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(sh.Count)) == sh.Index-1
+}
+
+// runLockKey returns the key of the run lock. Every shard has its own lock, so shards can run in parallel.
+func (s *Service) runLockKey() string {
+	if !s.Shard.enabled() {
+		return runLockKey
+	}
+	return fmt.Sprintf("%s-shard-%d-of-%d", runLockKey, s.Shard.Index, s.Shard.Count)
+}
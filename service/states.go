@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// unitStateObject is the state of a unit on a specific machine, as published by the fleet agent.
+type unitStateObject struct {
+	LoadState   string `json:"loadState"`
+	ActiveState string `json:"activeState"`
+	SubState    string `json:"subState"`
+	UnitHash    string `json:"unitHash"`
+}
+
+// unitStateNode is the state of a unit on a specific machine, together with its etcd key.
+type unitStateNode struct {
+	unitStateObject
+	Key           string
+	Value         string
+	Name          string // Name of the unit (job)
+	MachineID     string
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+}
+
+// findOrphanStates returns all unit states published for machines that are no longer registered
+// in fleet, or for units that no longer have a job.
+func (s *Service) findOrphanStates(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	if !s.current.schema.HasStates {
+		return nil, nil
+	}
+	machines, err := scan.Machines()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	jobs, err := scan.JobNames()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if len(machines) == 0 {
+		// Without any known machine, every unit state would be considered orphaned
+		s.rulesLogger.Warningf("No machines found in %s, skipping unit state cleanup", s.paths.machines)
+		return nil, nil
+	}
+	states, err := s.loadUnitStates()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	summary.States = len(states)
+	checkJobs := len(jobs) > 0
+	if !checkJobs && len(states) > 0 {
+		// Without any known job, every unit state would be considered orphaned
+		s.rulesLogger.Warningf("No jobs found in %s, only checking unit states for unknown machines", s.paths.job)
+	}
+
+	var result []candidate
+	for _, st := range states {
+		summary.RegistryBytes += int64(len(st.Value))
+		var detail string
+		if _, ok := machines[st.MachineID]; !ok {
+			detail = fmt.Sprintf("published for unknown machine %s", st.MachineID)
+		} else if _, ok := jobs[st.Name]; checkJobs && !ok {
+			detail = fmt.Sprintf("published for unknown unit %s", st.Name)
+		} else {
+			continue
+		}
+		if !s.current.includesJob(st.Name) || (st.UnitHash != "" && !s.current.includesUnit(st.UnitHash)) || !s.Shard.Includes(st.Name) {
+			continue
+		}
+		// Found orphaned unit state
+		summary.OrphanStates++
+		result = append(result, s.foundCandidate(candidate{
+			Kind:          kindState,
+			Key:           st.Key,
+			Value:         st.Value,
+			Job:           st.Name,
+			Detail:        detail,
+			CreatedIndex:  st.CreatedIndex,
+			ModifiedIndex: st.ModifiedIndex,
+		}))
+	}
+	return result, nil
+}
+
+// Load the names of all units that have a state published, indexed by unit hash.
+func (s *Service) loadUnitStateNames() (map[string][]string, error) {
+	states, err := s.loadUnitStates()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	result := make(map[string][]string)
+	for _, st := range states {
+		if st.UnitHash != "" {
+			result[st.UnitHash] = appendUnique(result[st.UnitHash], st.Name)
+		}
+	}
+	return result, nil
+}
+
+// Load all unit states published by fleet agents.
+func (s *Service) loadUnitStates() ([]unitStateNode, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+
+	resp, err := keysAPI.Get(context.Background(), s.paths.states, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, maskEtcd(err)
+	}
+	s.indexClock.Observe(resp.Index)
+
+	var result []unitStateNode
+	if resp.Node != nil {
+		// For over units
+		for _, n := range resp.Node.Nodes {
+			name := path.Base(n.Key)
+			// For over machines
+			for _, c := range n.Nodes {
+				if c.Dir {
+					continue
+				}
+				var data unitStateObject
+				if err := json.Unmarshal([]byte(c.Value), &data); err != nil {
+					s.rulesLogger.Warningf("Failed to parse unit state '%s' at %s: %#v", c.Value, c.Key, err)
+					continue
+				}
+				result = append(result, unitStateNode{
+					unitStateObject: data,
+					Key:             c.Key,
+					Value:           c.Value,
+					Name:            name,
+					MachineID:       path.Base(c.Key),
+					CreatedIndex:    c.CreatedIndex,
+					ModifiedIndex:   c.ModifiedIndex,
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// appendUnique appends the given value to the given list, unless it is already part of it.
+func appendUnique(list []string, value string) []string {
+	for _, x := range list {
+		if x == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// appendUniqueAll appends all given values to the given list, skipping values that are already part of it.
+func appendUniqueAll(list []string, values []string) []string {
+	for _, v := range values {
+		list = appendUnique(list, v)
+	}
+	return list
+}
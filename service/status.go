@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// Outcomes of a run, as written to the status file
+const (
+	StatusOutcomeSuccess = "success"
+	StatusOutcomeFailed  = "failed"
+)
+
+// Status describes the last run. It is written to the status file (see ServiceConfig.StatusFile) after
+// every run, so node-local monitoring can check the health of cleanups without access to etcd.
+type Status struct {
+	RunID       string        `json:"runID"`
+	Time        time.Time     `json:"time"` // End of the run
+	Outcome     string        `json:"outcome"`
+	Error       string        `json:"error,omitempty"`
+	LastSuccess *time.Time    `json:"lastSuccess,omitempty"` // End of the last successful run (if known)
+	Version     string        `json:"version"`
+	DryRun      bool          `json:"dryRun"`
+	Duration    time.Duration `json:"duration"`
+
+	ObsoleteUnits int            `json:"obsoleteUnits"`
+	RemovedUnits  int            `json:"removedUnits"`
+	StaleLeases   int            `json:"staleLeases"`
+	RemovedLeases int            `json:"removedLeases"`
+	OrphanStates  int            `json:"orphanStates"`
+	RemovedStates int            `json:"removedStates"`
+	FailedDeletes int            `json:"failedDeletes"`
+	Skipped       map[string]int `json:"skipped,omitempty"` // Number of candidates that were not removed, by reason
+}
+
+// writeStatus replaces the status file with the status of the given run.
+// The time of the last successful run is taken from the previous status file when the run failed.
+// Nothing is written when no status file is configured or when creating a plan.
+func (s *Service) writeStatus(start time.Time, summary RunSummary, runErr error) error {
+	if s.StatusFile == "" || s.current.planning {
+		return nil
+	}
+	end := time.Now()
+	status := Status{
+		RunID:         s.current.id,
+		Time:          end,
+		Outcome:       StatusOutcomeSuccess,
+		LastSuccess:   &end,
+		Version:       s.Version,
+		DryRun:        summary.DryRun,
+		Duration:      end.Sub(start),
+		ObsoleteUnits: summary.ObsoleteUnits,
+		RemovedUnits:  summary.RemovedUnits,
+		StaleLeases:   summary.StaleLeases,
+		RemovedLeases: summary.RemovedLeases,
+		OrphanStates:  summary.OrphanStates,
+		RemovedStates: summary.RemovedStates,
+		FailedDeletes: summary.FailedDeletes,
+		Skipped:       summary.Skipped,
+	}
+	if runErr != nil {
+		status.Outcome = StatusOutcomeFailed
+		status.Error = runErr.Error()
+		status.LastSuccess = nil
+		if previous, err := readStatus(s.StatusFile); err == nil {
+			status.LastSuccess = previous.LastSuccess
+		} else if !os.IsNotExist(errgo.Cause(err)) {
+			s.Logger.Warningf("Failed to read previous status file: %#v", err)
+		}
+	}
+	raw, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	// Write to a temporary file first, so monitoring never reads a half-written status
+	tmpPath := s.StatusFile + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(raw, '\n'), 0644); err != nil {
+		return maskAny(err)
+	}
+	if err := os.Rename(tmpPath, s.StatusFile); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// readStatus reads the status of the last run from the given status file.
+func readStatus(path string) (Status, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Status{}, maskAny(err)
+	}
+	var status Status
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return Status{}, maskAny(errgo.WithCausef(err, CorruptDataError, "invalid status file '%s'", path))
+	}
+	return status, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The names of the templates that used a unit are recorded under this directory (by unit hash),
+	// since they are lost once the template job is destroyed.
+	templateLinksPrefix = toolPrefix + "/templates"
+)
+
+// Treatments of units of template jobs (e.g. app@.service)
+const (
+	TemplateUnitsInstances = "instances" // Never consider the unit of a template obsolete while instances of the template exist (default)
+	TemplateUnitsHash      = "hash"      // Only keep units that are referenced by the hash in a job object
+)
+
+// validateTemplateUnits returns an error if the given treatment of template units is not valid.
+// An empty treatment is valid and means TemplateUnitsInstances.
+func validateTemplateUnits(mode string) error {
+	switch mode {
+	case "", TemplateUnitsInstances, TemplateUnitsHash:
+		return nil
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid template units treatment '%s', expected %s or %s",
+			mode, TemplateUnitsInstances, TemplateUnitsHash))
+	}
+}
+
+// templateName returns the name of the template of the given template or instance name
+// (e.g. app@.service for app@1.service), or "" when the name is not part of a template.
+func templateName(name string) string {
+	i := strings.Index(name, "@")
+	if i < 0 {
+		return ""
+	}
+	return name[:i+1] + path.Ext(name)
+}
+
+// isTemplateName returns true if the given name is the name of a template (e.g. app@.service).
+func isTemplateName(name string) bool {
+	return name != "" && templateName(name) == name
+}
+
+// templateInstances returns the number of instance jobs of every template, by template name.
+func templateInstances(objects []jobObject) map[string]int {
+	result := make(map[string]int)
+	for _, j := range objects {
+		if tmpl := templateName(j.Name); tmpl != "" && !isTemplateName(j.Name) {
+			result[tmpl]++
+		}
+	}
+	return result
+}
+
+// usedTemplate returns the name of a template whose unit had one of the given job names and that still has
+// instances, and the number of those instances. Returns "" when the names are not those of a template with instances.
+// Units of templates are linked to their instances by name, not by hash: fleet creates an instance with the unit
+// the template had at that time, so the current unit of a template may not be referenced by any of its instances.
+func usedTemplate(jobNames []string, instances map[string]int) (string, int) {
+	for _, name := range jobNames {
+		if !isTemplateName(name) {
+			continue
+		}
+		if n := instances[name]; n > 0 {
+			return name, n
+		}
+	}
+	return "", 0
+}
+
+// updateTemplateLinks returns the names of the templates that used every unit, by unit hash.
+// The names are those recorded by earlier runs, plus those of the given template jobs. Newly found names are
+// recorded and units that no longer exist are forgotten, unless the etcd credentials are read-only
+// or a unit is being explained.
+func (s *Service) updateTemplateLinks(units []unitNode, objects []jobObject) (map[string][]string, error) {
+	keysAPI := client.NewKeysAPI(s.client)
+	links := make(map[string][]string)
+	resp, err := keysAPI.Get(context.Background(), templateLinksPrefix, nil)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, maskEtcd(err)
+	}
+	if err == nil {
+		for _, n := range resp.Node.Nodes {
+			links[path.Base(n.Key)] = strings.Split(n.Value, ",")
+		}
+	}
+
+	changed := make(map[string]bool)
+	for _, j := range objects {
+		if !isTemplateName(j.Name) {
+			continue
+		}
+		hash := j.Hash()
+		if names := appendUnique(links[hash], j.Name); len(names) != len(links[hash]) {
+			sort.Strings(names)
+			links[hash] = names
+			changed[hash] = true
+		}
+	}
+	existing := make(map[string]struct{})
+	for _, u := range units {
+		existing[u.Hash] = struct{}{}
+	}
+	var forgotten []string
+	for hash := range links {
+		if _, ok := existing[hash]; !ok {
+			delete(links, hash)
+			forgotten = append(forgotten, hash)
+		}
+	}
+	if s.AssumeReadOnly || s.current.explaining {
+		return links, nil
+	}
+
+	for hash := range changed {
+		if _, err := keysAPI.Set(context.Background(), path.Join(templateLinksPrefix, hash), strings.Join(links[hash], ","), nil); err != nil {
+			return nil, maskEtcd(err)
+		}
+	}
+	for _, hash := range forgotten {
+		if _, err := keysAPI.Delete(context.Background(), path.Join(templateLinksPrefix, hash), nil); err != nil && !client.IsKeyNotFound(err) {
+			return nil, maskEtcd(err)
+		}
+	}
+	return links, nil
+}
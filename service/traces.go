@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+// TracedKey is a single key (or directory) of a job or machine, as found by FindJobTraces or FindMachineTraces.
+type TracedKey struct {
+	Kind          string `json:"kind"` // job, lease, unit-state, unit, schedule or machine
+	Key           string `json:"key"`
+	Dir           bool   `json:"dir,omitempty"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+	Removed       bool   `json:"removed,omitempty"`
+}
+
+// removeTracedKeys removes the given keys in order, marking them as removed. Directories are removed recursively.
+// Keys (other than directories) that were modified since they were found are not removed.
+// Removal stops at the first failure.
+func (s *Service) removeTracedKeys(keys []TracedKey, owner string) error {
+	keysAPI := client.NewKeysAPI(s.client)
+	for i, k := range keys {
+		opts := &client.DeleteOptions{Dir: k.Dir, Recursive: k.Dir}
+		if !k.Dir {
+			opts.PrevIndex = k.ModifiedIndex
+		}
+		_, err := keysAPI.Delete(context.Background(), k.Key, opts)
+		if client.IsKeyNotFound(err) {
+			continue
+		}
+		if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeTestFailed {
+			return maskAny(errgo.WithCausef(err, ModifiedError, "%s at %s was modified after index %d", k.Kind, k.Key, k.ModifiedIndex))
+		}
+		if err != nil {
+			err = maskEtcd(err)
+			if IsPermissionDenied(err) {
+				err = errgo.WithCausef(err, PermissionDeniedError, "etcd refused to remove %s at %s, the credentials appear to be read-only", k.Kind, k.Key)
+			}
+			return maskAny(err)
+		}
+		keys[i].Removed = true
+		s.Logger.Debugf("Removed %s at %s of %s", k.Kind, k.Key, owner)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+)
+
+// TransportConfig holds the settings of the HTTP transport used to connect to etcd.
+type TransportConfig struct {
+	// If set, all requests are sent through this HTTP proxy.
+	// Otherwise the HTTP_PROXY, HTTPS_PROXY & NO_PROXY environment variables are used.
+	Proxy string
+	// If set, the TLS certificate of etcd is not verified.
+	// This is dangerous and only meant for lab clusters with self-signed certificates.
+	InsecureSkipVerify bool
+	// If set, this value is sent as Authorization header with every request
+	AuthHeader string
+	// If set, a bearer token is read from this file and sent as Authorization header with every request
+	BearerTokenFile string
+	// Maximum number of idle connections kept per etcd endpoint (0 uses the Go default)
+	MaxIdleConns int
+	// Interval of TCP keep-alive probes (0 uses the default, negative disables them)
+	TCPKeepAlive time.Duration
+	// Maximum time to wait for the response headers of a request (0 means no limit)
+	ResponseHeaderTimeout time.Duration
+	// If set, every request uses a new connection
+	DisableKeepAlives bool
+	// If set, this prefix is added to all keys sent to etcd and removed from all keys received,
+	// e.g. when etcd is accessed through a proxy that stores all keys below a namespace
+	KeyPrefix string
+	// If set, requests are not sent to etcd, but served (read-only) from this etcd v2 backup:
+	// a data directory, a snapshot file or a JSON dump of the store (see loadBackup)
+	OfflineBackup string
+}
+
+const (
+	defaultTCPKeepAlive = 30 * time.Second
+)
+
+// newTransport creates an HTTP transport for the etcd client from the given config.
+func newTransport(config TransportConfig) (client.CancelableTransport, error) {
+	if config.MaxIdleConns < 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "maximum number of idle connections cannot be negative"))
+	}
+	if config.ResponseHeaderTimeout < 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "response header timeout cannot be negative"))
+	}
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid etcd proxy '%s'", config.Proxy))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	keepAlive := config.TCPKeepAlive
+	switch {
+	case keepAlive == 0:
+		keepAlive = defaultTCPKeepAlive
+	case keepAlive < 0:
+		keepAlive = 0
+	}
+	if config.OfflineBackup != "" {
+		transport, err := newOfflineTransport(config.OfflineBackup)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return wrapKeyPrefix(transport, config.KeyPrefix)
+	}
+	var transport client.CancelableTransport = &http.Transport{
+		Proxy: proxy,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConnsPerHost:   config.MaxIdleConns,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		DisableKeepAlives:     config.DisableKeepAlives,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		},
+	}
+	switch {
+	case config.AuthHeader != "" && config.BearerTokenFile != "":
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "specify either an auth header or a bearer token file, not both"))
+	case config.AuthHeader != "":
+		header := config.AuthHeader
+		transport = newAuthTransport(transport, func() (string, error) { return header, nil })
+	case config.BearerTokenFile != "":
+		tokenFile := &bearerTokenFile{path: config.BearerTokenFile}
+		if _, err := tokenFile.Header(); err != nil {
+			return nil, maskAny(err)
+		}
+		transport = newAuthTransport(transport, tokenFile.Header)
+	}
+	return wrapKeyPrefix(transport, config.KeyPrefix)
+}
+
+// wrapKeyPrefix wraps the given transport such that the given key prefix (if any) is added to all keys.
+func wrapKeyPrefix(transport client.CancelableTransport, keyPrefix string) (client.CancelableTransport, error) {
+	if keyPrefix == "" {
+		return transport, nil
+	}
+	prefix, err := normalizeKeyPrefix(keyPrefix)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return newPrefixTransport(transport, prefix), nil
+}
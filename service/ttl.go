@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultRestoredTTL is the TTL set by the restore-ttl action when ServiceConfig.RestoredTTL is not set.
+	// It leaves owners that are still alive enough time to refresh their keys.
+	DefaultRestoredTTL = 5 * time.Minute
+)
+
+// hasTTL returns true if the given node expires.
+func hasTTL(n *client.Node) bool {
+	return n.TTL > 0 || n.Expiration != nil
+}
+
+// findMissingTTLs returns all keys that fleet stores with a TTL, but that no longer have one.
+// This happens when etcd is restored from a backup that stripped TTLs, after which the keys of dead machines never expire.
+// Leases of unknown machines are left to the stale-leases rule.
+// Runs restricted to an explicit list of unit hashes skip this rule, runs restricted to jobs only check their leases.
+func (s *Service) findMissingTTLs(scan *registryScan, summary *RunSummary) ([]candidate, error) {
+	if s.current.unitHashes != nil {
+		s.rulesLogger.Debugf("Run is restricted to unit hashes, skipping missing TTL check")
+		return nil, nil
+	}
+	machines, err := scan.Machines()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	keysAPI := client.NewKeysAPI(s.client)
+	var result []candidate
+
+	// Presence of machines
+	resp, err := keysAPI.Get(context.Background(), s.paths.machines, &client.GetOptions{Recursive: true, Sort: true})
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, maskEtcd(err)
+	}
+	if err == nil && len(s.current.jobFilters) == 0 {
+		// Machines are not within the scope of a run restricted to jobs
+		for _, n := range resp.Node.Nodes {
+			id := path.Base(n.Key)
+			object := childNode(n, "object")
+			if object == nil || hasTTL(object) || !s.Shard.Includes(id) {
+				continue
+			}
+			result = append(result, s.foundCandidate(candidate{
+				Kind:          kindMachine,
+				Key:           object.Key,
+				Value:         object.Value,
+				Detail:        fmt.Sprintf("presence of machine %s has no TTL", id),
+				CreatedIndex:  object.CreatedIndex,
+				ModifiedIndex: object.ModifiedIndex,
+			}))
+		}
+	}
+
+	// Leases
+	resp, err = keysAPI.Get(context.Background(), s.paths.lease, &client.GetOptions{Sort: true})
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, maskEtcd(err)
+	}
+	if err == nil {
+		for _, n := range resp.Node.Nodes {
+			name := path.Base(n.Key)
+			if n.Dir || hasTTL(n) || !s.current.includesJob(name) || !s.Shard.Includes(name) {
+				continue
+			}
+			var lease leaseObject
+			if err := json.Unmarshal([]byte(n.Value), &lease); err == nil && lease.MachineID != "" {
+				if _, ok := machines[lease.MachineID]; !ok {
+					continue
+				}
+			}
+			result = append(result, s.foundCandidate(candidate{
+				Kind:          kindLease,
+				Key:           n.Key,
+				Value:         n.Value,
+				Detail:        "lease has no TTL",
+				CreatedIndex:  n.CreatedIndex,
+				ModifiedIndex: n.ModifiedIndex,
+			}))
+		}
+	}
+	return result, nil
+}
+
+// restoreTTL sets the configured TTL on the key of the given candidate, marking it as restored on success.
+// The key is only updated when it has not been modified since it was found, keys that no longer exist are skipped.
+// The outcome is recorded in the given collector, a failure is logged as well. An error is only
+// returned when etcd cannot be reached or refuses access, since further updates would fail as well.
+func (s *Service) restoreTTL(c *candidate, results *resultCollector) error {
+	keysAPI := client.NewKeysAPI(s.client)
+	resp, err := keysAPI.Set(context.Background(), c.Key, c.Value, &client.SetOptions{PrevIndex: c.ModifiedIndex, TTL: s.RestoredTTL})
+	if client.IsKeyNotFound(err) {
+		s.Logger.Infof("%s at %s no longer exists", c.Kind, c.Key)
+		s.emit(Event{Type: EventSkipped, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Reason: SkipReasonGone, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Skip = SkipReasonGone
+		return nil
+	}
+	if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeTestFailed {
+		// Modified since it was found, e.g. refreshed with a TTL by its owner
+		s.Logger.Infof("%s at %s was modified after index %d, not restoring its TTL", c.Kind, c.Key, c.ModifiedIndex)
+		s.emit(Event{Type: EventSkipped, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Reason: SkipReasonModified, Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Skip = SkipReasonModified
+		return nil
+	}
+	if err != nil {
+		err = maskEtcd(err)
+		if IsPermissionDenied(err) {
+			err = errgo.WithCausef(err, PermissionDeniedError, "etcd refused to update %s at %s, the credentials appear to be read-only", c.Kind, c.Key)
+		}
+		s.Logger.Errorf("Failed to restore TTL of %s at %s: %#v", c.Kind, c.Key, err)
+		s.emit(Event{Type: EventError, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Message: err.Error(), Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+		c.Error = err.Error()
+		results.failed(*c)
+		if IsEtcdUnreachable(err) || IsPermissionDenied(err) {
+			return maskAny(err)
+		}
+		return nil
+	}
+	s.emit(Event{Type: EventTTLRestored, Rule: c.Rule, Kind: c.Kind, Key: c.Key, Message: fmt.Sprintf("TTL %s at index %d", s.RestoredTTL, resp.Index), Severity: c.Severity, Owners: c.Owners, UnitTypes: c.UnitTypes})
+	c.Restored = true
+	results.restored(*c)
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// unitOption is a single option of a unit file.
+type unitOption struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+}
+
+// unitContent returns the unit file stored in the given unit value.
+func unitContent(value string) string {
+	// fleet stores units as {"Raw": "<unit file>"}, older versions as a list of options
+	var model struct {
+		Raw     string       `json:"Raw"`
+		Options []unitOption `json:"Options"`
+	}
+	if err := json.Unmarshal([]byte(value), &model); err != nil {
+		return value
+	}
+	if model.Raw != "" {
+		return model.Raw
+	}
+	if len(model.Options) > 0 {
+		var lines []string
+		section := ""
+		for _, o := range model.Options {
+			if o.Section != section {
+				if section != "" {
+					lines = append(lines, "")
+				}
+				section = o.Section
+				lines = append(lines, fmt.Sprintf("[%s]", section))
+			}
+			lines = append(lines, fmt.Sprintf("%s=%s", o.Name, o.Value))
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+	return value
+}
+
+// parseUnitOptions returns all options of the unit file stored in the given unit value.
+// Comments and lines outside a section are ignored.
+func parseUnitOptions(value string) []unitOption {
+	var result []unitOption
+	section := ""
+	for _, line := range strings.Split(unitContent(value), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		i := strings.Index(line, "=")
+		if section == "" || i <= 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		result = append(result, unitOption{
+			Section: section,
+			Name:    strings.TrimSpace(line[:i]),
+			Value:   strings.TrimSpace(line[i+1:]),
+		})
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unit types derived from the unit file, in addition to the type given by the extension
+// of the unit name (e.g. service or timer).
+const (
+	UnitTypeGlobal           = "global"            // Scheduled on all machines ([X-Fleet] Global=true)
+	UnitTypeTemplate         = "template"          // Template unit (e.g. app@.service)
+	UnitTypeTemplateInstance = "template-instance" // Instance of a template unit (e.g. app@1.service)
+)
+
+// classifyUnit returns the types of the unit with given name (if known) and value (if known), sorted by name.
+func classifyUnit(name, value string) []string {
+	var types []string
+	if name != "" {
+		if ext := path.Ext(name); len(ext) > 1 {
+			types = append(types, ext[1:])
+		}
+		if i := strings.Index(name, "@"); i >= 0 {
+			if strings.HasPrefix(name[i+1:], ".") {
+				types = append(types, UnitTypeTemplate)
+			} else {
+				types = append(types, UnitTypeTemplateInstance)
+			}
+		}
+	}
+	if value != "" {
+		for _, o := range parseUnitOptions(value) {
+			if o.Section == "X-Fleet" && o.Name == "Global" {
+				if global, err := strconv.ParseBool(o.Value); err == nil && global {
+					types = append(types, UnitTypeGlobal)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// candidateUnitTypes returns the unit types of the given candidate: those of the unit for unit candidates,
+// or those of the unit of its job for other candidates.
+func (s *Service) candidateUnitTypes(c candidate) []string {
+	job := c.Job
+	if c.Kind == kindLease {
+		// Leases are stored under the name of their job
+		job = path.Base(c.Key)
+	}
+	if i := strings.Index(job, ","); i >= 0 {
+		// Units may have been referenced by multiple jobs, which share their type
+		job = job[:i]
+	}
+	value := c.Value
+	if c.Kind != kindUnit {
+		value = s.current.jobUnits[job]
+	}
+	return classifyUnit(job, value)
+}
+
+// hasUnitType returns true when one of the given types is in the given list.
+func hasUnitType(types, list []string) bool {
+	for _, t := range types {
+		for _, l := range list {
+			if t == l {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+
+	"github.com/coreos/etcd/client"
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+)
+
+// VerifyResult describes the outcome of re-reading the registry after keys were removed (see ServiceConfig.VerifyDeletes).
+type VerifyResult struct {
+	Checked      int      `json:"checked"`                // Number of removed keys that were checked
+	StillPresent []string `json:"stillPresent,omitempty"` // Removed keys that still exist
+	Disappeared  []string `json:"disappeared,omitempty"`  // Units that disappeared without being removed by the run
+}
+
+// Failed returns true if any discrepancy was found.
+func (v VerifyResult) Failed() bool {
+	return len(v.StillPresent) > 0 || len(v.Disappeared) > 0
+}
+
+// verifyDeletes re-reads the unit directory and all other removed keys, to verify that all removed keys are gone
+// and that no unit disappeared that was not removed by this run. Does nothing when no key was removed.
+// Returns a VerificationFailedError if a discrepancy is found.
+func (s *Service) verifyDeletes(candidates []candidate, summary *RunSummary) (err error) {
+	var removed []candidate
+	for _, c := range candidates {
+		if c.Removed {
+			removed = append(removed, c)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	span := s.startPhase("verify")
+	defer func() { span.End(err) }()
+
+	units, err := s.loadUnitNames()
+	if err != nil {
+		return maskAny(err)
+	}
+	existing := make(map[string]unitNode)
+	for _, u := range units {
+		existing[s.paths.unitKey(u.Hash)] = u
+	}
+
+	result := VerifyResult{}
+	removedKeys := make(map[string]struct{})
+	keysAPI := client.NewKeysAPI(s.client)
+	for _, c := range removed {
+		result.Checked++
+		removedKeys[c.Key] = struct{}{}
+		var createdIndex uint64
+		if c.Kind == kindUnit {
+			u, ok := existing[c.Key]
+			if !ok {
+				continue
+			}
+			createdIndex = u.CreatedIndex
+		} else {
+			resp, err := keysAPI.Get(context.Background(), c.Key, nil)
+			if client.IsKeyNotFound(err) {
+				continue
+			} else if err != nil {
+				return maskEtcd(err)
+			}
+			createdIndex = resp.Node.CreatedIndex
+		}
+		if createdIndex > c.ModifiedIndex {
+			// Created again after it was removed (e.g. the same unit was submitted again)
+			s.Logger.Infof("Removed %s at %s was created again", c.Kind, c.Key)
+			continue
+		}
+		s.Logger.Errorf("Verification: removed %s at %s still exists", c.Kind, c.Key)
+		result.StillPresent = append(result.StillPresent, c.Key)
+	}
+
+	// Units seen by the scan of this run must still exist, unless removed
+	for _, u := range s.current.units {
+		key := s.paths.unitKey(u.Hash)
+		if _, ok := removedKeys[key]; ok {
+			continue
+		}
+		if _, ok := existing[key]; ok || !s.Shard.Includes(u.Hash) {
+			continue
+		}
+		s.Logger.Errorf("Verification: unit at %s disappeared, but was not removed by this run", key)
+		result.Disappeared = append(result.Disappeared, key)
+	}
+	sort.Strings(result.StillPresent)
+	sort.Strings(result.Disappeared)
+
+	summary.Verification = &result
+	if result.Failed() {
+		return maskAny(errgo.WithCausef(nil, VerificationFailedError, "%d removed keys still exist, %d units disappeared unexpectedly", len(result.StillPresent), len(result.Disappeared)))
+	}
+	s.Logger.Infof("Verified that all %d removed keys are gone", result.Checked)
+	return nil
+}
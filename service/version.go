@@ -0,0 +1,160 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Ways to handle an etcd server version outside the tested range (see ServiceConfig.EtcdVersionCheck)
+const (
+	EtcdVersionCheckWarn   = "warn"   // Log a warning and run anyway
+	EtcdVersionCheckStrict = "strict" // Refuse to run
+	EtcdVersionCheckOff    = "off"    // Do not query the version
+)
+
+const (
+	versionCheckTimeout = 10 * time.Second
+)
+
+var (
+	// Range of etcd server versions the v2 API is tested against: [min, max)
+	minTestedEtcdVersion = etcdVersion{2, 0, 0}
+	maxTestedEtcdVersion = etcdVersion{3, 4, 0} // etcd 3.4 disables the v2 API by default
+)
+
+// etcdVersion is a parsed etcd server version.
+type etcdVersion struct {
+	Major, Minor, Patch int
+}
+
+// parseEtcdVersion parses a version like "2.3.7", ignoring pre-release & build suffixes.
+func parseEtcdVersion(s string) (etcdVersion, error) {
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return etcdVersion{}, fmt.Errorf("invalid version '%s'", s)
+	}
+	var numbers [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return etcdVersion{}, fmt.Errorf("invalid version '%s'", s)
+		}
+		numbers[i] = n
+	}
+	return etcdVersion{numbers[0], numbers[1], numbers[2]}, nil
+}
+
+// less returns true if v is older than other.
+func (v etcdVersion) less(other etcdVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+func (v etcdVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// validateEtcdVersionCheck returns an error if the given version check mode is not valid.
+func validateEtcdVersionCheck(mode string) error {
+	switch mode {
+	case "", EtcdVersionCheckWarn, EtcdVersionCheckStrict, EtcdVersionCheckOff:
+		return nil
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid etcd version check '%s', expected %s, %s or %s",
+			mode, EtcdVersionCheckWarn, EtcdVersionCheckStrict, EtcdVersionCheckOff))
+	}
+}
+
+// checkEtcdVersion queries the version of the etcd server and records it in the current run.
+// When the version is outside the tested range (or cannot be determined), a warning is logged,
+// or in strict mode an error with cause UnsupportedVersionError is returned.
+func (s *Service) checkEtcdVersion() error {
+	if s.EtcdVersionCheck == EtcdVersionCheckOff {
+		return nil
+	}
+	span := s.startPhase("check-version")
+	var problem string
+	server, cluster, err := s.queryEtcdVersion()
+	if err != nil {
+		problem = fmt.Sprintf("cannot determine etcd version: %v", err)
+	} else {
+		s.current.etcdVersion = server
+		if server != s.etcdVersion {
+			s.registryLogger.Infof("Connected to etcd %s (cluster version %s) at %s", server, cluster, s.EtcdURL.String())
+			s.etcdVersion = server
+		}
+		if v, err := parseEtcdVersion(server); err != nil {
+			problem = fmt.Sprintf("cannot determine etcd version: %v", err)
+		} else if v.less(minTestedEtcdVersion) || !v.less(maxTestedEtcdVersion) {
+			problem = fmt.Sprintf("etcd %s is outside the tested range (%s up to %s)", server, minTestedEtcdVersion, maxTestedEtcdVersion)
+		}
+	}
+	if problem != "" && s.EtcdVersionCheck == EtcdVersionCheckStrict {
+		err := maskAny(errgo.WithCausef(nil, UnsupportedVersionError, "%s, refusing to run", problem))
+		span.End(err)
+		return err
+	}
+	if problem != "" {
+		s.Logger.Warningf("Version check: %s, running anyway", problem)
+	}
+	span.End(nil)
+	return nil
+}
+
+// queryEtcdVersion returns the server & cluster version reported by the configured etcd endpoint.
+func (s *Service) queryEtcdVersion() (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+
+	scheme := s.EtcdURL.Scheme
+	if scheme != "https" {
+		scheme = "http"
+	}
+	resp, err := ctxhttp.Get(ctx, &http.Client{Transport: s.transport}, scheme+"://"+s.EtcdURL.Host+"/version")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("version request failed with status %s", resp.Status)
+	}
+	var version struct {
+		Server  string `json:"etcdserver"`
+		Cluster string `json:"etcdcluster"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil || version.Server == "" {
+		// etcd before 2.1 replies with a plain text version
+		return "", "", fmt.Errorf("version response contains no server version")
+	}
+	return version.Server, version.Cluster, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// MaintenanceWindow is a daily time window (in a specific time zone) in which keys may be removed.
+type MaintenanceWindow struct {
+	Start    time.Duration // Time of day at which the window opens
+	End      time.Duration // Time of day at which the window closes (before Start if the window spans midnight)
+	Location *time.Location
+}
+
+// ParseMaintenanceWindow parses a window formatted as 'HH:MM-HH:MM', optionally followed by a
+// time zone name, e.g. '02:00-05:00 Europe/Amsterdam'. Without a time zone, local time is used.
+func ParseMaintenanceWindow(value string) (MaintenanceWindow, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return MaintenanceWindow{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid maintenance window '%s', expected 'HH:MM-HH:MM [time zone]'", value))
+	}
+	w := MaintenanceWindow{Location: time.Local}
+	if len(fields) == 2 {
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return MaintenanceWindow{}, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid time zone '%s' in maintenance window", fields[1]))
+		}
+		w.Location = loc
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return MaintenanceWindow{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid maintenance window '%s', expected 'HH:MM-HH:MM [time zone]'", value))
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return MaintenanceWindow{}, maskAny(err)
+	}
+	if w.End, err = parseTimeOfDay(times[1]); err != nil {
+		return MaintenanceWindow{}, maskAny(err)
+	}
+	if w.Start == w.End {
+		return MaintenanceWindow{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "maintenance window '%s' is empty", value))
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses a 'HH:MM' time of day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, maskAny(errgo.WithCausef(err, InvalidArgumentError, "invalid time of day '%s', expected 'HH:MM'", value))
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if the given time is inside the window.
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	t = t.In(w.Location)
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start < w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	// Window spans midnight
+	return tod >= w.Start || tod < w.End
+}
+
+func (w MaintenanceWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int((d%time.Hour)/time.Minute))
+	}
+	return fmt.Sprintf("%s-%s %s", format(w.Start), format(w.End), w.Location)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	defaultSystemdUnitDir  = "/etc/systemd/system"
+	defaultSystemdInterval = time.Hour
+)
+
+var (
+	cmdInstallSystemd = &cobra.Command{
+		Use:   "install-systemd [-- <cleanup flags>]",
+		Short: "Install a systemd service & timer that run a cleanup at an interval",
+		Long: "Install a systemd service & timer that run a cleanup at an interval.\n\n" +
+			"The etcd connection flags given to this command and all flags after '--' are passed to every cleanup,\n" +
+			"e.g. 'fleet-cleanup install-systemd --interval 1h --etcd-addr http://127.0.0.1:2379 -- --clean-leases'.",
+		Run: cmdInstallSystemdRun,
+	}
+	systemdFlags struct {
+		interval time.Duration
+		unitDir  string
+		name     string
+		binary   string
+		envFile  string
+		enable   bool
+		print    bool
+	}
+)
+
+func init() {
+	cmdInstallSystemd.Flags().DurationVar(&systemdFlags.interval, "interval", defaultSystemdInterval, "Interval between cleanups")
+	cmdInstallSystemd.Flags().StringVar(&systemdFlags.unitDir, "unit-dir", defaultSystemdUnitDir, "Directory to write the unit files to")
+	cmdInstallSystemd.Flags().StringVar(&systemdFlags.name, "name", projectName, "Name of the service & timer units (without extension)")
+	cmdInstallSystemd.Flags().StringVar(&systemdFlags.binary, "binary", "", "Path of the fleet-cleanup binary (defaults to the path of this binary)")
+	cmdInstallSystemd.Flags().StringVar(&systemdFlags.envFile, "env-file", "", "If set, the service reads additional cleanup flags from FLEET_CLEANUP_OPTS in this environment file")
+	cmdInstallSystemd.Flags().BoolVar(&systemdFlags.enable, "enable", false, "If set, reload systemd and enable & start the timer")
+	cmdInstallSystemd.Flags().BoolVar(&systemdFlags.print, "print", false, "If set, print the unit files instead of installing them")
+	cmdMain.AddCommand(cmdInstallSystemd)
+}
+
+// systemdUnits holds the values used to render the unit files.
+type systemdUnits struct {
+	Name      string
+	ExecStart string
+	EnvFile   string
+	Interval  string // In seconds
+	Period    string // Human readable interval
+}
+
+var (
+	systemdServiceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=Remove garbage from the fleet registry
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+{{if .EnvFile}}EnvironmentFile=-{{.EnvFile}}
+{{end}}ExecStart={{.ExecStart}}
+`))
+	systemdTimerTemplate = template.Must(template.New("timer").Parse(`[Unit]
+Description=Remove garbage from the fleet registry every {{.Period}}
+
+[Timer]
+OnBootSec={{.Interval}}
+OnUnitActiveSec={{.Interval}}
+Unit={{.Name}}.service
+
+[Install]
+WantedBy=timers.target
+`))
+)
+
+func cmdInstallSystemdRun(cmd *cobra.Command, args []string) {
+	if systemdFlags.interval < time.Second {
+		Exitf("--interval must be at least 1s")
+	}
+	if systemdFlags.name == "" || strings.ContainsAny(systemdFlags.name, "/ ") {
+		Exitf("--name '%s' is not valid", systemdFlags.name)
+	}
+	for _, arg := range args {
+		if arg == "--interval" || strings.HasPrefix(arg, "--interval=") {
+			Exitf("--interval cannot be passed to the cleanup, the timer starts every cleanup")
+		}
+	}
+	binary := systemdFlags.binary
+	if binary == "" {
+		path, err := exec.LookPath(os.Args[0])
+		if err != nil {
+			Exitf("Cannot find the path of this binary, use --binary: %#v", err)
+		}
+		binary = path
+	}
+	binary, err := filepath.Abs(binary)
+	if err != nil {
+		Exitf("--binary '%s' is not valid: %#v", binary, err)
+	}
+
+	// Pass etcd connection flags given to this command & all flags after '--'
+	execArgs := []string{binary}
+	cmd.InheritedFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			execArgs = append(execArgs, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	execArgs = append(execArgs, args...)
+	execStart := systemdQuoteArgs(execArgs)
+	if systemdFlags.envFile != "" {
+		execStart += " $FLEET_CLEANUP_OPTS"
+	}
+
+	units := systemdUnits{
+		Name:      systemdFlags.name,
+		ExecStart: execStart,
+		EnvFile:   systemdFlags.envFile,
+		Interval:  fmt.Sprintf("%ds", int64(systemdFlags.interval/time.Second)),
+		Period:    systemdFlags.interval.String(),
+	}
+	files := []struct {
+		name     string
+		template *template.Template
+	}{
+		{systemdFlags.name + ".service", systemdServiceTemplate},
+		{systemdFlags.name + ".timer", systemdTimerTemplate},
+	}
+	for _, f := range files {
+		var buf bytes.Buffer
+		if err := f.template.Execute(&buf, units); err != nil {
+			ExitWithCodef(exitCodeFailure, "Failed to render %s: %#v", f.name, err)
+		}
+		if systemdFlags.print {
+			fmt.Printf("# %s\n%s\n", filepath.Join(systemdFlags.unitDir, f.name), buf.String())
+			continue
+		}
+		path := filepath.Join(systemdFlags.unitDir, f.name)
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			ExitWithCodef(exitCodeFailure, "Failed to write %s: %#v", path, err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+	if systemdFlags.print || !systemdFlags.enable {
+		return
+	}
+
+	for _, systemctlArgs := range [][]string{
+		{"daemon-reload"},
+		{"enable", "--now", systemdFlags.name + ".timer"},
+	} {
+		c := exec.Command("systemctl", systemctlArgs...)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			ExitWithCodef(exitCodeFailure, "systemctl %s failed: %#v", strings.Join(systemctlArgs, " "), err)
+		}
+	}
+	fmt.Printf("Enabled %s.timer\n", systemdFlags.name)
+}
+
+// systemdQuoteArgs formats the given arguments as command line of an Exec* setting.
+// Arguments are quoted when needed, '%' & '$' are escaped so systemd does not expand them.
+func systemdQuoteArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		arg = strings.Replace(arg, "%", "%%", -1)
+		arg = strings.Replace(arg, "$", "$$", -1)
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\;") {
+			arg = `"` + strings.Replace(strings.Replace(arg, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
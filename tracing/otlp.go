@@ -0,0 +1,181 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+
+	exportTimeout = 10 * time.Second
+)
+
+// OTLP/HTTP JSON encoding of traces.
+// See https://github.com/open-telemetry/opentelemetry-proto
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// export sends all spans of the given trace to the OTLP endpoint.
+func (t *Tracer) export(tr *trace) error {
+	tr.mutex.Lock()
+	spans := make([]otlpSpan, 0, len(tr.spans))
+	for _, s := range tr.spans {
+		end := s.end
+		if end.IsZero() {
+			// Span was never ended, end it together with the trace
+			end = time.Now()
+		}
+		span := otlpSpan{
+			TraceID:           tr.id,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		spans = append(spans, span)
+	}
+	tr.mutex.Unlock()
+
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: otlpAttributes(map[string]interface{}{"service.name": t.ServiceName}),
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: t.ServiceName},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return maskAny(err)
+	}
+
+	client := &http.Client{Timeout: exportTimeout}
+	resp, err := client.Post(t.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return maskAny(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return maskAny(fmt.Errorf("OTLP endpoint returned status %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// otlpAttributes converts the given attributes into OTLP key-values (sorted by key).
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v otlpValue
+		switch value := attributes[k].(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case uint64:
+			s := strconv.FormatUint(value, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprintf("%v", value)
+			v.StringValue = &s
+		}
+		result = append(result, otlpKeyValue{Key: k, Value: v})
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+type TracerConfig struct {
+	// URL of the OTLP/HTTP traces endpoint (e.g. http://localhost:4318/v1/traces)
+	Endpoint    string
+	ServiceName string
+}
+
+type TracerDependencies struct {
+	Logger *logging.Logger
+}
+
+// Tracer records traces and exports them to an OTLP collector.
+// A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	TracerConfig
+	TracerDependencies
+}
+
+// Span is a single timed operation within a trace.
+// All methods of a nil *Span are no-ops.
+type Span struct {
+	tracer     *Tracer
+	trace      *trace
+	name       string
+	id         string
+	parentID   string
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+// trace holds all spans that belong to the same trace.
+type trace struct {
+	id    string
+	mutex sync.Mutex
+	spans []*Span
+}
+
+// NewTracer creates a new tracer instance.
+func NewTracer(config TracerConfig, deps TracerDependencies) *Tracer {
+	return &Tracer{
+		TracerConfig:       config,
+		TracerDependencies: deps,
+	}
+}
+
+// StartTrace starts a new trace with a root span with given name.
+// The trace is exported when the root span ends.
+func (t *Tracer) StartTrace(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	tr := &trace{id: randomID(16)}
+	return t.newSpan(tr, name, "")
+}
+
+// StartChild starts a new span with given name as child of the given span.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(s.trace, name, s.id)
+}
+
+// SetAttribute adds a key-value attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.trace.mutex.Lock()
+	defer s.trace.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+// End marks the end of the span, recording the given error (if any).
+// Ending a root span exports the entire trace.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.trace.mutex.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.trace.mutex.Unlock()
+
+	if s.parentID == "" {
+		if err := s.tracer.export(s.trace); err != nil {
+			s.tracer.Logger.Warningf("Failed to export trace %s: %#v", s.trace.id, err)
+		}
+	}
+}
+
+func (t *Tracer) newSpan(tr *trace, name, parentID string) *Span {
+	s := &Span{
+		tracer:     t,
+		trace:      tr,
+		name:       name,
+		id:         randomID(8),
+		parentID:   parentID,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.spans = append(tr.spans, s)
+	return s
+}
+
+// randomID creates a hex encoded random identifier of given length (in bytes).
+func randomID(length int) string {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		// Should not happen, fall back to a time based ID
+		return fmt.Sprintf("%0*x", length*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(raw)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdVeto = &cobra.Command{
+		Use:   "veto <key|id>",
+		Short: "Keep a key from being removed by all fleet-cleanup instances",
+		Long: "Keep a key from being removed by all fleet-cleanup instances, by setting a veto key in etcd.\n\n" +
+			"The key can be given as etcd key or as the identifier used in the candidate markers\n" +
+			"(see --annotate-ttl). Use 'unveto' to allow removing it again.",
+		Run: cmdVetoRun,
+	}
+	cmdUnveto = &cobra.Command{
+		Use:   "unveto <key|id>",
+		Short: "Allow removing a vetoed key again",
+		Run:   cmdUnvetoRun,
+	}
+	vetoFlags struct {
+		reason string
+		ttl    time.Duration
+	}
+)
+
+func init() {
+	cmdVeto.Flags().StringVar(&vetoFlags.reason, "reason", "", "Reason for the veto, shown in the logs of all instances")
+	cmdVeto.Flags().DurationVar(&vetoFlags.ttl, "ttl", 0, "If set, the veto expires after this duration")
+	cmdMain.AddCommand(cmdVeto)
+	cmdMain.AddCommand(cmdUnveto)
+}
+
+func cmdVetoRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the key (or identifier) to veto")
+	}
+	svc := newPauseService()
+	id, err := svc.Veto(args[0], vetoFlags.reason, vetoFlags.ttl)
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to veto %s: %#v", args[0], err)
+	}
+	what := args[0]
+	if id != what {
+		what = fmt.Sprintf("%s (%s)", what, id)
+	}
+	if vetoFlags.ttl > 0 {
+		fmt.Printf("Vetoed removal of %s for %s\n", what, vetoFlags.ttl)
+	} else {
+		fmt.Printf("Vetoed removal of %s until unvetoed\n", what)
+	}
+}
+
+func cmdUnvetoRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		Exitf("Please specify the key (or identifier) to unveto")
+	}
+	svc := newPauseService()
+	removed, err := svc.Unveto(args[0])
+	if err != nil {
+		ExitWithCodef(exitCodeForError(err), "Failed to unveto %s: %#v", args[0], err)
+	}
+	if removed {
+		fmt.Printf("Removed veto of %s\n", args[0])
+	} else {
+		fmt.Printf("%s was not vetoed\n", args[0])
+	}
+}